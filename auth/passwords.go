@@ -7,36 +7,102 @@ import (
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
 
 	"golang.org/x/crypto/scrypt"
 )
 
+// PasswordHashParams are the scrypt cost parameters, see golang.org/x/crypto/scrypt.Key.
+type PasswordHashParams struct {
+	N int // CPU/memory cost, a power of two
+	R int // Block size
+	P int // Parallelization
+}
+
+var DefaultPasswordHashParams = PasswordHashParams{N: 32768, R: 8, P: 1}
+
+func (p PasswordHashParams) Validate() error {
+	if p.N <= 1 || p.N&(p.N-1) != 0 {
+		return fmt.Errorf("scrypt N must be a power of two greater than 1: %d", p.N)
+	} else if p.R <= 0 || p.P <= 0 {
+		return fmt.Errorf("scrypt R and P must be positive: %d, %d", p.R, p.P)
+	} else if uint64(p.R)*uint64(p.P) >= 1<<30 {
+		return fmt.Errorf("scrypt R * P must be less than 2^30: %d * %d", p.R, p.P)
+	}
+	return nil
+}
+
 func PasswordHash(password string) (string, error) {
+	return PasswordHashWithParams(password, DefaultPasswordHashParams)
+}
+
+// PasswordHashWithParams hashes a password with given scrypt parameters.
+// Hashes with the default parameters keep the version 0 format: "0<salt><hash>".
+// Other hashes use the version 1 format, which stores the parameters: "1<N>:<R>:<P>$<salt><hash>".
+func PasswordHashWithParams(password string, params PasswordHashParams) (string, error) {
 	salt := rand.Text()[:10]
-	dk, err := scrypt.Key([]byte(password), []byte(salt), 32768, 8, 1, 32)
+	dk, err := scrypt.Key([]byte(password), []byte(salt), params.N, params.R, params.P, 32)
 	if err != nil {
 		return "", fmt.Errorf("unexpected error hashing password: %w", err)
 	}
 	// Prefix hash with a version number to allow for future changes to the hashing scheme.
-	return "0" + salt + hex.EncodeToString(dk), nil
+	if params == DefaultPasswordHashParams {
+		return "0" + salt + hex.EncodeToString(dk), nil
+	}
+	return fmt.Sprintf("1%d:%d:%d$%s%x", params.N, params.R, params.P, salt, dk), nil
 }
 
 func PasswordVerify(password, storedPassword string) (bool, error) {
-	if len(storedPassword) < 11 {
-		return false, fmt.Errorf("invalid stored password length: %d", len(storedPassword))
-	}
-	if storedPassword[0] != '0' {
-		return false, fmt.Errorf("unsupported password hash version: %c", storedPassword[0])
-	}
-	salt := []byte(storedPassword[1:11])
-	storedHash, err := hex.DecodeString(storedPassword[11:])
+	params, salt, storedHash, err := parsePasswordHash(storedPassword)
 	if err != nil {
-		return false, fmt.Errorf("unexpected error decoding password hash: %w", err)
+		return false, err
 	}
-	dk, err := scrypt.Key([]byte(password), salt, 32768, 8, 1, 32)
+	dk, err := scrypt.Key([]byte(password), salt, params.N, params.R, params.P, 32)
 	if err != nil {
 		return false, fmt.Errorf("unexpected error deriving key from password: %w", err)
 	}
 	return subtle.ConstantTimeCompare(dk, storedHash) == 1, nil
 }
+
+// PasswordNeedsRehash tells if a stored password was hashed with other parameters than given ones.
+func PasswordNeedsRehash(storedPassword string, params PasswordHashParams) bool {
+	stored, _, _, err := parsePasswordHash(storedPassword)
+	return err == nil && stored != params
+}
+
+func parsePasswordHash(storedPassword string) (params PasswordHashParams, salt, hash []byte, err error) {
+	if len(storedPassword) < 11 {
+		err = fmt.Errorf("invalid stored password length: %d", len(storedPassword))
+		return
+	}
+	rest := storedPassword[1:]
+	switch storedPassword[0] {
+	case '0':
+		params = DefaultPasswordHashParams
+	case '1':
+		var found bool
+		var paramsStr string
+		if paramsStr, rest, found = strings.Cut(rest, "$"); !found {
+			err = errors.New("missing password hash parameters")
+			return
+		} else if _, err = fmt.Sscanf(paramsStr, "%d:%d:%d", &params.N, &params.R, &params.P); err != nil {
+			err = fmt.Errorf("invalid password hash parameters: %w", err)
+			return
+		} else if err = params.Validate(); err != nil {
+			return
+		} else if len(rest) < 10 {
+			err = fmt.Errorf("invalid stored password length: %d", len(storedPassword))
+			return
+		}
+	default:
+		err = fmt.Errorf("unsupported password hash version: %c", storedPassword[0])
+		return
+	}
+	salt = []byte(rest[:10])
+	if hash, err = hex.DecodeString(rest[10:]); err != nil {
+		err = fmt.Errorf("unexpected error decoding password hash: %w", err)
+	}
+	return
+}
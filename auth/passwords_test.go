@@ -4,6 +4,7 @@
 package auth
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -78,3 +79,55 @@ func TestPasswordVerifyInvalidStoredPassword(t *testing.T) {
 		})
 	}
 }
+
+func TestPasswordHashParams(t *testing.T) {
+	password := "correct-horse-battery-staple"
+	cheap := PasswordHashParams{N: 1024, R: 8, P: 1}
+
+	defaultHash, err := PasswordHash(password)
+	if err != nil {
+		t.Fatalf("PasswordHash returned error: %v", err)
+	}
+	if defaultHash[0] != '0' {
+		t.Errorf("Default parameters should keep the version 0 format: %s", defaultHash)
+	}
+	cheapHash, err := PasswordHashWithParams(password, cheap)
+	if err != nil {
+		t.Fatalf("PasswordHashWithParams returned error: %v", err)
+	}
+	if !strings.HasPrefix(cheapHash, "11024:8:1$") {
+		t.Errorf("Custom parameters should be stored in the hash: %s", cheapHash)
+	}
+
+	// Verification succeeds whatever parameters are configured now.
+	for _, h := range []string{defaultHash, cheapHash} {
+		ok, err := PasswordVerify(password, h)
+		if err != nil {
+			t.Fatalf("PasswordVerify returned error for %s: %v", h, err)
+		}
+		if !ok {
+			t.Errorf("PasswordVerify should return true for %s", h)
+		}
+		if ok, _ = PasswordVerify("wrong-password", h); ok {
+			t.Errorf("PasswordVerify should return false for an incorrect password and %s", h)
+		}
+	}
+
+	if PasswordNeedsRehash(defaultHash, DefaultPasswordHashParams) || PasswordNeedsRehash(cheapHash, cheap) {
+		t.Error("Hashes with current parameters should not need a re-hash")
+	}
+	if !PasswordNeedsRehash(defaultHash, cheap) || !PasswordNeedsRehash(cheapHash, DefaultPasswordHashParams) {
+		t.Error("Hashes with other parameters should need a re-hash")
+	}
+
+	for _, params := range []PasswordHashParams{{N: 1000, R: 8, P: 1}, {N: 1024, R: 0, P: 1}, {N: 1, R: 8, P: 1}} {
+		if err := params.Validate(); err == nil {
+			t.Errorf("Invalid parameters should not validate: %v", params)
+		}
+	}
+	for _, stored := range []string{"11024:8:1", "11000:8:1$abcdefghijaa", "1x:8:1$abcdefghijaa"} {
+		if _, err := PasswordVerify(password, stored); err == nil {
+			t.Errorf("PasswordVerify should return an error for %s", stored)
+		}
+	}
+}
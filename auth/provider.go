@@ -6,6 +6,7 @@ package auth
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/foundriesio/dg-satellite/storage"
 	"github.com/foundriesio/dg-satellite/storage/users"
@@ -51,6 +52,23 @@ func NewProvider(e *echo.Echo, db *storage.DbHandle, fs *storage.FsHandle, users
 	if err != nil {
 		return nil, fmt.Errorf("failed to get auth config: %w", err)
 	}
+	if err = users.SetUniqueEmails(authConfig.UniqueUserEmails); err != nil {
+		return nil, err
+	}
+	if authConfig.MaxSessionsPerUser < 0 {
+		return nil, fmt.Errorf("invalid MaxSessionsPerUser, must not be negative: %d", authConfig.MaxSessionsPerUser)
+	}
+	users.SetMaxSessions(authConfig.MaxSessionsPerUser)
+	if authConfig.MinTokenLifetimeHours < 0 || authConfig.MaxTokenLifetimeHours < 0 {
+		return nil, fmt.Errorf("invalid MinTokenLifetimeHours or MaxTokenLifetimeHours, must not be negative: %d, %d",
+			authConfig.MinTokenLifetimeHours, authConfig.MaxTokenLifetimeHours)
+	} else if authConfig.MaxTokenLifetimeHours > 0 && authConfig.MinTokenLifetimeHours > authConfig.MaxTokenLifetimeHours {
+		return nil, fmt.Errorf("invalid MinTokenLifetimeHours, must not exceed MaxTokenLifetimeHours: %d > %d",
+			authConfig.MinTokenLifetimeHours, authConfig.MaxTokenLifetimeHours)
+	}
+	users.SetTokenLifetime(
+		time.Duration(authConfig.MinTokenLifetimeHours)*time.Hour, time.Duration(authConfig.MaxTokenLifetimeHours)*time.Hour,
+	)
 
 	if provider, ok := providers[authConfig.Type]; ok {
 		if err := provider.Configure(e, users, authConfig); err != nil {
@@ -7,9 +7,12 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/foundriesio/dg-satellite/server"
+	"github.com/foundriesio/dg-satellite/storage"
 	"github.com/foundriesio/dg-satellite/storage/users"
 	"github.com/labstack/echo/v4"
 )
@@ -18,10 +21,90 @@ type loginPageRenderer interface {
 	renderLoginPage(c echo.Context, reason string) error
 }
 
+// apiPathPrefix is where REST API handlers are served, see server/ui/api.
+const apiPathPrefix = "/v1/"
+
+// wantsHtml tells if an unauthenticated request should get an HTML page, rather than a JSON error.
+// API requests always get JSON errors, so that API clients never have to handle a login page.
+func wantsHtml(c echo.Context) bool {
+	req := c.Request()
+	if strings.HasPrefix(req.URL.Path, apiPathPrefix) {
+		return false
+	}
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// unauthenticated answers a request without a valid session: a login page for browsers or a JSON error for others.
+func (p *commonProvider) unauthenticated(c echo.Context, reason string) error {
+	if !wantsHtml(c) {
+		return c.JSON(http.StatusUnauthorized, map[string]string{
+			"error": "authentication required",
+		})
+	}
+	return p.renderer.renderLoginPage(c, reason)
+}
+
 type commonProvider struct {
-	users       *users.Storage
-	rateLimiter *authRateLimiter
-	renderer    loginPageRenderer
+	users          *users.Storage
+	rateLimiter    *authRateLimiter
+	renderer       loginPageRenderer
+	loginRedirects []loginRedirect
+	branding       storage.LoginBranding
+}
+
+// sessionTimeout returns how long sessions of a provider last: the provider's own SessionTimeoutHours when set,
+// or else the SessionTimeoutHours of the auth config.
+func sessionTimeout(cfg *storage.AuthConfig, providerHours int) (time.Duration, error) {
+	if providerHours < 0 {
+		return 0, fmt.Errorf("session timeout hours must not be negative: %d", providerHours)
+	} else if providerHours > 0 {
+		return time.Duration(providerHours) * time.Hour, nil
+	}
+	return time.Duration(cfg.SessionTimeoutHours) * time.Hour, nil
+}
+
+type loginRedirect struct {
+	scopes users.Scopes
+	path   string
+}
+
+func parseLoginRedirects(cfg []storage.LoginRedirect) ([]loginRedirect, error) {
+	redirects := make([]loginRedirect, 0, len(cfg))
+	for _, r := range cfg {
+		// Only same-site paths are allowed, so that the config cannot turn a login into an open redirect.
+		if !strings.HasPrefix(r.Path, "/") || strings.HasPrefix(r.Path, "//") || strings.Contains(r.Path, "\\") {
+			return nil, fmt.Errorf("login redirect must be an absolute path on this site: %s", r.Path)
+		}
+		scopes, err := users.ScopesFromSlice(r.Scopes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse login redirect scopes: %w", err)
+		}
+		redirects = append(redirects, loginRedirect{scopes: scopes, path: r.Path})
+	}
+	return redirects, nil
+}
+
+func validateLoginBranding(cfg storage.LoginBranding) error {
+	if len(cfg.LogoUrl) == 0 {
+		return nil
+	}
+	// The content security policy of the UI only allows images of this site, see ui.DefaultSecurityHeaders.
+	if u, err := url.Parse(cfg.LogoUrl); err != nil {
+		return fmt.Errorf("unable to parse login logo URL: %w", err)
+	} else if len(u.Scheme) > 0 || len(u.Host) > 0 || !strings.HasPrefix(u.Path, "/") {
+		return fmt.Errorf("login logo URL must be an absolute path on this site: %s", cfg.LogoUrl)
+	}
+	return nil
+}
+
+// postLoginPath returns where to send a user after a login, see storage.LoginRedirect.
+func (p *commonProvider) postLoginPath(user *users.User) string {
+	for _, r := range p.loginRedirects {
+		if user.AllowedScopes.Has(r.scopes) {
+			return r.path
+		}
+	}
+	return "/"
 }
 
 func (p *commonProvider) DropSession(c echo.Context, session *Session) {
@@ -67,9 +150,9 @@ func (p *commonProvider) GetUser(c echo.Context) (*users.User, error) {
 func (p *commonProvider) GetSession(c echo.Context) (*Session, error) {
 	cookie, err := c.Cookie(AuthCookieName)
 	if err != nil {
-		return nil, p.renderer.renderLoginPage(c, err.Error())
+		return nil, p.unauthenticated(c, err.Error())
 	} else if len(cookie.Value) == 0 {
-		return nil, p.renderer.renderLoginPage(c, "")
+		return nil, p.unauthenticated(c, "")
 	}
 	sessionID := cookie.Value
 	user, err := p.users.GetBySession(sessionID)
@@ -82,7 +165,7 @@ func (p *commonProvider) GetSession(c echo.Context) (*Session, error) {
 		return session, nil
 	}
 	if err != nil {
-		return nil, p.renderer.renderLoginPage(c, err.Error())
+		return nil, p.unauthenticated(c, err.Error())
 	}
-	return nil, p.renderer.renderLoginPage(c, "")
+	return nil, p.unauthenticated(c, "")
 }
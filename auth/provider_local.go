@@ -34,11 +34,14 @@ type authConfigLocal struct {
 	MinPasswordLength        int
 	PasswordHistory          int
 	PasswordAgeDays          int
+	MinPasswordAgeDays       int
 	PasswordComplexityRules  PasswordComplexityRules
+	PasswordHashParams       PasswordHashParams
 	AttemptsPerSecond        int
 	AttemptsBlockDurationSec int
 	BadAuthLimit             int
 	BadAuthBlockDurationSec  int
+	SessionTimeoutHours      int // Overrides the SessionTimeoutHours of the auth config when set
 }
 
 type localProvider struct {
@@ -65,11 +68,23 @@ func (p *localProvider) Configure(e *echo.Echo, userStorage *users.Storage, cfg
 	p.users = userStorage
 	p.rateLimiter = NewRateLimiter(cfg.RateLimits)
 	p.renderer = p
-	p.sessionTimeout = time.Duration(cfg.SessionTimeoutHours) * time.Hour
+	if p.sessionTimeout, err = sessionTimeout(cfg, p.authConfig.SessionTimeoutHours); err != nil {
+		return err
+	}
 	p.newUserScopes, err = users.ScopesFromSlice(cfg.NewUserDefaultScopes)
 	if err != nil {
 		return fmt.Errorf("unable to parse new user default scopes: %w", err)
 	}
+	if err = p.hashParams().Validate(); err != nil {
+		return fmt.Errorf("invalid password hash parameters: %w", err)
+	}
+	if p.loginRedirects, err = parseLoginRedirects(cfg.LoginRedirects); err != nil {
+		return err
+	}
+	if err = validateLoginBranding(cfg.LoginBranding); err != nil {
+		return err
+	}
+	p.branding = cfg.LoginBranding
 
 	e.POST("/auth/login", p.handleLogin, p.rateLimiter.Middleware)
 	e.POST("/users", p.handleUserCreate, p.rateLimiter.Middleware)
@@ -95,6 +110,7 @@ func (p *localProvider) handleUserCreate(c echo.Context) error {
 	type createRequest struct {
 		Username string   `json:"username"`
 		Password string   `json:"password"`
+		Email    string   `json:"email"`
 		Scopes   []string `json:"scopes"`
 	}
 	var req createRequest
@@ -119,7 +135,7 @@ func (p *localProvider) handleUserCreate(c echo.Context) error {
 		return server.EchoError(c, err, http.StatusBadRequest, err.Error())
 	}
 
-	hashed, err := PasswordHash(req.Password)
+	hashed, err := PasswordHashWithParams(req.Password, p.hashParams())
 	if err != nil {
 		return server.EchoError(c, err, http.StatusInternalServerError, "Unable to hash password")
 	}
@@ -135,10 +151,16 @@ func (p *localProvider) handleUserCreate(c echo.Context) error {
 	u := &users.User{
 		Username:      req.Username,
 		Password:      hashed,
+		Email:         req.Email,
 		AllowedScopes: scopes,
 	}
 
 	if err := p.users.Create(u); err != nil {
+		if errors.Is(err, users.ErrEmailRequired) {
+			return server.EchoError(c, err, http.StatusBadRequest, "Email is required")
+		} else if errors.Is(err, users.ErrEmailTaken) {
+			return server.EchoError(c, err, http.StatusConflict, "Email is already in use")
+		}
 		return server.EchoError(c, err, http.StatusInternalServerError, "Unable to create user")
 	}
 	return c.String(http.StatusCreated, "User created")
@@ -162,6 +184,7 @@ func (p *localProvider) handleLogin(c echo.Context) error {
 		p.rateLimiter.FlagBadOperation(c)
 		return p.renderLoginPage(c, "Invalid username or password")
 	}
+	p.rehashPassword(user, password)
 
 	expires := time.Now().Add(p.sessionTimeout)
 	sessionId, err := user.CreateSession(c.RealIP(), expires.Unix(), user.AllowedScopes)
@@ -179,17 +202,10 @@ func (p *localProvider) handleLogin(c echo.Context) error {
 	})
 	SetCsrfCookie(c, expires)
 
-	return c.Redirect(http.StatusSeeOther, "/")
+	return c.Redirect(http.StatusSeeOther, p.postLoginPath(user))
 }
 
 func (p localProvider) renderLoginPage(c echo.Context, reason string) error {
-	accepts := c.Request().Header.Get("Accept")
-	if !strings.Contains(accepts, "text/html") {
-		return c.JSON(http.StatusUnauthorized, map[string]string{
-			"error": "authentication required",
-		})
-	}
-
 	csrfToken := SetCsrfCookie(c, time.Now().Add(10*time.Minute))
 
 	context := struct {
@@ -198,10 +214,12 @@ func (p localProvider) renderLoginPage(c echo.Context, reason string) error {
 		User      *users.User
 		NavItems  []string
 		CsrfToken string
+		Branding  storage.LoginBranding
 	}{
 		Title:     "Login",
 		Reason:    reason,
 		CsrfToken: csrfToken,
+		Branding:  p.branding,
 	}
 	return templates.Templates.ExecuteTemplate(c.Response(), localLoginTemplate, context)
 }
@@ -225,6 +243,11 @@ func (p localProvider) GetSession(c echo.Context) (*Session, error) {
 			passwordAge := time.Now().Unix() - localData.PasswordTimestamp
 			maxAge := int64(p.authConfig.PasswordAgeDays * 24 * 60 * 60)
 			if localData.PasswordTimestamp == 0 || passwordAge > maxAge {
+				if !wantsHtml(c) {
+					return nil, c.JSON(http.StatusUnauthorized, map[string]string{
+						"error": "password expired",
+					})
+				}
 				return nil, p.handlePasswordPage(c, session)
 			}
 		} else {
@@ -348,12 +371,45 @@ func (p *localProvider) handlePasswordReset(c echo.Context) error {
 	return c.String(http.StatusOK, "")
 }
 
+// hashParams returns the configured password hash parameters, or the defaults if not configured.
+func (p localProvider) hashParams() PasswordHashParams {
+	if p.authConfig.PasswordHashParams == (PasswordHashParams{}) {
+		return DefaultPasswordHashParams
+	}
+	return p.authConfig.PasswordHashParams
+}
+
+// rehashPassword upgrades a verified password to the configured hash parameters, if they changed since it was hashed.
+// This is not critical - a failure is logged, and the next login tries again.
+func (p localProvider) rehashPassword(u *users.User, password string) {
+	if !PasswordNeedsRehash(u.Password, p.hashParams()) {
+		return
+	}
+	hashed, err := PasswordHashWithParams(password, p.hashParams())
+	if err != nil {
+		slog.Error("Unable to re-hash password", "user", u.Username, "error", err)
+		return
+	}
+	u.Password = hashed
+	if err = u.Update("Password re-hashed with new parameters"); err != nil {
+		slog.Error("Unable to save re-hashed password", "user", u.Username, "error", err)
+	}
+}
+
 func (p localProvider) setPassword(u *users.User, password string) (int, error) {
 	var localData localProviderUserData
 	if err := json.Unmarshal(u.AuthProviderData, &localData); err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("unable to unmarshal auth provider data: %w", err)
 	}
 
+	// A zero timestamp means the password was reset by an admin, and must be changeable right away.
+	if p.authConfig.MinPasswordAgeDays > 0 && localData.PasswordTimestamp > 0 {
+		minAge := int64(p.authConfig.MinPasswordAgeDays * 24 * 60 * 60)
+		if time.Now().Unix()-localData.PasswordTimestamp < minAge {
+			return http.StatusBadRequest, fmt.Errorf("password cannot be changed more than once in %d day(s)", p.authConfig.MinPasswordAgeDays)
+		}
+	}
+
 	if p.authConfig.MinPasswordLength > 0 && len(password) < p.authConfig.MinPasswordLength {
 		return http.StatusBadRequest, fmt.Errorf("new password must be at least %d characters", p.authConfig.MinPasswordLength)
 	}
@@ -362,7 +418,7 @@ func (p localProvider) setPassword(u *users.User, password string) (int, error)
 		return http.StatusBadRequest, err
 	}
 
-	hashed, err := PasswordHash(password)
+	hashed, err := PasswordHashWithParams(password, p.hashParams())
 	if err != nil {
 		return http.StatusInternalServerError, fmt.Errorf("unable to hash password: %w", err)
 	}
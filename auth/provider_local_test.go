@@ -0,0 +1,284 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foundriesio/dg-satellite/storage"
+	"github.com/foundriesio/dg-satellite/storage/users"
+)
+
+func TestMinPasswordAge(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	require.Nil(t, fs.Auth.InitHmacSecret())
+	userStorage, err := users.NewStorage(db, fs)
+	require.Nil(t, err)
+
+	p := localProvider{authConfig: &authConfigLocal{MinPasswordAgeDays: 2}}
+	p.users = userStorage
+	u := users.User{Username: "testuser", AllowedScopes: users.ScopeDevicesR, AuthProviderData: []byte("{}")}
+	require.Nil(t, userStorage.Create(&u))
+
+	setTimestamp := func(ts int64) {
+		data, err := json.Marshal(localProviderUserData{PasswordTimestamp: ts})
+		require.Nil(t, err)
+		u.AuthProviderData = data
+	}
+
+	// A password never set or reset by an admin can be changed right away.
+	_, err = p.setPassword(&u, "first")
+	require.Nil(t, err)
+
+	// Changed just now.
+	status, err := p.setPassword(&u, "second")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.ErrorContains(t, err, "more than once in 2 day(s)")
+
+	// Changed a day ago.
+	setTimestamp(time.Now().Add(-24 * time.Hour).Unix())
+	status, err = p.setPassword(&u, "second")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.NotNil(t, err)
+
+	// Changed more than the minimum age ago.
+	setTimestamp(time.Now().Add(-49 * time.Hour).Unix())
+	_, err = p.setPassword(&u, "second")
+	require.Nil(t, err)
+	ok, err := PasswordVerify("second", u.Password)
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	// Reset by an admin.
+	setTimestamp(0)
+	_, err = p.setPassword(&u, "third")
+	require.Nil(t, err)
+}
+
+func TestUnauthenticatedNegotiation(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	require.Nil(t, fs.Auth.InitHmacSecret())
+	userStorage, err := users.NewStorage(db, fs)
+	require.Nil(t, err)
+
+	p := &localProvider{authConfig: &authConfigLocal{PasswordAgeDays: 1}}
+	p.users = userStorage
+	p.renderer = p
+	e := echo.New()
+
+	getSession := func(path, accept, session string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		if len(session) > 0 {
+			req.AddCookie(&http.Cookie{Name: AuthCookieName, Value: session})
+		}
+		rec := httptest.NewRecorder()
+		s, err := p.GetSession(e.NewContext(req, rec))
+		require.Nil(t, err)
+		require.Nil(t, s)
+		return rec
+	}
+	const browser = "text/html,application/xhtml+xml,*/*;q=0.8"
+
+	// API clients always get a JSON error, even if they accept HTML.
+	for _, accept := range []string{"", "application/json", browser} {
+		rec := getSession("/v1/devices", accept, "")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+		assert.Equal(t, echo.MIMEApplicationJSON, rec.Header().Get(echo.HeaderContentType))
+		assert.JSONEq(t, `{"error":"authentication required"}`, rec.Body.String())
+	}
+
+	// Browsers get a login page for web UI paths, other clients get a JSON error.
+	rec := getSession("/devices", browser, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<form")
+	rec = getSession("/devices", "application/json", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = getSession("/devices", browser, "no-such-session")
+	assert.Contains(t, rec.Body.String(), "<form")
+
+	// An expired password is reported to API clients as a JSON error, not a password change page.
+	u := users.User{Username: "testuser", AllowedScopes: users.ScopeDevicesR, AuthProviderData: []byte("{}")}
+	require.Nil(t, userStorage.Create(&u))
+	session, err := u.CreateSession("127.0.0.1", time.Now().Add(time.Hour).Unix(), u.AllowedScopes)
+	require.Nil(t, err)
+	rec = getSession("/v1/devices", browser, session)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.JSONEq(t, `{"error":"password expired"}`, rec.Body.String())
+	rec = getSession("/devices", browser, session)
+	assert.Contains(t, rec.Body.String(), "Your password has expired")
+}
+
+func TestPasswordRehashOnLogin(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	require.Nil(t, fs.Auth.InitHmacSecret())
+	userStorage, err := users.NewStorage(db, fs)
+	require.Nil(t, err)
+
+	hashed, err := PasswordHash("secret")
+	require.Nil(t, err)
+	u := users.User{Username: "testuser", Password: hashed, AllowedScopes: users.ScopeDevicesR, AuthProviderData: []byte("{}")}
+	require.Nil(t, userStorage.Create(&u))
+
+	cheap := PasswordHashParams{N: 1024, R: 8, P: 1}
+	p := &localProvider{authConfig: &authConfigLocal{PasswordHashParams: cheap}}
+	p.users = userStorage
+	p.renderer = p
+	e := echo.New()
+	login := func(password string) int {
+		form := url.Values{"username": {"testuser"}, "password": {password}}
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		require.Nil(t, p.handleLogin(e.NewContext(req, rec)))
+		return rec.Code
+	}
+
+	// Hashes with old parameters still verify, and are upgraded on a successful login.
+	assert.Equal(t, http.StatusSeeOther, login("secret"))
+	updated, err := userStorage.Get("testuser")
+	require.Nil(t, err)
+	assert.NotEqual(t, hashed, updated.Password)
+	assert.False(t, PasswordNeedsRehash(updated.Password, cheap))
+	ok, err := PasswordVerify("secret", updated.Password)
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	// No re-hash when parameters did not change.
+	assert.Equal(t, http.StatusSeeOther, login("secret"))
+	again, err := userStorage.Get("testuser")
+	require.Nil(t, err)
+	assert.Equal(t, updated.Password, again.Password)
+
+	// Back to defaults.
+	p.authConfig.PasswordHashParams = PasswordHashParams{}
+	assert.Equal(t, http.StatusSeeOther, login("secret"))
+	again, err = userStorage.Get("testuser")
+	require.Nil(t, err)
+	assert.Equal(t, byte('0'), again.Password[0])
+}
+
+func TestLoginRedirects(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	require.Nil(t, fs.Auth.InitHmacSecret())
+	userStorage, err := users.NewStorage(db, fs)
+	require.Nil(t, err)
+
+	for _, path := range []string{"devices", "//evil.example.com", "/\\evil.example.com", "https://evil.example.com"} {
+		_, err = parseLoginRedirects([]storage.LoginRedirect{{Path: path}})
+		assert.NotNil(t, err, path)
+	}
+	_, err = parseLoginRedirects([]storage.LoginRedirect{{Scopes: []string{"no-such-scope"}, Path: "/"}})
+	assert.NotNil(t, err)
+
+	cheap := PasswordHashParams{N: 1024, R: 8, P: 1}
+	hashed, err := PasswordHashWithParams("secret", cheap)
+	require.Nil(t, err)
+	for _, u := range []users.User{
+		{Username: "admin", AllowedScopes: users.ScopeUsersR | users.ScopeDevicesR},
+		{Username: "operator", AllowedScopes: users.ScopeDevicesR},
+	} {
+		u.Password = hashed
+		u.AuthProviderData = []byte("{}")
+		require.Nil(t, userStorage.Create(&u))
+	}
+
+	p := &localProvider{authConfig: &authConfigLocal{PasswordHashParams: cheap}}
+	p.users = userStorage
+	p.renderer = p
+	e := echo.New()
+	login := func(username string) string {
+		form := url.Values{"username": {username}, "password": {"secret"}}
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		require.Nil(t, p.handleLogin(e.NewContext(req, rec)))
+		require.Equal(t, http.StatusSeeOther, rec.Code)
+		return rec.Header().Get("Location")
+	}
+
+	// Everyone lands on the home page by default.
+	assert.Equal(t, "/", login("admin"))
+	assert.Equal(t, "/", login("operator"))
+
+	p.loginRedirects, err = parseLoginRedirects([]storage.LoginRedirect{
+		{Scopes: []string{"users:read"}, Path: "/users"},
+		{Path: "/devices"},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, "/users", login("admin"))
+	assert.Equal(t, "/devices", login("operator"))
+}
+
+func TestLoginBranding(t *testing.T) {
+	render := func(p loginPageRenderer) string {
+		req := httptest.NewRequest(http.MethodGet, "/devices", nil)
+		rec := httptest.NewRecorder()
+		require.Nil(t, p.renderLoginPage(echo.New().NewContext(req, rec), ""))
+		return rec.Body.String()
+	}
+	local := &localProvider{}
+	require.Nil(t, local.Configure(echo.New(), nil, &storage.AuthConfig{Config: []byte(`{}`)}))
+	oauth := &oauth2BaseProvider{name: "test", displayName: "Test SSO"}
+	require.Nil(t, oauth.configure(echo.New(), nil, &storage.AuthConfig{Type: "test", Config: []byte(`{}`)}))
+
+	// Defaults.
+	for _, p := range []loginPageRenderer{local, oauth} {
+		body := render(p)
+		assert.Contains(t, body, "<h2>Login</h2>")
+		assert.NotContains(t, body, "<img")
+		assert.NotContains(t, body, "Need help?")
+	}
+
+	branding := storage.LoginBranding{
+		Title:          "Example Corp Devices",
+		LogoUrl:        "/static/logo.png",
+		SupportContact: "support@example.com",
+	}
+	cfg := storage.AuthConfig{Type: "test", LoginBranding: branding, Config: []byte(`{}`)}
+	require.Nil(t, local.Configure(echo.New(), nil, &cfg))
+	require.Nil(t, oauth.configure(echo.New(), nil, &cfg))
+	for _, p := range []loginPageRenderer{local, oauth} {
+		body := render(p)
+		assert.Contains(t, body, "<h2>Example Corp Devices</h2>")
+		assert.Contains(t, body, `<img src="/static/logo.png"`)
+		assert.Contains(t, body, "Need help? Contact support@example.com")
+	}
+
+	for _, logo := range []string{
+		"javascript:alert(1)", "logo.png", "data:image/png;base64,AAAA", "https://example.com/logo.png", "//example.com/logo.png",
+	} {
+		cfg.LoginBranding.LogoUrl = logo
+		assert.NotNil(t, local.Configure(echo.New(), nil, &cfg), logo)
+	}
+}
@@ -8,9 +8,9 @@ import (
 	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"html"
 	"log/slog"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/foundriesio/dg-satellite/server/ui/web/templates"
@@ -21,9 +21,10 @@ import (
 )
 
 type authConfigOauth2 struct {
-	ClientID     string
-	ClientSecret string
-	BaseUrl      string
+	ClientID            string
+	ClientSecret        string
+	BaseUrl             string
+	SessionTimeoutHours int // Overrides the SessionTimeoutHours of the auth config when set
 }
 
 type oauth2BaseProvider struct {
@@ -61,7 +62,16 @@ func (p *oauth2BaseProvider) configure(e *echo.Echo, usersStorage *users.Storage
 	p.users = usersStorage
 	p.rateLimiter = NewRateLimiter(cfg.RateLimits)
 	p.renderer = p
-	p.sessionTimeout = time.Duration(cfg.SessionTimeoutHours) * time.Hour
+	if p.sessionTimeout, err = sessionTimeout(cfg, cfgOauth.SessionTimeoutHours); err != nil {
+		return err
+	}
+	if p.loginRedirects, err = parseLoginRedirects(cfg.LoginRedirects); err != nil {
+		return err
+	}
+	if err = validateLoginBranding(cfg.LoginBranding); err != nil {
+		return err
+	}
+	p.branding = cfg.LoginBranding
 
 	e.GET(AuthLoginPath, p.handleLogin, p.rateLimiter.Middleware)
 	e.GET(AuthCallbackPath, p.handleOauthCallback, p.rateLimiter.Middleware)
@@ -69,12 +79,6 @@ func (p *oauth2BaseProvider) configure(e *echo.Echo, usersStorage *users.Storage
 }
 
 func (p oauth2BaseProvider) renderLoginPage(c echo.Context, reason string) error {
-	accepts := c.Request().Header.Get("Accept")
-	if !strings.Contains(accepts, "text/html") {
-		return c.JSON(http.StatusUnauthorized, map[string]string{
-			"error": "authentication required",
-		})
-	}
 	var csrfToken string
 	if cookie, err := c.Cookie(CsrfCookieName); err == nil {
 		csrfToken = cookie.Value
@@ -87,12 +91,14 @@ func (p oauth2BaseProvider) renderLoginPage(c echo.Context, reason string) error
 		User      *users.User
 		NavItems  []string
 		CsrfToken string
+		Branding  storage.LoginBranding
 	}{
 		Title:     "Login",
 		LoginTip:  p.loginTip,
 		Name:      p.displayName,
 		Reason:    reason,
 		CsrfToken: csrfToken,
+		Branding:  p.branding,
 	}
 	return templates.Templates.ExecuteTemplate(c.Response(), "oauth2-login.html", context)
 }
@@ -149,10 +155,13 @@ func (p oauth2BaseProvider) handleOauthCallback(c echo.Context) error {
 	// a direct redirect. Browsers won't send SameSiteStrict cookies on a
 	// cross-site redirect (the OAuth callback is a cross-site navigation),
 	// but they will send them on a navigation initiated from the same site.
-	c.Response().Header().Set("Location", "/")
+	location := p.postLoginPath(user)
+	escaped := html.EscapeString(location)
+	c.Response().Header().Set("Location", location)
 	c.Response().Header().Set("Cache-Control", "no-store")
 	c.Response().Header().Set("Content-Type", "text/html; charset=utf-8")
-	return c.HTML(http.StatusOK, `<!DOCTYPE html><html><head><meta http-equiv="refresh" content="0;url=/"></head><body>Redirecting <a href="/">here</a>...</body></html>`)
+	return c.HTML(http.StatusOK, `<!DOCTYPE html><html><head><meta http-equiv="refresh" content="0;url=`+escaped+
+		`"></head><body>Redirecting <a href="`+escaped+`">here</a>...</body></html>`)
 }
 
 func generateStateOauthCookie(c echo.Context) string {
@@ -0,0 +1,80 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"github.com/foundriesio/dg-satellite/storage"
+	"github.com/foundriesio/dg-satellite/storage/users"
+)
+
+func TestOauthSessionTimeout(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	require.Nil(t, fs.Auth.InitHmacSecret())
+	userStorage, err := users.NewStorage(db, fs)
+	require.Nil(t, err)
+	u := users.User{Username: "testuser", AllowedScopes: users.ScopeDevicesR, AuthProviderData: []byte("{}")}
+	require.Nil(t, userStorage.Create(&u))
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"token","token_type":"bearer"}`))
+	}))
+	defer tokenServer.Close()
+
+	login := func(cfg storage.AuthConfig) time.Duration {
+		p := &oauth2BaseProvider{name: "test"}
+		p.checkToken = func(echo.Context, *oauth2.Token) (*users.User, error) {
+			return &u, nil
+		}
+		p.oauthConfig = &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: tokenServer.URL}}
+		cfg.Type = "test"
+		require.Nil(t, p.configure(echo.New(), userStorage, &cfg))
+
+		req := httptest.NewRequest(http.MethodGet, AuthCallbackPath+"?state=xyz&code=abc", nil)
+		req.AddCookie(&http.Cookie{Name: "dg-oauthstate", Value: "xyz"})
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		require.Nil(t, p.handleOauthCallback(echo.New().NewContext(req, rec)))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name == AuthCookieName {
+				return cookie.Expires.Sub(start.Truncate(time.Second))
+			}
+		}
+		require.Fail(t, "no session cookie")
+		return 0
+	}
+
+	assertTimeout := func(expected, actual time.Duration) {
+		assert.GreaterOrEqual(t, actual, expected)
+		assert.LessOrEqual(t, actual, expected+2*time.Second)
+	}
+	assertTimeout(48*time.Hour, login(storage.AuthConfig{SessionTimeoutHours: 48, Config: []byte(`{}`)}))
+	assertTimeout(5*time.Hour, login(storage.AuthConfig{SessionTimeoutHours: 5, Config: []byte(`{}`)}))
+	// A provider config overrides the global timeout.
+	assertTimeout(2*time.Hour, login(storage.AuthConfig{
+		SessionTimeoutHours: 48, Config: []byte(`{"SessionTimeoutHours": 2}`),
+	}))
+
+	p := &oauth2BaseProvider{name: "test"}
+	err = p.configure(echo.New(), userStorage, &storage.AuthConfig{
+		Type: "test", Config: []byte(`{"SessionTimeoutHours": -1}`),
+	})
+	assert.ErrorContains(t, err, "must not be negative")
+}
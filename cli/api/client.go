@@ -6,6 +6,7 @@ package api
 import (
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/foundriesio/dg-satellite/cli/config"
 )
@@ -14,6 +15,13 @@ type Api struct {
 	URL string
 
 	Client *http.Client
+
+	// Timeout caps each request, except for streams like log tails and file transfers. Zero means no timeout.
+	Timeout time.Duration
+	// Retries is how many times a GET request is retried after a network error or a transient server error.
+	Retries int
+
+	retryBackoff time.Duration
 }
 
 func NewClient(appCtx config.Context) *Api {
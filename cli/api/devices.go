@@ -18,6 +18,12 @@ type Device = models.Device
 type DeviceUpdateEvent = models.DeviceUpdateEvent
 type TargetTest = storage.TargetTest
 
+// LabelsPatch is a set of label changes applied to a device at once.
+type LabelsPatch struct {
+	Upserts map[string]string `json:"Upserts,omitempty"`
+	Deletes []string          `json:"Deletes,omitempty"`
+}
+
 type DeviceApi struct {
 	api *Api
 }
@@ -86,6 +92,11 @@ func (d DeviceApi) UpdateEvents(uuid, updateId string) ([]DeviceUpdateEvent, err
 	return events, d.api.Get(fmt.Sprintf("/v1/devices/%s/updates/%s", uuid, updateId), &events)
 }
 
+func (d DeviceApi) PatchLabels(uuid string, patch LabelsPatch) error {
+	_, err := d.api.Patch(fmt.Sprintf("/v1/devices/%s/labels", uuid), patch)
+	return err
+}
+
 func (d DeviceApi) Delete(uuid string) error {
 	return d.api.Delete(fmt.Sprintf("/v1/devices/%s", uuid))
 }
@@ -0,0 +1,42 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDevicesPatchLabels(t *testing.T) {
+	var method, path, contentType, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, contentType = r.Method, r.URL.Path, r.Header.Get("Content-Type")
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		if r.URL.Path == "/v1/devices/bad/labels" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	a := &Api{URL: srv.URL, Client: srv.Client()}
+
+	err := a.Devices().PatchLabels("dev1", LabelsPatch{Upserts: map[string]string{"name": "foo"}})
+	require.Nil(t, err)
+	assert.Equal(t, http.MethodPatch, method)
+	assert.Equal(t, "/v1/devices/dev1/labels", path)
+	assert.Equal(t, "application/json", contentType)
+	assert.JSONEq(t, `{"Upserts":{"name":"foo"}}`, body)
+
+	err = a.Devices().PatchLabels("dev1", LabelsPatch{Deletes: []string{"name", "group"}})
+	require.Nil(t, err)
+	assert.JSONEq(t, `{"Deletes":["name","group"]}`, body)
+
+	err = a.Devices().PatchLabels("bad", LabelsPatch{Deletes: []string{"name"}})
+	assert.ErrorContains(t, err, "failed with status 400")
+}
@@ -5,13 +5,18 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 )
 
+// The first retry of a GET request waits for this long, and each next retry waits twice as long as the previous one.
+const defaultRetryBackoff = 500 * time.Millisecond
+
 type HttpOption func(opts *httpOptions)
 
 func HttpHeader(name, value string) HttpOption {
@@ -45,7 +50,7 @@ func parseLinkRel(linkHeader, rel string) (string, bool) {
 }
 
 func (a Api) GetWithHeaders(resource string, result any, opts ...HttpOption) (http.Header, error) {
-	body, headers, err := a.getStreamHeaders(resource, opts...)
+	body, headers, err := a.getStreamHeaders(resource, false, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -61,32 +66,82 @@ func (a Api) Get(resource string, result any, opts ...HttpOption) error {
 	return err
 }
 
+// GetStream returns the response body of a GET request, which is not subject to the request timeout.
 func (a Api) GetStream(resource string, opts ...HttpOption) (io.ReadCloser, error) {
-	body, _, err := a.getStreamHeaders(resource, opts...)
+	body, _, err := a.getStreamHeaders(resource, true, opts...)
 	return body, err
 }
 
-func (a Api) getStreamHeaders(resource string, opts ...HttpOption) (io.ReadCloser, http.Header, error) {
+func (a Api) getStreamHeaders(resource string, stream bool, opts ...HttpOption) (io.ReadCloser, http.Header, error) {
 	var options httpOptions
 	options.apply(opts)
 	url := a.URL + resource
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	backoff := a.retryBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
 	}
-	req.Header = options.header
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := a.requestContext(stream)
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			cancel()
+			return nil, nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header = options.header
 
-	resp, err := a.Client.Do(req)
+		resp, err := a.Client.Do(req)
+		if attempt < a.Retries && isRetryable(resp, err) {
+			if resp != nil {
+				a.closeHttpBody(resp.Body)
+			}
+			cancel()
+			time.Sleep(backoff << attempt)
+			continue
+		}
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			defer cancel()
+			defer a.closeHttpBody(resp.Body)
+			return nil, nil, a.handleHttpError(resp)
+		}
+		// Return the response without closing the body - caller must close it
+		return cancelOnClose{resp.Body, cancel}, resp.Header, nil
+	}
+}
+
+// isRetryable tells if a GET request failed for a reason that may go away on its own.
+func isRetryable(resp *http.Response, err error) bool {
 	if err != nil {
-		return nil, nil, err
+		return true
 	}
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		defer a.closeHttpBody(resp.Body)
-		return nil, nil, a.handleHttpError(resp)
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// requestContext returns a context which applies the request timeout, unless the request is a stream.
+func (a Api) requestContext(stream bool) (context.Context, context.CancelFunc) {
+	if stream || a.Timeout <= 0 {
+		return context.WithCancel(context.Background())
 	}
-	// Return the response without closing the body - caller must close it
-	return resp.Body, resp.Header, nil
+	return context.WithTimeout(context.Background(), a.Timeout)
+}
+
+// cancelOnClose releases the request context of a response body along with the body.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
 }
 
 func (a Api) Delete(resource string, opts ...HttpOption) error {
@@ -94,7 +149,9 @@ func (a Api) Delete(resource string, opts ...HttpOption) error {
 	options.apply(opts)
 	url := a.URL + resource
 
-	req, err := http.NewRequest("DELETE", url, nil)
+	ctx, cancel := a.requestContext(false)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
@@ -112,41 +169,30 @@ func (a Api) Delete(resource string, opts ...HttpOption) error {
 }
 
 func (a Api) Post(resource string, body any, opts ...HttpOption) ([]byte, error) {
-	var options httpOptions
-	options.apply(opts)
-	url := a.URL + resource
+	return a.send("POST", resource, body, opts...)
+}
 
-	reader, err := a.handleRequestBody(body, &options)
-	if err != nil {
-		return nil, err
-	}
-	req, err := http.NewRequest("POST", url, reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header = options.header
+func (a Api) Put(resource string, body any, opts ...HttpOption) ([]byte, error) {
+	return a.send("PUT", resource, body, opts...)
+}
 
-	resp, err := a.Client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer a.closeHttpBody(resp.Body)
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, a.handleHttpError(resp)
-	}
-	return io.ReadAll(resp.Body)
+func (a Api) Patch(resource string, body any, opts ...HttpOption) ([]byte, error) {
+	return a.send("PATCH", resource, body, opts...)
 }
 
-func (a Api) Put(resource string, body any, opts ...HttpOption) ([]byte, error) {
+// send makes a request with a body, and returns the response body.
+func (a Api) send(method, resource string, body any, opts ...HttpOption) ([]byte, error) {
 	var options httpOptions
 	options.apply(opts)
 	url := a.URL + resource
 
-	reader, err := a.handleRequestBody(body, &options)
+	reader, stream, err := a.handleRequestBody(body, &options)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("PUT", url, reader)
+	ctx, cancel := a.requestContext(stream)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -160,26 +206,26 @@ func (a Api) Put(resource string, body any, opts ...HttpOption) ([]byte, error)
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		return nil, a.handleHttpError(resp)
 	}
-
 	return io.ReadAll(resp.Body)
 }
 
-func (a Api) handleRequestBody(body any, options *httpOptions) (io.Reader, error) {
+// handleRequestBody returns a reader of the request body, and whether it is a stream like a file upload.
+func (a Api) handleRequestBody(body any, options *httpOptions) (io.Reader, bool, error) {
 	if reader, ok := body.(io.Reader); ok {
 		if _, ok = options.header["Content-Type"]; !ok {
 			options.header.Set("Content-Type", "application/octet-stream")
 		}
-		return reader, nil
+		return reader, true, nil
 	} else {
 		jsonData, err := json.Marshal(body)
 		if err != nil {
-			return nil, fmt.Errorf("failed to marshal request body: %w", err)
+			return nil, false, fmt.Errorf("failed to marshal request body: %w", err)
 		}
 		reader := bytes.NewBuffer(jsonData) // no need to close
 		if _, ok = options.header["Content-Type"]; !ok {
 			options.header.Set("Content-Type", "application/json")
 		}
-		return reader, nil
+		return reader, false, nil
 	}
 }
 
@@ -0,0 +1,90 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHttpRetries(t *testing.T) {
+	var requests, failures atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/bad":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			_, _ = w.Write([]byte(`{"name":"foo"}`))
+		}
+	}))
+	defer srv.Close()
+	a := &Api{URL: srv.URL, Client: srv.Client(), Retries: 2, retryBackoff: time.Millisecond}
+
+	var res map[string]string
+	failures.Store(2)
+	require.Nil(t, a.Get("/ok", &res))
+	assert.Equal(t, "foo", res["name"])
+	assert.Equal(t, int32(3), requests.Load())
+
+	requests.Store(0)
+	failures.Store(3)
+	assert.ErrorContains(t, a.Get("/ok", &res), "failed with status 503")
+	assert.Equal(t, int32(3), requests.Load())
+
+	// Client errors are not retried.
+	requests.Store(0)
+	failures.Store(0)
+	assert.ErrorContains(t, a.Get("/bad", &res), "failed with status 400")
+	assert.Equal(t, int32(1), requests.Load())
+
+	// Neither are requests which are not idempotent.
+	requests.Store(0)
+	failures.Store(1)
+	_, err := a.Post("/ok", map[string]string{})
+	assert.ErrorContains(t, err, "failed with status 503")
+	assert.Equal(t, int32(1), requests.Load())
+
+	// Network errors are retried.
+	a.URL = "http://127.0.0.1:1"
+	start := time.Now()
+	assert.NotNil(t, a.Get("/ok", &res))
+	assert.GreaterOrEqual(t, time.Since(start), 3*time.Millisecond)
+}
+
+func TestHttpTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("["))
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("]"))
+	}))
+	defer srv.Close()
+	a := &Api{URL: srv.URL, Client: srv.Client(), Timeout: 20 * time.Millisecond}
+
+	var res []string
+	assert.ErrorContains(t, a.Get("/slow", &res), "deadline exceeded")
+
+	// Streams are not capped by the timeout.
+	body, err := a.GetStream("/slow")
+	require.Nil(t, err)
+	data, err := io.ReadAll(body)
+	require.Nil(t, err)
+	require.Nil(t, body.Close())
+	assert.Equal(t, "[]", string(data))
+
+	a.Timeout = time.Second
+	require.Nil(t, a.Get("/slow", &res))
+}
@@ -9,7 +9,10 @@ import (
 	models "github.com/foundriesio/dg-satellite/storage/api"
 )
 
-type Rollout = models.Rollout
+type (
+	Rollout         = models.Rollout
+	RolloutListItem = models.RolloutListItem
+)
 
 type UpdatesApi struct {
 	api  *Api
@@ -35,6 +38,13 @@ func (u UpdatesApi) Get(tag, updateName string) ([]string, error) {
 	return rollouts, u.api.Get(endpoint, &rollouts)
 }
 
+// ListRollouts returns the rollouts of an update along with their commit status and device counts.
+func (u UpdatesApi) ListRollouts(tag, updateName string) ([]RolloutListItem, error) {
+	var rollouts []RolloutListItem
+	endpoint := "/v1/updates/" + u.Type + "/" + tag + "/" + updateName + "/rollouts?include=device-count"
+	return rollouts, u.api.Get(endpoint, &rollouts)
+}
+
 func (u UpdatesApi) Tail(tag, updateName string) (io.ReadCloser, error) {
 	endpoint := "/v1/updates/" + u.Type + "/" + tag + "/" + updateName
 	return u.api.GetStream(endpoint)
@@ -0,0 +1,40 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdatesListRollouts(t *testing.T) {
+	var method, path, query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, query = r.Method, r.URL.Path, r.URL.RawQuery
+		if r.URL.Path == "/v1/updates/prod/tag1/missing/rollouts" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`[{"name":"roll1","committed":true,"device-count":2,"modified-at":1700000000}]`))
+	}))
+	defer srv.Close()
+	a := &Api{URL: srv.URL, Client: srv.Client()}
+
+	rollouts, err := a.Updates("prod").ListRollouts("tag1", "update1")
+	require.Nil(t, err)
+	assert.Equal(t, http.MethodGet, method)
+	assert.Equal(t, "/v1/updates/prod/tag1/update1/rollouts", path)
+	assert.Equal(t, "include=device-count", query)
+	require.Len(t, rollouts, 1)
+	assert.Equal(t, "roll1", rollouts[0].Name)
+	assert.True(t, rollouts[0].Committed)
+	assert.Equal(t, 2, rollouts[0].DeviceCount)
+
+	_, err = a.Updates("prod").ListRollouts("tag1", "missing")
+	assert.ErrorContains(t, err, "failed with status 404")
+}
@@ -0,0 +1,95 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package devices
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/foundriesio/dg-satellite/cli/api"
+	"github.com/foundriesio/dg-satellite/storage"
+	"github.com/spf13/cobra"
+)
+
+var labelsCmd = &cobra.Command{
+	Use:   "labels",
+	Short: "Manage device labels",
+}
+
+var labelsGetCmd = &cobra.Command{
+	Use:   "get <uuid>",
+	Short: "Show labels of a device",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		api := api.CtxGetApi(cmd.Context())
+		device, err := api.Devices().Get(args[0])
+		cobra.CheckErr(err)
+		names := make([]string, 0, len(device.Labels))
+		for k := range device.Labels {
+			names = append(names, k)
+		}
+		slices.Sort(names)
+		for _, k := range names {
+			fmt.Printf("%s=%s\n", k, device.Labels[k])
+		}
+	},
+}
+
+var labelsSetCmd = &cobra.Command{
+	Use:   "set <uuid> <name=value>...",
+	Short: "Add or change labels of a device",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		upserts, err := parseLabelUpserts(args[1:])
+		cobra.CheckErr(err)
+		api := api.CtxGetApi(cmd.Context())
+		cobra.CheckErr(api.Devices().PatchLabels(args[0], upserts))
+	},
+}
+
+var labelsDeleteCmd = &cobra.Command{
+	Use:   "delete <uuid> <name>...",
+	Short: "Remove labels from a device",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		deletes, err := parseLabelDeletes(args[1:])
+		cobra.CheckErr(err)
+		api := api.CtxGetApi(cmd.Context())
+		cobra.CheckErr(api.Devices().PatchLabels(args[0], deletes))
+	},
+}
+
+func init() {
+	DevicesCmd.AddCommand(labelsCmd)
+	labelsCmd.AddCommand(labelsGetCmd)
+	labelsCmd.AddCommand(labelsSetCmd)
+	labelsCmd.AddCommand(labelsDeleteCmd)
+}
+
+// Labels are checked the same way as the server does, to give a clear error early.
+func parseLabelUpserts(args []string) (api.LabelsPatch, error) {
+	patch := api.LabelsPatch{Upserts: make(map[string]string, len(args))}
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return patch, fmt.Errorf("label %s must be in the form name=value", arg)
+		} else if err := storage.ValidateLabels(map[string]*string{name: &value}); err != nil {
+			return patch, err
+		}
+		patch.Upserts[name] = value
+	}
+	return patch, nil
+}
+
+func parseLabelDeletes(args []string) (api.LabelsPatch, error) {
+	patch := api.LabelsPatch{Deletes: make([]string, 0, len(args))}
+	for _, name := range args {
+		if err := storage.ValidateLabels(map[string]*string{name: nil}); err != nil {
+			return patch, err
+		}
+		patch.Deletes = append(patch.Deletes, name)
+	}
+	return patch, nil
+}
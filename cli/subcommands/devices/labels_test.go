@@ -0,0 +1,31 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package devices
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLabels(t *testing.T) {
+	patch, err := parseLabelUpserts([]string{"name=dev-1", "group=lab.A"})
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"name": "dev-1", "group": "lab.A"}, patch.Upserts)
+	assert.Nil(t, patch.Deletes)
+
+	for _, arg := range []string{"name", "Name=x", "name=a b", "name=", strings.Repeat("x", 21) + "=y"} {
+		_, err = parseLabelUpserts([]string{arg})
+		assert.NotNil(t, err, arg)
+	}
+
+	patch, err = parseLabelDeletes([]string{"name", "group"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"name", "group"}, patch.Deletes)
+	assert.Nil(t, patch.Upserts)
+	_, err = parseLabelDeletes([]string{"bad/name"})
+	assert.NotNil(t, err)
+}
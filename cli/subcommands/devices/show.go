@@ -51,6 +51,9 @@ func showDevice(devices api.DeviceApi, uuid string, aktoml, hwinfo bool) {
 	if device.CreatedAt > 0 {
 		fmt.Printf("Created At:   %s\n", time.Unix(device.CreatedAt, 0).Format("2006-01-02 15:04:05"))
 	}
+	if device.FirstSeen > 0 {
+		fmt.Printf("First Seen:   %s\n", time.Unix(device.FirstSeen, 0).Format("2006-01-02 15:04:05"))
+	}
 	if device.LastSeen > 0 {
 		fmt.Printf("Last Seen:    %s\n", time.Unix(device.LastSeen, 0).Format("2006-01-02 15:04:05"))
 	}
@@ -0,0 +1,49 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package updates
+
+import (
+	"fmt"
+
+	"github.com/foundriesio/dg-satellite/cli/api"
+	"github.com/foundriesio/dg-satellite/cli/subcommands"
+	"github.com/spf13/cobra"
+)
+
+var rolloutsCmd = &cobra.Command{
+	Use:   "rollouts <tag> <update-name>",
+	Short: "List rollouts for an update",
+	Long:  `List all rollouts for a specific update along with their commit status`,
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		api := api.CtxGetApi(cmd.Context())
+		channel, _ := cmd.Flags().GetString("channel")
+
+		updates := api.Updates(channel)
+		listRollouts(updates, args[0], args[1])
+		return nil
+	},
+}
+
+func init() {
+	UpdatesCmd.AddCommand(rolloutsCmd)
+	rolloutsCmd.Flags().String("channel", "", "Update channel: ci, prod, or a custom channel configured on the server")
+	_ = rolloutsCmd.MarkFlagRequired("channel")
+}
+
+func listRollouts(updates api.UpdatesApi, tag, updateName string) {
+	rollouts, err := updates.ListRollouts(tag, updateName)
+	cobra.CheckErr(err)
+
+	if len(rollouts) == 0 {
+		fmt.Printf("No rollouts found for %s update %s/%s\n", updates.Type, tag, updateName)
+		return
+	}
+
+	t := subcommands.NewTableWriter([]string{"NAME", "COMMITTED", "DEVICES"})
+	for _, r := range rollouts {
+		t.AddRow(r.Name, r.Committed, r.DeviceCount)
+	}
+	t.Render()
+}
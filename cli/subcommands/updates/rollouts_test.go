@@ -0,0 +1,56 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package updates
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foundriesio/dg-satellite/cli/api"
+)
+
+// captureStdout returns what fn prints, as tables are rendered to the standard output.
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	require.Nil(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	fn()
+	require.Nil(t, w.Close())
+	out, err := io.ReadAll(r)
+	require.Nil(t, err)
+	return string(out)
+}
+
+func TestListRollouts(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if r.URL.Path == "/v1/updates/beta/tag1/empty/rollouts" {
+			_, _ = w.Write([]byte(`[]`))
+			return
+		}
+		_, _ = w.Write([]byte(`[{"name":"roll1","committed":true,"device-count":12},` +
+			`{"name":"second-rollout","committed":false,"device-count":0}]`))
+	}))
+	defer srv.Close()
+	a := &api.Api{URL: srv.URL, Client: srv.Client()}
+
+	out := captureStdout(t, func() { listRollouts(a.Updates("beta"), "tag1", "update1") })
+	assert.Equal(t, "/v1/updates/beta/tag1/update1/rollouts", path)
+	assert.Equal(t, ""+
+		"NAME            COMMITTED  DEVICES\n"+
+		"roll1           true       12\n"+
+		"second-rollout  false      0\n", out)
+
+	out = captureStdout(t, func() { listRollouts(a.Updates("beta"), "tag1", "empty") })
+	assert.Equal(t, "No rollouts found for beta update tag1/empty\n", out)
+}
@@ -6,6 +6,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/foundriesio/dg-satellite/cli/api"
 	"github.com/foundriesio/dg-satellite/cli/config"
@@ -50,6 +52,12 @@ Configuration is stored in $HOME/.config/satcli.yaml`,
 		}
 
 		client := api.NewClient(*appctx)
+		if client.Timeout, err = durationFlagOrEnv(cmd, "timeout", "SATCLI_TIMEOUT"); err != nil {
+			return err
+		}
+		if client.Retries, err = intFlagOrEnv(cmd, "retries", "SATCLI_RETRIES"); err != nil {
+			return err
+		}
 
 		ctx := api.CtxWithApi(cmd.Context(), client)
 		cmd.SetContext(ctx)
@@ -61,6 +69,10 @@ Configuration is stored in $HOME/.config/satcli.yaml`,
 func init() {
 	rootCmd.PersistentFlags().StringP("context", "c", "", "Specify the context to use from the configuration file")
 	rootCmd.PersistentFlags().StringP("config", "f", "", "Specify the configuration file to use")
+	rootCmd.PersistentFlags().Duration("timeout", 30*time.Second,
+		"Timeout of API requests, except for log tails and file transfers, 0 for none (env SATCLI_TIMEOUT)")
+	rootCmd.PersistentFlags().Int("retries", 2,
+		"How many times to retry API reads after network or transient server errors (env SATCLI_RETRIES)")
 
 	rootCmd.AddCommand(login.LoginCmd)
 	rootCmd.AddCommand(configs.ConfigsCmd)
@@ -75,6 +87,31 @@ func init() {
 	})
 }
 
+// durationFlagOrEnv returns a flag value if it is set, or else the value of an environment variable if it is set,
+// or else the flag default.
+func durationFlagOrEnv(cmd *cobra.Command, flag, env string) (time.Duration, error) {
+	if value, ok := os.LookupEnv(env); ok && !cmd.Flags().Changed(flag) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s value: %w", env, err)
+		}
+		return d, nil
+	}
+	return cmd.Flags().GetDuration(flag)
+}
+
+// intFlagOrEnv is durationFlagOrEnv for integer values.
+func intFlagOrEnv(cmd *cobra.Command, flag, env string) (int, error) {
+	if value, ok := os.LookupEnv(env); ok && !cmd.Flags().Changed(flag) {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s value: %w", env, err)
+		}
+		return n, nil
+	}
+	return cmd.Flags().GetInt(flag)
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
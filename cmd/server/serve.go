@@ -5,16 +5,22 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/labstack/gommon/bytes"
+
 	"github.com/foundriesio/dg-satellite/server"
 	"github.com/foundriesio/dg-satellite/server/gateway"
 	"github.com/foundriesio/dg-satellite/server/ui"
+	apiHandlers "github.com/foundriesio/dg-satellite/server/ui/api"
 	"github.com/foundriesio/dg-satellite/storage"
+	"github.com/foundriesio/dg-satellite/storage/api"
 )
 
 type ServeCmd struct {
@@ -22,6 +28,55 @@ type ServeCmd struct {
 
 	UiAddr      string `default:":8080"`
 	GatewayAddr string `default:":8443"`
+
+	UiHstsMaxAge int    `default:"31536000" help:"Max age in seconds of the HSTS header sent by the UI server, 0 disables it"`
+	UiCsp        string `help:"Content-Security-Policy header sent by the UI server, overrides the built-in default"`
+
+	UiRateLimit      float64 `help:"Maximum sustained API requests per second of each user, 0 disables rate limiting"`
+	UiRateLimitBurst int     `default:"20" help:"Maximum API requests a user may make at once when rate limiting is enabled"`
+	UiBodyLimit      string  `default:"1M" help:"Maximum size of a request body sent to the UI server, 0 disables it; uploads of update and config archives are not limited"`
+
+	DevicesOrderBy string `default:"name-asc" help:"Default order of device lists, e.g. name-asc, last-seen-desc, created-at-desc, uuid-asc"`
+	DevicesListMax int    `default:"1000" help:"Maximum number of devices an API client may list in a single request"`
+
+	DevicesRequiredLabels []string `help:"Standard labels which API clients may change but not delete once a device has them: name and/or group"`
+
+	GatewayAppsStatesMaxSize  string        `default:"100K" help:"Maximum size of a single apps-states report sent by a device"`
+	GatewayAppsStatesMaxAge   time.Duration `help:"Remove apps-states reports of a device older than this, e.g. 168h, in addition to keeping at most the maximum count of them; 0 disables it"`
+	GatewayAppsStatesMaxCount int           `default:"10" help:"Maximum number of apps-states reports kept for each device"`
+	GatewayEventsMaxCount     int           `default:"20" help:"Maximum number of update events files and install results kept for each device"`
+	GatewayMaxDevices         int           `help:"Maximum number of devices the gateway creates, not counting deleted ones; 0 does not cap them"`
+	GatewayAppsStatesGzip     bool          `help:"Store apps-states reports sent by devices gzip compressed"`
+	GatewayAppsMaxLength      int           `default:"2048" help:"Maximum length of the apps list a device reports on check-in, 0 disables the check"`
+	GatewayProdOid            string        `default:"2.5.4.15" help:"OID of the device certificate subject attribute which marks production devices"`
+	GatewayProdValue          string        `default:"production" help:"Value of the device certificate subject attribute which marks production devices"`
+	GatewayLogSampling        int           `default:"1" help:"Log only 1 in N successful GET requests of devices, e.g. their check-ins; 1 logs all requests"`
+	GatewayNoUpdateStatus     int           `default:"404" help:"HTTP status returned to devices asking for TUF metadata while they have no update assigned: 204 or a 4xx status"`
+
+	GatewayTlsAlpn           []string      `help:"ALPN protocols offered to devices: h2 and/or http/1.1, by default only HTTP/1.1 is served"`
+	GatewayTlsTicketRotation time.Duration `help:"Rotation interval of TLS session ticket keys, e.g. 1h, 0 uses the Go default, negative disables session tickets"`
+
+	DevicesSharding bool `help:"Store device files under devices/_shards/<uuid-prefix>/<uuid>, migrating an existing flat layout"`
+
+	DevicesStrictEvents bool `help:"Fail listing device update events with any malformed line, instead of skipping such lines"`
+
+	DevicesStoreCerts bool `help:"Store full device client certificates for audit purposes, not only their public keys"`
+
+	CertExpiryWindow time.Duration `help:"Warn when many device client certificates expire within this time, e.g. 720h, 0 disables it"`
+	CertExpiryRatio  float64       `default:"0.1" help:"Fraction of devices with certificates nearing expiry which triggers the warning"`
+
+	StorageFileLocking bool `help:"Use advisory file locks for appends and rollovers, needed when several processes share the storage (e.g. over NFS)"`
+
+	RolloutsLogMaxSize  string        `help:"Rotate the rollouts log of an update once it exceeds this size, e.g. 10M; rollout progress forgets devices only logged in removed logs"`
+	RolloutsLogMaxFiles int           `default:"5" help:"Maximum number of rotated rollouts logs kept for each update"`
+	RolloutsLogMaxAge   time.Duration `help:"Remove rotated rollouts logs older than this, e.g. 720h; 0 disables it"`
+
+	RolloutsRequireApproval bool          `help:"New rollouts wait for an explicit approval before devices are updated"`
+	RolloutsAudit           string        `default:"none" help:"How devices moved to an update by a rollout are recorded in the audit log: summary (one entry per rollout), devices (one entry per device), or none"`
+	RolloutsMaxPerUpdate    int           `help:"Maximum number of rollouts an update may have, 0 does not cap them"`
+	RolloutsJournalGrace    time.Duration `help:"How long in-flight writes may append to a rolled over rollout journal before it is processed, e.g. 30s; 0 or more than 5m waits the 5m rollover interval"`
+
+	UpdateChannels []string `help:"Custom update channels besides ci and prod, as <name>:<ci|prod> (e.g. staging:prod)"`
 }
 
 func (c *ServeCmd) Run(args CommonArgs) error {
@@ -29,15 +84,162 @@ func (c *ServeCmd) Run(args CommonArgs) error {
 	if err != nil {
 		return fmt.Errorf("failed to load filesystem: %w", err)
 	}
+	storage.SetFileLocking(c.StorageFileLocking)
+	if c.DevicesSharding {
+		if err = fs.Devices.EnableSharding(); err != nil {
+			return fmt.Errorf("failed to shard device files: %w", err)
+		}
+	}
+	for _, channel := range c.UpdateChannels {
+		name, devices, _ := strings.Cut(channel, ":")
+		if devices != "ci" && devices != "prod" {
+			return fmt.Errorf("update channel %s must be followed by either :ci or :prod", name)
+		} else if err = fs.AddUpdatesChannel(name, devices == "prod"); err != nil {
+			return err
+		}
+	}
 	db, err := storage.NewDb(fs.Config.DbFile())
 	if err != nil {
 		return fmt.Errorf("failed to load database: %w", err)
 	}
-	uiServer, err := ui.NewServer(args.ctx, db, fs, c.UiAddr)
+	secHeaders := ui.DefaultSecurityHeaders
+	secHeaders.HstsMaxAge = c.UiHstsMaxAge
+	if len(c.UiCsp) > 0 {
+		secHeaders.ContentSecurityPolicy = c.UiCsp
+	}
+	uiOpts := []ui.Option{ui.WithSecurityHeaders(secHeaders)}
+	if len(c.DevicesOrderBy) > 0 {
+		if orderBy := api.OrderBy(c.DevicesOrderBy); !orderBy.Valid() {
+			return fmt.Errorf("invalid devices order: %s", c.DevicesOrderBy)
+		} else {
+			uiOpts = append(uiOpts, ui.WithDeviceOrderBy(orderBy))
+		}
+	}
+	if c.DevicesListMax <= 0 {
+		return fmt.Errorf("invalid devices list maximum: %d, must be positive", c.DevicesListMax)
+	}
+	uiOpts = append(uiOpts, ui.WithDeviceListMaxLimit(c.DevicesListMax))
+	if err := storage.ValidateRequiredLabels(c.DevicesRequiredLabels); err != nil {
+		return fmt.Errorf("invalid devices required label: %w", err)
+	} else if len(c.DevicesRequiredLabels) > 0 {
+		uiOpts = append(uiOpts, ui.WithRequiredLabels(c.DevicesRequiredLabels))
+	}
+	if c.UiRateLimit > 0 {
+		uiOpts = append(uiOpts, ui.WithUserRateLimit(c.UiRateLimit, c.UiRateLimitBurst))
+	}
+	if len(c.UiBodyLimit) > 0 {
+		if size, err := bytes.Parse(c.UiBodyLimit); err != nil {
+			return fmt.Errorf("invalid UI body limit %q: %w", c.UiBodyLimit, err)
+		} else if size > 0 {
+			uiOpts = append(uiOpts, ui.WithBodyLimit(c.UiBodyLimit))
+		}
+	}
+	if c.CertExpiryWindow > 0 {
+		uiOpts = append(uiOpts, ui.WithCertExpiryNotice(c.CertExpiryWindow, c.CertExpiryRatio))
+	}
+	if c.DevicesStrictEvents {
+		uiOpts = append(uiOpts, ui.WithStrictEvents(true))
+	}
+	if c.RolloutsRequireApproval {
+		uiOpts = append(uiOpts, ui.WithRolloutApproval(true))
+	}
+	if len(c.RolloutsAudit) > 0 {
+		if audit := apiHandlers.RolloutAudit(c.RolloutsAudit); !audit.Valid() {
+			return fmt.Errorf("invalid rollouts audit: %s", c.RolloutsAudit)
+		} else {
+			uiOpts = append(uiOpts, ui.WithRolloutAudit(audit))
+		}
+	}
+	if c.RolloutsMaxPerUpdate < 0 {
+		return fmt.Errorf("rollouts max per update must not be negative: %d", c.RolloutsMaxPerUpdate)
+	} else if c.RolloutsMaxPerUpdate > 0 {
+		uiOpts = append(uiOpts, ui.WithRolloutsMaxPerUpdate(c.RolloutsMaxPerUpdate))
+	}
+	if c.GatewayAppsStatesMaxAge > 0 {
+		uiOpts = append(uiOpts, ui.WithAppsStatesMaxAge(c.GatewayAppsStatesMaxAge))
+	}
+	if c.RolloutsJournalGrace > 0 {
+		uiOpts = append(uiOpts, ui.WithRolloutJournalGracePeriod(c.RolloutsJournalGrace))
+	}
+	var gtwOpts []gateway.Option
+	if len(c.GatewayAppsStatesMaxSize) > 0 {
+		if size, err := bytes.Parse(c.GatewayAppsStatesMaxSize); err != nil {
+			return fmt.Errorf("invalid gateway apps-states maximum size %q: %w", c.GatewayAppsStatesMaxSize, err)
+		} else if size <= 0 {
+			return fmt.Errorf("invalid gateway apps-states maximum size: %s", c.GatewayAppsStatesMaxSize)
+		}
+		gtwOpts = append(gtwOpts, gateway.WithAppsStatesMaxSize(c.GatewayAppsStatesMaxSize))
+	}
+	if c.GatewayAppsStatesMaxCount < 0 {
+		return fmt.Errorf("invalid gateway apps-states maximum count: %d", c.GatewayAppsStatesMaxCount)
+	} else if c.GatewayAppsStatesMaxCount > 0 {
+		gtwOpts = append(gtwOpts, gateway.WithAppsStatesMaxCount(c.GatewayAppsStatesMaxCount))
+	}
+	if c.GatewayEventsMaxCount < 0 {
+		return fmt.Errorf("invalid gateway events maximum count: %d", c.GatewayEventsMaxCount)
+	} else if c.GatewayEventsMaxCount > 0 {
+		gtwOpts = append(gtwOpts, gateway.WithMaxEvents(c.GatewayEventsMaxCount))
+	}
+	if c.GatewayMaxDevices < 0 {
+		return fmt.Errorf("invalid gateway maximum devices: %d", c.GatewayMaxDevices)
+	} else if c.GatewayMaxDevices > 0 {
+		gtwOpts = append(gtwOpts, gateway.WithMaxDevices(c.GatewayMaxDevices))
+	}
+	if c.GatewayAppsStatesMaxAge > 0 {
+		gtwOpts = append(gtwOpts, gateway.WithAppsStatesMaxAge(c.GatewayAppsStatesMaxAge))
+	}
+	if c.GatewayAppsStatesGzip {
+		gtwOpts = append(gtwOpts, gateway.WithAppsStatesCompression(true))
+	}
+	gtwOpts = append(gtwOpts, gateway.WithAppsMaxLength(c.GatewayAppsMaxLength))
+	if len(c.DevicesRequiredLabels) > 0 {
+		gtwOpts = append(gtwOpts, gateway.WithRequiredLabels(c.DevicesRequiredLabels))
+	}
+	var gtwEchoOpts []server.EchoOption
+	if c.GatewayLogSampling > 1 {
+		gtwEchoOpts = append(gtwEchoOpts, server.WithLogSampling(c.GatewayLogSampling))
+	}
+	if c.GatewayNoUpdateStatus != 0 {
+		if c.GatewayNoUpdateStatus != http.StatusNoContent && (c.GatewayNoUpdateStatus < 400 || c.GatewayNoUpdateStatus > 499) {
+			return fmt.Errorf("invalid gateway no-update status: %d, must be 204 or a 4xx status", c.GatewayNoUpdateStatus)
+		}
+		gtwOpts = append(gtwOpts, gateway.WithNoUpdateStatus(c.GatewayNoUpdateStatus))
+	}
+	if len(c.GatewayProdOid) > 0 {
+		if oid, err := gateway.ParseOid(c.GatewayProdOid); err != nil {
+			return err
+		} else {
+			gtwOpts = append(gtwOpts, gateway.WithProdSubjectAttribute(oid, c.GatewayProdValue))
+		}
+	}
+	if len(c.GatewayTlsAlpn) > 0 {
+		gtwOpts = append(gtwOpts, gateway.WithTlsNextProtos(c.GatewayTlsAlpn))
+	}
+	if c.GatewayTlsTicketRotation != 0 {
+		gtwOpts = append(gtwOpts, gateway.WithTlsTicketKeyRotation(c.GatewayTlsTicketRotation))
+	}
+	if len(c.RolloutsLogMaxSize) > 0 {
+		if size, err := bytes.Parse(c.RolloutsLogMaxSize); err != nil {
+			return fmt.Errorf("invalid rollouts log maximum size %q: %w", c.RolloutsLogMaxSize, err)
+		} else if c.RolloutsLogMaxFiles < 0 {
+			return fmt.Errorf("invalid rollouts log maximum files: %d", c.RolloutsLogMaxFiles)
+		} else if size > 0 {
+			gtwOpts = append(gtwOpts, gateway.WithRolloutsLogRetention(storage.LogRetention{
+				MaxSize: size, MaxFiles: c.RolloutsLogMaxFiles, MaxAge: c.RolloutsLogMaxAge,
+			}))
+		}
+	}
+	if c.DevicesStoreCerts {
+		gtwOpts = append(gtwOpts, gateway.WithStoreCertificates(true))
+	}
+	gtwServer, err := gateway.NewServer(args.ctx, db, fs, c.GatewayAddr, gtwEchoOpts, gtwOpts...)
 	if err != nil {
 		return err
 	}
-	gtwServer, err := gateway.NewServer(args.ctx, db, fs, c.GatewayAddr)
+
+	// The gateway is created first, so that the API can report its effective limits and TLS config.
+	uiOpts = append(uiOpts, ui.WithGatewayLimits(gtwServer.Limits()), ui.WithGatewayTlsConfig(gtwServer.TlsConfig()))
+	uiServer, err := ui.NewServer(args.ctx, db, fs, c.UiAddr, uiOpts...)
 	if err != nil {
 		return err
 	}
@@ -34,8 +34,10 @@ func TestServe(t *testing.T) {
 			gatewayAddress = gwAddr
 			wait <- true
 		},
-		UiAddr:      "127.0.0.1:0",
-		GatewayAddr: "127.0.0.1:0",
+		UiAddr:         "127.0.0.1:0",
+		GatewayAddr:    "127.0.0.1:0",
+		UiHstsMaxAge:   3600,
+		DevicesListMax: 1000,
 	}
 
 	log, err := context.InitLogger("debug")
@@ -59,6 +61,10 @@ func TestServe(t *testing.T) {
 	// create an empty ca file to make the server happy. no client will be able to handshake with it
 	require.Nil(t, fs.Certs.WriteFile(storage.CertsCasPemFile, []byte{}))
 
+	invalid := server
+	invalid.DevicesListMax = 0
+	require.ErrorContains(t, invalid.Run(common), "invalid devices list maximum: 0")
+
 	go func() {
 		if err = server.Run(common); err != nil {
 			// Unblock main thread and check an error over there
@@ -72,6 +78,17 @@ func TestServe(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, http.StatusNotFound, r.StatusCode)
 	require.Equal(t, 12, len(r.Header.Get("X-Request-Id")))
+	require.Equal(t, "nosniff", r.Header.Get("X-Content-Type-Options"))
+	require.Equal(t, "DENY", r.Header.Get("X-Frame-Options"))
+	require.Contains(t, r.Header.Get("Content-Security-Policy"), "default-src 'self'")
+	// HSTS is only sent over TLS, which is commonly terminated by a proxy in front of the UI.
+	require.Equal(t, "", r.Header.Get("Strict-Transport-Security"))
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/doesnotexist", apiAddress), nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	r, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, "max-age=3600; includeSubdomains", r.Header.Get("Strict-Transport-Security"))
 
 	_, err = http.Get(fmt.Sprintf("https://%s/doesnotexist", gatewayAddress))
 	require.NotNil(t, err)
@@ -18,6 +18,7 @@ import (
 type UserAddCmd struct {
 	Username      string   `arg:"required" help:"Username for the new user"`
 	Password      string   `arg:"" help:"Password for the new user (read from stdin if not provided)"`
+	Email         string   `arg:"" help:"Email of the new user, required if the auth config requires unique user emails"`
 	AllowedScopes []string `arg:"" help:"Roles to assign to the new user"`
 }
 
@@ -65,6 +66,9 @@ func (c UserAddCmd) Run(args CommonArgs) error {
 	if err != nil {
 		return fmt.Errorf("failed to initialize user storage: %w", err)
 	}
+	if err = userStorage.SetUniqueEmails(cfg.UniqueUserEmails); err != nil {
+		return err
+	}
 
 	if u, err := userStorage.Get(c.Username); err == nil && u != nil {
 		return fmt.Errorf("user %q already exists", c.Username)
@@ -78,6 +82,7 @@ func (c UserAddCmd) Run(args CommonArgs) error {
 	u := &users.User{
 		Username:      c.Username,
 		Password:      password,
+		Email:         c.Email,
 		AllowedScopes: scopes,
 	}
 
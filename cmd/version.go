@@ -3,4 +3,9 @@
 
 package cmd
 
-var Version string
+// The build of the program, set with linker flags, see the Makefile.
+var (
+	Version   string
+	Commit    string
+	BuildTime string
+)
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -15,12 +16,30 @@ import (
 	"github.com/foundriesio/dg-satellite/context"
 )
 
-func NewEchoServer() *echo.Echo {
+type echoOptions struct {
+	logSampleRate int
+}
+
+type EchoOption func(*echoOptions)
+
+// WithLogSampling logs only 1 in rate successful GET requests, which are mostly periodic polls of clients.
+// Other requests and failed requests are always logged.
+func WithLogSampling(rate int) EchoOption {
+	return func(o *echoOptions) {
+		o.logSampleRate = rate
+	}
+}
+
+func NewEchoServer(opts ...EchoOption) *echo.Echo {
+	var options echoOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
 	server := echo.New()
 	server.HideBanner = true
 	server.HidePort = true
 	server.Use(contextLogger())
-	server.Use(middlewareLogger())
+	server.Use(middlewareLogger(options.logSampleRate))
 	return server
 }
 
@@ -56,7 +75,8 @@ func ParseJsonBody(c echo.Context, bytes []byte, res any) error {
 	}
 }
 
-func middlewareLogger() echo.MiddlewareFunc {
+func middlewareLogger(sampleRate int) echo.MiddlewareFunc {
+	var sampled atomic.Uint64
 	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
 		HandleError:      true, // forwards error to the global error handler, so it can decide appropriate status code
 		LogContentLength: true,
@@ -65,6 +85,11 @@ func middlewareLogger() echo.MiddlewareFunc {
 		LogStatus:        true,
 		LogURI:           true,
 		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			if sampleRate > 1 && v.Error == nil && v.Method == http.MethodGet && v.Status < http.StatusBadRequest {
+				if sampled.Add(1)%uint64(sampleRate) != 1 {
+					return nil
+				}
+			}
 			log := context.CtxGetLog(c.Request().Context())
 			args := []any{"method", v.Method, "content-length", v.ContentLength, "status", v.Status}
 			if v.Error == nil {
@@ -4,6 +4,8 @@
 package gateway
 
 import (
+	"encoding/asn1"
+	"net/http"
 	"time"
 
 	cache "github.com/go-pkgz/expirable-cache/v3"
@@ -19,6 +21,138 @@ type handlers struct {
 	storage *storage.Storage
 
 	tokenCache cache.Cache[string, string]
+	installs   *installsTracker
+
+	maxDevices         int
+	maxEvents          int
+	appsStatesMaxCount int
+	appsStatesMaxSize  string
+	appsStatesMaxAge   time.Duration
+	appsStatesGzip     bool
+	appsMaxLength      int
+	storeCerts         bool
+	rolloutsLog        storage.LogRetention
+	noUpdateStatus     int
+	requiredLabels     []string
+
+	prodOid   asn1.ObjectIdentifier
+	prodValue string
+
+	// TLS settings are applied to the server rather than to the handlers, see configureTls.
+	tlsNextProtos     []string
+	tlsTicketRotation time.Duration
+}
+
+type Option func(*handlers)
+
+// WithAppsStatesMaxSize sets the maximum size of a single apps-states report, e.g. "500K".
+func WithAppsStatesMaxSize(limit string) Option {
+	return func(h *handlers) {
+		h.appsStatesMaxSize = limit
+	}
+}
+
+// WithMaxDevices caps how many devices the gateway creates, devices over the quota are rejected with 403 Forbidden.
+// Deleted devices do not count towards the quota. Zero, the default, does not cap devices.
+func WithMaxDevices(count int) Option {
+	return func(h *handlers) {
+		h.maxDevices = count
+	}
+}
+
+// WithMaxEvents sets how many update events and install results files are kept for each device, 20 by default.
+func WithMaxEvents(count int) Option {
+	return func(h *handlers) {
+		h.maxEvents = count
+	}
+}
+
+// WithAppsStatesMaxCount sets how many apps-states reports are kept for each device, 10 by default.
+func WithAppsStatesMaxCount(count int) Option {
+	return func(h *handlers) {
+		h.appsStatesMaxCount = count
+	}
+}
+
+// WithAppsStatesMaxAge removes apps-states reports of a device older than a given age, e.g. 7 days.
+// The newest reports, see WithAppsStatesMaxCount, are kept regardless of their age by default.
+func WithAppsStatesMaxAge(age time.Duration) Option {
+	return func(h *handlers) {
+		h.appsStatesMaxAge = age
+	}
+}
+
+// WithAppsStatesCompression stores apps-states reports gzip compressed, as they may be large JSON documents.
+func WithAppsStatesCompression(enabled bool) Option {
+	return func(h *handlers) {
+		h.appsStatesGzip = enabled
+	}
+}
+
+// WithAppsMaxLength sets the maximum length of the apps list a device reports on check-in.
+func WithAppsMaxLength(length int) Option {
+	return func(h *handlers) {
+		h.appsMaxLength = length
+	}
+}
+
+// WithRolloutsLogRetention rotates the rollouts log of an update once it exceeds a given size.
+// By default, these logs are never rotated.
+func WithRolloutsLogRetention(retention storage.LogRetention) Option {
+	return func(h *handlers) {
+		h.rolloutsLog = retention
+	}
+}
+
+// WithRequiredLabels forbids devices to delete these standard labels, see storage.ValidateRequiredLabels.
+func WithRequiredLabels(labels []string) Option {
+	return func(h *handlers) {
+		h.requiredLabels = labels
+	}
+}
+
+// WithStoreCertificates enables storing of full device client certificates, not only their public keys.
+// A certificate is stored when a device first connects with it, so devices known before it was enabled
+// have their certificates stored once they renew them.
+func WithStoreCertificates(enabled bool) Option {
+	return func(h *handlers) {
+		h.storeCerts = enabled
+	}
+}
+
+// WithNoUpdateStatus sets the HTTP status returned to a device asking for the TUF metadata of its update,
+// when it has no update assigned, e.g. because its tag has no updates yet. It defaults to 404 Not Found,
+// and must be 204 No Content or another 4xx status.
+// Such responses carry an "x-ats-update-status: none" header, so that agents can tell them from errors.
+func WithNoUpdateStatus(status int) Option {
+	return func(h *handlers) {
+		h.noUpdateStatus = status
+	}
+}
+
+// WithProdSubjectAttribute sets which device certificate subject attribute marks production devices.
+// By default, these are devices with a businessCategory (OID 2.5.4.15) of "production".
+func WithProdSubjectAttribute(oid asn1.ObjectIdentifier, value string) Option {
+	return func(h *handlers) {
+		h.prodOid = oid
+		h.prodValue = value
+	}
+}
+
+// WithTlsNextProtos sets the ALPN protocols the gateway offers to devices, e.g. "h2" and "http/1.1".
+// By default, only HTTP/1.1 is served.
+func WithTlsNextProtos(protos []string) Option {
+	return func(h *handlers) {
+		h.tlsNextProtos = protos
+	}
+}
+
+// WithTlsTicketKeyRotation rotates TLS session ticket keys at a given interval.
+// A negative interval disables session tickets, zero keeps the Go default of rotating keys daily.
+func WithTlsTicketKeyRotation(interval time.Duration) Option {
+	return func(h *handlers) {
+		h.tlsTicketRotation = interval
+	}
 }
 
 var (
@@ -28,21 +162,55 @@ var (
 	ParseJsonBody = server.ParseJsonBody
 )
 
-func RegisterHandlers(e *echo.Echo, storage *storage.Storage, url string) {
+// RegisterHandlers adds the device gateway routes to the server, and returns the effective storage limits.
+func RegisterHandlers(e *echo.Echo, storage *storage.Storage, url string, opts ...Option) storage.Limits {
 	cache := cache.NewCache[string, string]().WithMaxKeys(10000).WithTTL(time.Hour).WithLRU()
-	h := handlers{storage: storage, url: url, tokenCache: cache}
+	h := handlers{
+		storage:           storage,
+		url:               url,
+		tokenCache:        cache,
+		installs:          newInstallsTracker(),
+		appsStatesMaxSize: "100K",
+		appsMaxLength:     2048,
+		noUpdateStatus:    http.StatusNotFound,
+		prodOid:           businessCategoryOid,
+		prodValue:         businessCategoryProduction,
+	}
+	for _, opt := range opts {
+		opt(&h)
+	}
+	storage.SetMaxDevices(h.maxDevices)
+	if h.maxEvents > 0 {
+		storage.SetMaxEvents(h.maxEvents)
+	}
+	if h.appsStatesMaxCount > 0 {
+		storage.SetMaxStates(h.appsStatesMaxCount)
+	}
+	storage.SetMaxStatesAge(h.appsStatesMaxAge)
+	storage.SetCompressStates(h.appsStatesGzip)
+	storage.SetRolloutsLogRetention(h.rolloutsLog)
+	storage.SetRequiredLabels(h.requiredLabels)
 
 	mtls := e.Group("/")
 	mtls.Use(
 		h.authDevice,
-		middleware.BodyLimit("100K"), // After TLS authentication but before we read headers.
+		// After TLS authentication but before we read headers.
+		middleware.BodyLimitWithConfig(middleware.BodyLimitConfig{
+			Limit: "100K",
+			Skipper: func(c echo.Context) bool {
+				// Apps states have their own configurable limit.
+				return c.Path() == "/apps-states"
+			},
+		}),
 		h.checkinDevice,
 	)
 
-	mtls.POST("apps-states", h.appsStatesInfo)
+	mtls.POST("apps-states", h.appsStatesInfo, middleware.BodyLimit(h.appsStatesMaxSize))
 	mtls.POST("app-proxy-url", h.appsProxyUrl)
 	mtls.GET("config", h.configGet)
 	mtls.GET("device", h.deviceGet)
+	mtls.GET("device/tuf", h.deviceTufGet)
+	mtls.POST("device/install-result", h.installResult)
 	mtls.POST("events", h.eventsUpload)
 	mtls.POST("ostree/download-urls", h.ostreeUrls)
 	mtls.GET("ostree/*", h.ostreeFileStream)
@@ -50,6 +218,7 @@ func RegisterHandlers(e *echo.Echo, storage *storage.Storage, url string) {
 	mtls.GET("repo/snapshot.json", h.metaSnapshot)
 	mtls.GET("repo/targets.json", h.metaTargets)
 	mtls.GET("repo/:root", h.metaRoot)
+	mtls.GET("version", h.versionGet)
 	mtls.PUT("system_info", h.hardwareInfo)
 	mtls.PUT("system_info/config", h.akTomlInfo)
 	mtls.PUT("system_info/network", h.networkInfo)
@@ -61,4 +230,9 @@ func RegisterHandlers(e *echo.Echo, storage *storage.Storage, url string) {
 	registry.Use(h.authToken)
 	registry.HEAD("/*", h.blobHead)
 	registry.GET("/*", h.blobGet)
+
+	limits := storage.Limits()
+	limits.AppsStatesMaxSize = h.appsStatesMaxSize
+	limits.AppsMaxLength = h.appsMaxLength
+	return limits
 }
@@ -4,17 +4,49 @@
 package gateway
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
+
+	storage "github.com/foundriesio/dg-satellite/storage/gateway"
 )
 
 // @Summary Get server side information on device
+// @Description Devices may label themselves, e.g. at provisioning, with a JSON object of labels in the x-ats-labels header.
+// @Description These are merged with the existing device labels, a null value deletes a label.
+// @Description Standard labels, i.e. name and group, can only be changed through the API.
 // @Produce json
+// @Param   x-ats-labels header string false "Device labels as JSON, e.g. {\"site\":\"berlin\"}"
 // @Success 200 {object} Device
+// @Failure 400 "Invalid labels"
+// @Header  200 {string} x-ats-update "Update assigned to the device"
 // @Router  /device [get]
 func (handlers) deviceGet(c echo.Context) error {
 	ctx := c.Request().Context()
 	d := CtxGetDevice(ctx)
+	if header := c.Request().Header.Get("x-ats-labels"); len(header) > 0 {
+		var labels map[string]*string
+		if err := json.Unmarshal([]byte(header), &labels); err != nil {
+			return EchoError(c, err, http.StatusBadRequest, "Invalid x-ats-labels header, it must be a JSON object")
+		} else if err = storage.ValidateLabels(labels); err != nil {
+			return EchoError(c, err, http.StatusBadRequest, err.Error())
+		}
+		for k := range labels {
+			if storage.IsStandardLabel(k) {
+				err := fmt.Errorf("label %s can only be changed through the API", k)
+				return EchoError(c, err, http.StatusBadRequest, err.Error())
+			}
+		}
+		if err := d.PatchLabels(labels); errors.Is(err, storage.ErrRequiredLabel) {
+			return EchoError(c, err, http.StatusBadRequest, err.Error())
+		} else if err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to update device labels")
+		}
+	}
+	// Mirror the x-ats-* request headers, so that agents can read these without parsing JSON.
+	c.Response().Header().Set("x-ats-update", d.UpdateName)
 	return c.JSON(http.StatusOK, d)
 }
@@ -4,6 +4,7 @@
 package gateway
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
@@ -17,7 +18,7 @@ import (
 // @Produce plain
 // @Success 200 ""
 // @Router  /events [post]
-func (handlers) eventsUpload(c echo.Context) error {
+func (h handlers) eventsUpload(c echo.Context) error {
 	ctx := c.Request().Context()
 	log := CtxGetLog(ctx)
 	d := CtxGetDevice(ctx)
@@ -42,12 +43,15 @@ func (handlers) eventsUpload(c echo.Context) error {
 			log.Warn("Invalid event correlation ID - skip it", "event", event.Id, "corr-id", event.Event.CorrelationId)
 			continue
 		}
-		if _, err := time.Parse(time.RFC3339, event.DeviceTime); err != nil {
+		if deviceTime, err := parseDeviceTime(event.DeviceTime); err != nil {
 			// The UI needs this field to be a valid datetime.  If it is not - warn and substitute it
 			// with the current time.  Normally, the time skew should be within seconds.
 			log.Warn("Invalid event deviceTime, must be RFC3339 - use current time",
 				"error", err, "value", event.DeviceTime, "event", event.Id, "corr-id", event.Event.CorrelationId)
 			event.DeviceTime = time.Now().UTC().Format(time.RFC3339)
+		} else {
+			// Store all times in UTC, so that events from devices in different time zones sort and compare as is.
+			event.DeviceTime = deviceTime.UTC().Format(time.RFC3339)
 		}
 		validEvents = append(validEvents, event)
 	}
@@ -59,5 +63,59 @@ func (handlers) eventsUpload(c echo.Context) error {
 	if err := d.ProcessEvents(validEvents); err != nil {
 		return EchoError(c, err, http.StatusInternalServerError, "Failed to save events")
 	}
+	if len(d.UpdateName) > 0 {
+		key := d.UpdateKey(d.Tag)
+		for _, event := range validEvents {
+			h.installs.processEvent(key, d.Uuid, event)
+		}
+	}
+	return c.String(http.StatusOK, "")
+}
+
+// Real-world UTC offsets are within -12:00 and +14:00.
+const maxDeviceTimeOffset = 14 * 60 * 60
+
+func parseDeviceTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, err
+	}
+	if _, offset := t.Zone(); offset > maxDeviceTimeOffset || offset < -maxDeviceTimeOffset {
+		return t, fmt.Errorf("time zone offset out of range: %s", t.Format("-07:00"))
+	}
+	return t, nil
+}
+
+// @Summary Report the final result of an update, including a failure or rollback reason
+// @Accept  json
+// @Param   result body InstallResult true "Install result"
+// @Produce plain
+// @Success 200 ""
+// @Router  /device/install-result [post]
+func (h handlers) installResult(c echo.Context) error {
+	d := CtxGetDevice(c.Request().Context())
+
+	var res InstallResult
+	if err := ReadJsonBody(c, &res); err != nil {
+		return err
+	}
+	if !storage.ValidCorrelationId(res.CorrelationId) {
+		return c.String(http.StatusBadRequest, "Invalid correlationId")
+	} else if res.Success == nil {
+		return c.String(http.StatusBadRequest, "Missing success")
+	}
+
+	result := storage.DeviceInstallResult{
+		CorrelationId: res.CorrelationId,
+		Success:       *res.Success,
+		Reason:        res.Reason,
+		DeviceTime:    time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := d.SaveInstallResult(result); err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to save install result")
+	}
+	if len(d.UpdateName) > 0 {
+		h.installs.set(d.UpdateKey(d.Tag), d.Uuid, false)
+	}
 	return c.String(http.StatusOK, "")
 }
@@ -3,15 +3,26 @@
 package gateway
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/labstack/echo/v4"
 
+	"github.com/foundriesio/dg-satellite/server"
 	storage "github.com/foundriesio/dg-satellite/storage/gateway"
 )
 
+// @Summary Get the server version
+// @Produce json
+// @Success 200 {object} server.VersionInfo
+// @Router  /version [get]
+func (handlers) versionGet(c echo.Context) error {
+	return c.JSON(http.StatusOK, server.GetVersionInfo())
+}
+
 // @Summary Set aktualizr-lites's running configuration
 // @Accept  application/toml
 // @Produce plain
@@ -81,14 +92,40 @@ func (handlers) appsStatesInfo(c echo.Context) error {
 	d := CtxGetDevice(c.Request().Context())
 	if bytes, err := ReadBody(c); err != nil {
 		return err
-	} else if err = ParseJsonBody(c, bytes, &data); err != nil {
-		return err
+	} else if err = json.Unmarshal(bytes, &data); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			msg := fmt.Sprintf("Invalid apps-states: %s must be of type %s", typeErr.Field, typeErr.Type)
+			return EchoError(c, err, http.StatusBadRequest, msg)
+		}
+		return EchoError(c, err, http.StatusBadRequest, "Failed to parse request JSON body")
 	} else if _, err := time.Parse(time.RFC3339, data.DeviceTime); err != nil {
 		msg := fmt.Sprintf("Failed to parse device time, must be RFC3339: %s", data.DeviceTime)
 		return EchoError(c, err, http.StatusBadRequest, msg)
+	} else if err = validateAppsStates(data); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, "Invalid apps-states: "+err.Error())
 	} else if err = d.SaveAppsStates(string(bytes)); err != nil {
 		return EchoError(c, err, http.StatusInternalServerError, "Failed to save apps-states")
 	} else {
 		return c.String(http.StatusOK, "")
 	}
 }
+
+// validateAppsStates checks the structure of apps entries beyond what JSON typing enforces.
+func validateAppsStates(data AppsStates) error {
+	for name, app := range data.Apps {
+		if len(name) == 0 {
+			return errors.New("app name must not be empty")
+		} else if len(app.Uri) == 0 {
+			return fmt.Errorf("app %s has no uri", name)
+		}
+		for idx, svc := range app.Services {
+			if len(svc.Name) == 0 {
+				return fmt.Errorf("app %s service #%d has no name", name, idx)
+			} else if len(svc.ImageUri) == 0 {
+				return fmt.Errorf("app %s service %s has no image", name, svc.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -17,9 +17,15 @@ import (
 	storage "github.com/foundriesio/dg-satellite/storage/gateway"
 )
 
+const (
+	noUpdateHeader = "x-ats-update-status"
+	noUpdateValue  = "none"
+)
+
 // @Summary Get the current TUF timestamp metadata
 // @Produce json
 // @Success 200
+// @Header  404 {string} x-ats-update-status "Set to none when the device has no update assigned"
 // @Router  /repo/timestamp.json [get]
 func (h handlers) metaTimestamp(c echo.Context) error {
 	return h.metaHandler(c, "timestamp", storage.TufTimestampFile)
@@ -28,23 +34,57 @@ func (h handlers) metaTimestamp(c echo.Context) error {
 // @Summary Get the current TUF snapshot metadata
 // @Produce json
 // @Success 200
+// @Header  404 {string} x-ats-update-status "Set to none when the device has no update assigned"
 // @Router  /repo/snapshot.json [get]
 func (h handlers) metaSnapshot(c echo.Context) error {
 	return h.metaHandler(c, "snapshot", storage.TufSnapshotFile)
 }
 
 // @Summary Get the current TUF targets metadata
+// @Description When too many devices are installing the device's update, the device is told to retry later.
 // @Produce json
 // @Success 200
+// @Failure 503 "Too many devices are installing the update, see the Retry-After header"
+// @Header  404 {string} x-ats-update-status "Set to none when the device has no update assigned"
 // @Router  /repo/targets.json [get]
 func (h handlers) metaTargets(c echo.Context) error {
+	if err := h.checkInstallsLimit(c); err != nil {
+		return err
+	}
 	return h.metaHandler(c, "targets", storage.TufTargetsFile)
 }
 
+// checkInstallsLimit tells a device to back off, if its update limits concurrent installs and the limit is reached.
+func (h handlers) checkInstallsLimit(c echo.Context) error {
+	d := CtxGetDevice(c.Request().Context())
+	if len(d.UpdateName) == 0 {
+		return nil
+	}
+	tag, err := readTagHeader(c)
+	if err != nil {
+		return err
+	}
+	limit, err := d.MaxConcurrentInstalls(tag)
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to read update installs limit")
+	}
+	if limit <= 0 {
+		return nil
+	}
+	if pending, err := d.InstallPending(tag); err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to check if the update is installed")
+	} else if pending && !h.installs.admit(d.UpdateKey(tag), d.Uuid, limit) {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(installRetryAfter.Seconds())))
+		return c.String(http.StatusServiceUnavailable, "Too many devices are installing this update, retry later")
+	}
+	return nil
+}
+
 // @Summary Get the current TUF root metadata
 // @Produce json
 // @Param   version path int true "Root metadata version"
 // @Success 200
+// @Header  404 {string} x-ats-update-status "Set to none when the device has no update assigned"
 // @Router  /repo/{version}.root.json [get]
 func (h handlers) metaRoot(c echo.Context) error {
 	version, err := readRootVersion(c)
@@ -55,7 +95,33 @@ func (h handlers) metaRoot(c echo.Context) error {
 	return h.metaHandler(c, "root", file)
 }
 
-func (handlers) metaHandler(c echo.Context, role, file string) error {
+// @Summary Get where the TUF metadata of the device's update lives
+// @Description URLs are computed from the device's last reported tag and its assigned update.
+// @Produce json
+// @Success 200 {object} TufPointers
+// @Failure 404 "Device has no tag or no update assigned"
+// @Header  404 {string} x-ats-update-status "Set to none when the device has no update assigned"
+// @Router  /device/tuf [get]
+func (h handlers) deviceTufGet(c echo.Context) error {
+	d := CtxGetDevice(c.Request().Context())
+	if len(d.Tag) == 0 {
+		return c.String(http.StatusNotFound, "Device sent no tag")
+	} else if len(d.UpdateName) == 0 {
+		return h.noUpdate(c)
+	}
+	root, err := d.GetTufRootName(d.Tag)
+	if err != nil {
+		return EchoError(c, err, http.StatusNotFound, "Not found TUF root")
+	}
+	return c.JSON(http.StatusOK, TufPointers{
+		Channel:     d.UpdatesChannel(),
+		Tag:         d.Tag,
+		Update:      d.UpdateName,
+		TufMetaUrls: storage.NewTufMetaUrls(h.url, root),
+	})
+}
+
+func (h handlers) metaHandler(c echo.Context, role, file string) error {
 	req := c.Request()
 	ctx := req.Context()
 	tag, err := readTagHeader(c)
@@ -66,6 +132,9 @@ func (handlers) metaHandler(c echo.Context, role, file string) error {
 	c.SetRequest(req.WithContext(CtxWithLog(ctx, log)))
 
 	d := CtxGetDevice(ctx)
+	if len(d.UpdateName) == 0 {
+		return h.noUpdate(c)
+	}
 	if content, err := d.GetTufMeta(tag, file); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return EchoError(c, err, http.StatusNotFound, "Not found TUF role")
@@ -79,6 +148,15 @@ func (handlers) metaHandler(c echo.Context, role, file string) error {
 	}
 }
 
+// noUpdate tells a device it has no update assigned, in a way distinguishable from errors, see WithNoUpdateStatus.
+func (h handlers) noUpdate(c echo.Context) error {
+	c.Response().Header().Set(noUpdateHeader, noUpdateValue)
+	if h.noUpdateStatus == http.StatusNoContent {
+		return c.NoContent(h.noUpdateStatus)
+	}
+	return c.String(h.noUpdateStatus, "Device has no update assigned")
+}
+
 func readTagHeader(c echo.Context) (tag string, err error) {
 	if tag = c.Request().Header.Get("x-ats-tags"); len(tag) == 0 {
 		err = errors.New("device x-ats-tags header not set")
@@ -11,15 +11,20 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -28,9 +33,11 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/foundriesio/dg-satellite/clock"
+	"github.com/foundriesio/dg-satellite/cmd"
 	"github.com/foundriesio/dg-satellite/context"
 	"github.com/foundriesio/dg-satellite/server"
 	baseStorage "github.com/foundriesio/dg-satellite/storage"
+	apiStorage "github.com/foundriesio/dg-satellite/storage/api"
 	storage "github.com/foundriesio/dg-satellite/storage/gateway"
 )
 
@@ -163,6 +170,263 @@ func TestApiDevice(t *testing.T) {
 	assert.Less(t, lastSeen, device.LastSeen)
 }
 
+func TestApiDevicePubKeyEncoding(t *testing.T) {
+	tc := NewTestClient(t)
+	_ = tc.GET("/device", 200)
+	d, err := tc.gw.DeviceGet(tc.uuid)
+	require.Nil(t, err)
+
+	// The same key stored with CRLF line endings, another line length, and surrounding whitespace.
+	block, _ := pem.Decode([]byte(d.PubKey))
+	require.NotNil(t, block)
+	b64 := base64.StdEncoding.EncodeToString(block.Bytes)
+	var lines []string
+	for len(b64) > 40 {
+		lines = append(lines, b64[:40])
+		b64 = b64[40:]
+	}
+	lines = append(lines, b64)
+	stored := "\r\n-----BEGIN PUBLIC KEY-----\r\n" + strings.Join(lines, "\r\n") + "\r\n-----END PUBLIC KEY-----\r\n\r\n"
+	require.NotEqual(t, d.PubKey, stored)
+	stmt, err := tc.db.Prepare("TestUpdatePubKey", "UPDATE devices SET pubkey=? WHERE uuid=?")
+	require.Nil(t, err)
+	_, err = stmt.Exec(stored, tc.uuid)
+	require.Nil(t, err)
+	_ = tc.GET("/device", 200)
+
+	// Another key is still refused.
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tc.cert.PublicKey = priv.Public()
+	_ = tc.GET("/device", 502)
+}
+
+func TestApiDeviceUpdateHeader(t *testing.T) {
+	tc := NewTestClient(t)
+	req := httptest.NewRequest(http.MethodGet, "/device", nil)
+	req.Header.Set("x-ats-tags", "main")
+	rec := tc.Do(req)
+	require.Equal(t, 200, rec.Code)
+	assert.Equal(t, "", rec.Header().Get("x-ats-update"))
+
+	api, err := apiStorage.NewStorage(tc.db, tc.fs)
+	require.Nil(t, err)
+	require.Nil(t, api.CommitRollout("main", "update42", "rollout", "ci", apiStorage.Rollout{Uuids: []string{tc.uuid}}))
+
+	rec = tc.Do(httptest.NewRequest(http.MethodGet, "/device", nil))
+	require.Equal(t, 200, rec.Code)
+	assert.Equal(t, "update42", rec.Header().Get("x-ats-update"))
+}
+
+func TestApiDeviceLabelsHeader(t *testing.T) {
+	tc := NewTestClient(t)
+	api, err := apiStorage.NewStorage(tc.db, tc.fs)
+	require.Nil(t, err)
+	labels := func(uuid string) map[string]string {
+		d, err := api.DeviceGet(uuid)
+		require.Nil(t, err)
+		return d.Labels
+	}
+
+	_ = tc.GET("/device", 200)
+	group, name := "lab", "mine"
+	require.Nil(t, api.PatchDeviceLabels(map[string]*string{"group": &group, "name": &name}, []string{tc.uuid}))
+
+	var device storage.Device
+	require.Nil(t, json.Unmarshal(tc.GET("/device", 200, "x-ats-labels", `{"site":"berlin"}`), &device))
+	assert.Equal(t, "lab", device.GroupName)
+	assert.Equal(t, map[string]string{"site": "berlin", "group": "lab", "name": "mine"}, labels(tc.uuid))
+
+	// Labels are merged, and a null value deletes a label.
+	_ = tc.GET("/device", 200, "x-ats-labels", `{"site":null,"rack":"r1"}`)
+	assert.Equal(t, map[string]string{"rack": "r1", "group": "lab", "name": "mine"}, labels(tc.uuid))
+
+	_ = tc.GET("/device", 400, "x-ats-labels", `["site"]`)
+	_ = tc.GET("/device", 400, "x-ats-labels", `{"Site":"berlin"}`)
+	_ = tc.GET("/device", 400, "x-ats-labels", `{"site":"berlin west"}`)
+	assert.Equal(t, map[string]string{"rack": "r1", "group": "lab", "name": "mine"}, labels(tc.uuid))
+
+	// Standard labels can only be changed through the API.
+	_ = tc.GET("/device", 400, "x-ats-labels", `{"group":"other"}`)
+	_ = tc.GET("/device", 400, "x-ats-labels", `{"group":null}`)
+	_ = tc.GET("/device", 400, "x-ats-labels", `{"rack":"r2","name":"other"}`)
+	assert.Equal(t, map[string]string{"rack": "r1", "group": "lab", "name": "mine"}, labels(tc.uuid))
+}
+
+func TestProdSubjectAttribute(t *testing.T) {
+	oid, err := ParseOid("1.3.6.1.4.1.55555.1")
+	require.Nil(t, err)
+	for _, bad := range []string{"", "1", "1.x.2", "1.-2"} {
+		_, err = ParseOid(bad)
+		assert.NotNil(t, err, bad)
+	}
+
+	isProd := func(tc *testClient) bool {
+		tc.e = server.NewEchoServer()
+		RegisterHandlers(tc.e, tc.gw, "https://does-not-matter", WithProdSubjectAttribute(oid, "prod-channel"))
+		var device storage.Device
+		require.Nil(t, json.Unmarshal(tc.GET("/device", 200), &device))
+		return device.IsProd
+	}
+
+	// A custom attribute marks a production device.
+	tc := NewTestClient(t)
+	tc.cert.Subject.Names = append(tc.cert.Subject.Names, pkix.AttributeTypeAndValue{Type: oid, Value: "prod-channel"})
+	assert.True(t, isProd(tc))
+
+	// A default businessCategory attribute no longer does.
+	assert.False(t, isProd(NewProdTestClient(t)))
+
+	// Nor does a custom attribute with a different value.
+	tc = NewTestClient(t)
+	tc.cert.Subject.Names = append(tc.cert.Subject.Names, pkix.AttributeTypeAndValue{Type: oid, Value: "ci-channel"})
+	assert.False(t, isProd(tc))
+}
+
+func TestLogSampling(t *testing.T) {
+	tc := newTestClient(t, false)
+	var buf bytes.Buffer
+	tc.log = slog.New(slog.NewJSONHandler(&buf, nil))
+	tc.e = server.NewEchoServer(server.WithLogSampling(10))
+	RegisterHandlers(tc.e, tc.gw, "https://does-not-matter")
+
+	responses := func() (total int) {
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.Contains(line, `"msg":"response"`) {
+				total++
+			}
+		}
+		buf.Reset()
+		return
+	}
+
+	for range 1000 {
+		tc.GET("/device", 200)
+	}
+	assert.InDelta(t, 100, responses(), 1)
+
+	// Failures and requests other than GET are always logged.
+	for range 20 {
+		tc.GET("/repo/no-such-meta.json", 404)
+		tc.PUT("/system_info", 200, "{}")
+	}
+	assert.Equal(t, 40, responses())
+}
+
+func TestApiDeviceFirstSeen(t *testing.T) {
+	tc := NewTestClient(t)
+	// Pre-register a device before it connects for the first time.
+	pub, err := pubkey(tc.cert)
+	require.Nil(t, err)
+	d, err := tc.gw.DeviceCreate(tc.uuid, pub, false)
+	require.Nil(t, err)
+	assert.Zero(t, d.FirstSeen)
+
+	firstSeen := time.Now().Add(time.Hour)
+	clock.Now = func() time.Time { return firstSeen }
+	defer func() { clock.Now = time.Now }()
+	_ = tc.GET("/device", 200)
+	d, err = tc.gw.DeviceGet(tc.uuid)
+	require.Nil(t, err)
+	assert.Equal(t, firstSeen.Unix(), d.FirstSeen)
+
+	// First seen never changes afterwards.
+	clock.Now = func() time.Time { return firstSeen.Add(time.Hour) }
+	_ = tc.GET("/device", 200)
+	d, err = tc.gw.DeviceGet(tc.uuid)
+	require.Nil(t, err)
+	assert.Equal(t, firstSeen.Unix(), d.FirstSeen)
+}
+
+func TestMaxDevices(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.e = server.NewEchoServer()
+	RegisterHandlers(tc.e, tc.gw, "https://does-not-matter", WithMaxDevices(2))
+
+	_, err := tc.gw.DeviceCreate("pre-registered", "pubkey", false)
+	require.Nil(t, err)
+	tc.GET("/device", 200)
+
+	// Another device is rejected, while known devices are still served.
+	other := NewTestClient(t)
+	other.gw, other.e = tc.gw, tc.e
+	other.GET("/device", 403)
+	_, err = tc.gw.DeviceCreate("pre-registered-2", "pubkey", false)
+	assert.ErrorIs(t, err, storage.ErrDeviceQuota)
+	tc.GET("/device", 200)
+
+	// Deleted devices do not count towards the quota.
+	api, err := apiStorage.NewStorage(tc.db, tc.fs)
+	require.Nil(t, err)
+	d, err := api.DeviceGet("pre-registered")
+	require.Nil(t, err)
+	require.Nil(t, d.Delete())
+	other.GET("/device", 200)
+	other.GET("/device", 200)
+}
+
+func TestDeviceKeyReset(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.GET("/device", 200)
+	oldCert := tc.cert
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tc.cert = &x509.Certificate{Subject: oldCert.Subject, PublicKey: priv.Public()}
+	tc.GET("/device", 502)
+
+	api, err := apiStorage.NewStorage(tc.db, tc.fs)
+	require.Nil(t, err)
+	d, err := api.DeviceGet(tc.uuid)
+	require.Nil(t, err)
+	require.Nil(t, d.ResetKey())
+
+	// The first key after a reset is enrolled, and is the only one accepted afterwards.
+	tc.GET("/device", 200)
+	newKey, err := pubkey(tc.cert)
+	require.Nil(t, err)
+	device, err := tc.gw.DeviceGet(tc.uuid)
+	require.Nil(t, err)
+	assert.Equal(t, newKey, device.PubKey)
+	d, err = api.DeviceGet(tc.uuid)
+	require.Nil(t, err)
+	assert.Equal(t, newKey, d.PubKey)
+
+	tc.cert = oldCert
+	tc.GET("/device", 502)
+}
+
+func TestApiDeviceActivity(t *testing.T) {
+	tc := NewTestClient(t)
+	defer func() { clock.Now = time.Now }()
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// The first request registers the device.
+	// Check-ins within a minute of the last recorded one are skipped.
+	for _, offset := range []time.Duration{0, 30 * time.Second, 2 * time.Minute, 150 * time.Second, 4 * time.Minute} {
+		clock.Now = func() time.Time { return start.Add(offset) }
+		_ = tc.GET("/device", 200)
+	}
+	names, err := tc.fs.Devices.ListFiles(tc.uuid, baseStorage.ActivityPrefix, false)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"activity-20260101"}, names)
+	content, err := tc.fs.Devices.ReadFile(tc.uuid, "activity-20260101")
+	require.Nil(t, err)
+	expected := fmt.Sprintf("%d\n%d\n", start.Add(2*time.Minute).Unix(), start.Add(4*time.Minute).Unix())
+	assert.Equal(t, expected, content)
+
+	// Only the last few days of activity are kept.
+	for day := 1; day <= baseStorage.ActivityMaxDays+2; day++ {
+		clock.Now = func() time.Time { return start.AddDate(0, 0, day) }
+		_ = tc.GET("/device", 200)
+	}
+	names, err = tc.fs.Devices.ListFiles(tc.uuid, baseStorage.ActivityPrefix, false)
+	require.Nil(t, err)
+	assert.Len(t, names, baseStorage.ActivityMaxDays)
+	assert.NotContains(t, names, "activity-20260101")
+	assert.Contains(t, names, "activity-20260110")
+}
+
 func TestApiProxy(t *testing.T) {
 	tc := NewTestClient(t)
 	resBytes := tc.POST("/app-proxy-url", 201, nil)
@@ -218,6 +482,23 @@ func TestCheckIn(t *testing.T) {
 	assert.Equal(t, target, d.TargetName)
 }
 
+func TestCheckInAppsMaxLength(t *testing.T) {
+	tc := NewTestClient(t)
+	apps := strings.Repeat("app,", 512) + "x"
+	body := tc.GET("/device", 400, "x-ats-dockerapps", apps)
+	assert.Equal(t, "x-ats-dockerapps header exceeds the maximum length of 2048 characters", string(body))
+	d, err := tc.gw.DeviceGet(tc.uuid)
+	require.Nil(t, err)
+	assert.Equal(t, "", d.Apps)
+
+	tc.e = server.NewEchoServer()
+	RegisterHandlers(tc.e, tc.gw, "https://does-not-matter", WithAppsMaxLength(4096))
+	_ = tc.GET("/device", 200, "x-ats-dockerapps", apps)
+	d, err = tc.gw.DeviceGet(tc.uuid)
+	require.Nil(t, err)
+	assert.Equal(t, apps, d.Apps)
+}
+
 func TestConfig(t *testing.T) {
 	tc := NewTestClient(t)
 
@@ -446,6 +727,18 @@ tags = "group"
 	require.Equal(t, mergedCfg, serverCfg)
 }
 
+func TestVersion(t *testing.T) {
+	defer func(version, commit, buildTime string) {
+		cmd.Version, cmd.Commit, cmd.BuildTime = version, commit, buildTime
+	}(cmd.Version, cmd.Commit, cmd.BuildTime)
+	cmd.Version, cmd.Commit, cmd.BuildTime = "v1.2.3", "abc123", "2025-01-02T03:04:05Z"
+
+	tc := NewTestClient(t)
+	var info server.VersionInfo
+	require.Nil(t, json.Unmarshal(tc.GET("/version", 200), &info))
+	assert.Equal(t, server.VersionInfo{Version: "v1.2.3", Commit: "abc123", BuildTime: "2025-01-02T03:04:05Z"}, info)
+}
+
 func TestInfo(t *testing.T) {
 	akInfo := "[config]\nkey=value"
 	hwInfo := `{"key":"value"}`
@@ -503,6 +796,124 @@ func TestInfo(t *testing.T) {
 	}
 }
 
+func TestAppsStatesValidation(t *testing.T) {
+	tc := NewTestClient(t)
+	valid := `{"deviceTime":"2025-09-12T10:00:00Z","ostree":"abcd","apps":{"app1":{` +
+		`"uri":"hub.example.org/factory/app1@sha256:1234","state":"installed","services":[` +
+		`{"name":"svc1","hash":"beef","image":"hub.example.org/factory/svc1@sha256:5678",` +
+		`"state":"running","status":"healthy"}]}}}`
+	_ = tc.POST("/apps-states", 200, valid)
+
+	tests := map[string]string{
+		`{"deviceTime":"2025-09-12T10:00:00Z","apps":["app1"]}`:                                        "Invalid apps-states: apps must be of type",
+		`{"deviceTime":"2025-09-12T10:00:00Z","apps":{"app1":"uri"}}`:                                  "Invalid apps-states: apps.app1 must be of type",
+		`{"deviceTime":"2025-09-12T10:00:00Z","apps":{"app1":{}}}`:                                     "Invalid apps-states: app app1 has no uri",
+		`{"deviceTime":"2025-09-12T10:00:00Z","apps":{"app1":null}}`:                                   "Invalid apps-states: app app1 has no uri",
+		`{"deviceTime":"2025-09-12T10:00:00Z","apps":{"app1":{"uri":"u","services":[{"image":"i"}]}}}`: "Invalid apps-states: app app1 service #0 has no name",
+		`{"deviceTime":"2025-09-12T10:00:00Z","apps":{"app1":{"uri":"u","services":[{"name":"s"}]}}}`:  "Invalid apps-states: app app1 service s has no image",
+	}
+	for payload, msg := range tests {
+		t.Run(msg, func(t *testing.T) {
+			data := tc.POST("/apps-states", 400, payload)
+			assert.Contains(t, string(data), msg)
+		})
+	}
+
+	states, err := tc.fs.Devices.ListFiles(tc.uuid, storage.StatesPrefix, true)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(states))
+	data, err := tc.fs.Devices.ReadFile(tc.uuid, states[0])
+	require.Nil(t, err)
+	assert.Equal(t, valid, data)
+}
+
+func TestStoreCertificates(t *testing.T) {
+	tc := NewTestClient(t)
+	// Use a real DER encoded certificate, a test client only has a certificate template.
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	issue := func(notAfter time.Time) {
+		tmpl := x509.Certificate{SerialNumber: big.NewInt(1), Subject: tc.cert.Subject, NotAfter: notAfter}
+		der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, priv.Public(), priv)
+		require.Nil(t, err)
+		tc.cert, err = x509.ParseCertificate(der)
+		require.Nil(t, err)
+	}
+	issue(time.Now().Add(time.Hour).Truncate(time.Second))
+
+	_ = tc.GET("/device", 200)
+	data, err := tc.fs.Devices.ReadFile(tc.uuid, baseStorage.CertFile)
+	require.Nil(t, err)
+	assert.Empty(t, data, "certificates are not stored by default")
+
+	tc.e = server.NewEchoServer()
+	RegisterHandlers(tc.e, tc.gw, "https://does-not-matter", WithStoreCertificates(true))
+	_ = tc.GET("/device", 200)
+	data, err = tc.fs.Devices.ReadFile(tc.uuid, baseStorage.CertFile)
+	require.Nil(t, err)
+	assert.Empty(t, data, "certificates are stored once renewed")
+
+	issue(time.Now().Add(2 * time.Hour).Truncate(time.Second))
+	_ = tc.GET("/device", 200)
+	data, err = tc.fs.Devices.ReadFile(tc.uuid, baseStorage.CertFile)
+	require.Nil(t, err)
+	block, _ := pem.Decode([]byte(data))
+	require.NotNil(t, block)
+	assert.Equal(t, "CERTIFICATE", block.Type)
+	assert.Equal(t, tc.cert.Raw, block.Bytes)
+	d, err := tc.gw.DeviceGet(tc.uuid)
+	require.Nil(t, err)
+	assert.Equal(t, tc.cert.NotAfter.Unix(), d.CertNotAfter)
+}
+
+func TestAppsStatesMaxSize(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.e = server.NewEchoServer()
+	RegisterHandlers(tc.e, tc.gw, "https://does-not-matter", WithAppsStatesMaxSize("200K"))
+
+	padded := func(size int) string {
+		return `{"deviceTime":"2025-09-12T10:00:00Z","apps":{},"pad":"` + strings.Repeat("x", size) + `"}`
+	}
+	// Apps states are not subject to the common body limit.
+	_ = tc.POST("/apps-states", 200, padded(150*1024))
+	_ = tc.POST("/apps-states", 413, padded(200*1024))
+	_ = tc.PUT("/system_info/config", 413, padded(150*1024))
+
+	states, err := tc.fs.Devices.ListFiles(tc.uuid, storage.StatesPrefix, true)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(states))
+
+	// Default limit
+	tc = NewTestClient(t)
+	_ = tc.POST("/apps-states", 413, padded(100*1024))
+}
+
+func TestStorageLimits(t *testing.T) {
+	tc := NewTestClient(t)
+	limits := RegisterHandlers(server.NewEchoServer(), tc.gw, "https://does-not-matter")
+	assert.Equal(t, storage.Limits{
+		MaxEvents:         20,
+		MaxAppsStates:     10,
+		AppsStatesMaxSize: "100K",
+		AppsMaxLength:     2048,
+	}, limits)
+
+	limits = RegisterHandlers(server.NewEchoServer(), tc.gw, "https://does-not-matter",
+		WithMaxEvents(5), WithAppsStatesMaxCount(3), WithAppsStatesMaxAge(time.Hour), WithAppsStatesCompression(true))
+	assert.Equal(t, storage.Limits{
+		MaxEvents:         5,
+		MaxAppsStates:     3,
+		AppsStatesMaxAge:  3600,
+		AppsStatesGzip:    true,
+		AppsStatesMaxSize: "100K",
+		AppsMaxLength:     2048,
+	}, limits)
+
+	limits = RegisterHandlers(server.NewEchoServer(), tc.gw, "https://does-not-matter", WithMaxDevices(100))
+	assert.Equal(t, 100, limits.MaxDevices)
+	assert.Equal(t, limits.MaxEvents, tc.gw.Limits().MaxEvents)
+}
+
 func TestEvents(t *testing.T) {
 	var (
 		eventSatus = `{"id":"dead","deviceTime":"2023-12-12T12:00:00Z",` +
@@ -541,6 +952,226 @@ func TestEvents(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf("%s\n%s\n%s\n", eventSatus, eventFinis, eventFixedDate), eventsSaved)
 }
 
+func TestEventsTimezones(t *testing.T) {
+	event := func(id, deviceTime string) string {
+		return fmt.Sprintf(`{"id":"%s","deviceTime":"%s",`+
+			`"event":{"correlationId":"feed","ecu":"","targetName":"metam","version":"42"},`+
+			`"eventType":{"id":"satus","version":123}}`, id, deviceTime)
+	}
+	tc := NewTestClient(t)
+	before := time.Now().UTC().Truncate(time.Second)
+	events := []string{
+		event("utc", "2023-12-12T12:00:00Z"),
+		event("east", "2023-12-12T14:30:00+02:30"),
+		event("west", "2023-12-12T04:00:00-08:00"),
+		event("frac", "2023-12-12T12:00:00.123+00:00"),
+		event("far", "2023-12-12T12:00:00+15:00"),
+	}
+	_ = tc.POST("/events", 200, "["+strings.Join(events, ",")+"]")
+
+	eventsSaved, err := tc.fs.Devices.ReadFile(tc.uuid, storage.EventsPrefix+"-feed")
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(eventsSaved), "\n")
+	require.Len(t, lines, 5)
+	times := make([]string, 0, len(lines))
+	for _, line := range lines {
+		var evt UpdateEvent
+		require.Nil(t, json.Unmarshal([]byte(line), &evt))
+		times = append(times, evt.DeviceTime)
+	}
+	assert.Equal(t, []string{
+		"2023-12-12T12:00:00Z", "2023-12-12T12:00:00Z", "2023-12-12T12:00:00Z", "2023-12-12T12:00:00Z",
+	}, times[:4])
+	// An out of range offset is replaced with the server time.
+	substituted, err := time.Parse(time.RFC3339, times[4])
+	require.Nil(t, err)
+	assert.False(t, substituted.Before(before))
+	assert.True(t, strings.HasSuffix(times[4], "Z"))
+}
+
+func TestEventsReusedCorrelationId(t *testing.T) {
+	event := func(id, eventType, target string) string {
+		return fmt.Sprintf(`{"id":"%s","deviceTime":"2023-12-12T12:00:00Z",`+
+			`"event":{"correlationId":"feed","ecu":"","targetName":"%s","version":"42"},`+
+			`"eventType":{"id":"%s","version":123}}`, id, target, eventType)
+	}
+	tc := NewTestClient(t)
+	first := []string{
+		event("a1", "EcuDownloadStarted", "t-1"),
+		event("a2", "EcuInstallationCompleted", "t-1"),
+		// Late events of a completed update stay in its history.
+		event("a3", "EcuInstallationApplied", "t-1"),
+		event("a4", "EcuInstallationCompleted", "t-1"),
+	}
+	second := []string{event("b1", "EcuDownloadStarted", "t-2"), event("b2", "EcuInstallationCompleted", "t-2")}
+	third := []string{event("c1", "EcuDownloadStarted", "t-3")}
+	// An update abandoned before its completion has a history of its own too.
+	fourth := []string{event("d1", "EcuDownloadStarted", "t-4")}
+	_ = tc.POST("/events", 200, "["+strings.Join(first[:2], ",")+"]")
+	_ = tc.POST("/events", 200, "["+strings.Join(first[2:], ",")+"]")
+	_ = tc.POST("/events", 200, "["+strings.Join(append(second, third...), ",")+"]")
+	_ = tc.POST("/events", 200, "["+strings.Join(fourth, ",")+"]")
+
+	eventsFiles, err := tc.fs.Devices.ListFiles(tc.uuid, storage.EventsPrefix, true)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"events-feed", "events-feed.2", "events-feed.3", "events-feed.4"}, eventsFiles)
+	for i, expected := range [][]string{first, second, third, fourth} {
+		content, err := tc.fs.Devices.ReadFile(tc.uuid, eventsFiles[i])
+		require.Nil(t, err)
+		assert.Equal(t, strings.Join(expected, "\n")+"\n", content)
+	}
+}
+
+func TestMaxConcurrentInstalls(t *testing.T) {
+	defer func() { clock.Now = time.Now }()
+	tc := NewTestClient(t)
+	stmt, err := tc.db.Prepare("TestUpdateUpdate", "UPDATE devices SET update_name=?, tag=? WHERE uuid=?")
+	require.Nil(t, err)
+	devices := make([]*testClient, 4)
+	for i := range devices {
+		d := *tc
+		d.uuid = rand.Text()
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.Nil(t, err)
+		d.cert = &x509.Certificate{Subject: pkix.Name{CommonName: d.uuid}, PublicKey: priv.Public()}
+		_ = d.GET("/device", 200) // This creates the device via auto-register
+		_, err = stmt.Exec("42", "main", d.uuid)
+		require.Nil(t, err)
+		devices[i] = &d
+	}
+	targets := `{"signed":{"targets":{"lmp-2":{"custom":{"tags":["main"],"version":"2"}}}}}`
+	require.Nil(t, tc.fs.Updates.Ci.Tuf.WriteFile("main", "42", storage.TufTargetsFile, targets))
+
+	getTargets := func(d *testClient, status int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/repo/targets.json", nil)
+		req.Header.Set("x-ats-tags", "main")
+		rec := d.Do(req)
+		require.Equal(t, status, rec.Code)
+		return rec
+	}
+	event := func(d *testClient, eventType string, success *bool) {
+		evt := storage.DeviceUpdateEvent{
+			Id:         rand.Text(),
+			DeviceTime: "2023-12-12T12:00:00Z",
+			Event:      baseStorage.DeviceEvent{CorrelationId: "corr-" + d.uuid, TargetName: "lmp-2", Success: success},
+			EventType:  baseStorage.DeviceEventType{Id: eventType},
+		}
+		_ = d.POST("/events", 200, []storage.DeviceUpdateEvent{evt})
+	}
+	ok, failed := true, false
+
+	// No limit
+	for _, d := range devices {
+		getTargets(d, 200)
+	}
+
+	require.Nil(t, tc.fs.Updates.Ci.Settings.WriteFile("main", "42", baseStorage.SettingsMaxInstallsFile, "2"))
+	event(devices[0], "EcuDownloadStarted", nil)
+	event(devices[1], "EcuDownloadStarted", nil)
+	event(devices[1], "EcuDownloadCompleted", &ok)
+	rec := getTargets(devices[2], 503)
+	assert.Equal(t, "300", rec.Header().Get("Retry-After"))
+	// Devices already installing are never told to back off
+	getTargets(devices[0], 200)
+	getTargets(devices[1], 200)
+
+	// A completed install frees a slot, and the device is no longer limited, without taking a slot
+	event(devices[0], "EcuInstallationCompleted", &ok)
+	getTargets(devices[0], 200)
+	getTargets(devices[2], 200)
+	event(devices[2], "EcuDownloadStarted", nil)
+	getTargets(devices[0], 200)
+
+	// Devices already running the update's target never take a slot
+	stmt, err = tc.db.Prepare("TestUpdateTarget", "UPDATE devices SET target_name='lmp-2' WHERE uuid=?")
+	require.Nil(t, err)
+	_, err = stmt.Exec(devices[3].uuid)
+	require.Nil(t, err)
+	getTargets(devices[3], 200)
+
+	// So does a failed install
+	event(devices[1], "EcuInstallationStarted", &failed)
+	event(devices[0], "EcuDownloadStarted", nil)
+	getTargets(devices[1], 503)
+
+	// And an install result
+	_ = devices[0].POST("/device/install-result", 200, `{"correlationId":"feed","success":false}`)
+	getTargets(devices[1], 200)
+	event(devices[1], "EcuDownloadStarted", nil)
+
+	// Devices which stopped sending events free their slot after a timeout
+	getTargets(devices[0], 503)
+	clock.Now = func() time.Time { return time.Now().Add(installSlotTimeout + time.Minute) }
+	getTargets(devices[0], 200)
+
+	// Removing the limit
+	require.Nil(t, tc.fs.Updates.Ci.Settings.WriteFile("main", "42", baseStorage.SettingsMaxInstallsFile, "0"))
+	clock.Now = time.Now
+	event(devices[0], "EcuDownloadStarted", nil)
+	event(devices[1], "EcuDownloadStarted", nil)
+	event(devices[2], "EcuDownloadStarted", nil)
+	for _, d := range devices {
+		getTargets(d, 200)
+	}
+}
+
+func TestInstallsTrackerAdmit(t *testing.T) {
+	defer func() { clock.Now = time.Now }()
+	installs := newInstallsTracker()
+	var admitted atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if installs.admit("main/42", fmt.Sprintf("device-%d", i), 5) {
+				admitted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 5, admitted.Load())
+	assert.Len(t, installs.updates["main/42"], 5)
+
+	// Admitted devices which never send update events free their slot sooner than installing devices.
+	installs.set("main/42", "device-installing", true)
+	clock.Now = func() time.Time { return time.Now().Add(installReserveTimeout + time.Minute) }
+	assert.True(t, installs.admit("main/42", "device-late", 5))
+	assert.Len(t, installs.updates["main/42"], 2)
+}
+
+func TestInstallResult(t *testing.T) {
+	tc := NewTestClient(t)
+	_ = tc.GET("/device", 200) // This creates the device via auto-register
+	stmt, err := tc.db.Prepare("TestUpdateUpdate", "UPDATE devices SET update_name=?, tag=? WHERE uuid=?")
+	require.Nil(t, err)
+	_, err = stmt.Exec("42", "main", tc.uuid)
+	require.Nil(t, err)
+
+	_ = tc.POST("/device/install-result", 400, "here we go")
+	_ = tc.POST("/device/install-result", 400, `{"correlationId":"../feed","success":false}`)
+	_ = tc.POST("/device/install-result", 400, `{"correlationId":"feed"}`)
+	_ = tc.POST("/device/install-result", 200,
+		`{"correlationId":"feed","success":false,"reason":"rolled back: app failed to start"}`)
+
+	content, err := tc.fs.Devices.ReadFile(tc.uuid, storage.InstallResultPrefix+"-feed")
+	require.Nil(t, err)
+	var res storage.DeviceInstallResult
+	require.Nil(t, json.Unmarshal([]byte(content), &res))
+	assert.Equal(t, "feed", res.CorrelationId)
+	assert.False(t, res.Success)
+	assert.Equal(t, "rolled back: app failed to start", res.Reason)
+
+	logs, err := tc.fs.Updates.Ci.Logs.ReadFile("main", "42", baseStorage.LogRolloutsFile)
+	require.Nil(t, err)
+	var status baseStorage.DeviceStatus
+	require.Nil(t, json.Unmarshal([]byte(logs), &status))
+	assert.Equal(t, tc.uuid, status.Uuid)
+	assert.Equal(t, "feed", status.CorrelationId)
+	assert.Equal(t, "Update failed", status.Status)
+	assert.Equal(t, "rolled back: app failed to start", status.Reason)
+}
+
 func TestTufMeta(t *testing.T) {
 	tcCi42 := NewTestClient(t)
 	tcCi137 := NewTestClient(t)
@@ -626,6 +1257,70 @@ func TestTufMeta(t *testing.T) {
 	})
 }
 
+func TestDeviceTuf(t *testing.T) {
+	tc := NewProdTestClient(t)
+	tc.GET("/device/tuf", 404)
+	tc.GET("/device/tuf", 404, "x-ats-tags", "main")
+
+	stmt, err := tc.db.Prepare("TestUpdateUpdate", "UPDATE devices SET update_name=? WHERE uuid=?")
+	require.Nil(t, err)
+	_, err = stmt.Exec("42", tc.uuid)
+	require.Nil(t, err)
+	tc.GET("/device/tuf", 404, "x-ats-tags", "main") // No TUF metadata yet
+
+	for _, role := range []string{"1.root.json", "2.root.json", "timestamp.json", "snapshot.json", "targets.json"} {
+		require.Nil(t, tc.fs.Updates.Prod.Tuf.WriteFile("main", "42", role, role))
+	}
+	var pointers TufPointers
+	require.Nil(t, json.Unmarshal(tc.GET("/device/tuf", 200, "x-ats-tags", "main"), &pointers))
+	assert.Equal(t, TufPointers{
+		Channel: "prod",
+		Tag:     "main",
+		Update:  "42",
+		TufMetaUrls: storage.TufMetaUrls{
+			Root:      "https://does-not-matter/repo/2.root.json",
+			Timestamp: "https://does-not-matter/repo/timestamp.json",
+			Snapshot:  "https://does-not-matter/repo/snapshot.json",
+			Targets:   "https://does-not-matter/repo/targets.json",
+		},
+	}, pointers)
+
+	// The pointers lead to the metadata of the device's update.
+	for _, url := range []string{pointers.Root, pointers.Targets} {
+		path := strings.TrimPrefix(url, "https://does-not-matter")
+		assert.Equal(t, path[len("/repo/"):], string(tc.GET(path, 200, "x-ats-tags", "main")))
+	}
+}
+
+func TestNoUpdate(t *testing.T) {
+	tc := NewTestClient(t)
+	// The device's tag has no updates, so no update is assigned to it.
+	getTimestamp := func(status int) string {
+		req := httptest.NewRequest(http.MethodGet, "/repo/timestamp.json", nil)
+		req.Header.Set("x-ats-tags", "main")
+		rec := tc.Do(req)
+		require.Equal(t, status, rec.Code)
+		return rec.Header().Get("x-ats-update-status")
+	}
+	assert.Equal(t, "none", getTimestamp(404))
+
+	tc.e = server.NewEchoServer()
+	RegisterHandlers(tc.e, tc.gw, "https://does-not-matter", WithNoUpdateStatus(http.StatusNoContent))
+	assert.Equal(t, "none", getTimestamp(204))
+	req := httptest.NewRequest(http.MethodGet, "/device/tuf", nil)
+	req.Header.Set("x-ats-tags", "main")
+	rec := tc.Do(req)
+	assert.Equal(t, 204, rec.Code)
+	assert.Equal(t, "none", rec.Header().Get("x-ats-update-status"))
+
+	// Missing metadata of an assigned update is an error.
+	stmt, err := tc.db.Prepare("TestUpdateUpdate", "UPDATE devices SET update_name=? WHERE uuid=?")
+	require.Nil(t, err)
+	_, err = stmt.Exec("42", tc.uuid)
+	require.Nil(t, err)
+	assert.Equal(t, "", getTimestamp(404))
+}
+
 func TestOstree(t *testing.T) {
 	tcCi42 := NewTestClient(t)
 	tcCi137 := NewTestClient(t)
@@ -769,3 +1464,29 @@ func TestApiFiotest(t *testing.T) {
 	require.Len(t, files, 1)
 	require.Equal(t, prefix+"console.txt", files[0])
 }
+
+func TestConfigureTls(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &tls.Config{}
+	require.Nil(t, configureTls(ctx, cfg))
+	assert.Empty(t, cfg.NextProtos)
+	assert.False(t, cfg.SessionTicketsDisabled)
+
+	cfg = &tls.Config{}
+	require.Nil(t, configureTls(ctx, cfg, WithTlsNextProtos([]string{"h2", "http/1.1"})))
+	assert.Equal(t, []string{"h2", "http/1.1"}, cfg.NextProtos)
+
+	cfg = &tls.Config{}
+	err := configureTls(ctx, cfg, WithTlsNextProtos([]string{"h3"}))
+	assert.ErrorContains(t, err, `unsupported ALPN protocol "h3"`)
+
+	cfg = &tls.Config{}
+	require.Nil(t, configureTls(ctx, cfg, WithTlsTicketKeyRotation(-1)))
+	assert.True(t, cfg.SessionTicketsDisabled)
+
+	cfg = &tls.Config{}
+	require.Nil(t, configureTls(ctx, cfg, WithTlsTicketKeyRotation(time.Millisecond)))
+	assert.False(t, cfg.SessionTicketsDisabled)
+}
@@ -0,0 +1,91 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	"github.com/foundriesio/dg-satellite/clock"
+	storage "github.com/foundriesio/dg-satellite/storage/gateway"
+)
+
+const (
+	// A device which stops sending events in the middle of an install, e.g. because it lost power,
+	// no longer counts towards the update's concurrent installs after this timeout.
+	installSlotTimeout = time.Hour
+	// A device admitted to install an update holds its slot for this long, until its first update event.
+	installReserveTimeout = 10 * time.Minute
+	// How long devices are asked to back off when too many devices are installing an update.
+	installRetryAfter = 5 * time.Minute
+)
+
+// installsTracker counts devices in the middle of installing an update, based on their update events.
+// The counts are kept in memory: after a restart, devices are counted again as they send more events.
+// Only devices which have yet to install an update take a slot, see storage.Device.InstallPending.
+type installsTracker struct {
+	lock    sync.Mutex
+	updates map[string]map[string]int64 // Update key -> device UUID -> slot expiry time
+}
+
+func newInstallsTracker() *installsTracker {
+	return &installsTracker{updates: make(map[string]map[string]int64)}
+}
+
+// processEvent marks a device as installing an update until it reports completion or a failure.
+func (t *installsTracker) processEvent(key, uuid string, evt storage.DeviceUpdateEvent) {
+	failed := evt.Event.Success != nil && !*evt.Event.Success
+	t.set(key, uuid, !failed && evt.EventType.Id != storage.EventInstallCompleted)
+}
+
+func (t *installsTracker) set(key, uuid string, installing bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if installing {
+		t.reserve(key, uuid, installSlotTimeout)
+	} else {
+		t.release(key, uuid)
+	}
+}
+
+func (t *installsTracker) reserve(key, uuid string, timeout time.Duration) {
+	devices := t.updates[key]
+	if devices == nil {
+		devices = make(map[string]int64)
+		t.updates[key] = devices
+	}
+	devices[uuid] = clock.Now().Add(timeout).Unix()
+}
+
+func (t *installsTracker) release(key, uuid string) {
+	if devices := t.updates[key]; devices != nil {
+		delete(devices, uuid)
+		if len(devices) == 0 {
+			delete(t.updates, key)
+		}
+	}
+}
+
+// admit tells if a device may install an update: either it is already installing it,
+// or fewer than a limit of devices are installing it now. In the latter case, the device takes a slot,
+// so that concurrent requests of other devices cannot exceed the limit.
+func (t *installsTracker) admit(key, uuid string, limit int) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	devices := t.updates[key]
+	if _, ok := devices[uuid]; ok {
+		return true
+	}
+	now := clock.Now().Unix()
+	for other, expiry := range devices {
+		if expiry < now {
+			delete(devices, other)
+		}
+	}
+	if len(devices) >= limit {
+		return false
+	}
+	t.reserve(key, uuid, installReserveTimeout)
+	return true
+}
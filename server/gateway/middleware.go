@@ -11,8 +11,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
+
+	storage "github.com/foundriesio/dg-satellite/storage/gateway"
 )
 
 var (
@@ -32,7 +36,7 @@ func (h handlers) authDevice(next echo.HandlerFunc) echo.HandlerFunc {
 		log := CtxGetLog(ctx).With("device", uuid)
 		ctx = CtxWithLog(ctx, log)
 
-		isProd := getBusinessCategory(cert.Subject) == businessCategoryProduction
+		isProd := getSubjectAttribute(cert.Subject, h.prodOid) == h.prodValue
 		pub, err := pubkey(cert)
 		if err != nil {
 			return c.String(http.StatusForbidden, fmt.Sprintf("unable to extract device's public key: %s", err))
@@ -45,20 +49,45 @@ func (h handlers) authDevice(next echo.HandlerFunc) echo.HandlerFunc {
 			return c.String(http.StatusBadGateway, err.Error())
 		} else if device == nil {
 			device, err = h.storage.DeviceCreate(cert.Subject.CommonName, pub, isProd)
-			if err != nil {
+			if errors.Is(err, storage.ErrDeviceQuota) {
+				log.Warn("Unable to create device", "error", err)
+				return c.String(http.StatusForbidden, "Device quota exceeded")
+			} else if err != nil {
 				log.Error("Unable to create device", "error", err)
 				return c.String(http.StatusBadGateway, "Unable to create device")
 			}
 			log.Info("Created device")
 		} else if device.Deleted {
 			return c.String(http.StatusForbidden, fmt.Sprintf("Device(%s) has been deleted", uuid))
-		} else if pub != device.PubKey {
+		} else if len(device.PubKey) == 0 {
+			// An operator reset the device key: the first key seen afterwards is enrolled.
+			if err := device.Enroll(pub); err != nil {
+				log.Error("Unable to enroll device key", "error", err)
+				return c.String(http.StatusForbidden, "Unable to enroll device key")
+			}
+			log.Info("Enrolled a new device key")
+		} else if !storage.SamePubKey(pub, device.PubKey) {
+			// Keys are compared by their DER bytes, as a stored PEM may be formatted differently, e.g. with CRLF line endings.
 			/*if err := device.RotatePubKey(pub); err != nil {
 				return c.String(http.StatusForbidden, err.Error())
 			}*/
 			return c.String(http.StatusBadGateway, "Key rotation is not supported")
 		}
 
+		// None of these are critical for serving a device, the next request will retry them.
+		if err := device.MarkFirstSeen(); err != nil {
+			log.Error("Unable to set device first seen time", "error", err)
+		}
+		// A certificate is only stored when its expiry time changes, i.e. when a device connects with a renewed one.
+		if notAfter := cert.NotAfter.Unix(); h.storeCerts && notAfter != device.CertNotAfter {
+			certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+			if err := device.SaveCertificate(string(certPem), notAfter); err != nil {
+				log.Error("Unable to save device certificate", "error", err)
+			}
+		} else if err := device.SetCertNotAfter(notAfter); err != nil {
+			log.Error("Unable to set device certificate expiry", "error", err)
+		}
+
 		ctx = CtxWithDevice(ctx, device)
 		c.SetRequest(req.WithContext(ctx))
 
@@ -106,6 +135,11 @@ func (h handlers) checkinDevice(next echo.HandlerFunc) echo.HandlerFunc {
 		tag := getHeader(req, "x-ats-tags", d.Tag)
 		target := getHeader(req, "x-ats-target", d.TargetName)
 
+		if h.appsMaxLength > 0 && len(apps) > h.appsMaxLength {
+			msg := fmt.Sprintf("x-ats-dockerapps header exceeds the maximum length of %d characters", h.appsMaxLength)
+			return c.String(http.StatusBadRequest, msg)
+		}
+
 		if err := d.CheckIn(target, tag, hash, apps); err != nil {
 			log := CtxGetLog(ctx)
 			log.Error("Failed to update device check-in info", "error", err)
@@ -127,15 +161,33 @@ func pubkey(cert *x509.Certificate) (string, error) {
 }
 
 // Golang crypto/x509/pkix package doesn't parse a dozen of standard attributes
-func getBusinessCategory(subject pkix.Name) string {
+func getSubjectAttribute(subject pkix.Name, oid asn1.ObjectIdentifier) string {
 	for _, atv := range subject.Names {
-		if businessCategoryOid.Equal(atv.Type) {
-			return atv.Value.(string)
+		if oid.Equal(atv.Type) {
+			if value, ok := atv.Value.(string); ok {
+				return value
+			}
 		}
 	}
 	return ""
 }
 
+// ParseOid parses an object identifier in a dotted notation, e.g. "2.5.4.15".
+func ParseOid(oid string) (asn1.ObjectIdentifier, error) {
+	var res asn1.ObjectIdentifier
+	for _, part := range strings.Split(oid, ".") {
+		if num, err := strconv.Atoi(part); err != nil || num < 0 {
+			return nil, fmt.Errorf("invalid object identifier: %s", oid)
+		} else {
+			res = append(res, num)
+		}
+	}
+	if len(res) < 2 {
+		return nil, fmt.Errorf("object identifier must have at least two components: %s", oid)
+	}
+	return res, nil
+}
+
 func getHeader(req *http.Request, header, defVal string) string {
 	// Differentiate between an empty header value (unset) and missing header value (ignore).
 	if v := req.Header.Values(header); len(v) > 0 {
@@ -13,8 +13,23 @@ type (
 	UpdateEvent = storage.DeviceUpdateEvent
 )
 
+type InstallResult struct {
+	CorrelationId string `json:"correlationId"`
+	Success       *bool  `json:"success"`
+	Reason        string `json:"reason"`
+}
+
 type NetworkInfo struct {
 	Hostname  string `json:"hostname,omitempty"`
 	Mac       string `json:"mac,omitempty"`
 	LocalIpv4 string `json:"local_ipv4,omitempty"`
 }
+
+// TufPointers tells a device where the TUF metadata of its assigned update lives.
+// The device must send its tag in the x-ats-tags header when fetching these URLs.
+type TufPointers struct {
+	Channel string `json:"channel"`
+	Tag     string `json:"tag"`
+	Update  string `json:"update"`
+	storage.TufMetaUrls
+}
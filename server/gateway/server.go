@@ -4,10 +4,12 @@
 package gateway
 
 import (
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"net"
+	"slices"
 	"time"
 
 	"github.com/foundriesio/dg-satellite/context"
@@ -17,17 +19,38 @@ import (
 
 const serverName = "gateway-api"
 
-func NewServer(ctx context.Context, db *storage.DbHandle, fs *storage.FsHandle, bindAddr string) (server.Server, error) {
+// Server is the device gateway server, which also knows the effective limits of device reports.
+type Server struct {
+	server.Server
+	limits    storage.Limits
+	tlsConfig *tls.Config
+}
+
+// Limits returns the effective storage limits of the device gateway.
+func (s Server) Limits() storage.Limits {
+	return s.limits
+}
+
+// TlsConfig returns the TLS config the device gateway serves devices with.
+func (s Server) TlsConfig() *tls.Config {
+	return s.tlsConfig
+}
+
+// NewServer creates the device gateway, echoOpts configure its request logging, e.g. server.WithLogSampling.
+func NewServer(ctx context.Context, db *storage.DbHandle, fs *storage.FsHandle, bindAddr string, echoOpts []server.EchoOption, opts ...Option) (*Server, error) {
 	tlsCfg, err := loadTlsConfig(fs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load %s TLS config: %w", serverName, err)
 	}
+	if err = configureTls(ctx, tlsCfg, opts...); err != nil {
+		return nil, fmt.Errorf("failed to configure %s TLS: %w", serverName, err)
+	}
 	strg, err := storage.NewStorage(db, fs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load %s storage: %w", serverName, err)
 	}
 
-	e := server.NewEchoServer()
+	e := server.NewEchoServer(echoOpts...)
 	srv := server.NewServer(ctx, e, serverName, bindAddr, tlsCfg)
 
 	_, port, err := net.SplitHostPort(bindAddr)
@@ -36,8 +59,8 @@ func NewServer(ctx context.Context, db *storage.DbHandle, fs *storage.FsHandle,
 	}
 	url := "https://" + net.JoinHostPort(srv.GetDnsName(), port)
 
-	RegisterHandlers(e, strg, url)
-	return srv, nil
+	limits := RegisterHandlers(e, strg, url, opts...)
+	return &Server{Server: srv, limits: limits, tlsConfig: tlsCfg}, nil
 }
 
 func loadTlsConfig(fs *storage.FsHandle) (*tls.Config, error) {
@@ -67,6 +90,51 @@ func loadTlsConfig(fs *storage.FsHandle) (*tls.Config, error) {
 	return cfg, nil
 }
 
+// tlsTicketKeysKept is how many recent session ticket keys are accepted, so that
+// tickets issued shortly before a rotation are still valid after it.
+const tlsTicketKeysKept = 3
+
+func configureTls(ctx context.Context, cfg *tls.Config, opts ...Option) error {
+	var h handlers
+	for _, opt := range opts {
+		opt(&h)
+	}
+
+	for _, proto := range h.tlsNextProtos {
+		if proto != "h2" && proto != "http/1.1" {
+			return fmt.Errorf("unsupported ALPN protocol %q, must be h2 or http/1.1", proto)
+		}
+	}
+	cfg.NextProtos = slices.Clone(h.tlsNextProtos)
+
+	if h.tlsTicketRotation < 0 {
+		cfg.SessionTicketsDisabled = true
+	} else if h.tlsTicketRotation > 0 {
+		keys := [][32]byte{newTicketKey()}
+		cfg.SetSessionTicketKeys(keys)
+		go func() {
+			ticker := time.NewTicker(h.tlsTicketRotation)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					keys = append([][32]byte{newTicketKey()}, keys[:min(len(keys), tlsTicketKeysKept-1)]...)
+					cfg.SetSessionTicketKeys(keys)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+func newTicketKey() (key [32]byte) {
+	// Never returns an error, see the crypto/rand docs.
+	_, _ = rand.Read(key[:])
+	return
+}
+
 func loadCas(fs *storage.FsHandle) (*x509.CertPool, error) {
 	bytes, err := fs.Certs.ReadFile(storage.CertsCasPemFile)
 	if err != nil {
@@ -18,13 +18,13 @@ var (
 )
 
 const (
-	ctxKeyProd ctxKey = iota
+	ctxKeyChannel ctxKey = iota
 )
 
-func CtxGetIsProd(ctx Context) bool {
-	return ctx.Value(ctxKeyProd).(bool)
+func CtxGetChannel(ctx Context) string {
+	return ctx.Value(ctxKeyChannel).(string)
 }
 
-func CtxWithIsProd(ctx Context, isProd bool) Context {
-	return context.WithValue(ctx, ctxKeyProd, isProd)
+func CtxWithChannel(ctx Context, channel string) Context {
+	return context.WithValue(ctx, ctxKeyChannel, channel)
 }
@@ -4,6 +4,9 @@
 package api
 
 import (
+	"crypto/tls"
+	"time"
+
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 
@@ -15,43 +18,177 @@ import (
 
 type handlers struct {
 	storage *storage.Storage
+	users   *users.Storage
+
+	deviceOrderBy    storage.OrderBy
+	deviceListLimit  int
+	rolloutApproval  bool
+	rolloutAudit     RolloutAudit
+	rolloutsMax      int
+	userRateLimit    float64
+	userRateBurst    int
+	appsStatesMaxAge time.Duration
+	gatewayLimits    *GatewayLimits
+	gatewayTls       *tls.Config
+	bodyLimit        *BodyLimit
+}
+
+type Option func(*handlers)
+
+// WithDeviceOrderBy sets the order of the device list when a client does not ask for one.
+// By default the storage.DefaultDeviceOrderBy is used.
+func WithDeviceOrderBy(orderBy storage.OrderBy) Option {
+	return func(h *handlers) {
+		h.deviceOrderBy = orderBy
+	}
+}
+
+// WithDeviceListMaxLimit caps how many devices a client may list in a single request, 1000 by default.
+// Larger limits asked by clients are reduced to this maximum.
+func WithDeviceListMaxLimit(limit int) Option {
+	return func(h *handlers) {
+		h.deviceListLimit = limit
+	}
+}
+
+// WithAppsStatesMaxAge tells clients how old apps states reports the device gateway keeps, see gateway.WithAppsStatesMaxAge.
+func WithAppsStatesMaxAge(age time.Duration) Option {
+	return func(h *handlers) {
+		h.appsStatesMaxAge = age
+	}
+}
+
+// WithGatewayLimits reports the effective storage limits of the device gateway to administrators,
+// and tells clients how many apps states reports it keeps.
+func WithGatewayLimits(limits GatewayLimits) Option {
+	return func(h *handlers) {
+		h.gatewayLimits = &limits
+	}
+}
+
+// WithGatewayTlsConfig reports the TLS certificate and client CAs the device gateway serves with to administrators.
+func WithGatewayTlsConfig(cfg *tls.Config) Option {
+	return func(h *handlers) {
+		h.gatewayTls = cfg
+	}
+}
+
+// WithRolloutApproval makes new rollouts wait for an explicit approval before they are committed.
+func WithRolloutApproval(required bool) Option {
+	return func(h *handlers) {
+		h.rolloutApproval = required
+	}
+}
+
+// WithRolloutAudit sets how the devices moved by a rollout are recorded in the audit log, RolloutAuditNone by default.
+func WithRolloutAudit(audit RolloutAudit) Option {
+	return func(h *handlers) {
+		h.rolloutAudit = audit
+	}
+}
+
+// WithRolloutsMaxPerUpdate caps how many rollouts an update may have, so that its rollout files do not grow unbounded.
+// Zero, the default, does not cap rollouts.
+func WithRolloutsMaxPerUpdate(limit int) Option {
+	return func(h *handlers) {
+		h.rolloutsMax = limit
+	}
+}
+
+// WithUserRateLimit limits the number of API requests per second each user may make.
+// The burst is the number of requests a user may make at once. Streams, e.g. log tails, are not limited.
+func WithUserRateLimit(requestsPerSecond float64, burst int) Option {
+	return func(h *handlers) {
+		h.userRateLimit = requestsPerSecond
+		h.userRateBurst = burst
+	}
+}
+
+// WithBodyLimit lets upload routes opt out of a body limit the server applies to all requests.
+func WithBodyLimit(limit *BodyLimit) Option {
+	return func(h *handlers) {
+		h.bodyLimit = limit
+	}
 }
 
 var EchoError = server.EchoError
 
-func RegisterHandlers(e *echo.Echo, storage *storage.Storage, a auth.Provider) {
-	h := handlers{storage: storage}
+func RegisterHandlers(e *echo.Echo, storage *storage.Storage, userStorage *users.Storage, a auth.Provider, opts ...Option) {
+	h := handlers{storage: storage, users: userStorage, deviceListLimit: 1000, rolloutAudit: RolloutAuditNone}
+	for _, opt := range opts {
+		opt(&h)
+	}
 	g := e.Group("/v1")
 	g.Use(authUser(a))
+	if h.userRateLimit > 0 {
+		g.Use(rateLimitUser(h.userRateLimit, h.userRateBurst))
+	}
 
-	g.PUT("/configs", h.configsUpload, requireScope(users.ScopeDevicesRU|users.ScopeUpdatesRU),
-		gzipContentTypeAsContentEncoding, middleware.Decompress())
+	h.unlimitedBody(g.PUT("/configs", h.configsUpload, requireScope(users.ScopeDevicesRU|users.ScopeUpdatesRU),
+		gzipContentTypeAsContentEncoding, middleware.Decompress()))
 	g.GET("/devices", h.deviceList, requireScope(users.ScopeDevicesR))
+	g.POST("/devices/bulk-delete", h.deviceBulkDelete, requireScope(users.ScopeDevicesD))
 	g.GET("/devices/:uuid", h.deviceGet, requireScope(users.ScopeDevicesR))
+	g.HEAD("/devices/:uuid", h.deviceGet, requireScope(users.ScopeDevicesR))
 	g.DELETE("/devices/:uuid", h.deviceDelete, requireScope(users.ScopeDevicesD))
+	g.GET("/devices/:uuid/events", h.deviceEventsGet, requireScope(users.ScopeDevicesR))
+	g.GET("/devices/:uuid/activity", h.deviceActivityGet, requireScope(users.ScopeDevicesR))
+	g.GET("/devices/:uuid/aktualizr.toml", h.deviceAktomlGet, requireScope(users.ScopeDevicesR))
+	g.GET("/devices/:uuid/effective-config", h.deviceEffectiveConfigGet, requireScope(users.ScopeDevicesR))
+	g.POST("/devices/:uuid/cancel-update", h.deviceCancelUpdate, requireScope(users.ScopeDevicesRU))
+	g.PUT("/devices/:uuid/update", h.deviceUpdatePut, requireScope(users.ScopeDevicesRU|users.ScopeUpdatesRU))
+	g.POST("/devices/:uuid/claim", h.deviceClaim, requireScope(users.ScopeDevicesRU))
+	g.DELETE("/devices/:uuid/claim", h.deviceUnclaim, requireScope(users.ScopeDevicesRU))
+	g.POST("/devices/:uuid/pin", h.devicePin, requireScope(users.ScopeDevicesRU))
+	g.DELETE("/devices/:uuid/pin", h.deviceUnpin, requireScope(users.ScopeDevicesRU))
+	g.POST("/devices/:uuid/reset-key", h.deviceResetKey, requireScope(users.ScopeDevicesRU|users.ScopeAdminR))
+	g.GET("/devices/:uuid/certificate", h.deviceCertificateGet, requireScope(users.ScopeDevicesR))
 	g.GET("/devices/:uuid/apps-states", h.deviceAppsStatesGet, requireScope(users.ScopeDevicesR))
 	g.GET("/devices/:uuid/tests", h.deviceTestsList, requireScope(users.ScopeDevicesR))
 	g.GET("/devices/:uuid/tests/:testid", h.deviceTestGet, requireScope(users.ScopeDevicesR))
 	g.GET("/devices/:uuid/tests/:testid/:artifact", h.deviceTestArtifact, requireScope(users.ScopeDevicesR))
 	g.GET("/devices/:uuid/updates", h.deviceUpdatesList, requireScope(users.ScopeDevicesR))
 	g.GET("/devices/:uuid/updates/:id", h.deviceUpdatesGet, requireScope(users.ScopeDevicesR))
+	g.GET("/devices/:uuid/updates/:id/result", h.deviceUpdateResultGet, requireScope(users.ScopeDevicesR))
+	g.GET("/devices/:uuid/events.ndjson", h.deviceEventsExport, requireScope(users.ScopeDevicesR))
 	g.PATCH("/devices/:uuid/labels", h.deviceLabelsPatch, requireScope(users.ScopeDevicesRU))
 	g.PUT("/devices/:uuid/labels", h.deviceLabelsPut, requireScope(users.ScopeDevicesRU))
+	g.GET("/device-groups", h.deviceGroupList, requireScope(users.ScopeDevicesR))
+	g.POST("/device-groups/:name/assign-by-filter", h.deviceGroupAssignByFilter, requireScope(users.ScopeDevicesRU))
+	g.PUT("/device-groups/:name/selector", h.deviceGroupSelectorPut, requireScope(users.ScopeDevicesRU))
+	g.DELETE("/device-groups/:name", h.deviceGroupDelete, requireScope(users.ScopeDevicesRU))
+	g.GET("/device-selector", h.deviceSelectorGet, requireScope(users.ScopeDevicesR))
 	g.GET("/known-labels/devices", h.deviceKnownLabelsGet, requireScope(users.ScopeDevicesR))
 	g.GET("/known-labels/device-groups", h.deviceKnownGroupsGet, requireScope(users.ScopeDevicesR))
-	// In updates APIs :prod path element can be either "prod" or "ci".
+	g.GET("/reports/tags", h.reportTags, requireScope(users.ScopeDevicesR))
+	g.GET("/admin/audit", h.auditList, requireScope(users.ScopeAdminR))
+	g.GET("/admin/config", h.adminConfigGet, requireScope(users.ScopeAdminR))
+	g.GET("/admin/metrics", h.adminMetricsGet, requireScope(users.ScopeAdminR))
+	g.POST("/admin/db/backup", h.dbBackup, requireScope(users.ScopeAdminR))
+	g.GET("/admin/tls-status", h.tlsStatusGet, requireScope(users.ScopeAdminR))
+	g.GET("/admin/rollouts/:prod/journal", h.rolloutJournalGet, requireScope(users.ScopeAdminR))
+	g.GET("/version", h.versionGet)
+	// Access control is done by the handler: users may always read their own audit log.
+	g.GET("/users/:username/audit", h.userAuditList)
+	g.GET("/users/:username/tokens", h.userTokensList)
+	// In updates APIs :prod path element is an update channel: "prod", "ci", or a custom channel.
 	upd := g.Group("/updates/:prod")
-	upd.Use(validateUpdateParams)
+	upd.Use(h.validateUpdateParams)
 	upd.GET("", h.updateList, requireScope(users.ScopeUpdatesR))
 	upd.GET("/:tag", h.updateList, requireScope(users.ScopeUpdatesR))
 	// TODO: What data would we want to show for an update?
 	// upd.GET("/:tag/:update", h.updateGet, requireScope(users.ScopeDevicesR))
-	upd.POST("/:tag/:update", h.updateCreate, requireScope(users.ScopeUpdatesRU),
-		gzipContentTypeAsContentEncoding, middleware.Decompress())
+	h.unlimitedBody(upd.POST("/:tag/:update", h.updateCreate, requireScope(users.ScopeUpdatesRU),
+		gzipContentTypeAsContentEncoding, middleware.Decompress()))
 	upd.GET("/:tag/:update/tuf", h.updateGetTuf, requireScope(users.ScopeUpdatesR))
+	upd.PUT("/:tag/:update/tuf/root", h.updatePutTufRoot, requireScope(users.ScopeUpdatesRU))
+	upd.PUT("/:tag/:update/max-concurrent-installs", h.updatePutInstallsLimit, requireScope(users.ScopeUpdatesRU))
 	upd.GET("/:tag/:update/rollouts", h.rolloutList, requireScope(users.ScopeUpdatesR))
 	upd.GET("/:tag/:update/rollouts/:rollout", h.rolloutGet, requireScope(users.ScopeUpdatesR))
+	upd.HEAD("/:tag/:update/rollouts/:rollout", h.rolloutGet, requireScope(users.ScopeUpdatesR))
+	upd.GET("/:tag/:update/rollouts/:rollout/targets", h.rolloutTargetsGet, requireScope(users.ScopeUpdatesR))
 	upd.PUT("/:tag/:update/rollouts/:rollout", h.rolloutPut, requireScope(users.ScopeUpdatesRU))
+	upd.POST("/:tag/:update/rollouts/:rollout/approve", h.rolloutApprove, requireScope(users.ScopeUpdatesRU))
 	upd.GET("/:tag/:update/rollouts/:rollout/tail", h.rolloutTail, requireScope(users.ScopeUpdatesR))
 	upd.GET("/:tag/:update/tail", h.updateTail, requireScope(users.ScopeUpdatesR))
 }
@@ -0,0 +1,221 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package api
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/foundriesio/dg-satellite/server"
+	gatewayStorage "github.com/foundriesio/dg-satellite/storage/gateway"
+	"github.com/foundriesio/dg-satellite/storage/users"
+)
+
+type (
+	AdminConfig struct {
+		Gateway GatewayLimits `json:"gateway"`
+	}
+	GatewayLimits  = gatewayStorage.Limits
+	UserAuditEvent = users.UserAuditEvent
+	VersionInfo    = server.VersionInfo
+)
+
+// TlsStatus describes the TLS certificate of the device gateway and whether it trusts any CAs for device certificates.
+type TlsStatus struct {
+	Subject     string   `json:"subject"`
+	Issuer      string   `json:"issuer"`
+	DnsNames    []string `json:"dns-names"`
+	IpAddresses []string `json:"ip-addresses"`
+	NotBefore   int64    `json:"not-before"`
+	NotAfter    int64    `json:"not-after"`
+	// Devices cannot authenticate when no client CA certificates are loaded.
+	HasClientCas bool `json:"has-client-cas"`
+}
+
+// @Summary List audit log events of all users
+// @Description A merged audit log of all users, for compliance exports.
+// @Description Requires scope: admin:read
+// @Tags    Admin
+// @Param _ query AuditListOpts false "Pagination options"
+// @Produce json
+// @Success 200 {array} UserAuditEvent "Oldest events first"
+// @Header  200 {string} Link "Pagination links (first, next, last)"
+// @Router  /admin/audit [get]
+func (h *handlers) auditList(c echo.Context) error {
+	opts := AuditListOpts{Limit: 100}
+	if err := c.Bind(&opts); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, "Failed to parse list options")
+	} else if opts.Limit <= 0 || opts.Offset < 0 {
+		err = errors.New("limit must be positive and offset must not be negative")
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	}
+
+	events, total, err := h.users.GetAllAuditEvents(opts.Offset, opts.Limit)
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to read audit logs")
+	}
+	setPaginationLinks(c, opts.Limit, opts.Offset, total, "")
+	return c.JSON(http.StatusOK, events)
+}
+
+// @Summary Get the effective server configuration
+// @Description The limits the device gateway applies to the files it keeps for each device, and to device reports.
+// @Description The maximum age of apps states is in seconds, zero means they are kept regardless of their age.
+// @Description Requires scope: admin:read
+// @Tags    Admin
+// @Produce json
+// @Success 200 {object} AdminConfig
+// @Failure 404 "The server was started without the device gateway"
+// @Router  /admin/config [get]
+func (h *handlers) adminConfigGet(c echo.Context) error {
+	if h.gatewayLimits == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.JSON(http.StatusOK, AdminConfig{Gateway: *h.gatewayLimits})
+}
+
+// @Summary Get the server metrics
+// @Description Metrics published by the server, e.g. device_certs_expiring and device_certs_total,
+// @Description the device certificate counts of the last expiry check, along with Go runtime memory statistics.
+// @Description Requires scope: admin:read
+// @Tags    Admin
+// @Produce json
+// @Success 200 {object} map[string]any
+// @Router  /admin/metrics [get]
+func (h *handlers) adminMetricsGet(c echo.Context) error {
+	metrics := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		// The command line may carry secrets in flags.
+		if kv.Key != "cmdline" {
+			metrics[kv.Key] = json.RawMessage(kv.Value.String())
+		}
+	})
+	return c.JSON(http.StatusOK, metrics)
+}
+
+// @Summary Get the server version
+// @Description The build of the server, fields are empty when the server was built without version information.
+// @Tags    Admin
+// @Produce json
+// @Success 200 {object} VersionInfo
+// @Router  /version [get]
+func (h *handlers) versionGet(c echo.Context) error {
+	return c.JSON(http.StatusOK, server.GetVersionInfo())
+}
+
+// @Summary Back up the database
+// @Description A consistent snapshot of the SQLite database, made with the SQLite online backup API.
+// @Description The server keeps serving requests while the backup is made.
+// @Description To restore, stop the server and replace <datadir>/db.sqlite with the snapshot.
+// @Description Requires scope: admin:read
+// @Tags    Admin
+// @Produce octet-stream
+// @Success 200 {file} file "SQLite database"
+// @Router  /admin/db/backup [post]
+func (h *handlers) dbBackup(c echo.Context) error {
+	backup, err := h.storage.BackupDb(c.Request().Context())
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to back up database")
+	}
+	defer func() {
+		if err := backup.Close(); err != nil {
+			CtxGetLog(c.Request().Context()).Error("Failed to close database backup", "error", err)
+		}
+	}()
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="db.sqlite"`)
+	return c.Stream(http.StatusOK, echo.MIMEOctetStream, backup)
+}
+
+// @Summary Get the TLS status of the device gateway
+// @Description The certificate the device gateway serves, and whether it has CAs to verify device certificates against,
+// @Description to help diagnose failing TLS handshakes of devices.
+// @Description Requires scope: admin:read
+// @Tags    Admin
+// @Produce json
+// @Success 200 {object} TlsStatus
+// @Failure 404 "The server was started without the device gateway"
+// @Router  /admin/tls-status [get]
+func (h *handlers) tlsStatusGet(c echo.Context) error {
+	if h.gatewayTls == nil || len(h.gatewayTls.Certificates) == 0 {
+		return c.NoContent(http.StatusNotFound)
+	}
+	cert := h.gatewayTls.Certificates[0].Leaf
+	if cert == nil {
+		var err error
+		if cert, err = x509.ParseCertificate(h.gatewayTls.Certificates[0].Certificate[0]); err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to parse the TLS certificate")
+		}
+	}
+
+	status := TlsStatus{
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		DnsNames:     cert.DNSNames,
+		IpAddresses:  make([]string, 0, len(cert.IPAddresses)),
+		NotBefore:    cert.NotBefore.Unix(),
+		NotAfter:     cert.NotAfter.Unix(),
+		HasClientCas: h.gatewayTls.ClientCAs != nil && !h.gatewayTls.ClientCAs.Equal(x509.NewCertPool()),
+	}
+	for _, ip := range cert.IPAddresses {
+		status.IpAddresses = append(status.IpAddresses, ip.String())
+	}
+	if status.DnsNames == nil {
+		status.DnsNames = []string{}
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// @Summary Stream the rollout journal of an update channel
+// @Description Rollouts not yet processed by the rollout daemon, one "tag|update|rollout" per line.
+// @Description Rollouts created since the last journal rollover are still written to a temporary part file, and are not included.
+// @Description Requires scope: admin:read
+// @Tags    Admin
+// @Produce plain
+// @Success 200 {string} string
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
+// @Router  /admin/rollouts/{prod}/journal [get]
+func (h *handlers) rolloutJournalGet(c echo.Context) error {
+	channel := c.Param("prod")
+	if !h.storage.HasUpdateChannel(channel) {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	log := CtxGetLog(c.Request().Context())
+	r := c.Response()
+	for entry, err := range h.storage.ReadRolloutJournal(channel) {
+		if err != nil {
+			if !r.Committed {
+				return EchoError(c, err, http.StatusInternalServerError, "Failed to read rollout journal")
+			}
+			log.Error("Failed to read rollout journal", "error", err)
+			break
+		}
+		if !r.Committed {
+			r.Header().Set("Content-Type", echo.MIMETextPlainCharsetUTF8)
+			r.Header().Set("Cache-Control", "no-cache")
+			r.WriteHeader(http.StatusOK)
+		}
+		line := fmt.Sprintf("%s|%s|%s\n", entry[0], entry[1], entry[2])
+		if _, err := r.Write([]byte(line)); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Error("Failed to write rollout journal to client", "error", err)
+			}
+			break
+		}
+		r.Flush()
+	}
+	if !r.Committed {
+		// An empty journal is a common state after the daemon processed all rollouts.
+		return c.NoContent(http.StatusOK)
+	}
+	return nil
+}
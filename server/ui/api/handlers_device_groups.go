@@ -0,0 +1,204 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+
+	storage "github.com/foundriesio/dg-satellite/storage/api"
+	"github.com/foundriesio/dg-satellite/storage/users"
+)
+
+type AssignByFilterReq struct {
+	Selector storage.LabelSelector `json:"selector"`
+}
+
+type AssignByFilterResp struct {
+	Uuids []string `json:"uuids"`
+}
+
+type DeviceGroupMembers = storage.DeviceGroupMembers
+
+type DeviceGroupListOpts struct {
+	CountsOnly bool `query:"counts-only"`
+	Limit      int  `query:"limit"  default:"1000"`
+	Offset     int  `query:"offset" default:"0"`
+}
+
+type DeviceSelectorOpts struct {
+	Expr   string `query:"expr"`
+	Limit  int    `query:"limit"  default:"1000"`
+	Offset int    `query:"offset" default:"0"`
+}
+
+// @Summary Preview devices matching a label selector
+// @Description Lists the devices a selector group or a group assignment with the same selector would match.
+// @Description The expression is a comma separated list of label=value pairs, all of which must match, e.g. env=prod,region=eu.
+// @Description Limits above the server's maximum, 1000 by default, are reduced to it.
+// @Description Requires scope: devices:read or devices:read-update
+// @Tags    Devices
+// @Param _ query DeviceSelectorOpts false "Selector expression and pagination options"
+// @Produce json
+// @Success 200 {array} DeviceListItem "Ordered by UUID"
+// @Header  200 {string} Link "Pagination links (first, next, last)"
+// @Router  /device-selector [get]
+func (h *handlers) deviceSelectorGet(c echo.Context) error {
+	opts := DeviceSelectorOpts{Limit: h.deviceListLimit}
+	if err := c.Bind(&opts); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, "Failed to parse selector options")
+	} else if opts.Limit <= 0 || opts.Offset < 0 {
+		err = errors.New("limit must be positive and offset must not be negative")
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	}
+	opts.Limit = min(opts.Limit, h.deviceListLimit)
+
+	selector, err := storage.ParseLabelSelector(opts.Expr)
+	if err == nil {
+		err = validateSelector(selector)
+	}
+	if err != nil {
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	}
+
+	devices, total, err := h.storage.DevicesBySelector(selector, opts.Limit, opts.Offset)
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to list devices matching the selector")
+	}
+	setPaginationLinks(c, opts.Limit, opts.Offset, total, "expr="+url.QueryEscape(opts.Expr))
+	return c.JSON(http.StatusOK, devices)
+}
+
+// @Summary List device groups with their devices
+// @Description Each group named by the group label of devices, with the UUIDs and the count of its devices.
+// @Description Selector groups list only the devices which have their group label set to the group name.
+// @Description Set counts-only to leave out the UUIDs, e.g. for groups too large to list.
+// @Description Limits above the server's maximum, 1000 by default, are reduced to it.
+// @Description Requires scope: devices:read or devices:read-update
+// @Tags    Devices
+// @Param _ query DeviceGroupListOpts false "Counts only and pagination options"
+// @Produce json
+// @Success 200 {array} DeviceGroupMembers "Ordered by group name, devices by UUID"
+// @Header  200 {string} Link "Pagination links (first, next, last)"
+// @Failure 400 "Invalid counts-only or pagination options"
+// @Router  /device-groups [get]
+func (h *handlers) deviceGroupList(c echo.Context) error {
+	opts := DeviceGroupListOpts{Limit: h.deviceListLimit}
+	if err := c.Bind(&opts); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, "Failed to parse device group list options")
+	} else if opts.Limit <= 0 || opts.Offset < 0 {
+		err = errors.New("limit must be positive and offset must not be negative")
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	}
+	opts.Limit = min(opts.Limit, h.deviceListLimit)
+
+	groups, total, err := h.storage.DeviceGroupMembers(opts.CountsOnly, opts.Limit, opts.Offset)
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to list device groups")
+	}
+	query := ""
+	if opts.CountsOnly {
+		query = "counts-only=true"
+	}
+	setPaginationLinks(c, opts.Limit, opts.Offset, total, query)
+	return c.JSON(http.StatusOK, groups)
+}
+
+// @Summary Assign all devices matching a label selector to a group
+// @Description Devices claimed by other users are skipped, unless the user is an admin.
+// @Description Requires scope: devices:read-update
+// @Tags    Devices
+// @Accept  json
+// @Produce json
+// @Param   data body AssignByFilterReq true "Label selector, all labels must match"
+// @Param   name path string true "Device group name"
+// @Success 200 {object} AssignByFilterResp
+// @Router  /device-groups/{name}/assign-by-filter [post]
+func (h *handlers) deviceGroupAssignByFilter(c echo.Context) error {
+	group := c.Param("name")
+	if err := storage.ValidateLabels(map[string]*string{"group": &group}); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	}
+	var req AssignByFilterReq
+	if err := c.Bind(&req); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, "Bad JSON body")
+	}
+	if err := validateSelector(req.Selector); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	}
+
+	user := c.Get("user").(*users.User)
+	uuids, err := h.storage.AssignDeviceGroup(group, req.Selector, claimEditor(user))
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to assign devices to group")
+	}
+	if uuids == nil {
+		uuids = []string{}
+	}
+	return c.JSON(http.StatusOK, AssignByFilterResp{Uuids: uuids})
+}
+
+// @Summary Create or replace a selector group
+// @Description Devices belong to a selector group while their labels match its selector.
+// @Description Requires scope: devices:read-update
+// @Tags    Devices
+// @Accept  json
+// @Param   data body AssignByFilterReq true "Label selector, all labels must match"
+// @Param   name path string true "Device group name"
+// @Success 200
+// @Router  /device-groups/{name}/selector [put]
+func (h *handlers) deviceGroupSelectorPut(c echo.Context) error {
+	group := c.Param("name")
+	if err := storage.ValidateLabels(map[string]*string{"group": &group}); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	}
+	var req AssignByFilterReq
+	if err := c.Bind(&req); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, "Bad JSON body")
+	}
+	if err := validateSelector(req.Selector); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	}
+
+	if err := h.storage.SaveSelectorGroup(group, req.Selector); err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to save selector group")
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// @Summary Delete a device group
+// @Description Removes the selector group of this name, and unassigns all devices assigned to the group by their group label.
+// @Description Devices claimed by other users stay in the group, unless the user is an admin.
+// @Description Requires scope: devices:read-update
+// @Tags    Devices
+// @Param   name path string true "Device group name"
+// @Success 200
+// @Failure 400 "The group label is required by the server, and devices are assigned to the group"
+// @Failure 404 "Neither a selector group nor a device assigned to the group exists"
+// @Router  /device-groups/{name} [delete]
+func (h *handlers) deviceGroupDelete(c echo.Context) error {
+	user := c.Get("user").(*users.User)
+	if found, err := h.storage.DeleteDeviceGroup(c.Param("name"), claimEditor(user)); errors.Is(err, storage.ErrRequiredLabel) {
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	} else if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to delete device group")
+	} else if !found {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func validateSelector(selector storage.LabelSelector) error {
+	if len(selector) == 0 {
+		return errors.New("a label selector must be set")
+	}
+	labels := make(map[string]*string, len(selector))
+	for k, v := range selector {
+		labels[k] = &v
+	}
+	return storage.ValidateLabels(labels)
+}
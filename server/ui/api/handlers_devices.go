@@ -4,26 +4,47 @@
 package api
 
 import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
-	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
 
+	"github.com/foundriesio/dg-satellite/clock"
 	storage "github.com/foundriesio/dg-satellite/storage/api"
+	"github.com/foundriesio/dg-satellite/storage/users"
 )
 
 type (
-	Device            = storage.Device
-	DeviceListItem    = storage.DeviceListItem
-	DeviceListOpts    = storage.DeviceListOpts
-	DeviceUpdateEvent = storage.DeviceUpdateEvent
+	Device                = storage.Device
+	DeviceEffectiveConfig = storage.DeviceEffectiveConfig
+	DesiredTarget         = storage.DesiredTarget
+	RunningTarget         = storage.RunningTarget
+	TufMetaUrls           = storage.TufMetaUrls
+	DeviceInstallResult   = storage.DeviceInstallResult
+	DeviceListItem        = storage.DeviceListItem
+	DeviceListOpts        = storage.DeviceListOpts
+	DeviceUpdateEvent     = storage.DeviceUpdateEvent
 )
 
 type AppsStatesResp struct {
 	AppsStates []storage.AppsStates `json:"apps_states"`
+	Retention  AppsStatesRetention  `json:"retention"`
+}
+
+// AppsStatesRetention tells which apps states reports of a device are kept, older reports are removed.
+type AppsStatesRetention struct {
+	MaxCount int `json:"max_count"`
+	// Maximum age of reports in seconds, zero when reports are kept regardless of their age.
+	MaxAge int64 `json:"max_age"`
 }
 
 type LabelsReq struct {
@@ -33,10 +54,18 @@ type LabelsReq struct {
 
 type LabelsPutReq map[string]*string
 
+type DeviceUpdateReq struct {
+	Update string `json:"update"`
+	// Channel defaults to the channel of the device type: prod for production devices, ci for others.
+	Channel string `json:"channel,omitempty"`
+}
+
 // @Summary List devices
+// @Description Limits above the server's maximum, 1000 by default, are reduced to it.
+// @Description Last seen times are Unix times in seconds, devices are selected when last seen within [after, before).
 // @Description Requires scope: devices:read or devices:read-update
 // @Tags    Devices
-// @Param _ query DeviceListOpts false "Sorting options"
+// @Param _ query DeviceListOpts false "Sorting and filtering options"
 // @Accept  json
 // @Produce json
 // @Success 200 {array} DeviceListItem
@@ -44,12 +73,28 @@ type LabelsPutReq map[string]*string
 // @Router  /devices [get]
 func (h *handlers) deviceList(c echo.Context) error {
 	opts := storage.DeviceListOpts{
-		OrderBy: storage.OrderByDeviceNameAsc,
-		Limit:   1000,
+		OrderBy: h.deviceOrderBy,
+		Limit:   h.deviceListLimit,
 		Offset:  0,
 	}
 	if err := c.Bind(&opts); err != nil {
 		return EchoError(c, err, http.StatusBadRequest, "Failed to parse list options")
+	} else if opts.Limit <= 0 || opts.Offset < 0 {
+		err = errors.New("limit must be positive and offset must not be negative")
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	} else if opts.LastSeenAfter < 0 || opts.LastSeenBefore < 0 {
+		err = errors.New("last-seen-after and last-seen-before must not be negative")
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	} else if opts.LastSeenBefore > 0 && opts.LastSeenAfter > opts.LastSeenBefore {
+		err = errors.New("last-seen-after must not be later than last-seen-before")
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	}
+	opts.Limit = min(opts.Limit, h.deviceListLimit)
+	if opts.OrderBy == "" {
+		opts.OrderBy = storage.DefaultDeviceOrderBy
+	}
+	if opts.Update != "" && opts.Update != storage.DeviceUpdateNone {
+		return c.String(http.StatusBadRequest, "Only update=none filter is supported")
 	}
 
 	devices, total, err := h.storage.DevicesList(opts)
@@ -62,15 +107,32 @@ func (h *handlers) deviceList(c echo.Context) error {
 }
 
 func setPaginationHeaders(c echo.Context, opts storage.DeviceListOpts, total int) {
-	if opts.Limit <= 0 {
+	query := "order-by=" + string(opts.OrderBy)
+	if opts.Update != "" {
+		query += "&update=" + opts.Update
+	}
+	if opts.LastSeenAfter > 0 {
+		query += "&last-seen-after=" + strconv.FormatInt(opts.LastSeenAfter, 10)
+	}
+	if opts.LastSeenBefore > 0 {
+		query += "&last-seen-before=" + strconv.FormatInt(opts.LastSeenBefore, 10)
+	}
+	setPaginationLinks(c, opts.Limit, opts.Offset, total, query)
+}
+
+func setPaginationLinks(c echo.Context, limit, offset, total int, query string) {
+	if limit <= 0 {
 		return
 	}
 
 	basePath := c.Request().URL.Path
-	orderBy := string(opts.OrderBy)
 
 	buildURL := func(offset int) string {
-		return fmt.Sprintf("%s?offset=%d&limit=%d&order-by=%s", basePath, offset, opts.Limit, orderBy)
+		url := fmt.Sprintf("%s?offset=%d&limit=%d", basePath, offset, limit)
+		if len(query) > 0 {
+			url += "&" + query
+		}
+		return url
 	}
 
 	var links []string
@@ -79,31 +141,50 @@ func setPaginationHeaders(c echo.Context, opts storage.DeviceListOpts, total int
 	links = append(links, fmt.Sprintf("<%s>; rel=\"first\"", buildURL(0)))
 
 	// next (only if there are more results)
-	nextOffset := opts.Offset + opts.Limit
+	nextOffset := offset + limit
 	if nextOffset < total {
 		links = append(links, fmt.Sprintf("<%s>; rel=\"next\"", buildURL(nextOffset)))
 	}
 
 	// last
 	lastOffset := 0
-	if total > opts.Limit {
-		lastOffset = ((total - 1) / opts.Limit) * opts.Limit
+	if total > limit {
+		lastOffset = ((total - 1) / limit) * limit
 	}
 	links = append(links, fmt.Sprintf("<%s>; rel=\"last\"", buildURL(lastOffset)))
 
 	c.Response().Header().Set("Link", strings.Join(links, ", "))
 }
 
+// jsonWithEtag responds with the data as JSON along with an ETag of it.
+// HEAD requests get the same headers without the body, so clients can check a resource exists or changed.
+func jsonWithEtag(c echo.Context, data any) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to encode response")
+	}
+	body = append(body, '\n')
+	h := c.Response().Header()
+	h.Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(body)))
+	if c.Request().Method == http.MethodHead {
+		h.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		return c.NoContent(http.StatusOK)
+	}
+	return c.JSONBlob(http.StatusOK, body)
+}
+
 // @Summary Get a device by its UUID
 // @Description Requires scope: devices:read or devices:read-update
 // @Tags    Devices
 // @Produce json
 // @Success 200 {object} Device
+// @Header  200 {string} ETag "Changes whenever the device does"
 // @Param   uuid path string true "Device UUID"
 // @Router  /devices/{uuid} [get]
+// @Router  /devices/{uuid} [head]
 func (h *handlers) deviceGet(c echo.Context) error {
 	return h.handleDevice(c, func(device *Device) error {
-		return c.JSON(http.StatusOK, device)
+		return jsonWithEtag(c, device)
 	})
 }
 
@@ -115,7 +196,7 @@ func (h *handlers) deviceGet(c echo.Context) error {
 // @Param   uuid path string true "Device UUID"
 // @Router  /devices/{uuid} [delete]
 func (h *handlers) deviceDelete(c echo.Context) error {
-	return h.handleDevice(c, func(device *Device) error {
+	return h.handleEditableDevice(c, func(device *Device) error {
 		if err := device.Delete(); err != nil {
 			return EchoError(c, err, http.StatusInternalServerError, "Failed to delete device")
 		}
@@ -123,6 +204,90 @@ func (h *handlers) deviceDelete(c echo.Context) error {
 	})
 }
 
+// BulkDeleteReq selects devices to delete, they must match all of the set conditions.
+type BulkDeleteReq struct {
+	// LastSeenBefore selects devices which did not check in since this Unix time, including those which never did.
+	LastSeenBefore int64                 `json:"last-seen-before"`
+	Selector       storage.LabelSelector `json:"selector"`
+	// DryRun only reports which devices would be deleted.
+	DryRun bool `json:"dry-run"`
+}
+
+type BulkDeleteResp struct {
+	Count int      `json:"count"`
+	Uuids []string `json:"uuids"`
+}
+
+// @Summary Delete all devices matching a filter
+// @Description Removes stale devices at once, e.g. those not seen for months, or those with a given label.
+// @Description At least one of last-seen-before or selector must be set.
+// @Description Devices claimed by other users are skipped, unless the caller is an admin.
+// @Description Requires scope: devices:delete
+// @Tags    Devices
+// @Accept  json
+// @Produce json
+// @Param   data body BulkDeleteReq true "Devices to delete"
+// @Success 200 {object} BulkDeleteResp
+// @Router  /devices/bulk-delete [post]
+func (h *handlers) deviceBulkDelete(c echo.Context) error {
+	var req BulkDeleteReq
+	if err := c.Bind(&req); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, "Bad JSON body")
+	}
+	if req.LastSeenBefore < 0 {
+		err := errors.New("last-seen-before must not be negative")
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	} else if len(req.Selector) > 0 {
+		if err := validateSelector(req.Selector); err != nil {
+			return EchoError(c, err, http.StatusBadRequest, err.Error())
+		}
+	} else if req.LastSeenBefore == 0 {
+		err := errors.New("either last-seen-before or a selector must be set")
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	}
+
+	filter := storage.DeviceDeleteFilter{LastSeenBefore: req.LastSeenBefore, Selector: req.Selector}
+	user := c.Get("user").(*users.User)
+	uuids, err := h.storage.DeleteDevices(filter, claimEditor(user), req.DryRun)
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to delete devices")
+	}
+	if uuids == nil {
+		uuids = []string{}
+	}
+	if !req.DryRun && len(uuids) > 0 {
+		user.LogAuditEvent(fmt.Sprintf("Deleted %d devices by filter", len(uuids)))
+	}
+	return c.JSON(http.StatusOK, BulkDeleteResp{Count: len(uuids), Uuids: uuids})
+}
+
+// @Summary Get device check-in times
+// @Description Requires scope: devices:read or devices:read-update
+// @Tags    Devices
+// @Produce json
+// @Success 200 {array} int "Unix timestamps of check-ins, oldest first"
+// @Param   uuid path string true "Device UUID"
+// @Param   hours query int false "Window of activity to return in hours (default 24, at most 7 days)"
+// @Router  /devices/{uuid}/activity [get]
+func (h *handlers) deviceActivityGet(c echo.Context) error {
+	hours := 24
+	if param := c.QueryParam("hours"); len(param) > 0 {
+		var err error
+		if hours, err = strconv.Atoi(param); err != nil || hours <= 0 || hours > 24*storage.ActivityMaxDays {
+			msg := fmt.Sprintf("hours must be a number between 1 and %d", 24*storage.ActivityMaxDays)
+			return c.String(http.StatusBadRequest, msg)
+		}
+	}
+	return h.handleDevice(c, func(device *Device) error {
+		since := clock.Now().Add(-time.Duration(hours) * time.Hour).Unix()
+		activity, err := device.Activity(since)
+		if err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to lookup device activity")
+		}
+		return c.JSON(http.StatusOK, activity)
+	})
+}
+
 // @Summary Get a list of updates for a device
 // @Description Requires scope: devices:read or devices:read-update
 // @Tags    Devices
@@ -147,25 +312,110 @@ func (h *handlers) deviceUpdatesList(c echo.Context) error {
 // @Success 200 {array} DeviceUpdateEvent
 // @Param   uuid path string true "Device UUID"
 // @Param   id path string true "Update ID"
+// @Param   order query string false "Events order: asc (oldest first, default) or desc (newest first)"
+// @Param   after query int false "Only return events the device sent after the first N ones, e.g. to poll for new events"
 // @Router  /devices/{uuid}/updates/{id} [get]
 func (h *handlers) deviceUpdatesGet(c echo.Context) error {
+	order := c.QueryParam("order")
+	if len(order) > 0 && order != "asc" && order != "desc" {
+		return c.String(http.StatusBadRequest, "order must be asc or desc")
+	}
+	after := 0
+	if val := c.QueryParam("after"); len(val) > 0 {
+		var err error
+		if after, err = strconv.Atoi(val); err != nil || after < 0 {
+			return EchoError(c, err, http.StatusBadRequest, "After must be a non-negative integer")
+		}
+	}
 	return h.handleDevice(c, func(device *Device) error {
 		updateId := c.Param("id")
-		if !storage.ValidCorrelationId(updateId) {
+		if !storage.ValidUpdateId(updateId) {
 			return c.NoContent(http.StatusNotFound)
 		}
-		events, err := device.Events(updateId)
+		// Events are stored one per line, so the first events are skipped without reading them.
+		events, err := device.EventsAfter(updateId, after)
 		if err != nil {
 			return EchoError(c, err, http.StatusInternalServerError, "Failed to lookup device update events")
 		}
-		if len(events) == 0 {
+		if len(events) == 0 && after == 0 {
 			return c.NoContent(http.StatusNotFound)
 		}
+		if order == "desc" {
+			// Devices append events to the file as they happen, so reversing the file order puts the newest first.
+			slices.Reverse(events)
+		}
 		return c.JSON(http.StatusOK, events)
 	})
 }
 
+// @Summary Export all update events of a device
+// @Description Events of all updates of the device in chronological order, one JSON object per line (NDJSON),
+// @Description e.g. for ingestion into log systems.
+// @Description Requires scope: devices:read or devices:read-update
+// @Tags    Devices
+// @Produce x-ndjson
+// @Success 200 {object} DeviceUpdateEvent "Each line"
+// @Param   uuid path string true "Device UUID"
+// @Router  /devices/{uuid}/events.ndjson [get]
+func (h *handlers) deviceEventsExport(c echo.Context) error {
+	return h.handleDevice(c, func(device *Device) error {
+		log := CtxGetLog(c.Request().Context())
+		r := c.Response()
+		r.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		enc := json.NewEncoder(r)
+		for evt, err := range device.AllEvents() {
+			if err != nil {
+				if !r.Committed {
+					return EchoError(c, err, http.StatusInternalServerError, "Failed to read device update events")
+				}
+				log.Error("Failed to read device update events", "error", err)
+				break
+			}
+			if !r.Committed {
+				r.WriteHeader(http.StatusOK)
+			}
+			// Encode appends a newline to each event.
+			if err := enc.Encode(evt); err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					log.Error("Failed to write device update events to client", "error", err)
+				}
+				break
+			}
+		}
+		if !r.Committed {
+			// A device without any update events.
+			return c.NoContent(http.StatusOK)
+		}
+		return nil
+	})
+}
+
+// @Summary Get the final result of an update reported by a device
+// @Description Requires scope: devices:read or devices:read-update
+// @Tags    Devices
+// @Produce json
+// @Success 200 {object} DeviceInstallResult
+// @Param   uuid path string true "Device UUID"
+// @Param   id path string true "Update ID"
+// @Router  /devices/{uuid}/updates/{id}/result [get]
+func (h *handlers) deviceUpdateResultGet(c echo.Context) error {
+	return h.handleDevice(c, func(device *Device) error {
+		updateId := c.Param("id")
+		if !storage.ValidCorrelationId(updateId) {
+			return c.NoContent(http.StatusNotFound)
+		}
+		res, err := device.InstallResult(updateId)
+		if err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to lookup device update result")
+		} else if res == nil {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return c.JSON(http.StatusOK, res)
+	})
+}
+
 // @Summary Get a list of Apps states reported by the device
+// @Description Only the most recent reports are kept, see the retention of the response.
 // @Description Requires scope: devices:read or devices:read-update
 // @Tags    Devices
 // @Produce json
@@ -178,7 +428,72 @@ func (h *handlers) deviceAppsStatesGet(c echo.Context) error {
 		if err != nil {
 			return EchoError(c, err, http.StatusInternalServerError, "Failed to lookup device updates")
 		}
-		return c.JSON(http.StatusOK, AppsStatesResp{AppsStates: appsStates})
+		maxCount := storage.StatesMaxCount
+		if h.gatewayLimits != nil {
+			maxCount = h.gatewayLimits.MaxAppsStates
+		}
+		return c.JSON(http.StatusOK, AppsStatesResp{
+			AppsStates: appsStates,
+			Retention: AppsStatesRetention{
+				MaxCount: maxCount,
+				MaxAge:   int64(h.appsStatesMaxAge.Seconds()),
+			},
+		})
+	})
+}
+
+// @Summary Get the aktualizr-lite configuration reported by the device
+// @Description Requires scope: devices:read or devices:read-update
+// @Tags    Devices
+// @Produce plain
+// @Success 200 {string} string "Raw aktualizr.toml content"
+// @Param   uuid path string true "Device UUID"
+// @Router  /devices/{uuid}/aktualizr.toml [get]
+func (h *handlers) deviceAktomlGet(c echo.Context) error {
+	return h.handleDevice(c, func(device *Device) error {
+		if len(device.Aktoml) == 0 {
+			return c.String(http.StatusNotFound, "Device has not reported its configuration yet")
+		}
+		return c.String(http.StatusOK, device.Aktoml)
+	})
+}
+
+// @Summary Get the effective config of the device
+// @Description What the device runs now, which target its assigned update wants it to run,
+// @Description and where the device gateway serves the TUF metadata of that update.
+// @Description Requires scope: devices:read or devices:read-update
+// @Tags    Devices
+// @Produce json
+// @Success 200 {object} DeviceEffectiveConfig
+// @Param   uuid path string true "Device UUID"
+// @Router  /devices/{uuid}/effective-config [get]
+func (h *handlers) deviceEffectiveConfigGet(c echo.Context) error {
+	return h.handleDevice(c, func(device *Device) error {
+		if cfg, err := device.EffectiveConfig(); err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to compose device effective config")
+		} else {
+			return c.JSON(http.StatusOK, cfg)
+		}
+	})
+}
+
+// @Summary Get the client certificate of the device
+// @Description Only available when the server stores device certificates.
+// @Description Requires scope: devices:read or devices:read-update
+// @Tags    Devices
+// @Produce plain
+// @Success 200 {string} string "PEM encoded certificate"
+// @Param   uuid path string true "Device UUID"
+// @Router  /devices/{uuid}/certificate [get]
+func (h *handlers) deviceCertificateGet(c echo.Context) error {
+	return h.handleDevice(c, func(device *Device) error {
+		cert, err := device.Certificate()
+		if err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to read device certificate")
+		} else if len(cert) == 0 {
+			return c.String(http.StatusNotFound, "No certificate stored for this device")
+		}
+		return c.String(http.StatusOK, cert)
 	})
 }
 
@@ -196,7 +511,12 @@ func (h *handlers) deviceKnownGroupsGet(c echo.Context) error {
 	}
 }
 
-var standardLabels = []string{"name", "group"}
+var standardLabels = storage.StandardLabels
+
+// IsStandardLabel tells if a label is one of those which all clients know, see storage.ValidateRequiredLabels.
+func IsStandardLabel(label string) bool {
+	return storage.IsStandardLabel(label)
+}
 
 // @Summary Get known device label names
 // @Description Requires scope: devices:read or devices:read-update
@@ -212,7 +532,7 @@ func (h *handlers) deviceKnownLabelsGet(c echo.Context) error {
 		labels = slices.DeleteFunc(labels, func(s string) bool {
 			return slices.Contains(standardLabels, s)
 		})
-		labels = append(standardLabels, labels...)
+		labels = slices.Concat(standardLabels, labels)
 		return c.JSON(http.StatusOK, labels)
 	}
 }
@@ -223,10 +543,11 @@ func (h *handlers) deviceKnownLabelsGet(c echo.Context) error {
 // @Accept json
 // @Param data body LabelsReq true "Labels to upsert or delete"
 // @Success 200
+// @Failure 400 "Bad labels, or a label required by the server is deleted"
 // @Param   uuid path string true "Device UUID"
 // @Router  /devices/{uuid}/labels [patch]
 func (h *handlers) deviceLabelsPatch(c echo.Context) error {
-	return h.handleDevice(c, func(device *Device) error {
+	return h.handleEditableDevice(c, func(device *Device) error {
 		var labelsReq LabelsReq
 		if err := c.Bind(&labelsReq); err != nil {
 			return EchoError(c, err, http.StatusBadRequest, "Bad JSON body")
@@ -234,7 +555,9 @@ func (h *handlers) deviceLabelsPatch(c echo.Context) error {
 		if labels, err := parseLabels(labelsReq); err != nil {
 			return EchoError(c, err, http.StatusBadRequest, err.Error())
 		} else if err = h.storage.PatchDeviceLabels(labels, []string{device.Uuid}); err != nil {
-			if storage.IsDbError(err, storage.ErrDbConstraintUnique) {
+			if errors.Is(err, storage.ErrRequiredLabel) {
+				return EchoError(c, err, http.StatusBadRequest, err.Error())
+			} else if storage.IsDbError(err, storage.ErrDbConstraintUnique) {
 				return EchoError(c, err, http.StatusConflict, "A device with the same 'name' label value already exists")
 			}
 			return EchoError(c, err, http.StatusInternalServerError, "Failed to update device labels")
@@ -249,15 +572,16 @@ func (h *handlers) deviceLabelsPatch(c echo.Context) error {
 // @Accept json
 // @Param data body LabelsPutReq true "Labels to set"
 // @Success 200
+// @Failure 400 "Bad labels, or a label required by the server is deleted"
 // @Param   uuid path string true "Device UUID"
 // @Router  /devices/{uuid}/labels [put]
 func (h *handlers) deviceLabelsPut(c echo.Context) error {
-	return h.handleDevice(c, func(device *Device) error {
+	return h.handleEditableDevice(c, func(device *Device) error {
 		var labels LabelsPutReq
 		if err := c.Bind(&labels); err != nil {
 			return EchoError(c, err, http.StatusBadRequest, "Bad JSON body")
 		}
-		if err := validateLabels(labels); err != nil {
+		if err := storage.ValidateLabels(labels); err != nil {
 			return EchoError(c, err, http.StatusBadRequest, err.Error())
 		}
 
@@ -266,9 +590,10 @@ func (h *handlers) deviceLabelsPut(c echo.Context) error {
 				labels[k] = nil
 			}
 		}
-
 		if err := h.storage.PatchDeviceLabels(labels, []string{device.Uuid}); err != nil {
-			if storage.IsDbError(err, storage.ErrDbConstraintUnique) {
+			if errors.Is(err, storage.ErrRequiredLabel) {
+				return EchoError(c, err, http.StatusBadRequest, err.Error())
+			} else if storage.IsDbError(err, storage.ErrDbConstraintUnique) {
 				return EchoError(c, err, http.StatusConflict, "A device with the same 'name' label value already exists")
 			}
 			return EchoError(c, err, http.StatusInternalServerError, "Failed to update device labels")
@@ -277,6 +602,236 @@ func (h *handlers) deviceLabelsPut(c echo.Context) error {
 	})
 }
 
+// @Summary Cancel the update of a device
+// @Description Unassigns the device from its update, and drops it from the rollouts of that update.
+// @Description Other devices of these rollouts keep their update.
+// @Description Requires scope: devices:read-update
+// @Tags    Devices
+// @Success 200
+// @Failure 409 "Device has no update assigned"
+// @Param   uuid path string true "Device UUID"
+// @Router  /devices/{uuid}/cancel-update [post]
+func (h *handlers) deviceCancelUpdate(c echo.Context) error {
+	user := c.Get("user").(*users.User)
+	return h.handleEditableDevice(c, func(device *Device) error {
+		if len(device.UpdateName) == 0 {
+			return c.String(http.StatusConflict, "Device has no update assigned")
+		}
+		if err := device.CancelUpdate(); err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to cancel device update")
+		}
+		user.LogAuditEvent(fmt.Sprintf("Cancelled update %s/%s of device %s", device.Tag, device.UpdateName, device.Uuid))
+		return c.NoContent(http.StatusOK)
+	})
+}
+
+// @Summary Assign a device to an update
+// @Description Sets the update of a single device directly, without creating a rollout.
+// @Description The update must exist for the device tag in the given channel.
+// @Description Requires scope: devices:read-update, updates:read-update
+// @Tags    Devices
+// @Accept  json
+// @Success 200
+// @Failure 400 "Update not available for the device"
+// @Failure 409 "Device is pinned"
+// @Param   uuid path string true "Device UUID"
+// @Param   data body DeviceUpdateReq true "Update to assign"
+// @Router  /devices/{uuid}/update [put]
+func (h *handlers) deviceUpdatePut(c echo.Context) error {
+	user := c.Get("user").(*users.User)
+	var req DeviceUpdateReq
+	if err := c.Bind(&req); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, "Bad JSON body")
+	} else if len(req.Update) == 0 {
+		return c.String(http.StatusBadRequest, "update must be set")
+	}
+	return h.handleEditableDevice(c, func(device *Device) error {
+		if ok, err := device.SetUpdate(req.Update, req.Channel); err != nil {
+			switch {
+			case errors.Is(err, storage.ErrUpdateNotFound):
+				return EchoError(c, err, http.StatusBadRequest, "Update does not exist for the device tag")
+			case errors.Is(err, storage.ErrUnknownUpdateChannel), errors.Is(err, storage.ErrUpdateChannelType):
+				return EchoError(c, err, http.StatusBadRequest, err.Error())
+			}
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to assign device update")
+		} else if !ok {
+			return c.String(http.StatusConflict, "Device is pinned")
+		}
+		user.LogAuditEvent(fmt.Sprintf("Assigned device %s to update %s/%s without a rollout", device.Uuid, device.Tag, req.Update))
+		return c.NoContent(http.StatusOK)
+	})
+}
+
+// @Summary Claim a device
+// @Description Makes the user the claimant of the device: only the claimant and admins may change a claimed device.
+// @Description To transfer a device, its claimant unclaims it, and a new user claims it.
+// @Description Admins may claim a device claimed by another user.
+// @Description Requires scope: devices:read-update
+// @Tags    Devices
+// @Success 200
+// @Failure 409 "Device is claimed by another user"
+// @Param   uuid path string true "Device UUID"
+// @Router  /devices/{uuid}/claim [post]
+func (h *handlers) deviceClaim(c echo.Context) error {
+	user := c.Get("user").(*users.User)
+	return h.handleDevice(c, func(device *Device) error {
+		if device.ClaimedBy == user.Username {
+			return c.NoContent(http.StatusOK)
+		} else if len(device.ClaimedBy) > 0 && !user.AllowedScopes.Has(users.ScopeAdminR) {
+			return c.String(http.StatusConflict, "Device is claimed by another user")
+		}
+		if ok, err := device.SetClaimant(user.Username); err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to claim device")
+		} else if !ok {
+			return c.String(http.StatusConflict, "Device is claimed by another user")
+		}
+		user.LogAuditEvent(fmt.Sprintf("Claimed device %s", device.Uuid))
+		return c.NoContent(http.StatusOK)
+	})
+}
+
+// @Summary Unclaim a device
+// @Description Releases a claimed device, so that any user with the required scopes may change it again.
+// @Description Requires scope: devices:read-update
+// @Tags    Devices
+// @Success 200
+// @Failure 403 "Device is claimed by another user"
+// @Failure 409 "Device claim changed in the meantime"
+// @Param   uuid path string true "Device UUID"
+// @Router  /devices/{uuid}/claim [delete]
+func (h *handlers) deviceUnclaim(c echo.Context) error {
+	user := c.Get("user").(*users.User)
+	return h.handleEditableDevice(c, func(device *Device) error {
+		if len(device.ClaimedBy) == 0 {
+			return c.NoContent(http.StatusOK)
+		}
+		if ok, err := device.SetClaimant(""); err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to unclaim device")
+		} else if !ok {
+			return c.String(http.StatusConflict, "Device claim changed, retry")
+		}
+		user.LogAuditEvent(fmt.Sprintf("Unclaimed device %s", device.Uuid))
+		return c.NoContent(http.StatusOK)
+	})
+}
+
+// @Summary Pin a device
+// @Description Freezes a device at its current update: rollouts skip pinned devices, even when they target them.
+// @Description Requires scope: devices:read-update
+// @Tags    Devices
+// @Success 200
+// @Failure 403 "Device is claimed by another user"
+// @Param   uuid path string true "Device UUID"
+// @Router  /devices/{uuid}/pin [post]
+func (h *handlers) devicePin(c echo.Context) error {
+	return h.setDevicePinned(c, true)
+}
+
+// @Summary Unpin a device
+// @Description Lets rollouts update a pinned device again.
+// @Description Requires scope: devices:read-update
+// @Tags    Devices
+// @Success 200
+// @Failure 403 "Device is claimed by another user"
+// @Param   uuid path string true "Device UUID"
+// @Router  /devices/{uuid}/pin [delete]
+func (h *handlers) deviceUnpin(c echo.Context) error {
+	return h.setDevicePinned(c, false)
+}
+
+func (h *handlers) setDevicePinned(c echo.Context, pinned bool) error {
+	user := c.Get("user").(*users.User)
+	return h.handleEditableDevice(c, func(device *Device) error {
+		if device.Pinned == pinned {
+			return c.NoContent(http.StatusOK)
+		}
+		if err := device.SetPinned(pinned); err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to update device pin")
+		}
+		if pinned {
+			user.LogAuditEvent(fmt.Sprintf("Pinned device %s", device.Uuid))
+		} else {
+			user.LogAuditEvent(fmt.Sprintf("Unpinned device %s", device.Uuid))
+		}
+		return c.NoContent(http.StatusOK)
+	})
+}
+
+// @Summary Stream changes of a device
+// @Description Server-sent events, one per change of the device record, e.g. a check-in or a label change.
+// @Description Event names are the kinds of changes: check-in, labels, group, update, claim, pin, or deleted.
+// @Description The stream ends after the device is deleted.
+// @Description Requires scope: devices:read or devices:read-update
+// @Tags    Devices
+// @Produce text/event-stream
+// @Success 200 {object} DeviceChange "Data of each event"
+// @Param   uuid path string true "Device UUID"
+// @Router  /devices/{uuid}/events [get]
+func (h *handlers) deviceEventsGet(c echo.Context) error {
+	return h.handleDevice(c, func(device *Device) error {
+		changes, cancel := h.storage.SubscribeDeviceChanges(device.Uuid, 16)
+		defer cancel()
+		keepalive := time.NewTicker(keepaliveResponseInterval)
+		defer keepalive.Stop()
+
+		ctx := c.Request().Context()
+		log := CtxGetLog(ctx)
+		r := c.Response()
+		r.Header().Set("Content-Type", "text/event-stream")
+		// Below two headers prevent proxy caching and buffering.
+		r.Header().Set("Cache-Control", "no-cache")
+		r.Header().Set("X-Accel-Buffering", "no")
+		r.WriteHeader(http.StatusOK)
+		r.Flush()
+
+		for deleted := false; !deleted; {
+			var msg string
+			select {
+			case <-ctx.Done():
+				return nil
+			case change := <-changes:
+				data, err := json.Marshal(change)
+				if err != nil {
+					log.Error("Failed to marshal device change", "error", err)
+					return nil
+				}
+				msg = fmt.Sprintf("event: %s\ndata: %s\n\n", change.Kind, data)
+				deleted = change.Kind == storage.DeviceChangeDeleted
+			case <-keepalive.C:
+				msg = keepaliveResponseText
+			}
+			if _, err := r.Write([]byte(msg)); err != nil {
+				// Client disconnected - only log unexpected errors
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					log.Error("Failed to write device changes to client", "error", err)
+				}
+				return nil
+			}
+			r.Flush()
+		}
+		return nil
+	})
+}
+
+// @Summary Reset the key of a device
+// @Description Forgets the public key of a device, e.g. when it was compromised.
+// @Description The device gateway then enrolls the key of the next request from a device with this UUID.
+// @Description Requires scopes: devices:read-update and admin:read
+// @Tags    Devices
+// @Success 200
+// @Param   uuid path string true "Device UUID"
+// @Router  /devices/{uuid}/reset-key [post]
+func (h *handlers) deviceResetKey(c echo.Context) error {
+	user := c.Get("user").(*users.User)
+	return h.handleEditableDevice(c, func(device *Device) error {
+		if err := device.ResetKey(); err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to reset device key")
+		}
+		user.LogAuditEvent(fmt.Sprintf("Reset the key of device %s", device.Uuid))
+		return c.NoContent(http.StatusOK)
+	})
+}
+
 func (h *handlers) handleDevice(c echo.Context, next func(*Device) error) error {
 	uuid := c.Param("uuid")
 	if device, err := h.storage.DeviceGet(uuid); err != nil {
@@ -288,20 +843,25 @@ func (h *handlers) handleDevice(c echo.Context, next func(*Device) error) error
 	}
 }
 
-const (
-	// Together with a 2048 limit on total labels JSONB size,
-	// these constraints allow at least 24 labels per device (realistic limit is around 60-70).
-	maxLabelName  = 20
-	maxLabelValue = 60
-	// Label names are lowercase only; label values are case-sensitive.
-	validLabelNameRegex  = `^[a-z0-9_\-\.]+$`
-	validLabelValueRegex = `^[a-zA-Z0-9_\-\.]+$`
-)
+// handleEditableDevice is handleDevice for changes of a device: claimed devices may only be changed by their claimant or admins.
+func (h *handlers) handleEditableDevice(c echo.Context, next func(*Device) error) error {
+	user := c.Get("user").(*users.User)
+	return h.handleDevice(c, func(device *Device) error {
+		if len(device.ClaimedBy) > 0 && device.ClaimedBy != user.Username && !user.AllowedScopes.Has(users.ScopeAdminR) {
+			return c.String(http.StatusForbidden, "Device is claimed by another user")
+		}
+		return next(device)
+	})
+}
 
-var (
-	validateLabelName  = regexp.MustCompile(validLabelNameRegex).MatchString
-	validateLabelValue = regexp.MustCompile(validLabelValueRegex).MatchString
-)
+// claimEditor returns the user whose claims restrict changes of many devices at once, see handleEditableDevice.
+// It is empty for admins, who may change devices claimed by anyone.
+func claimEditor(user *users.User) string {
+	if user.AllowedScopes.Has(users.ScopeAdminR) {
+		return ""
+	}
+	return user.Username
+}
 
 func parseLabels(req LabelsReq) (map[string]*string, error) {
 	if len(req.Upserts) == 0 && len(req.Deletes) == 0 {
@@ -317,24 +877,8 @@ func parseLabels(req LabelsReq) (map[string]*string, error) {
 		}
 		labels[k] = nil
 	}
-	if err := validateLabels(labels); err != nil {
+	if err := storage.ValidateLabels(labels); err != nil {
 		return nil, err
 	}
 	return labels, nil
 }
-
-func validateLabels(labels map[string]*string) error {
-	for k, v := range labels {
-		switch {
-		case len(k) > maxLabelName:
-			return fmt.Errorf("label %s exceeds maximum label name limit %d", k, maxLabelName)
-		case v != nil && len(*v) > maxLabelValue:
-			return fmt.Errorf("label %s exceeds maximum label value limit %d", k, maxLabelValue)
-		case !validateLabelName(k):
-			return fmt.Errorf("label %s name must match a given regexp: %s", k, validLabelNameRegex)
-		case v != nil && !validateLabelValue(*v):
-			return fmt.Errorf("label %s value must match a given regexp: %s", k, validLabelValueRegex)
-		}
-	}
-	return nil
-}
@@ -0,0 +1,29 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	storage "github.com/foundriesio/dg-satellite/storage/api"
+)
+
+type TagDevicesCount = storage.TagDevicesCount
+
+// @Summary Count devices per tag
+// @Description Production and CI devices are counted separately, as they are served by different update channels.
+// @Description Requires scope: devices:read
+// @Tags    Reports
+// @Produce json
+// @Success 200 {array} TagDevicesCount
+// @Router  /reports/tags [get]
+func (h handlers) reportTags(c echo.Context) error {
+	counts, err := h.storage.DeviceCountsByTag()
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to count devices")
+	}
+	return c.JSON(http.StatusOK, counts)
+}
@@ -9,35 +9,60 @@ import (
 	"fmt"
 	"io"
 	"iter"
+	"maps"
 	"net"
 	"net/http"
 	"os"
 	"regexp"
 	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 
 	storage "github.com/foundriesio/dg-satellite/storage/api"
+	"github.com/foundriesio/dg-satellite/storage/users"
 )
 
-type Rollout = storage.Rollout
+type (
+	Rollout                = storage.Rollout
+	RolloutListItem        = storage.RolloutListItem
+	RolloutProgress        = storage.RolloutProgress
+	RolloutTargets         = storage.RolloutTargets
+	RolloutTargetExclusion = storage.RolloutTargetExclusion
+)
+
+// RolloutAudit tells how the devices which a rollout moves to its update are recorded in the audit log of the user.
+type RolloutAudit string
+
+const (
+	// RolloutAuditSummary records a single entry per rollout, counting the moved devices by their previous update.
+	RolloutAuditSummary RolloutAudit = "summary"
+	// RolloutAuditDevices records an entry for each moved device.
+	RolloutAuditDevices RolloutAudit = "devices"
+	// RolloutAuditNone does not record moved devices.
+	RolloutAuditNone RolloutAudit = "none"
+)
+
+func (a RolloutAudit) Valid() bool {
+	return a == RolloutAuditSummary || a == RolloutAuditDevices || a == RolloutAuditNone
+}
 
 // @Summary List updates
 // @Description Requires scope: updates:read or updates:read-update
 // @Tags    Updates
 // @Produce json
 // @Success 200 {object} map[string][]string
-// @Param   prod path bool true "Whether the update is for production devices"
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
 // @Param   tag path string true "Update tag"
 // @Router  /updates/{prod}/{tag} [get]
 func (h *handlers) updateList(c echo.Context) error {
 	ctx := c.Request().Context()
-	isProd := CtxGetIsProd(ctx)
+	channel := CtxGetChannel(ctx)
 	tag := c.Param("tag")
 
-	if updates, err := h.storage.ListUpdates(tag, isProd); err != nil {
+	if updates, err := h.storage.ListUpdates(tag, channel); err != nil {
 		return EchoError(c, err, http.StatusInternalServerError, "Failed to look up updates")
 	} else {
 		if updates == nil {
@@ -52,43 +77,102 @@ func (h *handlers) updateList(c echo.Context) error {
 // @Tags    Updates
 // @Produce text/plain
 // @Success 200
-// @Param   prod path bool true "Whether the update is for production devices"
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
 // @Param   tag path string true "Update tag"
 // @Param   update path string true "Update name"
+// @Param   tail query int false "Only replay the last N log lines before streaming new ones"
+// @Param   since query string false "Only replay log lines from the first one with a device time after this RFC3339 timestamp"
 // @Router  /updates/{prod}/{tag}/{update}/tail [get]
 func (h *handlers) updateTail(c echo.Context) error {
 	ctx := c.Request().Context()
-	isProd := CtxGetIsProd(ctx)
+	channel := CtxGetChannel(ctx)
 	tag := c.Param("tag")
 	updateName := c.Param("update")
+	first, err := h.storage.RolloutsLogFirstLine(tag, updateName, channel)
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to read rollout logs")
+	}
+	lastId, err := h.parseResumeId(c, tag, updateName, channel, first, nil)
+	if err != nil {
+		return err
+	}
 	// Read file infinitely until client disconnects (writes to ctx.Done() channel).
-	reader := h.storage.TailRolloutsLog(tag, updateName, isProd, ctx.Done())
-	return streamUpdateLogs(c, reader)
+	// The log is indexed by lines, so that the lines a client has already seen are skipped without reading them.
+	skip := max(lastId, first)
+	reader := h.storage.TailRolloutsLogFrom(tag, updateName, channel, skip, ctx.Done())
+	return streamUpdateLogs(c, reader, skip, lastId, nil)
+}
+
+type RolloutListOpts struct {
+	Limit  int `query:"limit"`
+	Offset int `query:"offset"`
 }
 
 // @Summary List update rollouts
+// @Description Rollouts are ordered by their modification time, oldest first.
 // @Description Requires scope: updates:read or updates:read-update
 // @Tags    Updates
+// @Param _ query RolloutListOpts false "Pagination options, only supported along with include"
 // @Produce json
 // @Success 200 {array} string
-// @Param   prod path bool true "Whether the update is for production devices"
+// @Success 200 {array} RolloutListItem "When include=device-count or include=progress is set"
+// @Header  200 {string} Link "Pagination links (first, next, last), when a limit is set along with include"
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
 // @Param   tag path string true "Update tag"
 // @Param   update path string true "Update name"
+// @Param   include query string false "Set to device-count to return rollout objects with commit status, device counts, and modification times, or to progress to also return counts of devices by their update status"
 // @Router  /updates/{prod}/{tag}/{update}/rollouts [get]
 func (h *handlers) rolloutList(c echo.Context) error {
 	ctx := c.Request().Context()
-	isProd := CtxGetIsProd(ctx)
+	channel := CtxGetChannel(ctx)
 	tag := c.Param("tag")
 	updateName := c.Param("update")
 
-	if rollouts, err := h.storage.ListRollouts(tag, updateName, isProd); err != nil {
+	var opts RolloutListOpts
+	if err := c.Bind(&opts); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, "Failed to parse list options")
+	} else if opts.Limit < 0 || opts.Offset < 0 {
+		err = errors.New("limit and offset must not be negative")
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	}
+
+	var rollouts []RolloutListItem
+	var err error
+	switch include := c.QueryParam("include"); include {
+	case "":
+		if opts.Limit > 0 || opts.Offset > 0 {
+			return c.String(http.StatusBadRequest, "Pagination requires include=device-count or include=progress")
+		}
+		if names, err := h.storage.ListRollouts(tag, updateName, channel); err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to look up update rollouts")
+		} else {
+			if names == nil {
+				names = []string{}
+			}
+			return c.JSON(http.StatusOK, names)
+		}
+	case "device-count":
+		rollouts, err = h.storage.ListRolloutsDetails(tag, updateName, channel)
+	case "progress":
+		rollouts, err = h.storage.ListRolloutsProgress(tag, updateName, channel)
+	default:
+		return c.String(http.StatusBadRequest, "Unsupported include value: "+include)
+	}
+	if err != nil {
 		return EchoError(c, err, http.StatusInternalServerError, "Failed to look up update rollouts")
-	} else {
-		if rollouts == nil {
-			rollouts = []string{}
+	}
+
+	if opts.Limit > 0 || opts.Offset > 0 {
+		total := len(rollouts)
+		start := min(opts.Offset, total)
+		end := total
+		if opts.Limit > 0 {
+			end = min(start+opts.Limit, total)
 		}
-		return c.JSON(http.StatusOK, rollouts)
+		setPaginationLinks(c, opts.Limit, opts.Offset, total, "include="+c.QueryParam("include"))
+		rollouts = rollouts[start:end]
 	}
+	return c.JSON(http.StatusOK, rollouts)
 }
 
 // @Summary Get update rollout
@@ -96,26 +180,60 @@ func (h *handlers) rolloutList(c echo.Context) error {
 // @Tags    Updates
 // @Produce json
 // @Success 200 {object} Rollout
-// @Param   prod path bool true "Whether the update is for production devices"
+// @Header  200 {string} ETag "Changes whenever the rollout does, e.g. when it is committed"
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
 // @Param   tag path string true "Update tag"
 // @Param   update path string true "Update name"
 // @Param   rollout path string true "Rollout name"
 // @Router  /updates/{prod}/{tag}/{update}/rollouts/{rollout} [get]
+// @Router  /updates/{prod}/{tag}/{update}/rollouts/{rollout} [head]
 func (h *handlers) rolloutGet(c echo.Context) error {
 	ctx := c.Request().Context()
-	isProd := CtxGetIsProd(ctx)
+	channel := CtxGetChannel(ctx)
 	tag := c.Param("tag")
 	updateName := c.Param("update")
 	rolloutName := c.Param("rollout")
 
-	if rollout, err := h.storage.GetRollout(tag, updateName, rolloutName, isProd); err != nil {
+	if rollout, err := h.storage.GetRollout(tag, updateName, rolloutName, channel); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return EchoError(c, err, http.StatusNotFound, "Not found rollout")
 		} else {
 			return EchoError(c, err, http.StatusInternalServerError, "Failed to look up update rollout")
 		}
 	} else {
-		return c.JSON(http.StatusOK, rollout)
+		return jsonWithEtag(c, rollout)
+	}
+}
+
+// @Summary Get devices targeted by update rollout
+// @Description Shows how requested UUIDs and groups of a rollout resolve to devices.
+// @Description Requested and group devices are only effective when they exist, are not deleted,
+// @Description and match the rollout tag and update channel; excluded devices have a reason:
+// @Description "nonexistent", "deleted", "wrong-tag", or "wrong-device-kind" (prod vs CI).
+// @Description Requires scope: updates:read or updates:read-update
+// @Tags    Updates
+// @Produce json
+// @Success 200 {object} RolloutTargets
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
+// @Param   tag path string true "Update tag"
+// @Param   update path string true "Update name"
+// @Param   rollout path string true "Rollout name"
+// @Router  /updates/{prod}/{tag}/{update}/rollouts/{rollout}/targets [get]
+func (h *handlers) rolloutTargetsGet(c echo.Context) error {
+	ctx := c.Request().Context()
+	channel := CtxGetChannel(ctx)
+	tag := c.Param("tag")
+	updateName := c.Param("update")
+	rolloutName := c.Param("rollout")
+
+	if targets, err := h.storage.GetRolloutTargets(tag, updateName, rolloutName, channel); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return EchoError(c, err, http.StatusNotFound, "Not found rollout")
+		} else {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to resolve update rollout targets")
+		}
+	} else {
+		return c.JSON(http.StatusOK, targets)
 	}
 }
 
@@ -126,14 +244,16 @@ func (h *handlers) rolloutGet(c echo.Context) error {
 // @Param data body Rollout true "Rollout data"
 // @Produce json
 // @Success 202
-// @Param   prod path bool true "Whether the update is for production devices"
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
 // @Param   tag path string true "Update tag"
 // @Param   update path string true "Update name"
 // @Param   rollout path string true "Rollout name"
+// @Param   force query bool false "Skip checking that all uuids exist and belong to the update tag"
+// @Failure 409 "A rollout with this name exists, or the update has the maximum number of rollouts"
 // @Router  /updates/{prod}/{tag}/{update}/rollouts/{rollout} [put]
 func (h *handlers) rolloutPut(c echo.Context) error {
 	ctx := c.Request().Context()
-	isProd := CtxGetIsProd(ctx)
+	channel := CtxGetChannel(ctx)
 	tag := c.Param("tag")
 	updateName := c.Param("update")
 	rolloutName := c.Param("rollout")
@@ -150,33 +270,132 @@ func (h *handlers) rolloutPut(c echo.Context) error {
 	if len(rollout.Effect) > 0 {
 		return c.String(http.StatusBadRequest, "Effective uuids are readonly")
 	}
+	if rollout.Commit || rollout.PendingApproval {
+		return c.String(http.StatusBadRequest, "Rollout state is readonly")
+	}
+	if len(rollout.Editor) > 0 {
+		return c.String(http.StatusBadRequest, "Rollout editor is readonly")
+	}
+	// Devices claimed by other users are skipped, also when the rollout is committed later, e.g. after an approval.
+	rollout.Editor = claimEditor(c.Get("user").(*users.User))
 
 	// Check if update with this name exists
-	if updates, err := h.storage.ListUpdates(tag, isProd); err != nil {
+	if updates, err := h.storage.ListUpdates(tag, channel); err != nil {
 		return EchoError(c, err, http.StatusInternalServerError, "Failed to check if update exists")
 	} else if tagUpdates, ok := updates[tag]; !ok || !slices.Contains(tagUpdates, updateName) {
 		return c.String(http.StatusNotFound, "Update with this name does not exist")
 	}
 
-	// Check if rollout with this name already exists
-	if _, err = h.storage.GetRollout(tag, updateName, rolloutName, isProd); err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return EchoError(c, err, http.StatusInternalServerError, "Failed to check if rollout exists")
+	if len(rollout.Uuids) > 0 && c.QueryParam("force") != "true" {
+		if invalid, err := h.storage.FindInvalidUuids(tag, channel, rollout.Uuids); err != nil {
+			return EchoError(c, err, http.StatusInternalServerError, "Failed to validate rollout uuids")
+		} else if len(invalid) > 0 {
+			msg := "Devices do not exist or do not match the update tag: " + strings.Join(invalid, ", ")
+			return c.String(http.StatusBadRequest, msg)
 		}
-	} else {
-		return c.String(http.StatusConflict, "Rollout with this name already exists")
 	}
 
-	if err = h.storage.CreateRollout(tag, updateName, rolloutName, isProd, rollout); err != nil {
+	// The rollout is not journaled while pending approval, so the background daemon does not commit it before.
+	rollout.PendingApproval = h.rolloutApproval
+	// The rollouts cap is checked along with the existing rollout names when the rollout is added.
+	if err = h.storage.AddRollout(tag, updateName, rolloutName, channel, rollout, h.rolloutsMax); err != nil {
+		if errors.Is(err, storage.ErrRolloutExists) {
+			return c.String(http.StatusConflict, "Rollout with this name already exists")
+		} else if errors.Is(err, storage.ErrRolloutsLimit) {
+			msg := fmt.Sprintf("Update already has the maximum number of rollouts: %d", h.rolloutsMax)
+			return c.String(http.StatusConflict, msg)
+		}
 		return EchoError(c, err, http.StatusInternalServerError, "Failed to save rollout to disk")
 	}
+	if !rollout.PendingApproval {
+		h.commitRollout(c, tag, updateName, rolloutName, channel, rollout)
+	}
+	return c.NoContent(http.StatusAccepted)
+}
+
+// @Summary Approve update rollout
+// @Description Commits a rollout created while the server requires rollout approvals.
+// @Description Requires scope: updates:read-update
+// @Tags    Updates
+// @Success 202
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
+// @Param   tag path string true "Update tag"
+// @Param   update path string true "Update name"
+// @Param   rollout path string true "Rollout name"
+// @Router  /updates/{prod}/{tag}/{update}/rollouts/{rollout}/approve [post]
+func (h *handlers) rolloutApprove(c echo.Context) error {
+	ctx := c.Request().Context()
+	channel := CtxGetChannel(ctx)
+	tag := c.Param("tag")
+	updateName := c.Param("update")
+	rolloutName := c.Param("rollout")
+
+	rollout, err := h.storage.GetRollout(tag, updateName, rolloutName, channel)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return EchoError(c, err, http.StatusNotFound, "Not found rollout")
+		}
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to look up update rollout")
+	} else if !rollout.PendingApproval {
+		return c.String(http.StatusConflict, "Rollout is not pending approval")
+	}
+	rollout.PendingApproval = false
+	if err := h.storage.CreateRollout(tag, updateName, rolloutName, channel, rollout); err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to save rollout to disk")
+	}
+	h.commitRollout(c, tag, updateName, rolloutName, channel, rollout)
+	return c.NoContent(http.StatusAccepted)
+}
+
+// commitRollout commits a created rollout in the background, the rollout daemon retries it if that fails.
+func (h *handlers) commitRollout(c echo.Context, tag, updateName, rolloutName, channel string, rollout Rollout) {
+	ctx := c.Request().Context()
+	user := c.Get("user").(*users.User)
 	go func() {
-		if err := h.storage.CommitRollout(tag, updateName, rolloutName, isProd, rollout); err != nil {
+		if h.rolloutAudit == RolloutAuditNone {
+			if err := h.storage.CommitRollout(tag, updateName, rolloutName, channel, rollout); err != nil {
+				// Background daemon should correct any database inconsistency, so we still return success here.
+				CtxGetLog(ctx).Error("Failed to update devices for rollout", "error", err)
+			}
+			return
+		}
+		if changes, err := h.storage.CommitRolloutChanges(tag, updateName, rolloutName, channel, rollout); err != nil {
 			// Background daemon should correct any database inconsistency, so we still return success here.
+			// Devices it updates are not audited, as it is unknown which user created the rollout.
 			CtxGetLog(ctx).Error("Failed to update devices for rollout", "error", err)
+		} else if len(changes) > 0 {
+			user.LogAuditEvents(h.rolloutAuditEvents(tag, updateName, rolloutName, changes))
 		}
 	}()
-	return c.NoContent(http.StatusAccepted)
+}
+
+func (h *handlers) rolloutAuditEvents(tag, updateName, rolloutName string, changes []storage.DeviceUpdateChange) []string {
+	prefix := fmt.Sprintf("Rollout %s/%s/%s", tag, updateName, rolloutName)
+	if h.rolloutAudit == RolloutAuditDevices {
+		events := make([]string, 0, len(changes))
+		for _, change := range changes {
+			from := "no update"
+			if len(change.FromUpdate) > 0 {
+				from = "update " + change.FromUpdate
+			}
+			events = append(events, fmt.Sprintf("%s moved device %s from %s", prefix, change.Uuid, from))
+		}
+		return events
+	}
+
+	counts := make(map[string]int)
+	for _, change := range changes {
+		counts[change.FromUpdate]++
+	}
+	froms := make([]string, 0, len(counts))
+	for _, from := range slices.Sorted(maps.Keys(counts)) {
+		if len(from) == 0 {
+			froms = append(froms, fmt.Sprintf("%d from no update", counts[from]))
+		} else {
+			froms = append(froms, fmt.Sprintf("%d from update %s", counts[from], from))
+		}
+	}
+	return []string{fmt.Sprintf("%s moved %d devices: %s", prefix, len(changes), strings.Join(froms, ", "))}
 }
 
 // @Summary Tail rollout logs
@@ -184,18 +403,20 @@ func (h *handlers) rolloutPut(c echo.Context) error {
 // @Tags    Updates
 // @Produce text/plain
 // @Success 200
-// @Param   prod path bool true "Whether the update is for production devices"
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
 // @Param   tag path string true "Update tag"
 // @Param   update path string true "Update name"
 // @Param   rollout path string true "Rollout name"
+// @Param   tail query int false "Only replay the last N log lines before streaming new ones"
+// @Param   since query string false "Only replay log lines from the first one with a device time after this RFC3339 timestamp"
 // @Router  /updates/{prod}/{tag}/{update}/rollouts/{rollout}/tail [get]
 func (h *handlers) rolloutTail(c echo.Context) error {
 	ctx := c.Request().Context()
-	isProd := CtxGetIsProd(ctx)
+	channel := CtxGetChannel(ctx)
 	tag := c.Param("tag")
 	updateName := c.Param("update")
 	rolloutName := c.Param("rollout")
-	if rollout, err := h.storage.GetRollout(tag, updateName, rolloutName, isProd); err != nil {
+	if rollout, err := h.storage.GetRollout(tag, updateName, rolloutName, channel); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return EchoError(c, err, http.StatusNotFound, "Not found rollout")
 		} else {
@@ -206,21 +427,29 @@ func (h *handlers) rolloutTail(c echo.Context) error {
 		reader := func(yield func(string, error) bool) {
 			yield("", errors.New("Rollout was not yet committed"))
 		}
-		return streamUpdateLogs(c, reader)
+		return streamUpdateLogs(c, reader, 0, parseLastEventId(c), nil)
+	} else if first, err := h.storage.RolloutsLogFirstLine(tag, updateName, channel); err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to read rollout logs")
 	} else {
+		// Event IDs are numbers of lines in the whole update log, so that the reader seeks past the seen ones.
+		filter := rolloutLogFilter(rollout.Effect)
+		lastId, err := h.parseResumeId(c, tag, updateName, channel, first, filter)
+		if err != nil {
+			return err
+		}
 		// Read file infinitely until client disconnects (writes to ctx.Done() channel).
-		reader := h.storage.TailRolloutsLog(tag, updateName, isProd, ctx.Done())
-		reader = filterUpdateLogs(rollout.Effect, reader)
-		return streamUpdateLogs(c, reader)
+		skip := max(lastId, first)
+		reader := h.storage.TailRolloutsLogFrom(tag, updateName, channel, skip, ctx.Done())
+		return streamUpdateLogs(c, reader, skip, lastId, filter)
 	}
 }
 
-func validateUpdateParams(next echo.HandlerFunc) echo.HandlerFunc {
+func (h *handlers) validateUpdateParams(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		req := c.Request()
 		ctx := req.Context()
-		var isProd bool
-		if !parseProdParam(c.Param("prod"), &isProd) {
+		channel := c.Param("prod")
+		if !h.storage.HasUpdateChannel(channel) {
 			return c.NoContent(http.StatusNotFound)
 		} else if tag := c.Param("tag"); len(tag) > 0 && !validateTag(tag) {
 			return echo.NewHTTPError(http.StatusNotFound, "Tag must match a given regexp: "+validTagRegex)
@@ -229,7 +458,7 @@ func validateUpdateParams(next echo.HandlerFunc) echo.HandlerFunc {
 		} else if rollout := c.Param("rollout"); len(rollout) > 0 && !validateRollout(rollout) {
 			return echo.NewHTTPError(http.StatusNotFound, "Rollout name must match a given regexp: "+validRolloutRegex)
 		}
-		ctx = CtxWithIsProd(ctx, isProd)
+		ctx = CtxWithChannel(ctx, channel)
 		c.SetRequest(req.WithContext(ctx))
 		return next(c)
 	}
@@ -247,19 +476,6 @@ var (
 	validateRollout = regexp.MustCompile(validRolloutRegex).MatchString
 )
 
-func parseProdParam(param string, isProd *bool) (ok bool) {
-	ok = true
-	switch param {
-	case "prod":
-		*isProd = true
-	case "ci":
-		*isProd = false
-	default:
-		ok = false
-	}
-	return
-}
-
 func parseLastEventId(c echo.Context) int {
 	r := c.Request()
 	val := r.Header.Get("Last-Event-ID")
@@ -273,9 +489,100 @@ func parseLastEventId(c echo.Context) int {
 	}
 }
 
-func streamUpdateLogs(c echo.Context, reader iter.Seq2[string, error]) error {
-	log := CtxGetLog(c.Request().Context())
+// parseResumeId returns the ID of the last event a client has already seen in the rollouts log of an update.
+// A "tail=N" query parameter moves it forward so that at most N history lines are replayed.
+// A "since=<RFC3339>" query parameter moves it forward to just before the first history line with a later device time,
+// lines with a device time which cannot be parsed are skipped along with the earlier ones.
+// History starts at a given line of the log, and only lines passing a filter are replayed, if it is not nil.
+// Lines already seen are skipped with the log index for a tail, and so are all lines for a tail without a filter.
+func (h *handlers) parseResumeId(c echo.Context, tag, updateName, channel string, first int, filter func(string) bool) (int, error) {
 	lastId := parseLastEventId(c)
+	tailVal, sinceVal := c.QueryParam("tail"), c.QueryParam("since")
+	if len(tailVal) == 0 && len(sinceVal) == 0 {
+		return lastId, nil
+	}
+	tail := -1
+	if len(tailVal) > 0 {
+		var err error
+		if tail, err = strconv.Atoi(tailVal); err != nil || tail < 0 {
+			return 0, EchoError(c, err, http.StatusBadRequest, "Tail must be a non-negative integer")
+		}
+	}
+	var since *time.Time
+	if len(sinceVal) > 0 {
+		if t, err := time.Parse(time.RFC3339, sinceVal); err != nil {
+			return 0, EchoError(c, err, http.StatusBadRequest, "Since must be an RFC3339 timestamp")
+		} else {
+			since = &t
+		}
+	}
+
+	if since != nil {
+		// The ID of an event is the number of log lines up to and including its line.
+		// When no line is after the timestamp yet, only new ones are streamed.
+		sinceId := first
+		for line, err := range h.storage.TailRolloutsLogFrom(tag, updateName, channel, first, nil) {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					break
+				}
+				return 0, EchoError(c, err, http.StatusInternalServerError, "Failed to read rollout logs")
+			}
+			if (filter == nil || filter(line)) && isLogAfter(line, *since) {
+				break
+			}
+			sinceId += 1
+		}
+		lastId = max(lastId, sinceId)
+	}
+	if tail == 0 || (tail > 0 && filter == nil) {
+		// Every line is replayed, so the tail starts N lines before the end of the log.
+		total, err := h.storage.RolloutsLogLines(tag, updateName, channel)
+		if err != nil {
+			return 0, EchoError(c, err, http.StatusInternalServerError, "Failed to read rollout logs")
+		}
+		lastId = max(lastId, total-tail)
+	} else if tail > 0 {
+		// Lines already seen are not replayed, so that only those after them make the tail.
+		total := max(lastId, first)
+		var tailIds []int // IDs before the last tail lines passing the filter
+		for line, err := range h.storage.TailRolloutsLogFrom(tag, updateName, channel, total, nil) {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					break
+				}
+				return 0, EchoError(c, err, http.StatusInternalServerError, "Failed to read rollout logs")
+			}
+			total += 1
+			if filter(line) {
+				if tailIds = append(tailIds, total-1); len(tailIds) > tail {
+					tailIds = tailIds[1:]
+				}
+			}
+		}
+		if len(tailIds) == tail {
+			lastId = max(lastId, tailIds[0])
+		}
+	}
+	return lastId, nil
+}
+
+// isLogAfter tells if the device time of a rollouts log line is after a given time.
+func isLogAfter(line string, since time.Time) bool {
+	var status storage.DeviceStatus
+	if err := json.Unmarshal([]byte(line), &status); err != nil {
+		return false
+	} else if t, err := time.Parse(time.RFC3339, status.DeviceTime); err != nil {
+		return false
+	} else {
+		return t.After(since)
+	}
+}
+
+// streamUpdateLogs streams lines of a reader which already skipped a given number of lines,
+// lines with event IDs up to lastId are not sent, nor lines not passing a filter, if it is not nil.
+func streamUpdateLogs(c echo.Context, reader iter.Seq2[string, error], skipped, lastId int, filter func(string) bool) error {
+	log := CtxGetLog(c.Request().Context())
 	r := c.Response()
 	r.Header().Set("Content-Type", "text/event-stream")
 	// Below two headers prevent proxy caching and buffering.
@@ -283,11 +590,11 @@ func streamUpdateLogs(c echo.Context, reader iter.Seq2[string, error]) error {
 	r.Header().Set("X-Accel-Buffering", "no")
 
 	eventStreamReader := func(yield func(string, error) bool) {
-		index := 0
+		index := skipped
 		for line, err := range reader {
 			if err != nil {
 				// Preserve the same event ID as the last success, so that client resumes at the correct line.
-				// If there was no success yet - index is zero, meaning restart from the beginning.
+				// If there was no success yet - index is the count of skipped lines, meaning restart from where it started.
 				msg := fmt.Sprintf("event: error\nid: %d\nretry: 1000\n", index)
 				if errors.Is(err, os.ErrNotExist) {
 					msg += "data: No rollout logs for this update yet.\n\n"
@@ -298,7 +605,7 @@ func streamUpdateLogs(c echo.Context, reader iter.Seq2[string, error]) error {
 				_ = yield(msg, nil)
 				break
 			}
-			if index += 1; index <= lastId {
+			if index += 1; index <= lastId || (filter != nil && !filter(line)) {
 				continue
 			}
 			line = fmt.Sprintf("event: log\nid: %d\ndata: %s\n\n", index, line)
@@ -322,21 +629,14 @@ func streamUpdateLogs(c echo.Context, reader iter.Seq2[string, error]) error {
 	return nil
 }
 
-func filterUpdateLogs(uuids []string, reader iter.Seq2[string, error]) iter.Seq2[string, error] {
-	return func(yield func(string, error) bool) {
-		for line, err := range reader {
-			if err == nil {
-				var status storage.DeviceStatus
-				if err = json.Unmarshal([]byte(line), &status); err == nil {
-					if !slices.Contains(uuids, status.Uuid) {
-						continue
-					}
-				}
-			}
-			if !yield(line, err) {
-				break
-			}
+// rolloutLogFilter passes rollouts log lines of given devices, and lines which are not a device status.
+func rolloutLogFilter(uuids []string) func(string) bool {
+	return func(line string) bool {
+		var status storage.DeviceStatus
+		if err := json.Unmarshal([]byte(line), &status); err != nil {
+			return true
 		}
+		return slices.Contains(uuids, status.Uuid)
 	}
 }
 
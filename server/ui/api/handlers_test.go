@@ -6,14 +6,31 @@ package api
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -22,6 +39,8 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/foundriesio/dg-satellite/auth"
+	"github.com/foundriesio/dg-satellite/clock"
+	"github.com/foundriesio/dg-satellite/cmd"
 	"github.com/foundriesio/dg-satellite/context"
 	"github.com/foundriesio/dg-satellite/server"
 	"github.com/foundriesio/dg-satellite/server/ui/daemons"
@@ -56,13 +75,14 @@ func generateUpdateEvents(corId, pack string, num int) []storage.DeviceUpdateEve
 }
 
 type testClient struct {
-	t   *testing.T
-	ctx Context
-	fs  *apiStorage.FsHandle
-	api *apiStorage.Storage
-	gw  *gatewayStorage.Storage
-	u   *users.User
-	e   *echo.Echo
+	t     *testing.T
+	ctx   Context
+	fs    *apiStorage.FsHandle
+	api   *apiStorage.Storage
+	gw    *gatewayStorage.Storage
+	users *users.Storage
+	u     *users.User
+	e     *echo.Echo
 }
 
 func (c testClient) Do(req *http.Request) *httptest.ResponseRecorder {
@@ -187,7 +207,7 @@ func (p testAuthProvider) GetSession(c echo.Context) (*auth.Session, error) {
 func (testAuthProvider) DropSession(echo.Context, *auth.Session) {
 }
 
-func NewTestClient(t *testing.T) *testClient {
+func NewTestClient(t *testing.T, opts ...Option) *testClient {
 	ctx := context.Background()
 	tmpDir := t.TempDir()
 	fsS, err := apiStorage.NewFs(tmpDir)
@@ -198,6 +218,9 @@ func NewTestClient(t *testing.T) *testClient {
 	require.Nil(t, err)
 	gwS, err := gatewayStorage.NewStorage(db, fsS)
 	require.Nil(t, err)
+	require.Nil(t, fsS.Auth.InitHmacSecret())
+	usersS, err := users.NewStorage(db, fsS)
+	require.Nil(t, err)
 
 	log, err := context.InitLogger("debug")
 	require.Nil(t, err)
@@ -209,16 +232,17 @@ func NewTestClient(t *testing.T) *testClient {
 		Username:      "root",
 		AllowedScopes: 0,
 	}
-	RegisterHandlers(e, apiS, &testAuthProvider{user: u})
+	RegisterHandlers(e, apiS, usersS, &testAuthProvider{user: u}, opts...)
 
 	tc := testClient{
-		t:   t,
-		ctx: ctx,
-		fs:  fsS,
-		api: apiS,
-		gw:  gwS,
-		u:   u,
-		e:   e,
+		t:     t,
+		ctx:   ctx,
+		fs:    fsS,
+		api:   apiS,
+		gw:    gwS,
+		users: usersS,
+		u:     u,
+		e:     e,
 	}
 	return &tc
 }
@@ -326,6 +350,187 @@ func TestApiDeviceList(t *testing.T) {
 
 }
 
+func TestApiDeviceListNoUpdate(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	for _, uuid := range []string{"test-device-1", "test-device-2", "test-device-3"} {
+		d, err := tc.gw.DeviceCreate(uuid, "pubkey-"+uuid, true)
+		require.Nil(t, err)
+		require.Nil(t, d.CheckIn("", "tag1", "", ""))
+	}
+	_, err := tc.api.SetUpdateName("tag1", "update1", "prod", []string{"test-device-2"}, nil, "", "")
+	require.Nil(t, err)
+
+	tc.GET("/devices?update=update1", 400)
+
+	rec := tc.Do(httptest.NewRequest(http.MethodGet, "/v1/devices?update=none&limit=1", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var devices []apiStorage.DeviceListItem
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &devices))
+	require.Len(t, devices, 1)
+	assert.Equal(t, "test-device-1", devices[0].Uuid)
+	assert.Contains(t, rec.Header().Get("Link"), "update=none")
+
+	data := tc.GET("/devices?update=none", 200)
+	require.Nil(t, json.Unmarshal(data, &devices))
+	require.Len(t, devices, 2)
+	assert.Equal(t, "test-device-1", devices[0].Uuid)
+	assert.Equal(t, "test-device-3", devices[1].Uuid)
+
+	data = tc.GET("/devices", 200)
+	require.Nil(t, json.Unmarshal(data, &devices))
+	require.Len(t, devices, 3)
+
+	// The fingerprint search honors the filter too.
+	fingerprint := func(uuid string) string {
+		return "pubkey-fingerprint=" + apiStorage.PubKeyFingerprint("pubkey-"+uuid)
+	}
+	data = tc.GET("/devices?update=none&"+fingerprint("test-device-1"), 200)
+	require.Nil(t, json.Unmarshal(data, &devices))
+	require.Len(t, devices, 1)
+	assert.Equal(t, "test-device-1", devices[0].Uuid)
+	data = tc.GET("/devices?update=none&"+fingerprint("test-device-2"), 200)
+	require.Nil(t, json.Unmarshal(data, &devices))
+	assert.Empty(t, devices)
+	data = tc.GET("/devices?"+fingerprint("test-device-2"), 200)
+	require.Nil(t, json.Unmarshal(data, &devices))
+	require.Len(t, devices, 1)
+}
+
+func TestApiDeviceListLastSeen(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	defer func() { clock.Now = time.Now }()
+	for i, uuid := range []string{"seen-1000", "seen-2000", "seen-3000"} {
+		clock.Now = func() time.Time { return time.Unix(int64(i+1)*1000, 0) }
+		_, err := tc.gw.DeviceCreate(uuid, "pubkey-"+uuid, true)
+		require.Nil(t, err)
+	}
+	clock.Now = time.Now
+
+	list := func(query string) []string {
+		rec := tc.Do(httptest.NewRequest(http.MethodGet, "/v1/devices?"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code, query)
+		var devices []apiStorage.DeviceListItem
+		require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &devices))
+		uuids := make([]string, 0, len(devices))
+		for _, d := range devices {
+			uuids = append(uuids, d.Uuid)
+		}
+		return uuids
+	}
+
+	assert.Equal(t, []string{"seen-2000", "seen-3000"}, list("last-seen-after=2000"))
+	assert.Equal(t, []string{"seen-3000"}, list("last-seen-after=2001"))
+	assert.Equal(t, []string{"seen-1000"}, list("last-seen-before=2000"))
+	assert.Equal(t, []string{"seen-1000", "seen-2000"}, list("last-seen-before=2001"))
+	assert.Equal(t, []string{"seen-2000"}, list("last-seen-after=1500&last-seen-before=2500"))
+	assert.Equal(t, []string{"seen-1000", "seen-2000", "seen-3000"}, list("last-seen-after=0&last-seen-before=0"))
+
+	rec := tc.Do(httptest.NewRequest(http.MethodGet, "/v1/devices?last-seen-after=1500&limit=1", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	// Both matching devices are counted.
+	assert.Contains(t, rec.Header().Get("Link"),
+		`</v1/devices?offset=1&limit=1&order-by=name-asc&last-seen-after=1500>; rel="last"`)
+
+	// A device looked up by its key is filtered by the range as well.
+	fingerprint := "pubkey-fingerprint=" + apiStorage.PubKeyFingerprint("pubkey-seen-2000")
+	assert.Equal(t, []string{"seen-2000"}, list(fingerprint+"&last-seen-before=2500"))
+	assert.Equal(t, []string{}, list(fingerprint+"&last-seen-after=2500"))
+
+	tc.GET("/devices?last-seen-after=-1", 400)
+	tc.GET("/devices?last-seen-before=yesterday", 400)
+	// Times are in seconds, not RFC 3339.
+	tc.GET("/devices?last-seen-after=2025-01-02T03:04:05Z", 400)
+	tc.GET("/devices?last-seen-after=2500&last-seen-before=1500", 400)
+}
+
+func TestApiDeviceListMaxLimit(t *testing.T) {
+	tc := NewTestClient(t, WithDeviceListMaxLimit(2))
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	for _, uuid := range []string{"dev1", "dev2", "dev3"} {
+		_, err := tc.gw.DeviceCreate(uuid, "pubkey", false)
+		require.Nil(t, err)
+	}
+
+	var devices []DeviceListItem
+	for _, query := range []string{"", "?limit=1000"} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/devices"+query, nil)
+		rec := tc.Do(req)
+		require.Equal(t, 200, rec.Code)
+		require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &devices))
+		assert.Len(t, devices, 2, query)
+		assert.Contains(t, rec.Header().Get("Link"), "offset=2&limit=2", query)
+	}
+	require.Nil(t, json.Unmarshal(tc.GET("/devices?limit=1", 200), &devices))
+	assert.Len(t, devices, 1)
+
+	tc.GET("/devices?offset=-1", 400)
+	tc.GET("/devices?limit=-1", 400)
+	tc.GET("/devices?limit=0", 400)
+}
+
+func TestApiDeviceListDefaultOrder(t *testing.T) {
+	uuids := func(data []byte) []string {
+		var devices []apiStorage.DeviceListItem
+		require.Nil(t, json.Unmarshal(data, &devices))
+		res := make([]string, 0, len(devices))
+		for _, d := range devices {
+			res = append(res, d.Uuid)
+		}
+		return res
+	}
+	createDevices := func(tc *testClient) {
+		for _, uuid := range []string{"b-device", "a-device", "c-device"} {
+			_, err := tc.gw.DeviceCreate(uuid, "pubkey-"+uuid, false)
+			require.Nil(t, err)
+		}
+	}
+
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	createDevices(tc)
+	assert.Equal(t, []string{"a-device", "b-device", "c-device"}, uuids(tc.GET("/devices", 200)))
+
+	tc = NewTestClient(t, WithDeviceOrderBy(apiStorage.OrderByDeviceUuidDesc))
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	createDevices(tc)
+	req := httptest.NewRequest(http.MethodGet, "/v1/devices?limit=2", nil)
+	rec := tc.Do(req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"c-device", "b-device"}, uuids(rec.Body.Bytes()))
+	assert.Contains(t, rec.Header().Get("Link"), "order-by=uuid-desc")
+	// An explicit order still wins over the configured default.
+	assert.Equal(t, []string{"a-device", "b-device", "c-device"}, uuids(tc.GET("/devices?order-by=uuid-asc", 200)))
+}
+
+func TestApiDeviceListByFingerprint(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+
+	pubkey := "-----BEGIN PUBLIC KEY-----\nMFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE\n-----END PUBLIC KEY-----\n"
+	_, err := tc.gw.DeviceCreate("test-device-1", pubkey, true)
+	require.Nil(t, err)
+	_, err = tc.gw.DeviceCreate("test-device-2", "pubkey2", false)
+	require.Nil(t, err)
+
+	var devices []apiStorage.DeviceListItem
+	fingerprint := apiStorage.PubKeyFingerprint(pubkey)
+	data := tc.GET("/devices?pubkey-fingerprint="+fingerprint, 200)
+	require.Nil(t, json.Unmarshal(data, &devices))
+	require.Len(t, devices, 1)
+	assert.Equal(t, "test-device-1", devices[0].Uuid)
+
+	// Lookup is case-insensitive
+	data = tc.GET("/devices?pubkey-fingerprint="+strings.ToUpper(fingerprint), 200)
+	require.Nil(t, json.Unmarshal(data, &devices))
+	require.Len(t, devices, 1)
+
+	data = tc.GET("/devices?pubkey-fingerprint=deadbeef", 200)
+	require.Nil(t, json.Unmarshal(data, &devices))
+	require.Len(t, devices, 0)
+}
+
 func TestApiDeviceGet(t *testing.T) {
 	tc := NewTestClient(t)
 	tc.GET("/devices/foo", 403)
@@ -361,6 +566,137 @@ func TestApiDeviceGet(t *testing.T) {
 
 }
 
+func TestApiDeviceAktoml(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.GET("/devices/test-device-1/aktualizr.toml", 403)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+
+	tc.GET("/devices/test-device-1/aktualizr.toml", 404)
+	_, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", false)
+	require.Nil(t, err)
+	tc.GET("/devices/test-device-1/aktualizr.toml", 404)
+
+	aktoml := "[pacman]\ntags = \"main\"\n"
+	require.Nil(t, tc.fs.Devices.WriteFile("test-device-1", storage.AktomlFile, aktoml))
+	rec := tc.Do(httptest.NewRequest(http.MethodGet, "/v1/devices/test-device-1/aktualizr.toml", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, aktoml, rec.Body.String())
+	assert.Equal(t, echo.MIMETextPlainCharsetUTF8, rec.Header().Get(echo.HeaderContentType))
+}
+
+func TestApiDeviceEffectiveConfig(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.GET("/devices/prod1/effective-config", 403)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+
+	tc.GET("/devices/prod1/effective-config", 404)
+	d, err := tc.gw.DeviceCreate("prod1", "pubkey", true)
+	require.Nil(t, err)
+	require.Nil(t, d.CheckIn("lmp-41", "main", "hash-41", "app1"))
+
+	get := func() (cfg DeviceEffectiveConfig) {
+		require.Nil(t, json.Unmarshal(tc.GET("/devices/prod1/effective-config", 200), &cfg))
+		return
+	}
+	assert.Equal(t, DeviceEffectiveConfig{
+		Uuid:          "prod1",
+		Tag:           "main",
+		UpdateChannel: "prod",
+		Running:       RunningTarget{Target: "lmp-41", OstreeHash: "hash-41", Apps: []string{"app1"}},
+	}, get())
+
+	// Targets for other hardware than the running target are not desired.
+	targets := `{"signed": {"targets": {
+		"lmp-41": {"hashes": {"sha256": "hash-41"}, "custom": {"tags": ["main"], "version": "41", "hardwareIds": ["intel"]}},
+		"lmp-42": {"hashes": {"sha256": "hash-42"}, "custom": {"tags": ["main"], "version": "42", "hardwareIds": ["intel"],
+			"docker_compose_apps": {"app1": {"uri": "hub.example.com/app1@sha256:42"}}}},
+		"lmp-43": {"hashes": {"sha256": "hash-43"}, "custom": {"tags": ["main"], "version": "43", "hardwareIds": ["intel"],
+			"docker_compose_apps": {"app1": {"uri": "hub.example.com/app1@sha256:43"}}}},
+		"lmp-44": {"hashes": {"sha256": "hash-44"}, "custom": {"tags": ["devel"], "version": "44", "hardwareIds": ["intel"]}},
+		"rpi-45": {"hashes": {"sha256": "hash-45"}, "custom": {"tags": ["main"], "version": "45", "hardwareIds": ["rpi"]}}
+	}}}`
+	for name, content := range map[string]string{
+		storage.TufTargetsFile: targets,
+		"1.root.json":          "{}",
+		"2.root.json":          "{}",
+	} {
+		require.Nil(t, tc.fs.Updates.Prod.Tuf.WriteFile("main", "update1", name, content))
+	}
+	_, err = tc.api.SetUpdateName("main", "update1", "prod", []string{"prod1"}, nil, "", "")
+	require.Nil(t, err)
+
+	expected := DeviceEffectiveConfig{
+		Uuid:          "prod1",
+		Tag:           "main",
+		UpdateName:    "update1",
+		UpdateChannel: "prod",
+		Running:       RunningTarget{Target: "lmp-41", OstreeHash: "hash-41", Apps: []string{"app1"}},
+		Desired: &DesiredTarget{
+			Target: "lmp-43", Version: "43", OstreeHash: "hash-43",
+			Apps: map[string]string{"app1": "hub.example.com/app1@sha256:43"},
+		},
+		Tuf: &TufMetaUrls{
+			Root:      "/repo/2.root.json",
+			Timestamp: "/repo/timestamp.json",
+			Snapshot:  "/repo/snapshot.json",
+			Targets:   "/repo/targets.json",
+		},
+	}
+	assert.Equal(t, expected, get())
+
+	require.Nil(t, d.CheckIn("lmp-43", "main", "hash-43", "app1"))
+	expected.Running = RunningTarget{Target: "lmp-43", OstreeHash: "hash-43", Apps: []string{"app1"}}
+	expected.UpToDate = true
+	assert.Equal(t, expected, get())
+
+	// Without root metadata, devices cannot fetch the update.
+	for _, name := range []string{"1.root.json", "2.root.json"} {
+		require.Nil(t, os.Remove(tc.fs.Updates.Prod.Tuf.FilePath("main", "update1", name)))
+	}
+	expected.Tuf = nil
+	expected.UpToDate = false
+	assert.Equal(t, expected, get())
+}
+
+func TestApiDeviceUpdateResult(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+
+	tc.GET("/devices/test-device-1/updates/feed/result", 404)
+	d, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", false)
+	require.Nil(t, err)
+	tc.GET("/devices/test-device-1/updates/feed/result", 404)
+
+	require.Nil(t, d.SaveInstallResult(storage.DeviceInstallResult{
+		CorrelationId: "feed",
+		Reason:        "rolled back: app failed to start",
+		DeviceTime:    "2023-12-12T12:00:42Z",
+	}))
+	data := tc.GET("/devices/test-device-1/updates/feed/result", 200)
+	var res storage.DeviceInstallResult
+	require.Nil(t, json.Unmarshal(data, &res))
+	assert.Equal(t, "feed", res.CorrelationId)
+	assert.False(t, res.Success)
+	assert.Equal(t, "rolled back: app failed to start", res.Reason)
+	tc.GET("/devices/test-device-1/updates/beef/result", 404)
+}
+
+func TestApiDeviceCertificate(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.GET("/devices/test-device-1/certificate", 403)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+
+	tc.GET("/devices/test-device-1/certificate", 404)
+	d, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", false)
+	require.Nil(t, err)
+	tc.GET("/devices/test-device-1/certificate", 404)
+
+	certPem := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+	require.Nil(t, d.SaveCertificate(certPem, 1))
+	data := tc.GET("/devices/test-device-1/certificate", 200)
+	assert.Equal(t, certPem, string(data))
+}
+
 func TestApiDeviceLabelsPatch(t *testing.T) {
 	tc := NewTestClient(t)
 	_, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
@@ -439,6 +775,39 @@ func TestApiDeviceLabelsPatch(t *testing.T) {
 	assert.Equal(t, []string{"new", "test"}, groups)
 }
 
+func TestApiKnownLabelsCache(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesRU
+	d, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
+	require.Nil(t, err)
+
+	var labels, groups []string
+	require.Nil(t, json.Unmarshal(tc.GET("/known-labels/devices", 200), &labels))
+	assert.Equal(t, []string{"name", "group"}, labels)
+	require.Nil(t, json.Unmarshal(tc.GET("/known-labels/device-groups", 200), &groups))
+	assert.Equal(t, []string{}, groups)
+
+	// Labels a device sets about itself via the gateway only show up once the cache expires.
+	site, group := "berlin", "lab"
+	require.Nil(t, d.PatchLabels(map[string]*string{"site": &site, "group": &group}))
+	require.Nil(t, json.Unmarshal(tc.GET("/known-labels/devices", 200), &labels))
+	assert.Equal(t, []string{"name", "group"}, labels)
+	require.Nil(t, json.Unmarshal(tc.GET("/known-labels/device-groups", 200), &groups))
+	assert.Equal(t, []string{}, groups)
+
+	// Label changes via the API invalidate the cache.
+	headers := []string{"content-type", "application/json"}
+	tc.PATCH("/devices/test-device-1/labels", 200, `{"upserts":{"rack":"r1"}}`, headers...)
+	require.Nil(t, json.Unmarshal(tc.GET("/known-labels/devices", 200), &labels))
+	assert.Equal(t, []string{"name", "group", "rack", "site"}, labels)
+	require.Nil(t, json.Unmarshal(tc.GET("/known-labels/device-groups", 200), &groups))
+	assert.Equal(t, []string{"lab"}, groups)
+
+	tc.DELETE("/device-groups/lab", 200)
+	require.Nil(t, json.Unmarshal(tc.GET("/known-labels/device-groups", 200), &groups))
+	assert.Equal(t, []string{}, groups)
+}
+
 func TestApiDeviceLabelsPut(t *testing.T) {
 	tc := NewTestClient(t)
 	_, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
@@ -476,6 +845,57 @@ func TestApiDeviceLabelsPut(t *testing.T) {
 	assert.Equal(t, "test2", device.Labels["name"])
 }
 
+func TestApiDeviceRequiredLabels(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.api.SetRequiredLabels([]string{"name"})
+	tc.u.AllowedScopes = users.ScopeDevicesRU
+	_, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
+	require.Nil(t, err)
+	headers := []string{"content-type", "application/json"}
+	assertLabels := func(expected apiStorage.Labels) {
+		var device apiStorage.Device
+		require.Nil(t, json.Unmarshal(tc.GET("/devices/test-device-1", 200), &device))
+		assert.Equal(t, expected, device.Labels)
+	}
+
+	// Deleting a label which the device does not have yet is harmless.
+	tc.PATCH("/devices/test-device-1/labels", 200, `{"deletes":["name"],"upserts":{"foo":"bar"}}`, headers...)
+	tc.PUT("/devices/test-device-1/labels", 200, `{"name":"test","group":"grp1"}`, headers...)
+	assertLabels(apiStorage.Labels{"name": "test", "group": "grp1"})
+
+	tc.PATCH("/devices/test-device-1/labels", 400, `{"deletes":["name"]}`, headers...)
+	tc.PUT("/devices/test-device-1/labels", 400, `{"group":"grp1"}`, headers...)
+	assertLabels(apiStorage.Labels{"name": "test", "group": "grp1"})
+	require.ErrorIs(t, tc.api.PatchDeviceLabels(map[string]*string{"name": nil}, []string{"test-device-1"}), storage.ErrRequiredLabel)
+
+	// Required labels may be changed, and other labels deleted.
+	tc.PATCH("/devices/test-device-1/labels", 200, `{"deletes":["group"],"upserts":{"name":"test2"}}`, headers...)
+	assertLabels(apiStorage.Labels{"name": "test2"})
+	tc.PUT("/devices/test-device-1/labels", 200, `{"name":"test3"}`, headers...)
+	assertLabels(apiStorage.Labels{"name": "test3"})
+
+	// A required group label keeps devices in their group when it is deleted.
+	tc.api.SetRequiredLabels([]string{"name", "group"})
+	tc.PUT("/devices/test-device-1/labels", 200, `{"name":"test3","group":"grp1"}`, headers...)
+	tc.DELETE("/device-groups/grp1", 400)
+	assertLabels(apiStorage.Labels{"name": "test3", "group": "grp1"})
+
+	// Devices can never delete required labels themselves.
+	tc.gw.SetRequiredLabels([]string{"group"})
+	d, err := tc.gw.DeviceGet("test-device-1")
+	require.Nil(t, err)
+	require.ErrorIs(t, d.PatchLabels(map[string]*string{"group": nil}), storage.ErrRequiredLabel)
+	assertLabels(apiStorage.Labels{"name": "test3", "group": "grp1"})
+
+	// Without required labels any label may be deleted.
+	tc.api.SetRequiredLabels(nil)
+	tc.DELETE("/device-groups/grp1", 200)
+	tc.PATCH("/devices/test-device-1/labels", 200, `{"deletes":["name"]}`, headers...)
+	assertLabels(apiStorage.Labels{})
+	require.Nil(t, storage.ValidateRequiredLabels([]string{"name", "group"}))
+	require.NotNil(t, storage.ValidateRequiredLabels([]string{"site"}))
+}
+
 func TestApiAppsStates(t *testing.T) {
 	tc := NewTestClient(t)
 	tc.GET("/devices/test-device-1/apps-states", 403)
@@ -507,6 +927,58 @@ func TestApiAppsStates(t *testing.T) {
 
 	require.Equal(t, "1", statesResp.AppsStates[1].DeviceTime)
 	require.Equal(t, "2", statesResp.AppsStates[0].DeviceTime)
+	assert.Equal(t, AppsStatesRetention{MaxCount: 10}, statesResp.Retention)
+}
+
+func TestApiDeviceAppsStatesRetention(t *testing.T) {
+	tc := NewTestClient(t, WithAppsStatesMaxAge(7*24*time.Hour))
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	d, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
+	require.Nil(t, err)
+	require.Nil(t, d.SaveAppsStates(`{"deviceTime":"1"}`))
+
+	res := tc.GET("/devices/test-device-1/apps-states", 200)
+	assert.Contains(t, string(res), `"retention":{"max_count":10,"max_age":604800}`)
+	var statesResp AppsStatesResp
+	require.Nil(t, json.Unmarshal(res, &statesResp))
+	assert.Len(t, statesResp.AppsStates, 1)
+}
+
+func TestApiDeviceAppsStatesCompressed(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	d, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
+	require.Nil(t, err)
+
+	var state storage.AppsStates
+	require.Nil(t, json.Unmarshal([]byte(`{"deviceTime":"1","apps":{"app1":{"uri":"hub/app1@sha256:1","state":"running"}}}`), &state))
+	stateBytes, err := json.Marshal(state)
+	require.Nil(t, err)
+	require.Nil(t, d.SaveAppsStates(string(stateBytes)))
+	tc.gw.SetCompressStates(true)
+	d, err = tc.gw.DeviceGet("test-device-1")
+	require.Nil(t, err)
+	state.DeviceTime = "2"
+	stateBytes, err = json.Marshal(state)
+	require.Nil(t, err)
+	require.Nil(t, d.SaveAppsStates(string(stateBytes)))
+
+	names, err := tc.fs.Devices.ListFiles("test-device-1", storage.StatesPrefix, true)
+	require.Nil(t, err)
+	require.Len(t, names, 2)
+	assert.False(t, strings.HasSuffix(names[0], storage.GzipSuffix))
+	assert.True(t, strings.HasSuffix(names[1], storage.GzipSuffix))
+	raw, err := tc.fs.Devices.ReadFile("test-device-1", names[1])
+	require.Nil(t, err)
+	assert.NotEqual(t, string(stateBytes), raw)
+
+	// Compressed and uncompressed reports are read alike.
+	var statesResp AppsStatesResp
+	require.Nil(t, json.Unmarshal(tc.GET("/devices/test-device-1/apps-states", 200), &statesResp))
+	require.Len(t, statesResp.AppsStates, 2)
+	assert.Equal(t, state, statesResp.AppsStates[0])
+	state.DeviceTime = "1"
+	assert.Equal(t, state, statesResp.AppsStates[1])
 }
 
 func TestApiDeviceUpdateEvents(t *testing.T) {
@@ -542,6 +1014,99 @@ func TestApiDeviceUpdateEvents(t *testing.T) {
 	assert.Equal(t, "first", events[1].Event.Details)
 
 	_ = tc.GET("/devices/test-device-1/updates/doesnoexist", 404)
+
+	ids := func(data []byte) (res []string) {
+		require.Nil(t, json.Unmarshal(data, &events))
+		for _, evt := range events {
+			res = append(res, evt.Id)
+		}
+		return
+	}
+	data = tc.GET("/devices/test-device-1/updates/uuid-2", 200)
+	assert.Equal(t, []string{"0_uuid-2", "1_uuid-2", "2_uuid-2"}, ids(data))
+	data = tc.GET("/devices/test-device-1/updates/uuid-2?order=asc", 200)
+	assert.Equal(t, []string{"0_uuid-2", "1_uuid-2", "2_uuid-2"}, ids(data))
+	data = tc.GET("/devices/test-device-1/updates/uuid-2?order=desc", 200)
+	assert.Equal(t, []string{"2_uuid-2", "1_uuid-2", "0_uuid-2"}, ids(data))
+	tc.GET("/devices/test-device-1/updates/uuid-2?order=newest", 400)
+
+	// Clients polling for new events skip those they already have.
+	data = tc.GET("/devices/test-device-1/updates/uuid-2?after=1", 200)
+	assert.Equal(t, []string{"1_uuid-2", "2_uuid-2"}, ids(data))
+	data = tc.GET("/devices/test-device-1/updates/uuid-2?after=1&order=desc", 200)
+	assert.Equal(t, []string{"2_uuid-2", "1_uuid-2"}, ids(data))
+	data = tc.GET("/devices/test-device-1/updates/uuid-2?after=3", 200)
+	assert.Empty(t, ids(data))
+	tc.GET("/devices/test-device-1/updates/uuid-2?after=-1", 400)
+}
+
+func TestApiDeviceUpdateEventsMalformed(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	d, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
+	require.Nil(t, err)
+
+	events := generateUpdateEvents("uuid-1", "first", 2)
+	require.Nil(t, d.ProcessEvents(events[:1]))
+	require.Nil(t, tc.fs.Devices.AppendFile("test-device-1", storage.EventsPrefix+"-uuid-1", "{\"id\":\"trunc\n"))
+	require.Nil(t, d.ProcessEvents(events[1:]))
+
+	data := tc.GET("/devices/test-device-1/updates/uuid-1", 200)
+	require.Nil(t, json.Unmarshal(data, &events))
+	require.Len(t, events, 2)
+	assert.Equal(t, "0_uuid-1", events[0].Id)
+	assert.Equal(t, "1_uuid-1", events[1].Id)
+
+	tc.api.SetStrictEvents(true)
+	tc.GET("/devices/test-device-1/updates/uuid-1", 500)
+}
+
+func TestApiDeviceEventsExport(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.GET("/devices/test-device-1/events.ndjson", 403)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	tc.GET("/devices/test-device-1/events.ndjson", 404)
+	d, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
+	require.Nil(t, err)
+
+	rec := tc.Do(httptest.NewRequest(http.MethodGet, "/v1/devices/test-device-1/events.ndjson", nil))
+	require.Equal(t, 200, rec.Code)
+	assert.Empty(t, rec.Body.String())
+
+	withTimes := func(events []storage.DeviceUpdateEvent, times ...string) []storage.DeviceUpdateEvent {
+		for i := range events {
+			events[i].DeviceTime = times[i]
+		}
+		return events
+	}
+	// Events of both updates interleave, an event with an unparsable time stays after the preceding one.
+	require.Nil(t, d.ProcessEvents(withTimes(generateUpdateEvents("uuid-2", "second", 2),
+		"2023-12-12T12:01:00Z", "2023-12-12T12:03:00Z")))
+	events := withTimes(generateUpdateEvents("uuid-1", "first", 4),
+		"2023-12-12T12:00:00Z", "2023-12-12T12:02:00Z", "bad time", "2023-12-12T14:04:00+02:00")
+	require.Nil(t, d.ProcessEvents(events[:2]))
+	// Malformed lines are skipped unless strict events are required.
+	require.Nil(t, tc.fs.Devices.AppendFile("test-device-1", storage.EventsPrefix+"-uuid-1", "{\"id\":\"trunc\n"))
+	require.Nil(t, d.ProcessEvents(events[2:]))
+
+	export := func() []string {
+		rec := tc.Do(httptest.NewRequest(http.MethodGet, "/v1/devices/test-device-1/events.ndjson", nil))
+		require.Equal(t, 200, rec.Code)
+		assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+		lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+		var ids []string
+		for _, line := range lines {
+			var evt storage.DeviceUpdateEvent
+			require.Nil(t, json.Unmarshal([]byte(line), &evt), line)
+			ids = append(ids, evt.Id)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"0_uuid-1", "0_uuid-2", "1_uuid-1", "2_uuid-1", "1_uuid-2", "3_uuid-1"}, export())
+
+	// The response is already sent when the malformed line is reached, so the export stops there.
+	tc.api.SetStrictEvents(true)
+	assert.Equal(t, []string{"0_uuid-1", "0_uuid-2", "1_uuid-1"}, export())
 }
 
 func TestApiUpdateList(t *testing.T) {
@@ -660,6 +1225,60 @@ func TestApiRolloutGet(t *testing.T) {
 	tc.GET("/updates/prod/tag/update/rollouts/omg+", 404)
 }
 
+func TestApiRolloutTargets(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.GET("/updates/prod/tag/update/rollouts/rollout/targets", 403)
+	tc.u.AllowedScopes = users.ScopeUpdatesR
+
+	tc.GET("/updates/prod/tag/update/rollouts/rollout/targets", 404)
+
+	for _, dev := range []struct {
+		uuid, tag string
+		isProd    bool
+	}{
+		{"prod1", "tag", true},
+		{"prod2", "other", true},
+		{"prod3", "tag", true},
+		{"prod4", "tag", true},
+		{"ci1", "tag", false},
+	} {
+		d, err := tc.gw.DeviceCreate(dev.uuid, "pubkey", dev.isProd)
+		require.Nil(t, err)
+		require.Nil(t, d.CheckIn("", dev.tag, "", ""))
+	}
+	grp := "grp"
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"group": &grp}, []string{"prod3", "prod4", "ci1"}))
+	d, err := tc.api.DeviceGet("prod4")
+	require.Nil(t, err)
+	require.Nil(t, d.Delete())
+
+	require.Nil(t, tc.fs.Updates.Prod.Rollouts.WriteFile("tag", "update", "rollout",
+		`{"uuids":["prod1","prod2","prod3","missing"],"groups":["grp"]}`))
+
+	var targets RolloutTargets
+	data := tc.GET("/updates/prod/tag/update/rollouts/rollout/targets", 200)
+	require.Nil(t, json.Unmarshal(data, &targets))
+	assert.Equal(t, []string{"missing", "prod1", "prod2", "prod3"}, targets.Requested)
+	assert.Equal(t, []string{"ci1", "prod3", "prod4"}, targets.Grouped)
+	assert.Equal(t, []string{"prod1", "prod3"}, targets.Effective)
+	assert.Equal(t, []RolloutTargetExclusion{
+		{Uuid: "ci1", Reason: "wrong-device-kind"},
+		{Uuid: "missing", Reason: "nonexistent"},
+		{Uuid: "prod2", Reason: "wrong-tag"},
+		{Uuid: "prod4", Reason: "deleted"},
+	}, targets.Excluded)
+
+	// A rollout updates exactly the effective devices.
+	uuids, err := tc.api.SetUpdateName(
+		"tag", "update", "prod", []string{"prod1", "prod2", "prod3", "missing"}, []string{"grp"}, "", "",
+	)
+	require.Nil(t, err)
+	slices.Sort(uuids)
+	assert.Equal(t, targets.Effective, uuids)
+
+	tc.GET("/updates/ci/tag/update/rollouts/rollout/targets", 404)
+}
+
 func TestApiRolloutPut(t *testing.T) {
 	tc := NewTestClient(t)
 	tc.PUT("/updates/ci/tag/update/rollouts/rolling", 403, "{}")
@@ -701,7 +1320,11 @@ func TestApiRolloutPut(t *testing.T) {
 	grp1 := "grp1"
 	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"group": &grp1}, []string{"prod3", "prod4", "ci4"}))
 
-	tc.PUT("/updates/ci/tag1/update1/rollouts/rocks", 202,
+	// ci3 is on a different tag, and ci5 and prod1 do not exist as CI devices.
+	data := tc.PUT("/updates/ci/tag1/update1/rollouts/rocks", 400,
+		`{"uuids":["ci1","ci2","ci3","ci5","prod1"]}`, "content-type", "application/json")
+	assert.Equal(t, "Devices do not exist or do not match the update tag: ci3, ci5, prod1", string(data))
+	tc.PUT("/updates/ci/tag1/update1/rollouts/rocks?force=true", 202,
 		`{"uuids":["ci1","ci2","ci3"]}`, "content-type", "application/json")
 	tc.PUT("/updates/ci/tag1/update2/rollouts/rocks", 404,
 		`{"uuids":["ci1","ci2"]}`, "content-type", "application/json")
@@ -717,10 +1340,10 @@ func TestApiRolloutPut(t *testing.T) {
 	}
 	time.Sleep(50 * time.Millisecond) // Allow async database updates to finish
 
-	data := tc.GET("/updates/ci/tag1/update1/rollouts/rocks", 200)
-	assert.Equal(t, `{"uuids":["ci1","ci2","ci3"],"effective-uuids":["ci1","ci2"],"committed":true}`, s(data))
+	data = tc.GET("/updates/ci/tag1/update1/rollouts/rocks", 200)
+	assert.Equal(t, `{"uuids":["ci1","ci2","ci3"],"effective-uuids":["ci1","ci2"],"committed":true,"editor":"root"}`, s(data))
 	data = tc.GET("/updates/prod/tag2/update2/rollouts/rocks", 200)
-	assert.Equal(t, `{"uuids":["prod2"],"groups":["grp1"],"effective-uuids":["prod2","prod3"],"committed":true}`, s(data))
+	assert.Equal(t, `{"uuids":["prod2"],"groups":["grp1"],"effective-uuids":["prod2","prod3"],"committed":true,"editor":"root"}`, s(data))
 	dev, err := tc.api.DeviceGet("ci1")
 	require.Nil(t, err)
 	assert.Equal(t, "update1", dev.UpdateName)
@@ -737,6 +1360,16 @@ func TestApiRolloutPut(t *testing.T) {
 	require.Nil(t, err)
 	assert.Equal(t, "update2", dev.UpdateName)
 
+	// Device count matches the effective UUIDs.
+	var items []RolloutListItem
+	data = tc.GET("/updates/ci/tag1/update1/rollouts?include=device-count", 200)
+	require.Nil(t, json.Unmarshal(data, &items))
+	assert.Equal(t, []RolloutListItem{{Name: "rocks", Committed: true, DeviceCount: 2}}, withoutModTimes(t, items))
+	data = tc.GET("/updates/prod/tag2/update2/rollouts?include=device-count", 200)
+	require.Nil(t, json.Unmarshal(data, &items))
+	assert.Equal(t, []RolloutListItem{{Name: "rocks", Committed: true, DeviceCount: 2}}, withoutModTimes(t, items))
+	tc.GET("/updates/prod/tag2/update2/rollouts?include=foo", 400)
+
 	// Synthetic tag/update/rollout validation - create a bad tag/update/rollout on disk - request must still return 404
 	require.Nil(t, tc.fs.Updates.Prod.Rollouts.WriteFile("bad^tag", "update42", "rollout1", "foo"))
 	require.Nil(t, tc.fs.Updates.Prod.Rollouts.WriteFile("tag", "update=bad", "rollout1", "foo"))
@@ -746,26 +1379,67 @@ func TestApiRolloutPut(t *testing.T) {
 	tc.PUT("/updates/prod/tag/update/rollouts/omg+", 404, "foo")
 }
 
-func TestApiRolloutDaemon(t *testing.T) {
-	tc := NewTestClient(t)
+func TestApiRolloutClaims(t *testing.T) {
+	tc := NewTestClient(t, WithRolloutApproval(true))
+	tc.u.AllowedScopes = users.ScopeUpdatesRU
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
+	for _, uuid := range []string{"prod1", "prod2", "prod3"} {
+		d, err := tc.gw.DeviceCreate(uuid, "pubkey", true)
+		require.Nil(t, err)
+		require.Nil(t, d.CheckIn("", "tag1", "", ""))
+	}
+	for uuid, claimant := range map[string]string{"prod1": "other", "prod2": tc.u.Username} {
+		d, err := tc.api.DeviceGet(uuid)
+		require.Nil(t, err)
+		ok, err := d.SetClaimant(claimant)
+		require.Nil(t, err)
+		require.True(t, ok)
+	}
+	headers := []string{"content-type", "application/json"}
+	assertUpdates := func(expected map[string]string) {
+		for uuid, update := range expected {
+			d, err := tc.api.DeviceGet(uuid)
+			require.Nil(t, err)
+			assert.Equal(t, update, d.UpdateName, uuid)
+		}
+	}
 
-	require.Nil(t, tc.fs.Auth.InitHmacSecret())
-	db, err := apiStorage.NewDb(filepath.Join(t.TempDir(), apiStorage.DbFile))
-	require.Nil(t, err)
-	usersS, err := users.NewStorage(db, tc.fs)
+	tc.PUT("/updates/prod/tag1/update1/rollouts/roll1", 400, `{"uuids":["prod1"],"editor":"other"}`, headers...)
+
+	// Devices claimed by others than the rollout creator are skipped, even when an admin approves the rollout.
+	tc.PUT("/updates/prod/tag1/update1/rollouts/roll1", 202, `{"uuids":["prod1","prod2","prod3"]}`, headers...)
+	var targets RolloutTargets
+	require.Nil(t, json.Unmarshal(tc.GET("/updates/prod/tag1/update1/rollouts/roll1/targets", 200), &targets))
+	assert.Equal(t, []string{"prod2", "prod3"}, targets.Effective)
+	assert.Equal(t, []RolloutTargetExclusion{{Uuid: "prod1", Reason: "claimed"}}, targets.Excluded)
+	tc.u.AllowedScopes |= users.ScopeAdminR
+	tc.POST("/updates/prod/tag1/update1/rollouts/roll1/approve", 202, nil)
+	require.Eventually(t, func() bool {
+		rollout, err := tc.api.GetRollout("tag1", "update1", "roll1", "prod")
+		return err == nil && rollout.Commit
+	}, time.Second, time.Millisecond)
+	rollout, err := tc.api.GetRollout("tag1", "update1", "roll1", "prod")
 	require.Nil(t, err)
-	daemons := daemons.New(tc.ctx, tc.api, usersS, daemons.WithRolloverInterval(20*time.Millisecond))
+	assert.Equal(t, []string{"prod2", "prod3"}, rollout.Effect)
+	assertUpdates(map[string]string{"prod1": "", "prod2": "update1", "prod3": "update1"})
+
+	// Rollouts of admins update devices claimed by anyone.
+	tc.PUT("/updates/prod/tag1/update1/rollouts/roll2", 202, `{"uuids":["prod1"]}`, headers...)
+	tc.POST("/updates/prod/tag1/update1/rollouts/roll2/approve", 202, nil)
+	require.Eventually(t, func() bool {
+		rollout, err := tc.api.GetRollout("tag1", "update1", "roll2", "prod")
+		return err == nil && rollout.Commit
+	}, time.Second, time.Millisecond)
+	assertUpdates(map[string]string{"prod1": "update1"})
+}
 
-	daemons.Start()
-	defer daemons.Shutdown()
-	tc.u.AllowedScopes = users.ScopeUpdatesR
+func TestApiRolloutApproval(t *testing.T) {
+	tc := NewTestClient(t, WithRolloutApproval(true))
+	tc.POST("/updates/prod/tag2/update2/rollouts/roll1/approve", 403, nil)
+	tc.u.AllowedScopes = users.ScopeUpdatesRU
 
-	require.Nil(t, tc.fs.Updates.Ci.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
 	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag2", "update2", "foo", "bar"))
-	d, err := tc.gw.DeviceCreate("ci1", "pubkey1", false)
-	require.Nil(t, err)
-	require.Nil(t, d.CheckIn("", "tag1", "", ""))
-	d, err = tc.gw.DeviceCreate("prod1", "pubkey2", true)
+	d, err := tc.gw.DeviceCreate("prod1", "pubkey1", true)
 	require.Nil(t, err)
 	require.Nil(t, d.CheckIn("", "tag2", "", ""))
 
@@ -773,39 +1447,554 @@ func TestApiRolloutDaemon(t *testing.T) {
 		return strings.TrimSpace(string(data))
 	}
 
-	// Emulate a non-committed rollout (file present, database not updated).
-	require.Nil(t, tc.api.CreateRollout("tag1", "update1", "roll1", false, Rollout{Uuids: []string{"ci1"}}))
-	require.Nil(t, tc.api.CreateRollout("tag2", "update2", "roll2", true, Rollout{Uuids: []string{"prod1"}}))
-
-	// Before the watchdog daemon processing, rollouts are not yet committed.
-	data := tc.GET("/updates/ci/tag1/update1/rollouts/roll1", 200)
-	assert.Equal(t, `{"uuids":["ci1"],"committed":false}`, s(data))
-	data = tc.GET("/updates/prod/tag2/update2/rollouts/roll2", 200)
-	assert.Equal(t, `{"uuids":["prod1"],"committed":false}`, s(data))
-	dev, err := tc.api.DeviceGet("ci1")
-	require.Nil(t, err)
-	assert.Equal(t, "", dev.UpdateName)
-	dev, err = tc.api.DeviceGet("prod1")
+	tc.POST("/updates/prod/tag2/update2/rollouts/roll1/approve", 404, nil)
+	tc.PUT("/updates/prod/tag2/update2/rollouts/roll1", 400,
+		`{"uuids":["prod1"],"pending-approval":true}`, "content-type", "application/json")
+	tc.PUT("/updates/prod/tag2/update2/rollouts/roll1", 202,
+		`{"uuids":["prod1"]}`, "content-type", "application/json")
+
+	// A pending rollout is neither journaled nor committed.
+	time.Sleep(20 * time.Millisecond)
+	data := tc.GET("/updates/prod/tag2/update2/rollouts/roll1", 200)
+	assert.Equal(t, `{"uuids":["prod1"],"committed":false,"pending-approval":true,"editor":"root"}`, s(data))
+	require.Nil(t, tc.api.RolloverRolloutJournal("prod", 0))
+	for line, err := range tc.api.ReadRolloutJournal("prod") {
+		require.Nil(t, err)
+		t.Errorf("Unexpected journal entry: %v", line)
+	}
+	dev, err := tc.api.DeviceGet("prod1")
 	require.Nil(t, err)
 	assert.Equal(t, "", dev.UpdateName)
 
-	// After the watchdog daemon processing, rollouts are committed.
-	time.Sleep(60 * time.Millisecond)
-	data = tc.GET("/updates/ci/tag1/update1/rollouts/roll1", 200)
-	assert.Equal(t, `{"uuids":["ci1"],"effective-uuids":["ci1"],"committed":true}`, s(data))
-	data = tc.GET("/updates/prod/tag2/update2/rollouts/roll2", 200)
-	assert.Equal(t, `{"uuids":["prod1"],"effective-uuids":["prod1"],"committed":true}`, s(data))
-	dev, err = tc.api.DeviceGet("ci1")
-	assert.Nil(t, err)
-	assert.Equal(t, "update1", dev.UpdateName)
+	tc.POST("/updates/prod/tag2/update2/rollouts/roll1/approve", 202, nil)
+	time.Sleep(20 * time.Millisecond)
+	data = tc.GET("/updates/prod/tag2/update2/rollouts/roll1", 200)
+	assert.Equal(t, `{"uuids":["prod1"],"effective-uuids":["prod1"],"committed":true,"editor":"root"}`, s(data))
 	dev, err = tc.api.DeviceGet("prod1")
-	assert.Nil(t, err)
+	require.Nil(t, err)
 	assert.Equal(t, "update2", dev.UpdateName)
+
+	tc.POST("/updates/prod/tag2/update2/rollouts/roll1/approve", 409, nil)
 }
 
-func TestApiUpdateTail(t *testing.T) {
-	tc := NewTestClient(t)
-	tc.GET("/updates/prod/tag1/update1/tail", 403)
+func TestApiRolloutsMaxPerUpdate(t *testing.T) {
+	// Pending rollouts are not committed in the background, yet they count towards the cap.
+	tc := NewTestClient(t, WithRolloutApproval(true), WithRolloutsMaxPerUpdate(2))
+	tc.u.AllowedScopes = users.ScopeUpdatesRU
+
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag2", "update1", "foo", "bar"))
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag2", "update2", "foo", "bar"))
+	d, err := tc.gw.DeviceCreate("prod1", "pubkey1", true)
+	require.Nil(t, err)
+	require.Nil(t, d.CheckIn("", "tag2", "", ""))
+
+	body := `{"uuids":["prod1"]}`
+	tc.PUT("/updates/prod/tag2/update2/rollouts/roll1", 202, body, "content-type", "application/json")
+	tc.PUT("/updates/prod/tag2/update2/rollouts/roll2", 202, body, "content-type", "application/json")
+	tc.PUT("/updates/prod/tag2/update2/rollouts/roll3", 409, body, "content-type", "application/json")
+	tc.PUT("/updates/prod/tag2/update2/rollouts/roll2", 409, body, "content-type", "application/json")
+	names, err := tc.api.ListRollouts("tag2", "update2", "prod")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"roll1", "roll2"}, names)
+
+	// The cap applies to each update separately.
+	tc.PUT("/updates/prod/tag2/update1/rollouts/roll3", 202, body, "content-type", "application/json")
+
+	// Concurrent requests cannot exceed the cap.
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag2", "update3", "foo", "bar"))
+	var (
+		wg    sync.WaitGroup
+		added atomic.Int32
+	)
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("roll%d", i)
+			if err := tc.api.AddRollout("tag2", "update3", name, "prod", Rollout{Uuids: []string{"prod1"}}, 2); err == nil {
+				added.Add(1)
+			} else {
+				assert.ErrorIs(t, err, apiStorage.ErrRolloutsLimit)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), added.Load())
+	names, err = tc.api.ListRollouts("tag2", "update3", "prod")
+	require.Nil(t, err)
+	assert.Len(t, names, 2)
+}
+
+func TestApiRolloutFromTarget(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeUpdatesR
+
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
+	for _, dev := range []struct{ uuid, target, hash string }{
+		{"prod1", "target-41", "hash-41"},
+		{"prod2", "target-42", "hash-42"},
+		{"prod3", "target-42-custom", "hash-42"},
+		{"prod4", "target-43", "hash-43"},
+	} {
+		d, err := tc.gw.DeviceCreate(dev.uuid, "pubkey", true)
+		require.Nil(t, err)
+		require.Nil(t, d.CheckIn(dev.target, "tag1", dev.hash, ""))
+	}
+	uuids := []string{"prod1", "prod2", "prod3", "prod4"}
+
+	require.Nil(t, tc.fs.Updates.Prod.Rollouts.WriteFile("tag1", "update1", "roll1",
+		`{"uuids":["prod1","prod2","prod3","prod4"],"from-target":"target-42"}`))
+	var targets RolloutTargets
+	require.Nil(t, json.Unmarshal(tc.GET("/updates/prod/tag1/update1/rollouts/roll1/targets", 200), &targets))
+	assert.Equal(t, []string{"prod2"}, targets.Effective)
+	assert.Equal(t, []RolloutTargetExclusion{
+		{Uuid: "prod1", Reason: "wrong-target"},
+		{Uuid: "prod3", Reason: "wrong-target"},
+		{Uuid: "prod4", Reason: "wrong-target"},
+	}, targets.Excluded)
+
+	assertUpdated := func(expected ...string) {
+		for _, uuid := range uuids {
+			d, err := tc.api.DeviceGet(uuid)
+			require.Nil(t, err)
+			assert.Equal(t, slices.Contains(expected, uuid), d.UpdateName == "update1", uuid)
+		}
+	}
+
+	// Only devices running the target name are updated.
+	rollout := Rollout{Uuids: uuids, FromTarget: "target-42"}
+	require.Nil(t, tc.api.CommitRollout("tag1", "update1", "roll1", "prod", rollout))
+	assertUpdated("prod2")
+	data := tc.GET("/updates/prod/tag1/update1/rollouts/roll1", 200)
+	require.Nil(t, json.Unmarshal(data, &rollout))
+	assert.Equal(t, "target-42", rollout.FromTarget)
+	assert.Equal(t, []string{"prod2"}, rollout.Effect)
+
+	// An ostree hash matches all devices running it, whatever their target names.
+	rollout = Rollout{Uuids: uuids, FromTarget: "hash-42"}
+	require.Nil(t, tc.api.CommitRollout("tag1", "update1", "roll2", "prod", rollout))
+	assertUpdated("prod2", "prod3")
+
+	rollout = Rollout{Uuids: uuids}
+	require.Nil(t, tc.api.CommitRollout("tag1", "update1", "roll3", "prod", rollout))
+	assertUpdated(uuids...)
+}
+
+func TestApiDeviceBulkDelete(t *testing.T) {
+	tc := NewTestClient(t)
+	require.Nil(t, tc.users.Create(tc.u))
+	headers := []string{"content-type", "application/json"}
+	now := time.Now()
+	defer func() { clock.Now = time.Now }()
+	clock.Now = func() time.Time { return now.Add(-90 * 24 * time.Hour) }
+	for _, uuid := range []string{"old1", "old2", "old3"} {
+		d, err := tc.gw.DeviceCreate(uuid, "pubkey", true)
+		require.Nil(t, err)
+		require.Nil(t, d.CheckIn("", "tag1", "", ""))
+	}
+	clock.Now = time.Now
+	d, err := tc.gw.DeviceCreate("new1", "pubkey", true)
+	require.Nil(t, err)
+	require.Nil(t, d.CheckIn("", "tag1", "", ""))
+	lab := "lab"
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"env": &lab}, []string{"old2", "new1"}))
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
+	rollout := Rollout{Uuids: []string{"old1", "new1"}}
+	require.Nil(t, tc.api.CreateRollout("tag1", "update1", "roll1", "prod", rollout))
+	require.Nil(t, tc.api.CommitRollout("tag1", "update1", "roll1", "prod", rollout))
+
+	stale := fmt.Sprintf(`{"last-seen-before":%d`, now.Add(-30*24*time.Hour).Unix())
+	tc.POST("/devices/bulk-delete", 403, strings.NewReader(stale+"}"), headers...)
+	tc.u.AllowedScopes = users.ScopeDevicesD
+
+	tc.POST("/devices/bulk-delete", 400, strings.NewReader(`{}`), headers...)
+	tc.POST("/devices/bulk-delete", 400, strings.NewReader(`{"dry-run":true}`), headers...)
+	tc.POST("/devices/bulk-delete", 400, strings.NewReader(`{"last-seen-before":-1}`), headers...)
+	tc.POST("/devices/bulk-delete", 400, strings.NewReader(`{"selector":{"Bad":"x"}}`), headers...)
+
+	bulkDelete := func(body string) BulkDeleteResp {
+		var resp BulkDeleteResp
+		require.Nil(t, json.Unmarshal(tc.POST("/devices/bulk-delete", 200, strings.NewReader(body), headers...), &resp))
+		return resp
+	}
+	assertDeleted := func(expected ...string) {
+		for _, uuid := range []string{"old1", "old2", "old3", "new1"} {
+			d, err := tc.api.DeviceGet(uuid)
+			require.Nil(t, err)
+			assert.Equal(t, slices.Contains(expected, uuid), d == nil, uuid)
+		}
+	}
+
+	// A dry run reports matching devices, but deletes none.
+	resp := bulkDelete(stale + `,"dry-run":true}`)
+	assert.Equal(t, BulkDeleteResp{Count: 3, Uuids: []string{"old1", "old2", "old3"}}, resp)
+	resp = bulkDelete(stale + `,"selector":{"env":"lab"},"dry-run":true}`)
+	assert.Equal(t, BulkDeleteResp{Count: 1, Uuids: []string{"old2"}}, resp)
+	assertDeleted()
+
+	resp = bulkDelete(stale + `,"selector":{"env":"lab"}}`)
+	assert.Equal(t, BulkDeleteResp{Count: 1, Uuids: []string{"old2"}}, resp)
+	assertDeleted("old2")
+
+	// Devices claimed by other users are skipped, unless an admin deletes them.
+	old3, err := tc.api.DeviceGet("old3")
+	require.Nil(t, err)
+	ok, err := old3.SetClaimant("other")
+	require.Nil(t, err)
+	require.True(t, ok)
+	resp = bulkDelete(stale + "}")
+	assert.Equal(t, BulkDeleteResp{Count: 1, Uuids: []string{"old1"}}, resp)
+	assertDeleted("old1", "old2")
+	tc.u.AllowedScopes |= users.ScopeAdminR
+	resp = bulkDelete(stale + `,"dry-run":true}`)
+	assert.Equal(t, BulkDeleteResp{Count: 1, Uuids: []string{"old3"}}, resp)
+	resp = bulkDelete(stale + "}")
+	assert.Equal(t, BulkDeleteResp{Count: 1, Uuids: []string{"old3"}}, resp)
+	assertDeleted("old1", "old2", "old3")
+	rollout, err = tc.api.GetRollout("tag1", "update1", "roll1", "prod")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"new1"}, rollout.Effect)
+
+	// Deleted devices are not matched again.
+	resp = bulkDelete(stale + "}")
+	assert.Equal(t, BulkDeleteResp{Count: 0, Uuids: []string{}}, resp)
+
+	events, err := tc.u.GetAuditEvents()
+	require.Nil(t, err)
+	assert.Equal(t, "Deleted 1 devices by filter", events[len(events)-1].Event)
+}
+
+func TestApiDeviceGroupLabel(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesRU
+	headers := []string{"content-type", "application/json"}
+	_, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
+	require.Nil(t, err)
+	changes, cancel := tc.api.SubscribeDeviceChanges("test-device-1", 10)
+	defer cancel()
+	assertChanges := func(expected ...string) {
+		var kinds []string
+		for len(changes) > 0 {
+			change := <-changes
+			assert.Equal(t, "test-device-1", change.Uuid)
+			kinds = append(kinds, change.Kind)
+		}
+		assert.Equal(t, expected, kinds)
+	}
+	assertGroup := func(expected string) {
+		d, err := tc.gw.DeviceGet("test-device-1")
+		require.Nil(t, err)
+		assert.Equal(t, expected, d.GroupName)
+		device, err := tc.api.DeviceGet("test-device-1")
+		require.Nil(t, err)
+		assert.Equal(t, expected, device.Labels["group"])
+	}
+
+	tc.PATCH("/devices/test-device-1/labels", 200, `{"upserts":{"group":"grp1"}}`, headers...)
+	assertGroup("grp1")
+	assertChanges(storage.DeviceChangeLabels, storage.DeviceChangeGroup)
+	var groups []string
+	require.Nil(t, json.Unmarshal(tc.GET("/known-labels/device-groups", 200), &groups))
+	assert.Equal(t, []string{"grp1"}, groups)
+
+	tc.PATCH("/devices/test-device-1/labels", 200, `{"upserts":{"name":"dev1"}}`, headers...)
+	assertGroup("grp1")
+	assertChanges(storage.DeviceChangeLabels)
+
+	tc.PATCH("/devices/test-device-1/labels", 200, `{"deletes":["group"]}`, headers...)
+	assertGroup("")
+	assertChanges(storage.DeviceChangeLabels, storage.DeviceChangeGroup)
+
+	// Labels reported by the device itself keep the group in sync as well.
+	d, err := tc.gw.DeviceGet("test-device-1")
+	require.Nil(t, err)
+	grp2 := "grp2"
+	require.Nil(t, d.PatchLabels(map[string]*string{"group": &grp2}))
+	assert.Equal(t, "grp2", d.GroupName)
+	assertGroup("grp2")
+	assertChanges(storage.DeviceChangeLabels, storage.DeviceChangeGroup)
+}
+
+func TestApiHead(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesR | users.ScopeUpdatesR
+	_, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
+	require.Nil(t, err)
+	require.Nil(t, tc.fs.Updates.Prod.Rollouts.WriteFile("tag1", "update1", "roll1", `{"uuids":["test-device-1"]}`))
+
+	head := func(resource string, status int) *httptest.ResponseRecorder {
+		rec := tc.Do(httptest.NewRequest(http.MethodHead, "/v1"+resource, nil))
+		assert.Equal(t, status, rec.Code, resource)
+		assert.Empty(t, rec.Body.Bytes(), resource)
+		return rec
+	}
+	for _, resource := range []string{"/devices/test-device-1", "/updates/prod/tag1/update1/rollouts/roll1"} {
+		get := tc.Do(httptest.NewRequest(http.MethodGet, "/v1"+resource, nil))
+		require.Equal(t, 200, get.Code)
+		require.NotEmpty(t, get.Header().Get("ETag"))
+		rec := head(resource, 200)
+		assert.Equal(t, get.Header().Get("ETag"), rec.Header().Get("ETag"), resource)
+		assert.Equal(t, echo.MIMEApplicationJSON, rec.Header().Get("Content-Type"), resource)
+	}
+	head("/devices/test-device-2", 404)
+	head("/updates/prod/tag1/update1/rollouts/roll2", 404)
+
+	// The ETag changes along with the resource.
+	etag := head("/devices/test-device-1", 200).Header().Get("ETag")
+	_, err = tc.api.SetUpdateName("", "update1", "prod", []string{"test-device-1"}, nil, "", "")
+	require.Nil(t, err)
+	assert.NotEqual(t, etag, head("/devices/test-device-1", 200).Header().Get("ETag"))
+
+	tc.u.AllowedScopes = 0
+	rec := tc.Do(httptest.NewRequest(http.MethodHead, "/v1/devices/test-device-1", nil))
+	assert.Equal(t, 403, rec.Code)
+}
+
+func TestApiRolloutAudit(t *testing.T) {
+	for _, audit := range []RolloutAudit{RolloutAuditSummary, RolloutAuditDevices, RolloutAuditNone} {
+		t.Run(string(audit), func(t *testing.T) {
+			tc := NewTestClient(t, WithRolloutAudit(audit))
+			require.Nil(t, tc.users.Create(tc.u))
+			tc.u.AllowedScopes = users.ScopeUpdatesRU
+			require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
+			for _, uuid := range []string{"prod1", "prod2", "prod3", "prod4"} {
+				d, err := tc.gw.DeviceCreate(uuid, "pubkey", true)
+				require.Nil(t, err)
+				require.Nil(t, d.CheckIn("", "tag1", "", ""))
+			}
+			_, err := tc.api.SetUpdateName("tag1", "update0", "prod", []string{"prod1", "prod2"}, nil, "", "")
+			require.Nil(t, err)
+			_, err = tc.api.SetUpdateName("tag1", "update1", "prod", []string{"prod3"}, nil, "", "")
+			require.Nil(t, err)
+			events, err := tc.u.GetAuditEvents()
+			require.Nil(t, err)
+			numEvents := len(events)
+
+			tc.PUT("/updates/prod/tag1/update1/rollouts/roll1", 202,
+				`{"uuids":["prod1","prod2","prod3","prod4"]}`, "content-type", "application/json")
+			require.Eventually(t, func() bool {
+				d, err := tc.api.DeviceGet("prod4")
+				return err == nil && d.UpdateName == "update1"
+			}, time.Second, 10*time.Millisecond)
+			// The audit log is written right after devices are updated.
+			var logged []string
+			require.Eventually(t, func() bool {
+				events, err := tc.u.GetAuditEvents()
+				require.Nil(t, err)
+				logged = nil
+				for _, e := range events[numEvents:] {
+					logged = append(logged, e.Event)
+				}
+				return audit == RolloutAuditNone || len(logged) > 0
+			}, time.Second, 10*time.Millisecond)
+
+			// prod3 was already assigned to the update, so it is not audited.
+			switch audit {
+			case RolloutAuditSummary:
+				assert.Equal(t, []string{
+					"Rollout tag1/update1/roll1 moved 3 devices: 1 from no update, 2 from update update0",
+				}, logged)
+			case RolloutAuditDevices:
+				assert.Equal(t, []string{
+					"Rollout tag1/update1/roll1 moved device prod1 from update update0",
+					"Rollout tag1/update1/roll1 moved device prod2 from update update0",
+					"Rollout tag1/update1/roll1 moved device prod4 from no update",
+				}, logged)
+			case RolloutAuditNone:
+				assert.Empty(t, logged)
+			}
+		})
+	}
+}
+
+func TestCertExpiryNotice(t *testing.T) {
+	tc := NewTestClient(t)
+	now := time.Unix(1700000000, 0)
+	clock.Now = func() time.Time { return now }
+	defer func() { clock.Now = time.Now }()
+	for i, notAfter := range []time.Time{
+		now.Add(24 * time.Hour),
+		now.Add(48 * time.Hour),
+		now.Add(72 * time.Hour),
+		now.Add(365 * 24 * time.Hour),
+	} {
+		d, err := tc.gw.DeviceCreate(fmt.Sprintf("test-device-%d", i), fmt.Sprintf("pubkey%d", i), false)
+		require.Nil(t, err)
+		require.Nil(t, d.SetCertNotAfter(notAfter.Unix()))
+	}
+	// A device which never authenticated has no known expiry and is not counted.
+	_, err := tc.gw.DeviceCreate("test-device-new", "pubkey-new", false)
+	require.Nil(t, err)
+
+	expiring, total, err := tc.api.CertExpiryCounts(now.Add(30 * 24 * time.Hour).Unix())
+	require.Nil(t, err)
+	assert.Equal(t, 3, expiring)
+	assert.Equal(t, 4, total)
+
+	runNotice := func(ratio float64) string {
+		var buf bytes.Buffer
+		ctx := CtxWithLog(tc.ctx, slog.New(slog.NewTextHandler(&buf, nil)))
+		d := daemons.New(ctx, tc.api, tc.users, daemons.WithCertExpiryNotice(30*24*time.Hour, ratio, time.Hour))
+		// The watchdog checks once on start, and Shutdown waits for it to pick the stop after that check.
+		d.Start()
+		d.Shutdown()
+		return buf.String()
+	}
+	assert.Contains(t, runNotice(0.5), "Many device certificates are nearing expiry")
+	assert.NotContains(t, runNotice(0.9), "Many device certificates are nearing expiry")
+
+	tc.GET("/admin/metrics", 403)
+	tc.u.AllowedScopes = users.ScopeAdminR
+	var metrics map[string]any
+	require.Nil(t, json.Unmarshal(tc.GET("/admin/metrics", 200), &metrics))
+	assert.Equal(t, 3.0, metrics["device_certs_expiring"])
+	assert.Equal(t, 4.0, metrics["device_certs_total"])
+	assert.NotContains(t, metrics, "cmdline")
+
+	// The window starts at the current time, so all certificates are expiring later on.
+	now = now.Add(340 * 24 * time.Hour)
+	assert.Contains(t, runNotice(0.9), "Many device certificates are nearing expiry")
+	require.Nil(t, json.Unmarshal(tc.GET("/admin/metrics", 200), &metrics))
+	assert.Equal(t, 4.0, metrics["device_certs_expiring"])
+}
+
+func TestApiRolloutDaemon(t *testing.T) {
+	tc := NewTestClient(t)
+
+	daemons := daemons.New(tc.ctx, tc.api, tc.users, daemons.WithRolloverInterval(20*time.Millisecond))
+
+	daemons.Start()
+	defer daemons.Shutdown()
+	tc.u.AllowedScopes = users.ScopeUpdatesR
+
+	require.Nil(t, tc.fs.Updates.Ci.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag2", "update2", "foo", "bar"))
+	d, err := tc.gw.DeviceCreate("ci1", "pubkey1", false)
+	require.Nil(t, err)
+	require.Nil(t, d.CheckIn("", "tag1", "", ""))
+	d, err = tc.gw.DeviceCreate("prod1", "pubkey2", true)
+	require.Nil(t, err)
+	require.Nil(t, d.CheckIn("", "tag2", "", ""))
+
+	s := func(data []byte) string {
+		return strings.TrimSpace(string(data))
+	}
+
+	// Emulate a non-committed rollout (file present, database not updated).
+	require.Nil(t, tc.api.CreateRollout("tag1", "update1", "roll1", "ci", Rollout{Uuids: []string{"ci1"}}))
+	require.Nil(t, tc.api.CreateRollout("tag2", "update2", "roll2", "prod", Rollout{Uuids: []string{"prod1"}}))
+
+	// Before the watchdog daemon processing, rollouts are not yet committed.
+	data := tc.GET("/updates/ci/tag1/update1/rollouts/roll1", 200)
+	assert.Equal(t, `{"uuids":["ci1"],"committed":false}`, s(data))
+	data = tc.GET("/updates/prod/tag2/update2/rollouts/roll2", 200)
+	assert.Equal(t, `{"uuids":["prod1"],"committed":false}`, s(data))
+	dev, err := tc.api.DeviceGet("ci1")
+	require.Nil(t, err)
+	assert.Equal(t, "", dev.UpdateName)
+	dev, err = tc.api.DeviceGet("prod1")
+	require.Nil(t, err)
+	assert.Equal(t, "", dev.UpdateName)
+
+	// After the watchdog daemon processing, rollouts are committed.
+	time.Sleep(60 * time.Millisecond)
+	data = tc.GET("/updates/ci/tag1/update1/rollouts/roll1", 200)
+	assert.Equal(t, `{"uuids":["ci1"],"effective-uuids":["ci1"],"committed":true}`, s(data))
+	data = tc.GET("/updates/prod/tag2/update2/rollouts/roll2", 200)
+	assert.Equal(t, `{"uuids":["prod1"],"effective-uuids":["prod1"],"committed":true}`, s(data))
+	dev, err = tc.api.DeviceGet("ci1")
+	assert.Nil(t, err)
+	assert.Equal(t, "update1", dev.UpdateName)
+	dev, err = tc.api.DeviceGet("prod1")
+	assert.Nil(t, err)
+	assert.Equal(t, "update2", dev.UpdateName)
+}
+
+func TestApiRolloutDaemonGracePeriod(t *testing.T) {
+	tc := NewTestClient(t)
+	var now atomic.Int64
+	now.Store(time.Now().UnixNano())
+	clock.Now = func() time.Time { return time.Unix(0, now.Load()) }
+	defer func() { clock.Now = time.Now }()
+	advance := func(d time.Duration) { now.Add(int64(d)) }
+
+	daemons := daemons.New(tc.ctx, tc.api, tc.users,
+		daemons.WithRolloverInterval(time.Hour), daemons.WithRolloverGracePeriod(10*time.Minute))
+	daemons.Start()
+	defer daemons.Shutdown()
+
+	require.Nil(t, tc.fs.Updates.Ci.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
+	d, err := tc.gw.DeviceCreate("ci1", "pubkey1", false)
+	require.Nil(t, err)
+	require.Nil(t, d.CheckIn("", "tag1", "", ""))
+
+	// Journal entries keep coming during several rollovers, see TestRolloverJournalLateEntries for late ones.
+	// The clock moves forward as they come, so that they land in every phase of the daemon.
+	const rollouts = 40
+	created := 0
+	require.Eventually(t, func() bool {
+		if created < rollouts {
+			name := fmt.Sprintf("roll%d", created)
+			require.Nil(t, tc.api.CreateRollout("tag1", "update1", name, "ci", Rollout{Uuids: []string{"ci1"}}))
+			created++
+		}
+		advance(5 * time.Minute)
+		for i := range created {
+			rollout, err := tc.api.GetRollout("tag1", "update1", fmt.Sprintf("roll%d", i), "ci")
+			require.Nil(t, err)
+			if !rollout.Commit {
+				return false
+			}
+		}
+		return created == rollouts
+	}, 10*time.Second, 10*time.Millisecond, "all journaled rollouts must be committed")
+}
+
+func TestApiUpdateChannel(t *testing.T) {
+	tc := NewTestClient(t)
+	require.Nil(t, tc.fs.AddUpdatesChannel("staging", true))
+	assert.NotNil(t, tc.fs.AddUpdatesChannel("staging", true))
+	assert.NotNil(t, tc.fs.AddUpdatesChannel("Bad Name", true))
+
+	daemons := daemons.New(tc.ctx, tc.api, tc.users, daemons.WithRolloverInterval(20*time.Millisecond))
+	daemons.Start()
+	defer daemons.Shutdown()
+	tc.u.AllowedScopes = users.ScopeUpdatesRU
+
+	ch, ok := tc.fs.Updates.Channel("staging")
+	require.True(t, ok)
+	require.Nil(t, ch.Ostree.WriteFile("tag2", "update2", "foo", "bar"))
+	d, err := tc.gw.DeviceCreate("ci1", "pubkey1", false)
+	require.Nil(t, err)
+	require.Nil(t, d.CheckIn("", "tag2", "", ""))
+	d, err = tc.gw.DeviceCreate("prod1", "pubkey2", true)
+	require.Nil(t, err)
+	require.Nil(t, d.CheckIn("", "tag2", "", ""))
+
+	tc.GET("/updates/unknown", 404)
+	data := tc.GET("/updates/staging", 200)
+	assert.Equal(t, `{"tag2":["update2"]}`, strings.TrimSpace(string(data)))
+	data = tc.GET("/updates/prod", 200)
+	assert.Equal(t, `{}`, strings.TrimSpace(string(data)))
+
+	// Only production devices may follow a channel backed by prod.
+	tc.PUT("/updates/staging/tag2/update2/rollouts/roll1", 400,
+		`{"uuids":["ci1"]}`, "content-type", "application/json")
+	tc.PUT("/updates/staging/tag2/update2/rollouts/roll1", 202,
+		`{"uuids":["prod1"]}`, "content-type", "application/json")
+
+	time.Sleep(60 * time.Millisecond)
+	data = tc.GET("/updates/staging/tag2/update2/rollouts/roll1", 200)
+	assert.Equal(t, `{"uuids":["prod1"],"effective-uuids":["prod1"],"committed":true,"editor":"root"}`, strings.TrimSpace(string(data)))
+	dev, err := tc.api.DeviceGet("prod1")
+	require.Nil(t, err)
+	assert.Equal(t, "update2", dev.UpdateName)
+	assert.Equal(t, "staging", dev.UpdateChannel)
+}
+
+func TestApiUpdateTail(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.GET("/updates/prod/tag1/update1/tail", 403)
 	tc.u.AllowedScopes = users.ScopeUpdatesR
 
 	d, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
@@ -817,7 +2006,7 @@ func TestApiUpdateTail(t *testing.T) {
 	d, err = tc.gw.DeviceCreate("test-device-3", "pubkey1", true)
 	require.Nil(t, err)
 	require.Nil(t, d.CheckIn("", "tag1", "", ""))
-	_, err = tc.api.SetUpdateName("tag1", "update1", true, []string{"test-device-1", "test-device-2"}, nil)
+	_, err = tc.api.SetUpdateName("tag1", "update1", "prod", []string{"test-device-1", "test-device-2"}, nil, "", "")
 	require.Nil(t, err)
 
 	d1, err := tc.gw.DeviceGet("test-device-1")
@@ -914,41 +2103,641 @@ data: {"uuid":"test-device-1","correlationId":"uuid-1","target-name":"intel-core
 	require.Equal(t, expectedStream3, rec3.Body.String())
 	tc.assertNotDone(done3)
 
-	cancel() // This is where we disconnect, closing all holding handlers.
-	time.Sleep(10 * time.Millisecond)
-	tc.assertDone(done1)
-	tc.assertDone(done2)
-	tc.assertDone(done3)
+	cancel() // This is where we disconnect, closing all holding handlers.
+	time.Sleep(10 * time.Millisecond)
+	tc.assertDone(done1)
+	tc.assertDone(done2)
+	tc.assertDone(done3)
+
+	// TODO: Add rollout tail tests
+}
+
+func TestApiUpdateTailLines(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeUpdatesR
+
+	d, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
+	require.Nil(t, err)
+	require.Nil(t, d.CheckIn("", "tag1", "", ""))
+	_, err = tc.api.SetUpdateName("tag1", "update1", "prod", []string{"test-device-1"}, nil, "", "")
+	require.Nil(t, err)
+	d, err = tc.gw.DeviceGet("test-device-1")
+	require.Nil(t, err)
+	for _, corId := range []string{"uuid-1", "uuid-2", "uuid-3"} {
+		require.Nil(t, d.ProcessEvents(generateUpdateEvents(corId, "", 1)))
+	}
+	// Event IDs are numbers of lines across rotations of the log.
+	retention := storage.LogRetention{MaxSize: 1, MaxFiles: 1}
+	require.Nil(t, tc.fs.Updates.Prod.Logs.RotateFile("tag1", "update1", storage.LogRolloutsFile, retention))
+
+	tc.GET("/updates/prod/tag1/update1/tail?tail=-1", 400)
+	tc.GET("/updates/prod/tag1/update1/tail?tail=x", 400)
+
+	ctx, cancel := context.WithCancel(tc.ctx)
+	tc.ctx = ctx
+	event := func(id int, corId string) string {
+		return fmt.Sprintf(`event: log
+id: %d
+data: {"uuid":"test-device-1","correlationId":"%s","target-name":"intel-corei7-64-lmp-23","status":"Download started","deviceTime":"2023-12-12T12:00:00"}
+
+`, id, corId)
+	}
+
+	done1 := make(chan bool)
+	rec1 := tc.DoAsync(httptest.NewRequest(http.MethodGet, "/v1/updates/prod/tag1/update1/tail?tail=1", nil), done1)
+	// Tail larger than the history replays everything.
+	done2 := make(chan bool)
+	rec2 := tc.DoAsync(httptest.NewRequest(http.MethodGet, "/v1/updates/prod/tag1/update1/tail?tail=10", nil), done2)
+	// Last-Event-ID takes precedence when it is further than the tail.
+	done3 := make(chan bool)
+	req3 := httptest.NewRequest(http.MethodGet, "/v1/updates/prod/tag1/update1/tail?tail=3", nil)
+	req3.Header.Add("Last-Event-ID", "2")
+	rec3 := tc.DoAsync(req3, done3)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, event(3, "uuid-3"), rec1.Body.String())
+	assert.Equal(t, event(1, "uuid-1")+event(2, "uuid-2")+event(3, "uuid-3"), rec2.Body.String())
+	assert.Equal(t, event(3, "uuid-3"), rec3.Body.String())
+
+	// Live streaming continues after the replayed lines.
+	require.Nil(t, d.ProcessEvents(generateUpdateEvents("uuid-4", "", 1)))
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, event(3, "uuid-3")+event(4, "uuid-4"), rec1.Body.String())
+
+	// Lines removed by the log retention are not replayed, and do not change IDs of the kept ones.
+	require.Nil(t, tc.fs.Updates.Prod.Logs.RotateFile("tag1", "update1", storage.LogRolloutsFile, retention))
+	done4 := make(chan bool)
+	rec4 := tc.DoAsync(httptest.NewRequest(http.MethodGet, "/v1/updates/prod/tag1/update1/tail?tail=10", nil), done4)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, event(4, "uuid-4"), rec4.Body.String())
+
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	tc.assertDone(done1)
+	tc.assertDone(done2)
+	tc.assertDone(done3)
+	tc.assertDone(done4)
+}
+
+func TestApiUpdateTailSince(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeUpdatesR
+
+	d, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
+	require.Nil(t, err)
+	require.Nil(t, d.CheckIn("", "tag1", "", ""))
+	_, err = tc.api.SetUpdateName("tag1", "update1", "prod", []string{"test-device-1"}, nil, "", "")
+	require.Nil(t, err)
+	d, err = tc.gw.DeviceGet("test-device-1")
+	require.Nil(t, err)
+	times := map[string]string{
+		"uuid-1": "2023-12-12T12:00:00Z",
+		"uuid-2": "bad time",
+		"uuid-3": "2023-12-12T12:02:00Z",
+		"uuid-4": "2023-12-12T12:01:00Z",
+	}
+	process := func(corId string) {
+		events := generateUpdateEvents(corId, "", 1)
+		events[0].DeviceTime = times[corId]
+		require.Nil(t, d.ProcessEvents(events))
+	}
+	for _, corId := range []string{"uuid-1", "uuid-2", "uuid-3"} {
+		process(corId)
+	}
+
+	tc.GET("/updates/prod/tag1/update1/tail?since=yesterday", 400)
+	tc.GET("/updates/prod/tag1/update1/tail?since=2023-12-12T12:00:00", 400)
+
+	ctx, cancel := context.WithCancel(tc.ctx)
+	tc.ctx = ctx
+	event := func(id int, corId string) string {
+		return fmt.Sprintf(`event: log
+id: %d
+data: {"uuid":"test-device-1","correlationId":"%s","target-name":"intel-corei7-64-lmp-23","status":"Download started","deviceTime":"%s"}
+
+`, id, corId, times[corId])
+	}
+
+	// Lines before the first one after the timestamp are skipped, including those with an unparsable time.
+	done1 := make(chan bool)
+	rec1 := tc.DoAsync(httptest.NewRequest(http.MethodGet, "/v1/updates/prod/tag1/update1/tail?since=2023-12-12T12:00:00Z", nil), done1)
+	// Time zones are respected.
+	done2 := make(chan bool)
+	rec2 := tc.DoAsync(httptest.NewRequest(http.MethodGet, "/v1/updates/prod/tag1/update1/tail?since=2023-12-12T11:59:00-01:00", nil), done2)
+	// The furthest of Last-Event-ID, tail, and since wins.
+	done3 := make(chan bool)
+	req3 := httptest.NewRequest(http.MethodGet, "/v1/updates/prod/tag1/update1/tail?since=2023-12-12T11:00:00Z&tail=3", nil)
+	req3.Header.Add("Last-Event-ID", "1")
+	rec3 := tc.DoAsync(req3, done3)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, event(3, "uuid-3"), rec1.Body.String())
+	assert.Equal(t, "", rec2.Body.String())
+	assert.Equal(t, event(2, "uuid-2")+event(3, "uuid-3"), rec3.Body.String())
+
+	// Live streaming continues regardless of the device time of new lines.
+	process("uuid-4")
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, event(3, "uuid-3")+event(4, "uuid-4"), rec1.Body.String())
+	assert.Equal(t, event(4, "uuid-4"), rec2.Body.String())
+
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	tc.assertDone(done1)
+	tc.assertDone(done2)
+	tc.assertDone(done3)
+}
+
+func TestApiDeviceDelete(t *testing.T) {
+	tc := NewTestClient(t)
+
+	// Create a device
+	_, err := tc.gw.DeviceCreate("del-device", "pubkey", false)
+	require.Nil(t, err)
+
+	// No permission
+	tc.DELETE("/devices/del-device", 403)
+
+	// Wrong scope
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	tc.DELETE("/devices/del-device", 403)
+
+	// With delete scope
+	tc.u.AllowedScopes = users.ScopeDevicesD
+
+	// 404 for non-existent device
+	tc.DELETE("/devices/no-such-device", 404)
+
+	// Successful delete
+	tc.DELETE("/devices/del-device", 204)
+
+	// Verify device is gone
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	tc.GET("/devices/del-device", 404)
+}
+
+func TestApiDeviceDeleteRolloutCleanup(t *testing.T) {
+	// Rollouts are changed holding file locks, as other processes sharing the storage may change them too.
+	storage.SetFileLocking(true)
+	defer storage.SetFileLocking(false)
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesD | users.ScopeUpdatesR
+
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
+	uuids := []string{"prod1", "prod2", "prod3", "prod4"}
+	for _, uuid := range uuids {
+		d, err := tc.gw.DeviceCreate(uuid, "pubkey", true)
+		require.Nil(t, err)
+		require.Nil(t, d.CheckIn("", "tag1", "", ""))
+	}
+	rollout := Rollout{Uuids: uuids}
+	require.Nil(t, tc.api.CreateRollout("tag1", "update1", "roll1", "prod", rollout))
+	require.Nil(t, tc.api.CommitRollout("tag1", "update1", "roll1", "prod", rollout))
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.Nil(t, os.Chtimes(tc.fs.Updates.Prod.Rollouts.FilePath("tag1", "update1", "roll1"), time.Time{}, modTime))
+
+	tc.DELETE("/devices/prod1", 204)
+	// Concurrent deletes do not lose each other's rollout changes.
+	var wg sync.WaitGroup
+	for _, uuid := range []string{"prod3", "prod4"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := tc.api.DeviceGet(uuid)
+			assert.Nil(t, err)
+			assert.Nil(t, d.Delete())
+		}()
+	}
+	wg.Wait()
+
+	data := tc.GET("/updates/prod/tag1/update1/rollouts/roll1", 200)
+	assert.Equal(t, `{"uuids":["prod1","prod2","prod3","prod4"],"effective-uuids":["prod2"],"committed":true}`,
+		strings.TrimSpace(string(data)))
+	// Dropping deleted devices does not change the rollout modification time, which orders rollout listings.
+	var items []RolloutListItem
+	data = tc.GET("/updates/prod/tag1/update1/rollouts?include=device-count", 200)
+	require.Nil(t, json.Unmarshal(data, &items))
+	assert.Equal(t, []RolloutListItem{
+		{Name: "roll1", Committed: true, DeviceCount: 1, ModifiedAt: modTime.Unix()},
+	}, items)
+}
+
+func TestApiRolloutListProgress(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeUpdatesR
+
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
+	for _, uuid := range []string{"prod1", "prod2", "prod3", "prod4"} {
+		d, err := tc.gw.DeviceCreate(uuid, "pubkey", true)
+		require.Nil(t, err)
+		require.Nil(t, d.CheckIn("", "tag1", "", ""))
+	}
+	dir := filepath.Join(tc.fs.Config.UpdatesProdDir(), "tag1", "update1", storage.UpdatesRolloutsDir)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, uuids := range [][]string{{"prod1", "prod2"}, {"prod3", "prod4"}} {
+		name := fmt.Sprintf("roll%d", i+1)
+		rollout := Rollout{Uuids: uuids}
+		require.Nil(t, tc.api.CreateRollout("tag1", "update1", name, "prod", rollout))
+		require.Nil(t, tc.api.CommitRollout("tag1", "update1", name, "prod", rollout))
+		// Rollouts are listed in the order of their file modification time.
+		modTime := base.Add(time.Duration(i) * time.Hour)
+		require.Nil(t, os.Chtimes(filepath.Join(dir, name), modTime, modTime))
+	}
+	// An empty rollout log means all devices are pending.
+	var items []RolloutListItem
+	data := tc.GET("/updates/prod/tag1/update1/rollouts?include=progress", 200)
+	require.Nil(t, json.Unmarshal(data, &items))
+	assert.Equal(t, []RolloutListItem{
+		{Name: "roll1", Committed: true, DeviceCount: 2, Progress: &RolloutProgress{Pending: 2}},
+		{Name: "roll2", Committed: true, DeviceCount: 2, Progress: &RolloutProgress{Pending: 2}},
+	}, withoutModTimes(t, items))
+
+	for _, line := range []string{
+		`{"uuid":"prod1","status":"Download started"}`,
+		`{"uuid":"prod2","status":"Download started"}`,
+		`{"uuid":"prod1","status":"Update succeeded"}`,
+		`{"uuid":"prod2","status":"Installation completed; failed"}`,
+		`{"uuid":"prod3","status":"Installation applied; awaiting update finalization"}`,
+		// Only final outcomes of an update count as a success or a failure.
+		`{"uuid":"prod4","status":"Download completed; failed"}`,
+	} {
+		require.Nil(t, tc.fs.Updates.Prod.Logs.AppendFile("tag1", "update1", storage.LogRolloutsFile, line+"\n"))
+		// The progress spans rotated logs.
+		retention := storage.LogRetention{MaxSize: 1, MaxFiles: 10}
+		require.Nil(t, tc.fs.Updates.Prod.Logs.RotateFile("tag1", "update1", storage.LogRolloutsFile, retention))
+	}
+	data = tc.GET("/updates/prod/tag1/update1/rollouts?include=progress", 200)
+	require.Nil(t, json.Unmarshal(data, &items))
+	assert.Equal(t, []RolloutListItem{
+		{Name: "roll1", Committed: true, DeviceCount: 2, Progress: &RolloutProgress{Succeeded: 1, Failed: 1}},
+		{Name: "roll2", Committed: true, DeviceCount: 2, Progress: &RolloutProgress{InProgress: 2}},
+	}, withoutModTimes(t, items))
+
+	// Other listings do not include progress.
+	data = tc.GET("/updates/prod/tag1/update1/rollouts?include=device-count", 200)
+	assert.NotContains(t, string(data), "progress")
+}
+
+// withoutModTimes checks that rollout list items have modification times and then clears them for comparisons.
+func withoutModTimes(t *testing.T, items []RolloutListItem) []RolloutListItem {
+	for i := range items {
+		assert.NotZero(t, items[i].ModifiedAt, items[i].Name)
+		items[i].ModifiedAt = 0
+	}
+	return items
+}
+
+func TestApiRolloutListTimestamps(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeUpdatesR
+
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
+	dir := filepath.Join(tc.fs.Config.UpdatesProdDir(), "tag1", "update1", storage.UpdatesRolloutsDir)
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, name := range []string{"roll3", "roll1", "roll2"} {
+		require.Nil(t, tc.api.CreateRollout("tag1", "update1", name, "prod", Rollout{Uuids: []string{"prod1"}}))
+		modTime := base.Add(time.Duration(i) * time.Hour)
+		require.Nil(t, os.Chtimes(filepath.Join(dir, name), modTime, modTime))
+	}
+
+	var items []RolloutListItem
+	data := tc.GET("/updates/prod/tag1/update1/rollouts?include=device-count", 200)
+	require.Nil(t, json.Unmarshal(data, &items))
+	assert.Equal(t, []RolloutListItem{
+		{Name: "roll3", ModifiedAt: base.Unix()},
+		{Name: "roll1", ModifiedAt: base.Add(time.Hour).Unix()},
+		{Name: "roll2", ModifiedAt: base.Add(2 * time.Hour).Unix()},
+	}, items)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/updates/prod/tag1/update1/rollouts?include=device-count&limit=2&offset=1", nil)
+	rec := tc.Do(req)
+	require.Equal(t, 200, rec.Code)
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &items))
+	assert.Equal(t, []RolloutListItem{
+		{Name: "roll1", ModifiedAt: base.Add(time.Hour).Unix()},
+		{Name: "roll2", ModifiedAt: base.Add(2 * time.Hour).Unix()},
+	}, items)
+	assert.Contains(t, rec.Header().Get("Link"), "include=device-count")
+
+	tc.GET("/updates/prod/tag1/update1/rollouts?limit=2", 400)
+	tc.GET("/updates/prod/tag1/update1/rollouts?include=device-count&offset=-1", 400)
+}
+
+func TestApiDeviceCancelUpdate(t *testing.T) {
+	tc := NewTestClient(t)
+	require.Nil(t, tc.users.Create(tc.u))
+
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
+	for _, uuid := range []string{"prod1", "prod2", "prod3"} {
+		d, err := tc.gw.DeviceCreate(uuid, "pubkey", true)
+		require.Nil(t, err)
+		require.Nil(t, d.CheckIn("", "tag1", "", ""))
+	}
+	rollout := Rollout{Uuids: []string{"prod1", "prod2"}}
+	require.Nil(t, tc.api.CreateRollout("tag1", "update1", "roll1", "prod", rollout))
+	require.Nil(t, tc.api.CommitRollout("tag1", "update1", "roll1", "prod", rollout))
+
+	tc.POST("/devices/prod1/cancel-update", 403, nil)
+	tc.u.AllowedScopes = users.ScopeDevicesRU | users.ScopeUpdatesR
+	tc.POST("/devices/no-such-device/cancel-update", 404, nil)
+	tc.POST("/devices/prod3/cancel-update", 409, nil)
+
+	tc.POST("/devices/prod1/cancel-update", 200, nil)
+	device, err := tc.api.DeviceGet("prod1")
+	require.Nil(t, err)
+	assert.Equal(t, "", device.UpdateName)
+	assert.Equal(t, "", device.UpdateChannel)
+	device, err = tc.api.DeviceGet("prod2")
+	require.Nil(t, err)
+	assert.Equal(t, "update1", device.UpdateName)
+
+	data := tc.GET("/updates/prod/tag1/update1/rollouts/roll1", 200)
+	assert.Equal(t, `{"uuids":["prod1","prod2"],"effective-uuids":["prod2"],"committed":true}`,
+		strings.TrimSpace(string(data)))
+	tc.POST("/devices/prod1/cancel-update", 409, nil)
+
+	events, err := tc.u.GetAuditEvents()
+	require.Nil(t, err)
+	assert.Equal(t, "Cancelled update tag1/update1 of device prod1", events[len(events)-1].Event)
+}
+
+func TestApiDeviceUpdatePut(t *testing.T) {
+	tc := NewTestClient(t)
+	require.Nil(t, tc.users.Create(tc.u))
+	headers := []string{"content-type", "application/json"}
+
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag1", "update2", "foo", "bar"))
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag2", "update3", "foo", "bar"))
+	require.Nil(t, tc.fs.Updates.Ci.Ostree.WriteFile("tag1", "update4", "foo", "bar"))
+	for _, uuid := range []string{"prod1", "prod2"} {
+		d, err := tc.gw.DeviceCreate(uuid, "pubkey", true)
+		require.Nil(t, err)
+		require.Nil(t, d.CheckIn("", "tag1", "", ""))
+	}
+	rollout := Rollout{Uuids: []string{"prod1"}}
+	require.Nil(t, tc.api.CreateRollout("tag1", "update1", "roll1", "prod", rollout))
+	require.Nil(t, tc.api.CommitRollout("tag1", "update1", "roll1", "prod", rollout))
+
+	tc.PUT("/devices/prod1/update", 403, `{"update":"update2"}`, headers...)
+	tc.u.AllowedScopes = users.ScopeDevicesRU | users.ScopeUpdatesRU
+	tc.PUT("/devices/no-such-device/update", 404, `{"update":"update2"}`, headers...)
+	tc.PUT("/devices/prod1/update", 400, `{}`, headers...)
+	// Updates of other tags or channels are not available for the device.
+	tc.PUT("/devices/prod1/update", 400, `{"update":"update3"}`, headers...)
+	tc.PUT("/devices/prod1/update", 400, `{"update":"update4"}`, headers...)
+	tc.PUT("/devices/prod1/update", 400, `{"update":"update4","channel":"ci"}`, headers...)
+	tc.PUT("/devices/prod1/update", 400, `{"update":"update2","channel":"no-such-channel"}`, headers...)
+	device, err := tc.api.DeviceGet("prod1")
+	require.Nil(t, err)
+	assert.Equal(t, "update1", device.UpdateName)
+
+	tc.PUT("/devices/prod1/update", 200, `{"update":"update2"}`, headers...)
+	device, err = tc.api.DeviceGet("prod1")
+	require.Nil(t, err)
+	assert.Equal(t, "update2", device.UpdateName)
+	assert.Equal(t, "prod", device.UpdateChannel)
+	// The device left the rollout of its previous update.
+	data := tc.GET("/updates/prod/tag1/update1/rollouts/roll1", 200)
+	assert.Equal(t, `{"uuids":["prod1"],"committed":true}`, strings.TrimSpace(string(data)))
+
+	events, err := tc.u.GetAuditEvents()
+	require.Nil(t, err)
+	assert.Equal(t, "Assigned device prod1 to update tag1/update2 without a rollout", events[len(events)-1].Event)
+
+	tc.POST("/devices/prod2/pin", 200, nil)
+	tc.PUT("/devices/prod2/update", 409, `{"update":"update2"}`, headers...)
+	device, err = tc.api.DeviceGet("prod2")
+	require.Nil(t, err)
+	assert.Equal(t, "", device.UpdateName)
+}
+
+func TestApiDeviceClaim(t *testing.T) {
+	tc := NewTestClient(t)
+	require.Nil(t, tc.users.Create(tc.u))
+	owner := tc.u.Username
+	headers := []string{"content-type", "application/json"}
+	for _, uuid := range []string{"dev1", "dev2"} {
+		_, err := tc.gw.DeviceCreate(uuid, "pubkey", false)
+		require.Nil(t, err)
+	}
+
+	tc.POST("/devices/dev1/claim", 403, nil)
+	tc.u.AllowedScopes = users.ScopeDevicesRU | users.ScopeDevicesD
+	tc.POST("/devices/no-such-device/claim", 404, nil)
+	tc.POST("/devices/dev1/claim", 200, nil)
+	tc.POST("/devices/dev1/claim", 200, nil)
+	device, err := tc.api.DeviceGet("dev1")
+	require.Nil(t, err)
+	assert.Equal(t, owner, device.ClaimedBy)
+
+	// The claimant may edit a claimed device.
+	tc.PATCH("/devices/dev1/labels", 200, `{"upserts":{"name":"mine"}}`, headers...)
+
+	// Other users may neither edit nor claim it.
+	tc.u.Username = "other"
+	tc.PATCH("/devices/dev1/labels", 403, `{"upserts":{"name":"theirs"}}`, headers...)
+	tc.PUT("/devices/dev1/labels", 403, `{"name":"theirs"}`, headers...)
+	tc.POST("/devices/dev1/cancel-update", 403, nil)
+	tc.DELETE("/devices/dev1", 403)
+	tc.DELETE("/devices/dev1/claim", 403)
+	tc.POST("/devices/dev1/claim", 409, nil)
+	// Unclaimed devices are editable by anyone.
+	tc.PATCH("/devices/dev2/labels", 200, `{"upserts":{"name":"theirs"}}`, headers...)
+	device, err = tc.api.DeviceGet("dev1")
+	require.Nil(t, err)
+	assert.Equal(t, "mine", device.Labels["name"])
+
+	// Admins may edit and claim devices claimed by others.
+	tc.u.AllowedScopes |= users.ScopeAdminR
+	tc.PATCH("/devices/dev1/labels", 200, `{"upserts":{"owner":"admin"}}`, headers...)
+	tc.POST("/devices/dev1/claim", 200, nil)
+	device, err = tc.api.DeviceGet("dev1")
+	require.Nil(t, err)
+	assert.Equal(t, "other", device.ClaimedBy)
+
+	// Ownership transfer: the claimant unclaims the device, and another user claims it.
+	tc.u.AllowedScopes &^= users.ScopeAdminR
+	tc.DELETE("/devices/dev1/claim", 200)
+	tc.u.Username = owner
+	tc.POST("/devices/dev1/claim", 200, nil)
+	device, err = tc.api.DeviceGet("dev1")
+	require.Nil(t, err)
+	assert.Equal(t, owner, device.ClaimedBy)
 
-	// TODO: Add rollout tail tests
+	events, err := tc.u.GetAuditEvents()
+	require.Nil(t, err)
+	assert.Equal(t, "Claimed device dev1", events[len(events)-1].Event)
+
+	// Of two users claiming an unclaimed device at the same time, only the first one gets it.
+	first, err := tc.api.DeviceGet("dev2")
+	require.Nil(t, err)
+	second, err := tc.api.DeviceGet("dev2")
+	require.Nil(t, err)
+	ok, err := first.SetClaimant("alice")
+	require.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = second.SetClaimant("bob")
+	require.Nil(t, err)
+	assert.False(t, ok)
+	device, err = tc.api.DeviceGet("dev2")
+	require.Nil(t, err)
+	assert.Equal(t, "alice", device.ClaimedBy)
 }
 
-func TestApiDeviceDelete(t *testing.T) {
+func TestApiDeviceClaimGroups(t *testing.T) {
 	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesRU
+	headers := []string{"content-type", "application/json"}
+	for _, uuid := range []string{"dev1", "dev2", "dev3"} {
+		_, err := tc.gw.DeviceCreate(uuid, "pubkey", false)
+		require.Nil(t, err)
+	}
+	lab := "lab"
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"site": &lab}, []string{"dev1", "dev2", "dev3"}))
+	for uuid, claimant := range map[string]string{"dev1": "other", "dev2": tc.u.Username} {
+		d, err := tc.api.DeviceGet(uuid)
+		require.Nil(t, err)
+		ok, err := d.SetClaimant(claimant)
+		require.Nil(t, err)
+		require.True(t, ok)
+	}
 
-	// Create a device
-	_, err := tc.gw.DeviceCreate("del-device", "pubkey", false)
+	// Devices claimed by other users are neither assigned to nor removed from a group.
+	data := tc.POST("/device-groups/lab/assign-by-filter", 200, strings.NewReader(`{"selector":{"site":"lab"}}`), headers...)
+	assert.Equal(t, `{"uuids":["dev2","dev3"]}`, strings.TrimSpace(string(data)))
+	tc.u.AllowedScopes |= users.ScopeAdminR
+	data = tc.POST("/device-groups/lab/assign-by-filter", 200, strings.NewReader(`{"selector":{"site":"lab"}}`), headers...)
+	assert.Equal(t, `{"uuids":["dev1","dev2","dev3"]}`, strings.TrimSpace(string(data)))
+
+	tc.u.AllowedScopes &^= users.ScopeAdminR
+	tc.DELETE("/device-groups/lab", 200)
+	for uuid, group := range map[string]string{"dev1": "lab", "dev2": "", "dev3": ""} {
+		d, err := tc.api.DeviceGet(uuid)
+		require.Nil(t, err)
+		assert.Equal(t, group, d.Labels["group"], uuid)
+	}
+	tc.DELETE("/device-groups/lab", 404)
+	tc.u.AllowedScopes |= users.ScopeAdminR
+	tc.DELETE("/device-groups/lab", 200)
+	d, err := tc.api.DeviceGet("dev1")
 	require.Nil(t, err)
+	assert.Equal(t, "", d.Labels["group"])
+}
 
-	// No permission
-	tc.DELETE("/devices/del-device", 403)
+func TestApiDevicePin(t *testing.T) {
+	tc := NewTestClient(t)
+	require.Nil(t, tc.users.Create(tc.u))
+
+	require.Nil(t, tc.fs.Updates.Prod.Ostree.WriteFile("tag1", "update1", "foo", "bar"))
+	grp := "grp"
+	for _, uuid := range []string{"prod1", "prod2", "prod3"} {
+		d, err := tc.gw.DeviceCreate(uuid, "pubkey", true)
+		require.Nil(t, err)
+		require.Nil(t, d.CheckIn("", "tag1", "", ""))
+	}
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"group": &grp}, []string{"prod3"}))
 
-	// Wrong scope
-	tc.u.AllowedScopes = users.ScopeDevicesR
-	tc.DELETE("/devices/del-device", 403)
+	tc.POST("/devices/prod1/pin", 403, nil)
+	tc.u.AllowedScopes = users.ScopeDevicesRU | users.ScopeUpdatesR
+	tc.POST("/devices/no-such-device/pin", 404, nil)
+	tc.POST("/devices/prod1/pin", 200, nil)
+	tc.POST("/devices/prod3/pin", 200, nil)
+	tc.POST("/devices/prod3/pin", 200, nil)
+	var device Device
+	require.Nil(t, json.Unmarshal(tc.GET("/devices/prod1", 200), &device))
+	assert.True(t, device.Pinned)
+
+	require.Nil(t, tc.fs.Updates.Prod.Rollouts.WriteFile("tag1", "update1", "roll1",
+		`{"uuids":["prod1","prod2"],"groups":["grp"]}`))
+	var targets RolloutTargets
+	require.Nil(t, json.Unmarshal(tc.GET("/updates/prod/tag1/update1/rollouts/roll1/targets", 200), &targets))
+	assert.Equal(t, []string{"prod2"}, targets.Effective)
+	assert.Equal(t, []RolloutTargetExclusion{
+		{Uuid: "prod1", Reason: "pinned"},
+		{Uuid: "prod3", Reason: "pinned"},
+	}, targets.Excluded)
+
+	// Pinned devices are skipped, whether a rollout targets them by UUID or by group.
+	rollout := Rollout{Uuids: []string{"prod1", "prod2"}, Groups: []string{"grp"}}
+	require.Nil(t, tc.api.CommitRollout("tag1", "update1", "roll1", "prod", rollout))
+	for uuid, update := range map[string]string{"prod1": "", "prod2": "update1", "prod3": ""} {
+		d, err := tc.api.DeviceGet(uuid)
+		require.Nil(t, err)
+		assert.Equal(t, update, d.UpdateName, uuid)
+	}
 
-	// With delete scope
-	tc.u.AllowedScopes = users.ScopeDevicesD
+	tc.DELETE("/devices/prod1/pin", 200)
+	d, err := tc.api.DeviceGet("prod1")
+	require.Nil(t, err)
+	assert.False(t, d.Pinned)
+	require.Nil(t, tc.api.CommitRollout("tag1", "update1", "roll1", "prod", rollout))
+	d, err = tc.api.DeviceGet("prod1")
+	require.Nil(t, err)
+	assert.Equal(t, "update1", d.UpdateName)
 
-	// 404 for non-existent device
-	tc.DELETE("/devices/no-such-device", 404)
+	events, err := tc.u.GetAuditEvents()
+	require.Nil(t, err)
+	assert.Equal(t, "Unpinned device prod1", events[len(events)-1].Event)
+}
 
-	// Successful delete
-	tc.DELETE("/devices/del-device", 204)
+func TestApiDeviceEvents(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.u.AllowedScopes = users.ScopeDevicesRU
+	headers := []string{"content-type", "application/json"}
+	d, err := tc.gw.DeviceCreate("dev1", "pubkey", false)
+	require.Nil(t, err)
+	_, err = tc.gw.DeviceCreate("dev2", "pubkey", false)
+	require.Nil(t, err)
+	tc.GET("/devices/no-such-device/events", 404)
 
-	// Verify device is gone
-	tc.u.AllowedScopes = users.ScopeDevicesR
-	tc.GET("/devices/del-device", 404)
+	ctx, cancel := context.WithCancel(tc.ctx)
+	tc.ctx = ctx
+	done := make(chan bool)
+	rec := tc.DoAsync(httptest.NewRequest(http.MethodGet, "/v1/devices/dev1/events", nil), done)
+	// The handler subscribes to changes before it flushes the response headers.
+	require.Eventually(t, func() bool { return rec.Flushed }, time.Second, time.Millisecond)
+	require.Equal(t, 200, rec.Code)
+	assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+
+	clock.Now = func() time.Time { return time.Unix(1700000000, 0) }
+	defer func() { clock.Now = time.Now }()
+	// Changes of other devices are not streamed, nor do they crowd out changes of the device.
+	for i := range 20 {
+		tc.PATCH("/devices/dev2/labels", 200, fmt.Sprintf(`{"upserts":{"name":"other-%d"}}`, i), headers...)
+	}
+	tc.PATCH("/devices/dev1/labels", 200, `{"upserts":{"name":"mine"}}`, headers...)
+	require.Nil(t, d.CheckIn("target", "main", "hash", ""))
+	expected := "" +
+		"event: labels\ndata: {\"uuid\":\"dev1\",\"kind\":\"labels\",\"time\":1700000000}\n\n" +
+		"event: check-in\ndata: {\"uuid\":\"dev1\",\"kind\":\"check-in\",\"time\":1700000000}\n\n"
+	require.Eventually(t, func() bool { return rec.Body.String() == expected }, time.Second, time.Millisecond)
+	tc.assertNotDone(done)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "Must be done")
+	}
+}
+
+func TestApiDeviceResetKey(t *testing.T) {
+	tc := NewTestClient(t)
+	require.Nil(t, tc.users.Create(tc.u))
+	_, err := tc.gw.DeviceCreate("dev1", "pubkey", false)
+	require.Nil(t, err)
+
+	tc.u.AllowedScopes = users.ScopeDevicesRU
+	tc.POST("/devices/dev1/reset-key", 403, nil)
+	tc.u.AllowedScopes |= users.ScopeAdminR
+	tc.POST("/devices/no-such-device/reset-key", 404, nil)
+	tc.POST("/devices/dev1/reset-key", 200, nil)
+
+	device, err := tc.api.DeviceGet("dev1")
+	require.Nil(t, err)
+	assert.Equal(t, "", device.PubKey)
+	events, err := tc.u.GetAuditEvents()
+	require.Nil(t, err)
+	assert.Equal(t, "Reset the key of device dev1", events[len(events)-1].Event)
 }
 
 func TestApiUploadConfigs(t *testing.T) {
@@ -999,6 +2788,87 @@ func TestApiUploadConfigs(t *testing.T) {
 	})
 }
 
+func TestApiUpdatePutInstallsLimit(t *testing.T) {
+	tc := NewTestClient(t)
+	headers := []string{"content-type", "application/json"}
+	tc.PUT("/updates/ci/main/v1/max-concurrent-installs", 403, `{"max-concurrent-installs":10}`, headers...)
+	tc.u.AllowedScopes = users.ScopeUpdatesRU
+
+	tc.PUT("/updates/ci/main/v1/max-concurrent-installs", 404, `{"max-concurrent-installs":10}`, headers...)
+	require.Nil(t, tc.fs.Updates.Ci.Tuf.WriteFile("main", "v1", "targets.json", `{}`))
+	tc.PUT("/updates/ci/main/v1/max-concurrent-installs", 400, `{"max-concurrent-installs":-1}`, headers...)
+	tc.PUT("/updates/ci/main/v1/max-concurrent-installs", 400, `not json`, headers...)
+
+	tc.PUT("/updates/ci/main/v1/max-concurrent-installs", 200, `{"max-concurrent-installs":10}`, headers...)
+	content, err := tc.fs.Updates.Ci.Settings.ReadFile("main", "v1", storage.SettingsMaxInstallsFile)
+	require.Nil(t, err)
+	assert.Equal(t, "10", content)
+}
+
+func TestApiUpdatePutTufRoot(t *testing.T) {
+	tc := NewTestClient(t)
+	pub1, priv1, err := ed25519.GenerateKey(nil)
+	require.Nil(t, err)
+	pub2, priv2, err := ed25519.GenerateKey(nil)
+	require.Nil(t, err)
+	keys := map[string]ed25519.PrivateKey{"k1": priv1, "k2": priv2}
+
+	// root builds root metadata trusting one key, with signatures of the signer keys.
+	root := func(version int, key string, pub ed25519.PublicKey, signers ...string) string {
+		signed := map[string]any{
+			"_type":   "root",
+			"version": version,
+			"expires": "2030-01-01T00:00:00Z",
+			"keys": map[string]any{
+				key: map[string]any{"keytype": "ED25519", "keyval": map[string]string{"public": hex.EncodeToString(pub)}},
+			},
+			"roles": map[string]any{"root": map[string]any{"keyids": []string{key}, "threshold": 1}},
+		}
+		canonical, err := json.Marshal(signed)
+		require.Nil(t, err)
+		sigs := []map[string]string{}
+		for _, signer := range signers {
+			sig := ed25519.Sign(keys[signer], canonical)
+			sigs = append(sigs, map[string]string{"keyid": signer, "sig": base64.StdEncoding.EncodeToString(sig)})
+		}
+		content, err := json.Marshal(map[string]any{"signatures": sigs, "signed": signed})
+		require.Nil(t, err)
+		return string(content)
+	}
+	tc.PUT("/updates/ci/main/v1/tuf/root", 403, root(3, "k1", pub1, "k1"))
+	tc.u.AllowedScopes = users.ScopeUpdatesRU
+
+	tc.PUT("/updates/ci/main/v1/tuf/root", 404, root(3, "k1", pub1, "k1"))
+	require.Nil(t, tc.fs.Updates.Ci.Tuf.WriteFile("main", "v1", "targets.json", `{}`))
+	tc.PUT("/updates/ci/main/v1/tuf/root", 404, root(3, "k1", pub1, "k1"))
+	require.Nil(t, tc.fs.Updates.Ci.Tuf.WriteFile("main", "v1", "1.root.json", root(1, "k1", pub1, "k1")))
+	require.Nil(t, tc.fs.Updates.Ci.Tuf.WriteFile("main", "v1", "2.root.json", root(2, "k1", pub1, "k1")))
+
+	tc.PUT("/updates/ci/main/v1/tuf/root", 400, "not json")
+	tc.PUT("/updates/ci/main/v1/tuf/root", 400, strings.Replace(root(3, "k1", pub1, "k1"), `"_type":"root"`, `"_type":"targets"`, 1))
+	tc.PUT("/updates/ci/main/v1/tuf/root", 400, root(3, "k1", pub1))
+	// The signature no longer matches the signed metadata.
+	tc.PUT("/updates/ci/main/v1/tuf/root", 400, strings.Replace(root(3, "k1", pub1, "k1"), "2030", "2031", 1))
+
+	// Rotating the root key needs signatures of both the current and the new root key.
+	tc.PUT("/updates/ci/main/v1/tuf/root", 400, root(3, "k2", pub2, "k1"))
+	tc.PUT("/updates/ci/main/v1/tuf/root", 400, root(3, "k2", pub2, "k2"))
+	tc.PUT("/updates/ci/main/v1/tuf/root", 201, root(3, "k2", pub2, "k1", "k2"))
+	content, err := tc.fs.Updates.Ci.Tuf.ReadFile("main", "v1", "3.root.json")
+	require.Nil(t, err)
+	assert.Equal(t, root(3, "k2", pub2, "k1", "k2"), content)
+	latest, err := tc.fs.Updates.Ci.Tuf.LatestRootMetaName("main", "v1")
+	require.Nil(t, err)
+	assert.Equal(t, "3.root.json", latest)
+
+	// Older, duplicate, and skipped versions are rejected.
+	tc.PUT("/updates/ci/main/v1/tuf/root", 409, root(2, "k2", pub2, "k2"))
+	tc.PUT("/updates/ci/main/v1/tuf/root", 409, root(3, "k2", pub2, "k2"))
+	tc.PUT("/updates/ci/main/v1/tuf/root", 409, root(5, "k2", pub2, "k2"))
+	tc.PUT("/updates/ci/main/v1/tuf/root", 400, root(4, "k1", pub1, "k1"))
+	tc.PUT("/updates/ci/main/v1/tuf/root", 201, root(4, "k2", pub2, "k2"))
+}
+
 func TestApiUpdateCreate(t *testing.T) {
 	tc := NewTestClient(t)
 
@@ -1124,3 +2994,633 @@ func gzipBuffer(t *testing.T, data *bytes.Buffer) *bytes.Buffer {
 	require.NoError(t, err)
 	return &buf
 }
+
+func TestApiDeviceGroupAssignByFilter(t *testing.T) {
+	tc := NewTestClient(t)
+	headers := []string{"content-type", "application/json"}
+	data := `{"selector":{"site":"lab"}}`
+	tc.POST("/device-groups/grp1/assign-by-filter", 403, strings.NewReader(data), headers...)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	tc.POST("/device-groups/grp1/assign-by-filter", 403, strings.NewReader(data), headers...)
+	tc.u.AllowedScopes = users.ScopeDevicesRU
+
+	for _, uuid := range []string{"test-device-1", "test-device-2", "test-device-3"} {
+		_, err := tc.gw.DeviceCreate(uuid, "pubkey", false)
+		require.Nil(t, err)
+	}
+	lab, hw := "lab", "rev2"
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"site": &lab}, []string{"test-device-1", "test-device-2"}))
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"hw": &hw}, []string{"test-device-2", "test-device-3"}))
+
+	tc.POST("/device-groups/grp1/assign-by-filter", 400, strings.NewReader(`{"selector":{}}`), headers...)
+	tc.POST("/device-groups/grp1/assign-by-filter", 400, strings.NewReader(`{"selector":{"Bad":"x"}}`), headers...)
+	tc.POST("/device-groups/bad^grp/assign-by-filter", 400, strings.NewReader(data), headers...)
+
+	var resp AssignByFilterResp
+	res := tc.POST("/device-groups/grp1/assign-by-filter", 200, strings.NewReader(data), headers...)
+	require.Nil(t, json.Unmarshal(res, &resp))
+	assert.ElementsMatch(t, []string{"test-device-1", "test-device-2"}, resp.Uuids)
+
+	// All labels of a selector must match.
+	res = tc.POST("/device-groups/grp2/assign-by-filter", 200, strings.NewReader(`{"selector":{"site":"lab","hw":"rev2"}}`), headers...)
+	require.Nil(t, json.Unmarshal(res, &resp))
+	assert.Equal(t, []string{"test-device-2"}, resp.Uuids)
+
+	res = tc.POST("/device-groups/grp3/assign-by-filter", 200, strings.NewReader(`{"selector":{"site":"home"}}`), headers...)
+	require.Nil(t, json.Unmarshal(res, &resp))
+	assert.Equal(t, []string{}, resp.Uuids)
+
+	var groups []string
+	require.Nil(t, json.Unmarshal(tc.GET("/known-labels/device-groups", 200), &groups))
+	assert.Equal(t, []string{"grp1", "grp2"}, groups)
+	device, err := tc.api.DeviceGet("test-device-1")
+	require.Nil(t, err)
+	assert.Equal(t, "grp1", device.Labels["group"])
+	device, err = tc.api.DeviceGet("test-device-3")
+	require.Nil(t, err)
+	assert.Equal(t, "", device.Labels["group"])
+}
+
+func TestApiDeviceSelectorGroups(t *testing.T) {
+	tc := NewTestClient(t)
+	headers := []string{"content-type", "application/json"}
+	tc.PUT("/device-groups/lab/selector", 403, `{"selector":{"site":"lab"}}`, headers...)
+	tc.u.AllowedScopes = users.ScopeDevicesRU
+
+	for _, uuid := range []string{"test-device-1", "test-device-2"} {
+		_, err := tc.gw.DeviceCreate(uuid, "pubkey", false)
+		require.Nil(t, err)
+	}
+	lab, hw := "lab", "rev2"
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"site": &lab, "hw": &hw}, []string{"test-device-1"}))
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"site": &lab}, []string{"test-device-2"}))
+
+	// No selector groups yet
+	var device apiStorage.Device
+	require.Nil(t, json.Unmarshal(tc.GET("/devices/test-device-1", 200), &device))
+	assert.Nil(t, device.Groups)
+
+	tc.PUT("/device-groups/lab/selector", 400, `{"selector":{}}`, headers...)
+	tc.PUT("/device-groups/lab/selector", 400, `{"selector":{"Bad":"x"}}`, headers...)
+	tc.PUT("/device-groups/bad^grp/selector", 400, `{"selector":{"site":"lab"}}`, headers...)
+
+	tc.PUT("/device-groups/lab/selector", 200, `{"selector":{"site":"lab"}}`, headers...)
+	tc.PUT("/device-groups/rev2/selector", 200, `{"selector":{"site":"home"}}`, headers...)
+	// Replacing a selector
+	tc.PUT("/device-groups/rev2/selector", 200, `{"selector":{"hw":"rev2"}}`, headers...)
+	tc.PUT("/device-groups/lab-rev2/selector", 200, `{"selector":{"site":"lab","hw":"rev2"}}`, headers...)
+	tc.PUT("/device-groups/home/selector", 200, `{"selector":{"site":"home"}}`, headers...)
+
+	require.Nil(t, json.Unmarshal(tc.GET("/devices/test-device-1", 200), &device))
+	assert.Equal(t, []string{"lab", "lab-rev2", "rev2"}, device.Groups)
+	device = apiStorage.Device{}
+	require.Nil(t, json.Unmarshal(tc.GET("/devices/test-device-2", 200), &device))
+	assert.Equal(t, []string{"lab"}, device.Groups)
+
+	// Membership follows label changes
+	home := "home"
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"site": &home}, []string{"test-device-1"}))
+	require.Nil(t, json.Unmarshal(tc.GET("/devices/test-device-1", 200), &device))
+	assert.Equal(t, []string{"home", "rev2"}, device.Groups)
+}
+
+func TestApiDeviceGroupList(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.GET("/device-groups", 403)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+
+	assert.Equal(t, "[]", strings.TrimSpace(string(tc.GET("/device-groups", 200))))
+
+	for _, uuid := range []string{"test-device-1", "test-device-2", "test-device-3", "test-device-4"} {
+		_, err := tc.gw.DeviceCreate(uuid, "pubkey", false)
+		require.Nil(t, err)
+	}
+	lab, home := "lab", "home"
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"group": &lab}, []string{"test-device-3", "test-device-1"}))
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"group": &home}, []string{"test-device-2"}))
+
+	var groups []DeviceGroupMembers
+	require.Nil(t, json.Unmarshal(tc.GET("/device-groups", 200), &groups))
+	assert.Equal(t, []DeviceGroupMembers{
+		{Name: "home", Devices: 1, Uuids: []string{"test-device-2"}},
+		{Name: "lab", Devices: 2, Uuids: []string{"test-device-1", "test-device-3"}},
+	}, groups)
+
+	// Moving devices between groups and deleting them updates the mapping.
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"group": &home}, []string{"test-device-3"}))
+	d, err := tc.api.DeviceGet("test-device-1")
+	require.Nil(t, err)
+	require.Nil(t, d.Delete())
+	require.Nil(t, json.Unmarshal(tc.GET("/device-groups", 200), &groups))
+	assert.Equal(t, []DeviceGroupMembers{
+		{Name: "home", Devices: 2, Uuids: []string{"test-device-2", "test-device-3"}},
+	}, groups)
+
+	// Groups are paginated, and their UUIDs can be left out.
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"group": &lab}, []string{"test-device-4"}))
+	rec := tc.Do(httptest.NewRequest(http.MethodGet, "/v1/device-groups?limit=1&counts-only=true", nil))
+	require.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Header().Get("Link"), "</v1/device-groups?offset=1&limit=1&counts-only=true>; rel=\"next\"")
+	groups = nil
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &groups))
+	assert.Equal(t, []DeviceGroupMembers{{Name: "home", Devices: 2}}, groups)
+	groups = nil
+	require.Nil(t, json.Unmarshal(tc.GET("/device-groups?limit=1&offset=1", 200), &groups))
+	assert.Equal(t, []DeviceGroupMembers{{Name: "lab", Devices: 1, Uuids: []string{"test-device-4"}}}, groups)
+
+	tc.GET("/device-groups?limit=0", 400)
+	tc.GET("/device-groups?offset=-1", 400)
+	tc.GET("/device-groups?counts-only=maybe", 400)
+}
+
+func TestApiDeviceGroupDelete(t *testing.T) {
+	tc := NewTestClient(t)
+	headers := []string{"content-type", "application/json"}
+	tc.DELETE("/device-groups/lab", 403)
+	tc.u.AllowedScopes = users.ScopeDevicesRU
+
+	for _, uuid := range []string{"test-device-1", "test-device-2", "test-device-3"} {
+		_, err := tc.gw.DeviceCreate(uuid, "pubkey", false)
+		require.Nil(t, err)
+	}
+	lab, home := "lab", "home"
+	require.Nil(t, tc.api.PatchDeviceLabels(
+		map[string]*string{"group": &lab, "site": &lab}, []string{"test-device-1", "test-device-2"}))
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"group": &home}, []string{"test-device-3"}))
+	tc.PUT("/device-groups/lab/selector", 200, `{"selector":{"site":"lab"}}`, headers...)
+	tc.PUT("/device-groups/hq/selector", 200, `{"selector":{"site":"hq"}}`, headers...)
+
+	tc.DELETE("/device-groups/unknown", 404)
+
+	tc.DELETE("/device-groups/lab", 200)
+	for _, uuid := range []string{"test-device-1", "test-device-2"} {
+		d, err := tc.api.DeviceGet(uuid)
+		require.Nil(t, err)
+		assert.Equal(t, apiStorage.Labels{"site": "lab"}, d.Labels, uuid)
+		assert.Empty(t, d.Groups, uuid)
+	}
+	d, err := tc.api.DeviceGet("test-device-3")
+	require.Nil(t, err)
+	assert.Equal(t, "home", d.Labels["group"])
+	groups, err := tc.api.GetKnownDeviceGroupNames()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"home"}, groups)
+
+	// Deleting again changes nothing.
+	tc.DELETE("/device-groups/lab", 404)
+	d, err = tc.api.DeviceGet("test-device-3")
+	require.Nil(t, err)
+	assert.Equal(t, "home", d.Labels["group"])
+
+	// Either a selector group or a group label is enough for a group to exist.
+	tc.DELETE("/device-groups/hq", 200)
+	tc.DELETE("/device-groups/hq", 404)
+	tc.DELETE("/device-groups/home", 200)
+	tc.DELETE("/device-groups/home", 404)
+	d, err = tc.api.DeviceGet("test-device-3")
+	require.Nil(t, err)
+	assert.Equal(t, apiStorage.Labels{}, d.Labels)
+}
+
+func TestApiDeviceSelector(t *testing.T) {
+	tc := NewTestClient(t, WithDeviceListMaxLimit(2))
+	tc.GET("/device-selector?expr=env=prod", 403)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+
+	for _, uuid := range []string{"test-device-1", "test-device-2", "test-device-3", "test-device-4"} {
+		_, err := tc.gw.DeviceCreate(uuid, "pubkey", false)
+		require.Nil(t, err)
+	}
+	prod, eu, us := "prod", "eu", "us"
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"env": &prod}, []string{"test-device-1", "test-device-2", "test-device-3"}))
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"region": &eu}, []string{"test-device-2", "test-device-3", "test-device-4"}))
+	require.Nil(t, tc.api.PatchDeviceLabels(map[string]*string{"region": &us}, []string{"test-device-1"}))
+	d, err := tc.api.DeviceGet("test-device-3")
+	require.Nil(t, err)
+	require.Nil(t, d.Delete())
+
+	uuids := func(expr string) []string {
+		var devices []DeviceListItem
+		require.Nil(t, json.Unmarshal(tc.GET("/device-selector?expr="+url.QueryEscape(expr), 200), &devices))
+		res := []string{}
+		for _, d := range devices {
+			res = append(res, d.Uuid)
+		}
+		return res
+	}
+	// Deleted devices never match.
+	assert.Equal(t, []string{"test-device-1", "test-device-2"}, uuids("env=prod"))
+	assert.Equal(t, []string{"test-device-2"}, uuids("env=prod,region=eu"))
+	assert.Equal(t, []string{"test-device-2"}, uuids(" region = eu , env=prod,"))
+	assert.Equal(t, []string{}, uuids("env=prod,region=apac"))
+	assert.Equal(t, []string{}, uuids("env=staging"))
+
+	// Results are paginated like the device list.
+	rec := tc.Do(httptest.NewRequest(http.MethodGet, "/v1/device-selector?expr=region=eu&limit=1", nil))
+	require.Equal(t, 200, rec.Code)
+	assert.Contains(t, rec.Header().Get("Link"), `/v1/device-selector?offset=1&limit=1&expr=region%3Deu>; rel="next"`)
+	assert.Equal(t, []string{"test-device-2", "test-device-4"}, uuids("region=eu"))
+
+	for _, expr := range []string{"", ",", "env", "=prod", "env!=prod", "env=prod,env=dev", "Env=prod", "env=pr od", "env="} {
+		tc.GET("/device-selector?expr="+url.QueryEscape(expr), 400)
+	}
+	// Not a device UUID
+	tc.GET("/devices/test-device-1", 200)
+}
+
+func TestApiUserTokensList(t *testing.T) {
+	tc := NewTestClient(t)
+	alice := &users.User{Username: "alice", AllowedScopes: users.ScopeDevicesRU | users.ScopeUpdatesR}
+	require.Nil(t, tc.users.Create(alice))
+	bob := &users.User{Username: "bob", AllowedScopes: users.ScopeDevicesR}
+	require.Nil(t, tc.users.Create(bob))
+
+	expires := time.Now().Add(time.Hour).Unix()
+	tok1, err := alice.GenerateToken("ci", expires, users.ScopeDevicesR)
+	require.Nil(t, err)
+	tok2, err := alice.GenerateToken("deploy", expires, users.ScopeDevicesRU|users.ScopeUpdatesR)
+	require.Nil(t, err)
+
+	// Users may list their own tokens only.
+	tc.u.Username = "alice"
+	tc.GET("/users/bob/tokens", 403)
+
+	var tokens []TokenListItem
+	data := tc.GET("/users/alice/tokens", 200)
+	require.Nil(t, json.Unmarshal(data, &tokens))
+	require.Len(t, tokens, 2)
+	assert.Equal(t, tok1.PublicID, tokens[0].Id)
+	assert.Equal(t, "ci", tokens[0].Description)
+	assert.Equal(t, []string{"devices:read"}, tokens[0].Scopes)
+	assert.Equal(t, expires, tokens[0].ExpiresAt)
+	assert.NotZero(t, tokens[0].CreatedAt)
+	assert.Equal(t, "deploy", tokens[1].Description)
+	assert.Equal(t, []string{"devices:read-update", "updates:read"}, tokens[1].Scopes)
+	// Token values are never exposed.
+	assert.NotContains(t, string(data), tok1.Value)
+	assert.NotContains(t, string(data), tok2.Value)
+	assert.NotContains(t, string(data), "value")
+
+	// Admins may list tokens of other users.
+	tc.u.Username = "root"
+	tc.u.AllowedScopes = users.ScopeUsersR
+	require.Nil(t, json.Unmarshal(tc.GET("/users/bob/tokens", 200), &tokens))
+	assert.Empty(t, tokens)
+	tc.GET("/users/nobody/tokens", 404)
+}
+
+func TestApiUserAuditList(t *testing.T) {
+	tc := NewTestClient(t)
+	alice := &users.User{Username: "alice", AllowedScopes: users.ScopeDevicesR}
+	require.Nil(t, tc.users.Create(alice))
+	for i := range 4 {
+		require.Nil(t, alice.Update(fmt.Sprintf("Update %d", i)))
+	}
+	bob := &users.User{Username: "bob", AllowedScopes: users.ScopeDevicesR}
+	require.Nil(t, tc.users.Create(bob))
+
+	// Users may read their own audit log only.
+	tc.u.Username = "alice"
+	tc.GET("/users/bob/audit", 403)
+
+	var events []AuditEvent
+	data := tc.GET("/users/alice/audit", 200)
+	require.Nil(t, json.Unmarshal(data, &events))
+	require.Len(t, events, 5)
+	assert.Equal(t, "Update 3", events[0].Event)
+	assert.Equal(t, "User created", events[4].Event)
+	assert.NotZero(t, events[0].Time)
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/users/alice/audit?limit=2&offset=2", nil)
+	rec := tc.Do(req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Nil(t, json.Unmarshal(rec.Body.Bytes(), &events))
+	require.Len(t, events, 2)
+	assert.Equal(t, "Update 1", events[0].Event)
+	assert.Equal(t, "Update 0", events[1].Event)
+	link := rec.Header().Get("Link")
+	assert.Contains(t, link, `</v1/users/alice/audit?offset=4&limit=2>; rel="next"`)
+	assert.Contains(t, link, `</v1/users/alice/audit?offset=4&limit=2>; rel="last"`)
+
+	data = tc.GET("/users/alice/audit?offset=10", 200)
+	require.Nil(t, json.Unmarshal(data, &events))
+	assert.Len(t, events, 0)
+	tc.GET("/users/alice/audit?limit=0", 400)
+
+	// Admins may read anyone's audit log.
+	tc.u.AllowedScopes = users.ScopeUsersR
+	data = tc.GET("/users/bob/audit", 200)
+	require.Nil(t, json.Unmarshal(data, &events))
+	require.Len(t, events, 1)
+	assert.Equal(t, "User created", events[0].Event)
+	tc.GET("/users/nobody/audit", 404)
+}
+
+func TestApiAuditList(t *testing.T) {
+	tc := NewTestClient(t)
+	alice := &users.User{Username: "alice", AllowedScopes: users.ScopeDevicesR}
+	require.Nil(t, tc.users.Create(alice))
+	bob := &users.User{Username: "bob", AllowedScopes: users.ScopeDevicesR}
+	require.Nil(t, tc.users.Create(bob))
+	require.Nil(t, alice.Update("Alice updated"))
+
+	tc.GET("/admin/audit", 403)
+	tc.u.AllowedScopes = users.ScopeAdminR
+
+	var events []UserAuditEvent
+	data := tc.GET("/admin/audit", 200)
+	require.Nil(t, json.Unmarshal(data, &events))
+	require.Len(t, events, 3)
+	for i := 1; i < len(events); i++ {
+		assert.LessOrEqual(t, events[i-1].Time, events[i].Time)
+	}
+	var alices, bobs []string
+	for _, evt := range events {
+		switch evt.Username {
+		case "alice":
+			alices = append(alices, evt.Event)
+		case "bob":
+			bobs = append(bobs, evt.Event)
+		}
+	}
+	assert.Equal(t, []string{"User created", "Alice updated"}, alices)
+	assert.Equal(t, []string{"User created"}, bobs)
+	assert.Contains(t, string(data), `"username":"alice"`)
+
+	data = tc.GET("/admin/audit?limit=1&offset=2", 200)
+	require.Nil(t, json.Unmarshal(data, &events))
+	require.Len(t, events, 1)
+	tc.GET("/admin/audit?limit=0", 400)
+}
+
+func TestApiReportTags(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.GET("/reports/tags", 403)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+
+	var counts []TagDevicesCount
+	require.Nil(t, json.Unmarshal(tc.GET("/reports/tags", 200), &counts))
+	assert.Empty(t, counts)
+
+	for i, tag := range []string{"main", "main", "beta", "main", "beta", "main"} {
+		uuid := fmt.Sprintf("test-device-%d", i)
+		d, err := tc.gw.DeviceCreate(uuid, "pubkey-"+uuid, i >= 4)
+		require.Nil(t, err)
+		require.Nil(t, d.CheckIn("", tag, "", ""))
+	}
+	d, err := tc.api.DeviceGet("test-device-0")
+	require.Nil(t, err)
+	require.Nil(t, d.Delete())
+
+	require.Nil(t, json.Unmarshal(tc.GET("/reports/tags", 200), &counts))
+	assert.Equal(t, []TagDevicesCount{
+		{Tag: "beta", IsProd: false, Devices: 1},
+		{Tag: "beta", IsProd: true, Devices: 1},
+		{Tag: "main", IsProd: false, Devices: 2},
+		{Tag: "main", IsProd: true, Devices: 1},
+	}, counts)
+}
+
+func TestApiDbBackup(t *testing.T) {
+	tc := NewTestClient(t)
+	_, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
+	require.Nil(t, err)
+	require.Nil(t, tc.users.Create(&users.User{Username: "alice", AllowedScopes: users.ScopeDevicesR}))
+
+	tc.POST("/admin/db/backup", 403, nil)
+	tc.u.AllowedScopes = users.ScopeAdminR
+
+	data := tc.POST("/admin/db/backup", 200, nil)
+	backupFile := filepath.Join(t.TempDir(), apiStorage.DbFile)
+	require.Nil(t, os.WriteFile(backupFile, data, 0o600))
+	// No staging leftovers in the data directory
+	matches, err := filepath.Glob(filepath.Join(tc.fs.Config.RootDir(), ".db-backup-*"))
+	require.Nil(t, err)
+	assert.Empty(t, matches)
+
+	// Reopen the copy: data written before the backup is intact
+	db, err := apiStorage.NewDb(backupFile)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, db.Close()) }()
+	apiS, err := apiStorage.NewStorage(db, tc.fs)
+	require.Nil(t, err)
+	device, err := apiS.DeviceGet("test-device-1")
+	require.Nil(t, err)
+	require.NotNil(t, device)
+	assert.Equal(t, "pubkey1", device.PubKey)
+	usersS, err := users.NewStorage(db, tc.fs)
+	require.Nil(t, err)
+	alice, err := usersS.Get("alice")
+	require.Nil(t, err)
+	require.NotNil(t, alice)
+	assert.Equal(t, users.ScopeDevicesR, alice.AllowedScopes)
+}
+
+func TestApiDeviceActivity(t *testing.T) {
+	tc := NewTestClient(t)
+	defer func() { clock.Now = time.Now }()
+	now := time.Now()
+	clock.Now = func() time.Time { return now.Add(-30 * time.Hour) }
+	d, err := tc.gw.DeviceCreate("test-device", "pubkey", false)
+	require.Nil(t, err)
+
+	var checkins []int64
+	for _, ago := range []time.Duration{26 * time.Hour, 3 * time.Hour, time.Hour} {
+		ts := now.Add(-ago)
+		clock.Now = func() time.Time { return ts }
+		require.Nil(t, d.CheckIn("target", "tag", "hash", ""))
+		checkins = append(checkins, ts.Unix())
+	}
+	clock.Now = func() time.Time { return now }
+
+	tc.GET("/devices/test-device/activity", 403)
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	tc.GET("/devices/not-found/activity", 404)
+	tc.GET("/devices/test-device/activity?hours=0", 400)
+	tc.GET("/devices/test-device/activity?hours=1000", 400)
+
+	var activity []int64
+	data := tc.GET("/devices/test-device/activity", 200)
+	require.Nil(t, json.Unmarshal(data, &activity))
+	assert.Equal(t, checkins[1:], activity)
+	data = tc.GET("/devices/test-device/activity?hours=48", 200)
+	require.Nil(t, json.Unmarshal(data, &activity))
+	assert.Equal(t, checkins, activity)
+	data = tc.GET("/devices/test-device/activity?hours=2", 200)
+	require.Nil(t, json.Unmarshal(data, &activity))
+	assert.Equal(t, checkins[2:], activity)
+}
+
+func TestApiAdminConfig(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.GET("/admin/config", 403)
+	tc.u.AllowedScopes = users.ScopeAdminR
+	tc.GET("/admin/config", 404)
+
+	tc.gw.SetMaxEvents(30)
+	tc.gw.SetMaxStates(5)
+	tc.gw.SetMaxStatesAge(24 * time.Hour)
+	limits := tc.gw.Limits()
+	limits.AppsStatesMaxSize = "200K"
+	limits.AppsMaxLength = 4096
+	tc.e = server.NewEchoServer()
+	RegisterHandlers(tc.e, tc.api, tc.users, &testAuthProvider{user: tc.u}, WithGatewayLimits(limits))
+
+	res := tc.GET("/admin/config", 200)
+	assert.JSONEq(t, `{"gateway":{"max-events":30,"max-apps-states":5,"apps-states-max-age":86400,`+
+		`"apps-states-gzip":false,"apps-states-max-size":"200K","apps-max-length":4096}}`, string(res))
+
+	// Clients listing apps states are told the effective maximum count.
+	tc.u.AllowedScopes = users.ScopeDevicesR
+	_, err := tc.gw.DeviceCreate("test-device-1", "pubkey1", true)
+	require.Nil(t, err)
+	res = tc.GET("/devices/test-device-1/apps-states", 200)
+	assert.Contains(t, string(res), `"retention":{"max_count":5,`)
+}
+
+func TestApiVersion(t *testing.T) {
+	tc := NewTestClient(t)
+	// Any user may see the version, regardless of their scopes.
+	data := tc.GET("/version", 200)
+	assert.JSONEq(t, `{"version":"","commit":"","build-time":""}`, string(data))
+
+	defer func(version, commit, buildTime string) {
+		cmd.Version, cmd.Commit, cmd.BuildTime = version, commit, buildTime
+	}(cmd.Version, cmd.Commit, cmd.BuildTime)
+	cmd.Version, cmd.Commit, cmd.BuildTime = "v1.2.3", "abc123", "2025-01-02T03:04:05Z"
+	var info VersionInfo
+	require.Nil(t, json.Unmarshal(tc.GET("/version", 200), &info))
+	assert.Equal(t, VersionInfo{Version: "v1.2.3", Commit: "abc123", BuildTime: "2025-01-02T03:04:05Z"}, info)
+}
+
+func TestApiTlsStatus(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.GET("/admin/tls-status", 403)
+	tc.u.AllowedScopes = users.ScopeAdminR
+	tc.GET("/admin/tls-status", 404)
+
+	newCert := func(tmpl, parent *x509.Certificate, pub, signer any) []byte {
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, signer)
+		require.Nil(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Factory CA"},
+		NotBefore:             time.Unix(1700000000, 0),
+		NotAfter:              time.Unix(1900000000, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caPem := newCert(ca, ca, caKey.Public(), caKey)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gateway.example.com"},
+		DNSNames:     []string{"gateway.example.com", "gw.example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("192.0.2.1")},
+		NotBefore:    time.Unix(1750000000, 0),
+		NotAfter:     time.Unix(1850000000, 0),
+	}
+	kp, err := tls.X509KeyPair(
+		newCert(leaf, ca, key.Public(), caKey), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	require.Nil(t, err)
+
+	// The status is reported from the loaded TLS config, like the gateway loads it, not from the files on disk.
+	cfg := &tls.Config{Certificates: []tls.Certificate{kp}, ClientCAs: x509.NewCertPool()}
+	tc = NewTestClient(t, WithGatewayTlsConfig(cfg))
+	tc.u.AllowedScopes = users.ScopeAdminR
+	var status TlsStatus
+	require.Nil(t, json.Unmarshal(tc.GET("/admin/tls-status", 200), &status))
+	assert.Equal(t, TlsStatus{
+		Subject:     "CN=gateway.example.com",
+		Issuer:      "CN=Factory CA",
+		DnsNames:    []string{"gateway.example.com", "gw.example.com"},
+		IpAddresses: []string{"192.0.2.1"},
+		NotBefore:   1750000000,
+		NotAfter:    1850000000,
+	}, status)
+
+	require.True(t, cfg.ClientCAs.AppendCertsFromPEM(caPem))
+	require.Nil(t, json.Unmarshal(tc.GET("/admin/tls-status", 200), &status))
+	assert.True(t, status.HasClientCas)
+}
+
+func TestApiRolloutJournalGet(t *testing.T) {
+	tc := NewTestClient(t)
+	tc.GET("/admin/rollouts/ci/journal", 403)
+	tc.u.AllowedScopes = users.ScopeAdminR
+
+	tc.GET("/admin/rollouts/unknown/journal", 404)
+	data := tc.GET("/admin/rollouts/ci/journal", 200)
+	assert.Empty(t, data)
+
+	require.Nil(t, tc.api.CreateRollout("tag1", "update1", "roll1", "ci", Rollout{Uuids: []string{"ci1"}}))
+	require.Nil(t, tc.api.CreateRollout("tag1", "update2", "roll2", "ci", Rollout{Uuids: []string{"ci2"}}))
+	require.Nil(t, tc.api.CreateRollout("tag2", "update3", "roll3", "prod", Rollout{Uuids: []string{"prod1"}}))
+	require.Nil(t, tc.api.RolloverRolloutJournal("ci", 0))
+	require.Nil(t, tc.api.RolloverRolloutJournal("prod", 0))
+	// Entries appended since the rollover are still in the temporary part file, which is not streamed.
+	require.Nil(t, tc.api.CreateRollout("tag1", "update1", "roll4", "ci", Rollout{Uuids: []string{"ci1"}}))
+
+	data = tc.GET("/admin/rollouts/ci/journal", 200)
+	assert.Equal(t, "tag1|update1|roll1\ntag1|update2|roll2\n", string(data))
+	data = tc.GET("/admin/rollouts/prod/journal", 200)
+	assert.Equal(t, "tag2|update3|roll3\n", string(data))
+}
+
+func TestApiBodyLimit(t *testing.T) {
+	limit := NewBodyLimit("1K")
+	tc := NewTestClient(t, WithBodyLimit(limit))
+	tc.e.Use(limit.Middleware())
+	require.Nil(t, tc.users.Create(tc.u))
+	tc.u.AllowedScopes = users.ScopeDevicesRU | users.ScopeUpdatesRU
+	headers := []string{"content-type", "application/json"}
+	_, err := tc.gw.DeviceCreate("dev1", "pubkey", false)
+	require.Nil(t, err)
+
+	tc.PATCH("/devices/dev1/labels", 200, `{"upserts":{"name":"small"}}`, headers...)
+	large := fmt.Sprintf(`{"upserts":{"name":"%s"}}`, strings.Repeat("x", 2048))
+	tc.PATCH("/devices/dev1/labels", 413, large, headers...)
+	device, err := tc.api.DeviceGet("dev1")
+	require.Nil(t, err)
+	assert.Equal(t, "small", device.Labels["name"])
+
+	// Archive uploads are not limited.
+	files := map[string]string{"factory/.journal": "deadbeef:123456\n", "factory/deadbeef": strings.Repeat("x", 2048)}
+	r := tarBuffer(t, files)
+	require.Greater(t, r.Len(), 1024)
+	tc.PUT("/configs", 200, r, "Content-Type", "application/x-tar")
+}
+
+func TestApiUserRateLimit(t *testing.T) {
+	tc := NewTestClient(t, WithUserRateLimit(0.1, 3))
+	tc.u.AllowedScopes = users.ScopeDevicesR | users.ScopeUpdatesR
+
+	tc.u.Username = "alice"
+	for range 3 {
+		tc.GET("/devices", 200)
+	}
+	rec := tc.Do(httptest.NewRequest(http.MethodGet, "/v1/devices", nil))
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "10", rec.Header().Get("Retry-After"))
+
+	// Streams are not limited.
+	tc.GET("/updates/prod/tag1/update1/rollouts/roll1/tail", 404)
+	tc.GET("/updates/prod/tag1/update1/tail", 200)
+	tc.GET("/devices/dev1/events", 404)
+	tc.GET("/admin/rollouts/prod/journal", 403)
+	tc.GET("/devices/dev1/events.ndjson", 429)
+
+	// Other users are not affected.
+	tc.u.Username = "bob"
+	tc.GET("/devices", 200)
+	tc.u.Username = "alice"
+	tc.GET("/devices", 429)
+}
@@ -5,6 +5,7 @@ package api
 
 import (
 	"errors"
+	"io"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
@@ -14,24 +15,28 @@ import (
 
 type UpdateTufResp map[string]map[string]any
 
+type UpdateInstallsLimitReq struct {
+	MaxConcurrentInstalls int `json:"max-concurrent-installs"`
+}
+
 // @Summary Create an update from a tar or tar+gz stream
 // @Description Requires scope: updates:read-update
 // @Tags    Updates
 // @Accept  application/x-tar,application/gzip
 // @Success 201
-// @Param   prod path bool true "Whether the update is for production devices"
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
 // @Param   tag path string true "Update tag"
 // @Param   update path string true "Update name"
 // @Router  /updates/{prod}/{tag}/{update} [post]
 func (h handlers) updateCreate(c echo.Context) error {
 	tag := c.Param("tag")
 	update := c.Param("update")
-	isProd := CtxGetIsProd(c.Request().Context())
+	channel := CtxGetChannel(c.Request().Context())
 
 	payload := c.Request().Body
 	defer payload.Close() //nolint:errcheck
 
-	if err := h.storage.CreateUpdate(tag, update, isProd, payload); err != nil {
+	if err := h.storage.CreateUpdate(tag, update, channel, payload); err != nil {
 		if errors.Is(err, storage.ErrInvalidUpdate) {
 			return EchoError(c, err, http.StatusBadRequest, err.Error())
 		}
@@ -46,19 +51,91 @@ func (h handlers) updateCreate(c echo.Context) error {
 // @Tags    Updates
 // @Produce json
 // @Success 200 {object} UpdateTufResp
-// @Param   prod path bool true "Whether the update is for production devices"
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
 // @Param   tag path string true "Update tag"
 // @Param   update path string true "Update name"
 // @Router  /updates/{prod}/{tag}/{update}/rollouts [get]
 func (h handlers) updateGetTuf(c echo.Context) error {
 	tag := c.Param("tag")
 	update := c.Param("update")
-	isProd := CtxGetIsProd(c.Request().Context())
+	channel := CtxGetChannel(c.Request().Context())
 
-	metas, err := h.storage.GetUpdateTufMetadata(tag, update, isProd)
+	metas, err := h.storage.GetUpdateTufMetadata(tag, update, channel)
 	if err != nil {
 		return EchoError(c, err, http.StatusInternalServerError, "failed to get update TUF metadata")
 	}
 
 	return c.JSON(http.StatusOK, metas)
 }
+
+// @Summary Import a new version of signed TUF root metadata into the update
+// @Description The root version must directly follow the current latest root of the update,
+// @Description and the root must be signed by the root keys of both the current latest root and itself.
+// @Description Requires scope: updates:read-update
+// @Tags    Updates
+// @Accept  json
+// @Success 201
+// @Failure 400 "Invalid or insufficiently signed root metadata"
+// @Failure 404 "Update not found"
+// @Failure 409 "Root version does not directly follow the current latest root"
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
+// @Param   tag path string true "Update tag"
+// @Param   update path string true "Update name"
+// @Param   root body object true "Signed root.json"
+// @Router  /updates/{prod}/{tag}/{update}/tuf/root [put]
+func (h handlers) updatePutTufRoot(c echo.Context) error {
+	tag := c.Param("tag")
+	update := c.Param("update")
+	channel := CtxGetChannel(c.Request().Context())
+
+	content, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return EchoError(c, err, http.StatusBadRequest, "Failed to read root metadata")
+	}
+
+	if err := h.storage.ImportTufRoot(tag, update, channel, content); err != nil {
+		switch {
+		case errors.Is(err, storage.ErrInvalidTufRoot):
+			return EchoError(c, err, http.StatusBadRequest, err.Error())
+		case errors.Is(err, storage.ErrTufRootVersion):
+			return EchoError(c, err, http.StatusConflict, err.Error())
+		case errors.Is(err, storage.ErrUpdateNotFound):
+			return EchoError(c, err, http.StatusNotFound, "Update not found")
+		}
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to import root metadata")
+	}
+	return c.NoContent(http.StatusCreated)
+}
+
+// @Summary Limit how many devices may install an update at the same time
+// @Description Devices which start installing the update over the limit are told to retry later.
+// @Description A zero limit removes the limit.
+// @Description Requires scope: updates:read-update
+// @Tags    Updates
+// @Accept  json
+// @Success 200
+// @Param   prod path string true "Update channel: ci, prod, or a custom channel configured on the server"
+// @Param   tag path string true "Update tag"
+// @Param   update path string true "Update name"
+// @Param   data body UpdateInstallsLimitReq true "Installs limit"
+// @Router  /updates/{prod}/{tag}/{update}/max-concurrent-installs [put]
+func (h handlers) updatePutInstallsLimit(c echo.Context) error {
+	tag := c.Param("tag")
+	update := c.Param("update")
+	channel := CtxGetChannel(c.Request().Context())
+
+	var req UpdateInstallsLimitReq
+	if err := c.Bind(&req); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, "Bad JSON body")
+	} else if req.MaxConcurrentInstalls < 0 {
+		return c.String(http.StatusBadRequest, "max-concurrent-installs must not be negative")
+	}
+
+	if err := h.storage.SetMaxConcurrentInstalls(tag, update, channel, req.MaxConcurrentInstalls); err != nil {
+		if errors.Is(err, storage.ErrUpdateNotFound) {
+			return EchoError(c, err, http.StatusNotFound, "Update not found")
+		}
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to set installs limit")
+	}
+	return c.NoContent(http.StatusOK)
+}
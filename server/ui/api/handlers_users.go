@@ -0,0 +1,119 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/foundriesio/dg-satellite/storage"
+	"github.com/foundriesio/dg-satellite/storage/users"
+)
+
+type AuditEvent = storage.AuditEvent
+
+// TokenListItem is API token metadata, token values are only shown once on creation.
+type TokenListItem struct {
+	Id          int64    `json:"id"`
+	CreatedAt   int64    `json:"created-at"`
+	ExpiresAt   int64    `json:"expires-at"`
+	Description string   `json:"description"`
+	Scopes      []string `json:"scopes"`
+}
+
+type AuditListOpts struct {
+	Limit  int `query:"limit"  default:"100"`
+	Offset int `query:"offset" default:"0"`
+}
+
+// @Summary List audit log events of a user
+// @Description Users may read their own audit log, other users' logs require scope: users:read
+// @Tags    Users
+// @Param _ query AuditListOpts false "Pagination options"
+// @Produce json
+// @Success 200 {array} AuditEvent "Newest events first"
+// @Header  200 {string} Link "Pagination links (first, next, last)"
+// @Param   username path string true "User name"
+// @Router  /users/{username}/audit [get]
+func (h *handlers) userAuditList(c echo.Context) error {
+	if !isSelfOrHasScope(c, users.ScopeUsersR) {
+		msg := "User missing required scope(s): " + users.ScopeUsersR.String()
+		return c.String(http.StatusForbidden, msg)
+	}
+	username := c.Param("username")
+
+	opts := AuditListOpts{Limit: 100}
+	if err := c.Bind(&opts); err != nil {
+		return EchoError(c, err, http.StatusBadRequest, "Failed to parse list options")
+	} else if opts.Limit <= 0 || opts.Offset < 0 {
+		err = errors.New("limit must be positive and offset must not be negative")
+		return EchoError(c, err, http.StatusBadRequest, err.Error())
+	}
+
+	user, err := h.users.Get(username)
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to look up user")
+	} else if user == nil {
+		return c.String(http.StatusNotFound, "User not found")
+	}
+
+	events, err := user.GetAuditEvents()
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to read audit log")
+	}
+	slices.Reverse(events)
+
+	total := len(events)
+	start := min(opts.Offset, total)
+	end := min(start+opts.Limit, total)
+	setPaginationLinks(c, opts.Limit, opts.Offset, total, "")
+	return c.JSON(http.StatusOK, events[start:end])
+}
+
+// @Summary List API tokens of a user
+// @Description Only token metadata is listed, token values are never returned.
+// @Description Users may list their own tokens, other users' tokens require scope: users:read
+// @Tags    Users
+// @Produce json
+// @Success 200 {array} TokenListItem "Oldest tokens first"
+// @Param   username path string true "User name"
+// @Router  /users/{username}/tokens [get]
+func (h *handlers) userTokensList(c echo.Context) error {
+	if !isSelfOrHasScope(c, users.ScopeUsersR) {
+		msg := "User missing required scope(s): " + users.ScopeUsersR.String()
+		return c.String(http.StatusForbidden, msg)
+	}
+
+	user, err := h.users.Get(c.Param("username"))
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to look up user")
+	} else if user == nil {
+		return c.String(http.StatusNotFound, "User not found")
+	}
+
+	tokens, err := user.ListTokens()
+	if err != nil {
+		return EchoError(c, err, http.StatusInternalServerError, "Failed to list tokens")
+	}
+	items := make([]TokenListItem, 0, len(tokens))
+	for _, t := range tokens {
+		items = append(items, TokenListItem{
+			Id:          t.PublicID,
+			CreatedAt:   t.CreatedAt,
+			ExpiresAt:   t.ExpiresAt,
+			Description: t.Description,
+			Scopes:      t.Scopes.ToSlice(),
+		})
+	}
+	return c.JSON(http.StatusOK, items)
+}
+
+// isSelfOrHasScope tells if a user accesses their own resources, or has a scope to access other users' resources.
+func isSelfOrHasScope(c echo.Context, scope users.Scopes) bool {
+	session := c.Get("user").(*users.User)
+	return session.Username == c.Param("username") || session.AllowedScopes.Has(scope)
+}
@@ -4,11 +4,16 @@
 package api
 
 import (
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
 
 	"github.com/foundriesio/dg-satellite/auth"
 	"github.com/foundriesio/dg-satellite/storage/users"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
 )
 
 func requireScope(scope users.Scopes) echo.MiddlewareFunc {
@@ -44,6 +49,64 @@ func authUser(provider auth.Provider) echo.MiddlewareFunc {
 	}
 }
 
+// streamingRoutes are long-lived streams, clients reconnect to them on their own pace.
+var streamingRoutes = []string{
+	"/v1/devices/:uuid/events",
+	"/v1/admin/rollouts/:prod/journal",
+	"/v1/updates/:prod/:tag/:update/tail",
+	"/v1/updates/:prod/:tag/:update/rollouts/:rollout/tail",
+}
+
+func rateLimitUser(requestsPerSecond float64, burst int) echo.MiddlewareFunc {
+	store := middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+		Rate:  rate.Limit(requestsPerSecond),
+		Burst: max(burst, 1),
+	})
+	retryAfter := strconv.Itoa(int(math.Ceil(1 / requestsPerSecond)))
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Skipper: func(c echo.Context) bool {
+			return slices.Contains(streamingRoutes, c.Path())
+		},
+		IdentifierExtractor: func(c echo.Context) (string, error) {
+			return c.Get("user").(*users.User).Username, nil
+		},
+		Store: store,
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			c.Response().Header().Set("Retry-After", retryAfter)
+			return EchoError(c, err, http.StatusTooManyRequests, "Rate limit exceeded, retry later")
+		},
+	})
+}
+
+// BodyLimit rejects requests with a body larger than a limit, e.g. "1M", with a 413 status.
+// Routes of the handlers it is passed to with WithBodyLimit may opt out of it, e.g. uploads of archives.
+type BodyLimit struct {
+	limit string
+	// Method and path of the routes which opted out. It is only written while routes are registered.
+	unlimited map[string]bool
+}
+
+func NewBodyLimit(limit string) *BodyLimit {
+	return &BodyLimit{limit: limit, unlimited: make(map[string]bool)}
+}
+
+// Middleware must run before any other middleware reading a request body, e.g. a CSRF check of form values.
+func (b *BodyLimit) Middleware() echo.MiddlewareFunc {
+	return middleware.BodyLimitWithConfig(middleware.BodyLimitConfig{
+		Limit: b.limit,
+		Skipper: func(c echo.Context) bool {
+			return b.unlimited[c.Request().Method+" "+c.Path()]
+		},
+	})
+}
+
+// unlimitedBody exempts a route from the BodyLimit, e.g. uploads of archives, which may be much larger than any JSON body.
+func (h *handlers) unlimitedBody(r *echo.Route) {
+	if h.bodyLimit != nil {
+		h.bodyLimit.unlimited[r.Method+" "+r.Path] = true
+	}
+}
+
 func gzipContentTypeAsContentEncoding(next echo.HandlerFunc) echo.HandlerFunc {
 	// An echo.decompose middleware uses a standard content-encoding header to identify if content was gzipped.
 	// We also support a non-standard way to specify that in a content-type header.
@@ -22,6 +22,7 @@ type daemons struct {
 	stops   []chan bool
 
 	rolloutOptions rolloutOptions
+	certOptions    certOptions
 }
 
 func New(context context.Context, storage *storage.Storage, users *users.Storage, opts ...Option) *daemons {
@@ -29,15 +30,17 @@ func New(context context.Context, storage *storage.Storage, users *users.Storage
 	d.rolloutOptions = rolloutOptions{
 		interval: 5 * time.Minute,
 	}
-	d.daemons = []daemonFunc{
-		d.rolloutWatchdog(true),
-		d.rolloutWatchdog(false),
-		userGcDaemonFunc(users),
+	for _, channel := range storage.UpdateChannels() {
+		d.daemons = append(d.daemons, d.rolloutWatchdog(channel))
 	}
+	d.daemons = append(d.daemons, userGcDaemonFunc(users))
 
 	for _, opt := range opts {
 		opt(d)
 	}
+	if d.certOptions.window > 0 && d.certOptions.interval > 0 {
+		d.daemons = append(d.daemons, d.certExpiryWatchdog())
+	}
 	return d
 }
 
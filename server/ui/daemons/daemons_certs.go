@@ -0,0 +1,64 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package daemons
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/foundriesio/dg-satellite/clock"
+	"github.com/foundriesio/dg-satellite/context"
+)
+
+// Device certificate counts of the last expiry check, see the admin metrics API.
+var (
+	certsExpiring = expvar.NewInt("device_certs_expiring")
+	certsTotal    = expvar.NewInt("device_certs_total")
+)
+
+// WithCertExpiryNotice enables a periodic warning when at least a given ratio of devices
+// authenticate with client certificates which expire within a given window.
+func WithCertExpiryNotice(window time.Duration, ratio float64, interval time.Duration) Option {
+	return func(d *daemons) {
+		d.certOptions = certOptions{window: window, ratio: ratio, interval: interval}
+	}
+}
+
+type certOptions struct {
+	window   time.Duration
+	ratio    float64
+	interval time.Duration
+}
+
+func (d *daemons) certExpiryWatchdog() daemonFunc {
+	return func(stop chan bool) {
+		for {
+			d.checkCertExpiry()
+			select {
+			case <-stop:
+				return
+			case <-time.After(d.certOptions.interval):
+			}
+		}
+	}
+}
+
+func (d *daemons) checkCertExpiry() {
+	log := context.CtxGetLog(d.context)
+	before := clock.Now().Add(d.certOptions.window).Unix()
+	expiring, total, err := d.storage.CertExpiryCounts(before)
+	if err != nil {
+		log.Error("failed to count expiring device certificates", "error", err)
+		return
+	}
+	certsExpiring.Set(int64(expiring))
+	certsTotal.Set(int64(total))
+	if total > 0 && float64(expiring)/float64(total) >= d.certOptions.ratio {
+		log.Warn("Many device certificates are nearing expiry, plan a re-provisioning",
+			"expiring", expiring, "total", total, "window", d.certOptions.window.String())
+	} else {
+		log.Debug("Device certificates expiry summary",
+			"expiring", expiring, "total", total, "window", d.certOptions.window.String())
+	}
+}
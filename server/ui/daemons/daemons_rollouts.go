@@ -8,6 +8,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/foundriesio/dg-satellite/clock"
 	"github.com/foundriesio/dg-satellite/context"
 )
 
@@ -18,64 +19,105 @@ func WithRolloverInterval(interval time.Duration) Option {
 	}
 }
 
+// WithRolloverGracePeriod sets how long in-flight writes may still append to a rolled over journal before it is processed.
+// A zero or a longer than the rollover interval grace period equals the rollover interval.
+func WithRolloverGracePeriod(grace time.Duration) Option {
+	return func(d *daemons) {
+		d.rolloutOptions.grace = grace
+	}
+}
+
 type rolloutOptions struct {
 	interval time.Duration
+	grace    time.Duration
 }
 
-func (d *daemons) rolloutWatchdog(isProd bool) daemonFunc {
-	// Watch for a file once every 5 minutes.
-	// API handlers have 5 minutes to write to the file after it was moved.
-	// That is more than enough for any in-flight writes to get to the disk.
+func (d *daemons) rolloutWatchdog(channel string) daemonFunc {
+	// Roll over the journal once every interval (5 minutes by default), and process it a grace period later.
+	// An API handler may open the journal right before a rollover and write to it right after.
+	// The grace period (equal to the interval by default) is more than enough for any in-flight writes to get to the disk.
+	// A shorter grace period commits rollouts sooner, and a write which still lands in the journal after it was processed
+	// is not lost: the next rollover carries it over to the new journal, which is processed next.
 	return func(stop chan bool) {
 		log := context.CtxGetLog(d.context)
+		interval := d.rolloutOptions.interval
+		grace := d.rolloutOptions.grace
+		if grace <= 0 || grace > interval {
+			grace = interval
+		}
 		firstRun := true
 		for {
-			processed := d.processJournal(isProd)
+			processed, ok := d.processJournal(channel)
+			if !sleepUntilStop(stop, interval-grace) {
+				return
+			}
 			if firstRun {
 				// Do not rollover the journal on application startup - it may have new entries after being processed.
 				firstRun = false
-			} else if processed {
-				if err := d.storage.RolloverRolloutJournal(isProd); err != nil {
+			} else if ok {
+				if err := d.storage.RolloverRolloutJournal(channel, processed); err != nil {
 					log.Error("failed to roll over the rollout journal", "error", err)
 				}
 			}
 			// Wait between the rollover and processing, so that any in-flight requests finish writing to journal.
-			select {
-			case <-stop:
+			if !sleepUntilStop(stop, grace) {
 				return
-			case <-time.After(d.rolloutOptions.interval):
 			}
 		}
 	}
 }
 
-func (d *daemons) processJournal(isProd bool) (success bool) {
+// clockPollInterval is how often sleepUntilStop checks the clock, so that tests may move the clock forward.
+const clockPollInterval = 100 * time.Millisecond
+
+// sleepUntilStop waits for a given duration of clock.Now, and returns false if the daemon was stopped in the meantime.
+func sleepUntilStop(stop chan bool, duration time.Duration) bool {
+	deadline := clock.Now().Add(duration)
+	for {
+		remaining := deadline.Sub(clock.Now())
+		if remaining <= 0 {
+			return true
+		}
+		select {
+		case <-stop:
+			return false
+		case <-time.After(min(remaining, clockPollInterval)):
+		}
+	}
+}
+
+// processJournal commits the rollouts of the journal, and returns how many journal entries it processed.
+func (d *daemons) processJournal(channel string) (processed int, success bool) {
 	log := context.CtxGetLog(d.context)
 	success = true
-	for line, err := range d.storage.ReadRolloutJournal(isProd) {
+	for line, err := range d.storage.ReadRolloutJournal(channel) {
 		if err != nil {
 			// Any journal reading error is critical - return and let the daemon retry later.
 			log.Error("failed to read rollout journal", "error", err)
 			success = false
 			break
 		}
+		processed++
 		tag := line[0]
 		updateName := line[1]
 		rolloutName := line[2]
-		if rollout, err := d.storage.GetRollout(tag, updateName, rolloutName, isProd); err != nil {
+		if rollout, err := d.storage.GetRollout(tag, updateName, rolloutName, channel); err != nil {
 			if errors.Is(err, os.ErrNotExist) {
-				log.Warn("rollout file not exist - skipping stale journal entry", "path", line, "is-prod", isProd)
+				log.Warn("rollout file not exist - skipping stale journal entry", "path", line, "channel", channel)
 				continue
 			}
 			// Rollout reading errors are non-critical - log and process other rollouts.
 			// Still, a failed rollout journal will be retried later again.
 			// User is expected to monitor these errors and investigate the root cause.
-			log.Error("failed to process rollout file", "error", err, "path", line, "is-prod", isProd)
+			log.Error("failed to process rollout file", "error", err, "path", line, "channel", channel)
 			success = false
+		} else if rollout.PendingApproval {
+			// Approval journals the rollout again, it is committed then.
+			log.Warn("rollout is pending approval - skipping journal entry", "path", line, "channel", channel)
 		} else if !rollout.Commit {
 			// Rollout file present but not committed - commit it now.
-			if err = d.storage.CommitRollout(tag, updateName, rolloutName, isProd, rollout); err != nil {
-				log.Error("failed to commit rollout", "error", err, "path", line, "is-prod", isProd)
+			if err = d.storage.CommitRollout(tag, updateName, rolloutName, channel, rollout); err != nil {
+				log.Error("failed to commit rollout", "error", err, "path", line, "channel", channel)
 				success = false
 			}
 		}
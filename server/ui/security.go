@@ -0,0 +1,40 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package ui
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// SecurityHeaders controls the security related response headers set by the UI/API server.
+// An empty value disables the corresponding header.
+type SecurityHeaders struct {
+	// HstsMaxAge is only sent for TLS requests (or requests with "X-Forwarded-Proto: https").
+	HstsMaxAge            int
+	ContentSecurityPolicy string
+	ContentTypeNosniff    string
+	FrameOptions          string
+	ReferrerPolicy        string
+}
+
+// DefaultSecurityHeaders allows inline scripts and styles, as our web templates rely on them.
+var DefaultSecurityHeaders = SecurityHeaders{
+	HstsMaxAge:            31536000,
+	ContentSecurityPolicy: "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; frame-ancestors 'none'",
+	ContentTypeNosniff:    "nosniff",
+	FrameOptions:          "DENY",
+	ReferrerPolicy:        "same-origin",
+}
+
+func securityHeaders(cfg SecurityHeaders) echo.MiddlewareFunc {
+	return middleware.SecureWithConfig(middleware.SecureConfig{
+		XSSProtection:         "", // Deprecated by browsers in favor of CSP
+		ContentTypeNosniff:    cfg.ContentTypeNosniff,
+		XFrameOptions:         cfg.FrameOptions,
+		HSTSMaxAge:            cfg.HstsMaxAge,
+		ContentSecurityPolicy: cfg.ContentSecurityPolicy,
+		ReferrerPolicy:        cfg.ReferrerPolicy,
+	})
+}
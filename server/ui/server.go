@@ -5,6 +5,7 @@ package ui
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
 	"time"
@@ -21,21 +22,154 @@ import (
 
 const serverName = "rest-api"
 
+type Option func(*serverOptions)
+
+type serverOptions struct {
+	securityHeaders SecurityHeaders
+	apiOptions      []apiHandlers.Option
+	daemonOptions   []daemons.Option
+	strictEvents    bool
+	requiredLabels  []string
+	bodyLimit       string
+}
+
+// WithSecurityHeaders overrides the DefaultSecurityHeaders.
+func WithSecurityHeaders(cfg SecurityHeaders) Option {
+	return func(o *serverOptions) {
+		o.securityHeaders = cfg
+	}
+}
+
+// WithBodyLimit rejects API and web requests with a body larger than the limit, e.g. "1M".
+// Uploads of update and config archives are not limited.
+func WithBodyLimit(limit string) Option {
+	return func(o *serverOptions) {
+		o.bodyLimit = limit
+	}
+}
+
+// WithDeviceOrderBy sets the default order of the device list for API and web clients.
+func WithDeviceOrderBy(orderBy api.OrderBy) Option {
+	return func(o *serverOptions) {
+		o.apiOptions = append(o.apiOptions, apiHandlers.WithDeviceOrderBy(orderBy))
+	}
+}
+
+// WithDeviceListMaxLimit caps how many devices API clients may list in a single request.
+func WithDeviceListMaxLimit(limit int) Option {
+	return func(o *serverOptions) {
+		o.apiOptions = append(o.apiOptions, apiHandlers.WithDeviceListMaxLimit(limit))
+	}
+}
+
+// WithRolloutApproval makes new rollouts wait for an explicit approval before they are committed.
+func WithRolloutApproval(required bool) Option {
+	return func(o *serverOptions) {
+		o.apiOptions = append(o.apiOptions, apiHandlers.WithRolloutApproval(required))
+	}
+}
+
+// WithRolloutAudit sets how the devices moved by a rollout are recorded in the audit log of the user.
+func WithRolloutAudit(audit apiHandlers.RolloutAudit) Option {
+	return func(o *serverOptions) {
+		o.apiOptions = append(o.apiOptions, apiHandlers.WithRolloutAudit(audit))
+	}
+}
+
+// WithRolloutsMaxPerUpdate caps how many rollouts an update may have, zero does not cap them.
+func WithRolloutsMaxPerUpdate(limit int) Option {
+	return func(o *serverOptions) {
+		o.apiOptions = append(o.apiOptions, apiHandlers.WithRolloutsMaxPerUpdate(limit))
+	}
+}
+
+// WithAppsStatesMaxAge tells API clients how old apps states reports the device gateway keeps.
+func WithAppsStatesMaxAge(age time.Duration) Option {
+	return func(o *serverOptions) {
+		o.apiOptions = append(o.apiOptions, apiHandlers.WithAppsStatesMaxAge(age))
+	}
+}
+
+// WithGatewayLimits tells API clients the effective storage limits of the device gateway.
+func WithGatewayLimits(limits apiHandlers.GatewayLimits) Option {
+	return func(o *serverOptions) {
+		o.apiOptions = append(o.apiOptions, apiHandlers.WithGatewayLimits(limits))
+	}
+}
+
+// WithGatewayTlsConfig tells administrators about the TLS certificate and client CAs of the device gateway.
+func WithGatewayTlsConfig(cfg *tls.Config) Option {
+	return func(o *serverOptions) {
+		o.apiOptions = append(o.apiOptions, apiHandlers.WithGatewayTlsConfig(cfg))
+	}
+}
+
+// WithUserRateLimit limits the number of API requests per second each user may make.
+func WithUserRateLimit(requestsPerSecond float64, burst int) Option {
+	return func(o *serverOptions) {
+		o.apiOptions = append(o.apiOptions, apiHandlers.WithUserRateLimit(requestsPerSecond, burst))
+	}
+}
+
+// WithCertExpiryNotice periodically warns when at least a given ratio of devices
+// have client certificates which expire within a given window.
+func WithCertExpiryNotice(window time.Duration, ratio float64) Option {
+	return func(o *serverOptions) {
+		o.daemonOptions = append(o.daemonOptions, daemons.WithCertExpiryNotice(window, ratio, time.Hour))
+	}
+}
+
+// WithRolloutJournalGracePeriod sets how long in-flight writes may still append to a rolled over rollout journal
+// before it is processed. By default, it equals the 5 minutes journal rollover interval.
+func WithRolloutJournalGracePeriod(grace time.Duration) Option {
+	return func(o *serverOptions) {
+		o.daemonOptions = append(o.daemonOptions, daemons.WithRolloverGracePeriod(grace))
+	}
+}
+
+// WithStrictEvents fails reading device update events when any of them is malformed, instead of skipping it.
+func WithStrictEvents(strict bool) Option {
+	return func(o *serverOptions) {
+		o.strictEvents = strict
+	}
+}
+
+// WithRequiredLabels forbids API clients to delete these standard labels from devices,
+// see storage.ValidateRequiredLabels.
+func WithRequiredLabels(labels []string) Option {
+	return func(o *serverOptions) {
+		o.requiredLabels = labels
+	}
+}
+
 type daemon interface {
 	Start()
 	Shutdown()
 }
 
-func NewServer(ctx context.Context, db *storage.DbHandle, fs *storage.FsHandle, bindAddr string) (server.Server, error) {
+func NewServer(ctx context.Context, db *storage.DbHandle, fs *storage.FsHandle, bindAddr string, opts ...Option) (server.Server, error) {
+	options := serverOptions{securityHeaders: DefaultSecurityHeaders}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	strg, err := api.NewStorage(db, fs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load %s storage: %w", serverName, err)
 	}
+	strg.SetStrictEvents(options.strictEvents)
+	strg.SetRequiredLabels(options.requiredLabels)
 	users, err := users.NewStorage(db, fs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize users storage: %w", err)
 	}
 	e := server.NewEchoServer()
+	e.Use(securityHeaders(options.securityHeaders))
+	if len(options.bodyLimit) > 0 {
+		limit := apiHandlers.NewBodyLimit(options.bodyLimit)
+		e.Use(limit.Middleware())
+		options.apiOptions = append(options.apiOptions, apiHandlers.WithBodyLimit(limit))
+	}
 
 	provider, err := auth.NewProvider(e, db, fs, users)
 	if err != nil {
@@ -43,11 +177,11 @@ func NewServer(ctx context.Context, db *storage.DbHandle, fs *storage.FsHandle,
 	}
 	slog.Info("Using authentication provider", "name", provider.Name())
 
-	daemons := daemons.New(ctx, strg, users)
+	daemons := daemons.New(ctx, strg, users, options.daemonOptions...)
 
 	srv := server.NewServer(ctx, e, serverName, bindAddr, nil)
 	e.Use(auth.CsrfCheck)
-	apiHandlers.RegisterHandlers(e, strg, provider)
+	apiHandlers.RegisterHandlers(e, strg, users, provider, options.apiOptions...)
 	webHandlers.RegisterHandlers(e, users, provider)
 	return &apiServer{server: srv, daemons: daemons}, nil
 }
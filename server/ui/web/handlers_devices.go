@@ -21,10 +21,8 @@ func (h handlers) devicesList(c echo.Context) error {
 	if page < 1 {
 		page = 1
 	}
+	// Without an explicit sort the server's configured default order applies.
 	sort := c.QueryParam("sort")
-	if sort == "" {
-		sort = "created-at-desc"
-	}
 	const pageSize = 50
 	offset := (page - 1) * pageSize
 
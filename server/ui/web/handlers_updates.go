@@ -109,9 +109,9 @@ func (h handlers) updatesList(c echo.Context) error {
 }
 
 func (h handlers) updatesGet(c echo.Context) error {
-	url := fmt.Sprintf("/v1/updates/%s/%s/%s/rollouts", c.Param("prod"), c.Param("tag"), c.Param("name"))
+	url := fmt.Sprintf("/v1/updates/%s/%s/%s/rollouts?include=device-count", c.Param("prod"), c.Param("tag"), c.Param("name"))
 
-	var rollouts []string
+	var rollouts []api.RolloutListItem
 	if err := getJson(c.Request().Context(), url, &rollouts); err != nil {
 		return h.handleUnexpected(c, err)
 	}
@@ -137,7 +137,7 @@ func (h handlers) updatesGet(c echo.Context) error {
 		Tag          string
 		Name         string
 		Prod         string
-		Rollouts     []string
+		Rollouts     []api.RolloutListItem
 		Groups       []string
 		Tuf          api.UpdateTufResp
 		TufJson      string
@@ -106,6 +106,9 @@ func (h *handlers) userScopesUpdate(c echo.Context) error {
 
 	user.AllowedScopes = scopes
 	if err := user.Update("Scopes changed by " + session.User.Username); err != nil {
+		if errors.Is(err, users.ErrEmailRequired) || errors.Is(err, users.ErrEmailTaken) {
+			return h.handleError(c, http.StatusConflict, err)
+		}
 		return h.handleUnexpected(c, err)
 	}
 	return c.NoContent(http.StatusNoContent)
@@ -118,6 +121,9 @@ func (h *handlers) userTokenCreate(c echo.Context) error {
 		Description string   `json:"description"`
 		Scopes      []string `json:"scopes"`
 		Expires     string   `json:"expires"`
+		// Clamp drops requested scopes the user is not allowed, and shortens an expiry beyond the maximum token lifetime,
+		// instead of failing the request.
+		Clamp bool `json:"clamp"`
 	}
 	var req TokenRequest
 	if err := c.Bind(&req); err != nil {
@@ -137,6 +143,12 @@ func (h *handlers) userTokenCreate(c echo.Context) error {
 	if err != nil {
 		return EchoError(c, err, http.StatusBadRequest, fmt.Sprintf("Invalid scope: %s", err))
 	}
+	if req.Clamp {
+		if scopes = scopes.Clamp(session.User.AllowedScopes); scopes == 0 {
+			err := errors.New("none of the requested scopes are allowed for this user")
+			return EchoError(c, err, http.StatusBadRequest, err.Error())
+		}
+	}
 
 	// Parse the ISO date string
 	expires, err := time.Parse(time.RFC3339, req.Expires)
@@ -149,8 +161,15 @@ func (h *handlers) userTokenCreate(c echo.Context) error {
 		err := fmt.Errorf("expiration date must be in the future. Got: %s", req.Expires)
 		return EchoError(c, err, http.StatusBadRequest, err.Error())
 	}
+	if req.Clamp {
+		expires = h.users.ClampTokenExpiry(expires)
+	}
 	tok, err := session.User.GenerateToken(req.Description, expires.Unix(), scopes)
 	if err != nil {
+		var errScopes users.ErrScopesExceeded
+		if errors.As(err, &errScopes) {
+			return EchoError(c, err, http.StatusForbidden, err.Error())
+		}
 		return EchoError(c, err, http.StatusBadRequest, err.Error())
 	}
 	return c.String(http.StatusCreated, tok.Value)
@@ -0,0 +1,88 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foundriesio/dg-satellite/auth"
+	"github.com/foundriesio/dg-satellite/context"
+	"github.com/foundriesio/dg-satellite/storage"
+	"github.com/foundriesio/dg-satellite/storage/users"
+)
+
+func TestUserTokenCreate(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	require.Nil(t, fs.Auth.InitHmacSecret())
+	us, err := users.NewStorage(db, fs)
+	require.Nil(t, err)
+	us.SetTokenLifetime(0, 30*24*time.Hour)
+
+	u := users.User{Username: "testuser", AllowedScopes: users.ScopeDevicesR | users.ScopeUpdatesR}
+	require.Nil(t, us.Create(&u))
+
+	h := handlers{users: us}
+	e := echo.New()
+	e.POST("/users/:username/tokens", h.userTokenCreate, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := context.CtxWithLog(c.Request().Context(), slog.Default())
+			ctx = CtxWithSession(ctx, &auth.Session{User: &u})
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	})
+	create := func(body string, status int) string {
+		req := httptest.NewRequest(http.MethodPost, "/users/testuser/tokens", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		require.Equal(t, status, rec.Code, rec.Body.String())
+		return rec.Body.String()
+	}
+	expires := func(d time.Duration) string {
+		return time.Now().Add(d).Format(time.RFC3339)
+	}
+
+	// Over-scoped tokens are rejected with the offending scopes.
+	body := fmt.Sprintf(`{"description":"over","scopes":["devices:read","devices:delete","users:read"],"expires":"%s"}`, expires(time.Hour))
+	res := create(body, http.StatusForbidden)
+	require.Contains(t, res, "requested scopes are not allowed for this user: devices:delete, users:read")
+	// Unless clamped, as long as any requested scope is allowed.
+	body = fmt.Sprintf(`{"description":"clamped","scopes":["devices:read","devices:delete"],"expires":"%s","clamp":true}`, expires(time.Hour))
+	create(body, http.StatusCreated)
+	body = fmt.Sprintf(`{"description":"none","scopes":["users:read"],"expires":"%s","clamp":true}`, expires(time.Hour))
+	res = create(body, http.StatusBadRequest)
+	require.Contains(t, res, "none of the requested scopes are allowed for this user")
+
+	// An expiry beyond the maximum token lifetime is rejected, or clamped to it.
+	body = fmt.Sprintf(`{"description":"long","scopes":["devices:read"],"expires":"%s"}`, expires(60*24*time.Hour))
+	res = create(body, http.StatusBadRequest)
+	require.Contains(t, res, "tokens may be valid for at most 720h0m0s")
+	body = fmt.Sprintf(`{"description":"long-clamped","scopes":["devices:read"],"expires":"%s","clamp":true}`, expires(60*24*time.Hour))
+	create(body, http.StatusCreated)
+
+	tokens, err := u.ListTokens()
+	require.Nil(t, err)
+	require.Len(t, tokens, 2)
+	byDesc := map[string]users.Token{}
+	for _, tok := range tokens {
+		byDesc[tok.Description] = tok
+	}
+	require.Equal(t, users.ScopeDevicesR, byDesc["clamped"].Scopes)
+	require.InDelta(t, time.Now().Add(30*24*time.Hour).Unix(), byDesc["long-clamped"].ExpiresAt, 5)
+}
@@ -0,0 +1,19 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package server
+
+import (
+	"github.com/foundriesio/dg-satellite/cmd"
+)
+
+// VersionInfo is the build of the server, fields are empty unless set by the linker flags of the build.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build-time"`
+}
+
+func GetVersionInfo() VersionInfo {
+	return VersionInfo{Version: cmd.Version, Commit: cmd.Commit, BuildTime: cmd.BuildTime}
+}
@@ -11,9 +11,16 @@ import (
 	"io"
 	"iter"
 	"log/slog"
+	"os"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/foundriesio/dg-satellite/clock"
+	"github.com/foundriesio/dg-satellite/context"
 	"github.com/foundriesio/dg-satellite/storage"
 )
 
@@ -23,9 +30,13 @@ type (
 
 	FsHandle = storage.FsHandle
 
-	AppsStates        = storage.AppsStates
-	DeviceStatus      = storage.DeviceStatus
-	DeviceUpdateEvent = storage.DeviceUpdateEvent
+	AppsStates          = storage.AppsStates
+	DesiredTarget       = storage.DesiredTarget
+	DeviceChange        = storage.DeviceChange
+	DeviceInstallResult = storage.DeviceInstallResult
+	DeviceStatus        = storage.DeviceStatus
+	DeviceUpdateEvent   = storage.DeviceUpdateEvent
+	TufMetaUrls         = storage.TufMetaUrls
 
 	ErrConfigUploadBroken = storage.ErrConfigUploadBroken
 )
@@ -39,6 +50,9 @@ const (
 	OrderByDeviceNameDesc    OrderBy = "name-desc"
 	OrderByDeviceUuidAsc     OrderBy = "uuid-asc"
 	OrderByDeviceUuidDesc    OrderBy = "uuid-desc"
+
+	// DefaultDeviceOrderBy is used when neither a client nor the server configuration set an order.
+	DefaultDeviceOrderBy = OrderByDeviceNameAsc
 )
 
 var orderByDeviceMap = map[OrderBy]string{
@@ -53,6 +67,19 @@ var orderByDeviceMap = map[OrderBy]string{
 	OrderByDeviceUuidDesc: "uuid DESC",
 }
 
+const (
+	DeviceChangeDeleted = storage.DeviceChangeDeleted
+
+	ActivityMaxDays = storage.ActivityMaxDays
+	StatesMaxCount  = storage.StatesMaxCount
+)
+
+// Valid returns true if devices can be listed in this order.
+func (o OrderBy) Valid() bool {
+	_, ok := orderByDeviceMap[o]
+	return ok
+}
+
 var (
 	NewDb = storage.NewDb
 	NewFs = storage.NewFs
@@ -60,21 +87,47 @@ var (
 	DbFile = storage.DbFile
 
 	ValidCorrelationId = storage.ValidCorrelationId
+	ValidUpdateId      = storage.ValidUpdateId
+	ValidateLabels     = storage.ValidateLabels
+	IsStandardLabel    = storage.IsStandardLabel
+	StandardLabels     = storage.StandardLabels
+	PubKeyFingerprint  = storage.PubKeyFingerprint
 	TestIdRegex        = storage.TestIdRegex
 
 	IsDbError             = storage.IsDbError
 	ErrDbConstraintUnique = storage.ErrDbConstraintUnique
 	ErrInvalidUpdate      = storage.ErrInvalidUpdate
+	ErrRequiredLabel      = storage.ErrRequiredLabel
+
+	ErrUnknownUpdateChannel = errors.New("unknown update channel")
+	ErrUpdateNotFound       = errors.New("update not found")
+	ErrUpdateChannelType    = errors.New("update channel is not for this type of device")
+	ErrInvalidTufRoot       = errors.New("invalid TUF root metadata")
+	ErrTufRootVersion       = errors.New("TUF root version must directly follow the current latest root")
+	ErrRolloutExists        = errors.New("rollout with this name already exists")
+	ErrRolloutsLimit        = errors.New("update has the maximum number of rollouts")
 )
 
 // DeviceListOpts lets you set the order devices will be returned
 // by the `List` api
 type DeviceListOpts struct {
-	OrderBy OrderBy `query:"order-by" default:"last-seen-desc"`
+	OrderBy OrderBy `query:"order-by" default:"name-asc"`
 	Limit   int     `query:"limit"    default:"1000"`
 	Offset  int     `query:"offset"   default:"0"`
+
+	PubKeyFingerprint string `query:"pubkey-fingerprint"`
+	// Update filters devices by their assigned update, only "none" is supported.
+	Update string `query:"update"`
+	// LastSeenAfter and LastSeenBefore select devices which last checked in within [after, before).
+	// Both are Unix times in seconds, zero values leave the range open.
+	LastSeenAfter int64 `query:"last-seen-after"`
+	// Unix time in seconds, devices which last checked in before it are selected.
+	LastSeenBefore int64 `query:"last-seen-before"`
 }
 
+// DeviceUpdateNone selects devices not assigned to any update.
+const DeviceUpdateNone = "none"
+
 type DeviceListItem struct {
 	Uuid      string `json:"uuid"`
 	CreatedAt int64  `json:"created-at"`
@@ -89,9 +142,18 @@ type Device struct {
 	DeviceListItem
 
 	Apps       []string `json:"apps"`
+	FirstSeen  int64    `json:"first-seen"`
 	OstreeHash string   `json:"ostree-hash"`
 	PubKey     string   `json:"pubkey"`
 	UpdateName string   `json:"update-name"`
+	// UpdateChannel is empty unless the device was assigned to an update by a rollout.
+	UpdateChannel string `json:"update-channel"`
+	// Groups are the selector groups whose selectors the device labels currently match.
+	Groups []string `json:"groups,omitempty"`
+	// ClaimedBy is the user who claimed the device; only they and admins may change a claimed device.
+	ClaimedBy string `json:"claimed-by,omitempty"`
+	// Pinned devices keep their current update: rollouts skip them.
+	Pinned bool `json:"pinned"`
 
 	Aktoml  string `json:"aktualizr-toml"`
 	HwInfo  string `json:"hardware-info"`
@@ -102,31 +164,331 @@ type Device struct {
 	storage Storage
 }
 
+// DeviceEffectiveConfig tells what a device runs now, and what its assigned update wants it to run.
+type DeviceEffectiveConfig struct {
+	Uuid       string `json:"uuid"`
+	Tag        string `json:"tag"`
+	UpdateName string `json:"update-name"`
+	// UpdateChannel is the channel the device's update is served from, also when no rollout assigned the device.
+	UpdateChannel string         `json:"update-channel"`
+	Pinned        bool           `json:"pinned"`
+	Running       RunningTarget  `json:"running"`
+	Desired       *DesiredTarget `json:"desired,omitempty"`
+	Tuf           *TufMetaUrls   `json:"tuf,omitempty"`
+	UpToDate      bool           `json:"up-to-date"`
+}
+
+// RunningTarget is what a device reported at its last check-in.
+type RunningTarget struct {
+	Target     string   `json:"target"`
+	OstreeHash string   `json:"ostree-hash"`
+	Apps       []string `json:"apps"`
+}
+
 type Rollout struct {
 	Uuids  []string `json:"uuids,omitempty"`
 	Groups []string `json:"groups,omitempty"`
 	Effect []string `json:"effective-uuids,omitempty"`
 	Commit bool     `json:"committed"`
+	// FromTarget restricts the rollout to devices currently running this target name or ostree hash.
+	FromTarget string `json:"from-target,omitempty"`
+	// PendingApproval rollouts are neither journaled nor committed until approved.
+	PendingApproval bool `json:"pending-approval,omitempty"`
+	// Editor is the user who created the rollout, which skips devices claimed by other users.
+	// It is empty for rollouts created by admins, which update devices claimed by anyone.
+	Editor string `json:"editor,omitempty"`
+}
+
+// DeviceUpdateChange is a device which a rollout moved from another update, see CommitRolloutChanges.
+type DeviceUpdateChange struct {
+	Uuid       string
+	FromUpdate string
+}
+
+// RolloutTargets shows how the devices requested by a rollout resolve to the devices it can update.
+type RolloutTargets struct {
+	Requested []string                 `json:"requested-uuids"`
+	Grouped   []string                 `json:"group-uuids"`
+	Effective []string                 `json:"effective-uuids"`
+	Excluded  []RolloutTargetExclusion `json:"excluded"`
+}
+
+// RolloutTargetExclusion tells why a requested device is not eligible for a rollout.
+type RolloutTargetExclusion struct {
+	Uuid   string `json:"uuid"`
+	Reason string `json:"reason"`
+}
+
+const (
+	ExclusionNonexistent = "nonexistent"
+	ExclusionDeleted     = "deleted"
+	ExclusionWrongTag    = "wrong-tag"
+	ExclusionPinned      = "pinned"
+	// The device is claimed by another user than the rollout's editor, see Rollout.Editor.
+	ExclusionClaimed = "claimed"
+	// The device does not run the target a rollout updates from, see Rollout.FromTarget.
+	ExclusionWrongTarget = "wrong-target"
+	// The device is a production device in a CI update channel, or vice versa.
+	ExclusionWrongKind = "wrong-device-kind"
+)
+
+// TagDevicesCount is how many devices of a kind (production or CI) report a tag.
+type TagDevicesCount struct {
+	Tag     string `json:"tag"`
+	IsProd  bool   `json:"is-prod"`
+	Devices int    `json:"devices"`
+}
+
+// DeviceGroupMembers lists the devices of a group, that is the devices having the group label set to its name.
+type DeviceGroupMembers struct {
+	Name    string   `json:"name"`
+	Devices int      `json:"devices"`
+	Uuids   []string `json:"uuids,omitempty"`
+}
+
+// RolloutListItem is an extended rollout listing entry, for clients that need more than just the name.
+type RolloutListItem struct {
+	Name        string           `json:"name"`
+	Committed   bool             `json:"committed"`
+	DeviceCount int              `json:"device-count"`
+	ModifiedAt  int64            `json:"modified-at"`
+	Progress    *RolloutProgress `json:"progress,omitempty"`
+}
+
+// RolloutProgress counts the devices of a rollout by the latest status they reported for its update.
+type RolloutProgress struct {
+	Pending    int `json:"pending"`
+	InProgress int `json:"in-progress"`
+	Succeeded  int `json:"succeeded"`
+	Failed     int `json:"failed"`
 }
 
 type Storage struct {
 	db *storage.DbHandle
 	fs *storage.FsHandle
 
-	stmtDeviceCount     stmtDeviceCount
-	stmtDeviceDelete    stmtDeviceDelete
-	stmtDeviceGet       stmtDeviceGet
-	stmtDeviceGetGroups stmtDeviceGetGroups
-	stmtDeviceGetLabels stmtDeviceGetLabels
-	stmtDeviceList      map[OrderBy]stmtDeviceList
-	stmtDeviceSetLabels stmtDeviceSetLabels
-	stmtDeviceSetUpdate stmtDeviceSetUpdate
+	stmtDeviceAssignGroup       stmtDeviceAssignGroup
+	stmtDeviceCancelUpdate      stmtDeviceCancelUpdate
+	stmtDeviceClearGroup        stmtDeviceClearGroup
+	stmtDeviceSetClaimant       stmtDeviceSetClaimant
+	stmtDeviceSetPinned         stmtDeviceSetPinned
+	stmtDeviceResetKey          stmtDeviceResetKey
+	stmtDeviceCount             stmtDeviceCount
+	stmtDeviceCertExpiry        stmtDeviceCertExpiry
+	stmtDeviceFindByKey         stmtDeviceFindByKey
+	stmtDeviceFindInvalid       stmtDeviceFindInvalid
+	stmtDeviceDelete            stmtDeviceDelete
+	stmtDeviceDeleteFilter      stmtDeviceDeleteFilter
+	stmtDeviceDeleteFilterList  stmtDeviceDeleteFilterList
+	stmtDeviceGet               stmtDeviceGet
+	stmtDeviceGetGroups         stmtDeviceGetGroups
+	stmtDeviceGetLabels         stmtDeviceGetLabels
+	stmtDeviceList              map[OrderBy]stmtDeviceList
+	stmtDeviceListNoUpd         map[OrderBy]stmtDeviceList
+	stmtDeviceCountNoUpd        stmtDeviceCountNoUpd
+	stmtDeviceCountByTag        stmtDeviceCountByTag
+	stmtDeviceCountGroup        stmtDeviceCountGroup
+	stmtDeviceCountLabeled      stmtDeviceCountLabeled
+	stmtDeviceGroupMembers      stmtDeviceGroupMembers
+	stmtDeviceGroupCount        stmtDeviceGroupCount
+	stmtDeviceRolloutCandidates stmtDeviceRolloutCandidates
+	stmtDeviceSetLabels         stmtDeviceSetLabels
+	stmtDeviceSetUpdate         stmtDeviceSetUpdate
+	stmtDeviceUpdateCandidates  stmtDeviceUpdateCandidates
+	stmtDeviceUpdatesList       stmtDeviceUpdatesList
+
+	stmtDeviceSelectorGroups stmtDeviceSelectorGroups
+	stmtDeviceSelectorList   stmtDeviceSelectorList
+	stmtDeviceSelectorCount  stmtDeviceSelectorCount
+	stmtSelectorGroupSave    stmtSelectorGroupSave
+	stmtSelectorGroupDelete  stmtSelectorGroupDelete
+
+	strictEvents   bool
+	requiredLabels []string
+	knownNames     *knownNamesCache
+	// rolloutsLock serializes changes of rollout files within this process, see lockRollouts.
+	rolloutsLock *sync.Mutex
+}
+
+// SetStrictEvents makes reading device update events fail on any malformed line.
+// By default, malformed lines are logged and skipped, so that one corrupt line does not hide all events.
+func (s *Storage) SetStrictEvents(strict bool) {
+	s.strictEvents = strict
+}
+
+// SetRequiredLabels sets the standard labels which may be changed but not deleted once a device has them,
+// see storage.ValidateRequiredLabels. By default, any label may be deleted.
+func (s *Storage) SetRequiredLabels(labels []string) {
+	s.requiredLabels = slices.Clone(labels)
 }
 
 func (d Device) Delete() error {
 	err1 := d.storage.stmtDeviceDelete.run(d.Uuid)
+	if err1 == nil {
+		d.storage.publishDeviceChanges(storage.DeviceChangeDeleted, d.Uuid)
+	}
 	err2 := d.storage.fs.Devices.Delete(d.Uuid)
-	return errors.Join(err1, err2)
+	err3 := d.storage.removeEffectiveUuids([]string{d.Uuid})
+	return errors.Join(err1, err2, err3)
+}
+
+// DeviceDeleteFilter selects devices to delete by DeleteDevices.
+// Devices must match all of the set conditions, at least one of them must be set.
+type DeviceDeleteFilter struct {
+	// LastSeenBefore selects devices which did not check in since this Unix time, including those which never did.
+	LastSeenBefore int64
+	Selector       LabelSelector
+}
+
+// DeleteDevices soft-deletes all devices matching the filter at once, and returns their UUIDs.
+// Devices claimed by other users than the editor are skipped, an empty editor may delete all devices.
+// With dryRun, matching devices are only looked up.
+func (s Storage) DeleteDevices(filter DeviceDeleteFilter, editor string, dryRun bool) (uuids []string, err error) {
+	if filter.LastSeenBefore <= 0 && len(filter.Selector) == 0 {
+		return nil, errors.New("either a last seen time or a label selector must be set")
+	}
+	if dryRun {
+		return s.stmtDeviceDeleteFilterList.run(filter, editor)
+	}
+	if uuids, err = s.stmtDeviceDeleteFilter.run(filter, editor); err != nil {
+		return nil, err
+	}
+	s.publishDeviceChanges(storage.DeviceChangeDeleted, uuids...)
+	errs := make([]error, 0, len(uuids)+1)
+	for _, uuid := range uuids {
+		errs = append(errs, s.fs.Devices.Delete(uuid))
+	}
+	errs = append(errs, s.removeEffectiveUuids(uuids))
+	return uuids, errors.Join(errs...)
+}
+
+// CancelUpdate unassigns the device from its update and drops it from the rollouts of that update.
+// Other devices of these rollouts keep their update.
+func (d Device) CancelUpdate() error {
+	if err := d.storage.stmtDeviceCancelUpdate.run(d.Uuid); err != nil {
+		return err
+	}
+	d.storage.publishDeviceChanges(storage.DeviceChangeUpdate, d.Uuid)
+	return d.storage.removeUpdateEffectiveUuid(d.updatesFsHandle(), d.Tag, d.UpdateName, d.Uuid)
+}
+
+// SetUpdate assigns the device to an update of its tag directly, without a rollout.
+// An empty channel stands for the default channel of the device type (production or CI).
+// It returns false if the device is pinned, and so was not assigned.
+func (d Device) SetUpdate(updateName, channel string) (bool, error) {
+	h := d.storage.fs.Updates.ForDevice(d.IsProd)
+	if len(channel) > 0 {
+		var err error
+		if h, err = d.storage.getUpdatesFsHandle(channel); err != nil {
+			return false, err
+		} else if h.IsProd != d.IsProd {
+			return false, fmt.Errorf("%w: %s", ErrUpdateChannelType, channel)
+		}
+	}
+	if updates, err := h.Rollouts.ListUpdates(d.Tag); err != nil {
+		return false, err
+	} else if len(d.Tag) == 0 || !slices.Contains(updates[d.Tag], updateName) {
+		return false, fmt.Errorf("%w: %s/%s", ErrUpdateNotFound, d.Tag, updateName)
+	}
+
+	var effectiveUuids []string
+	err := d.storage.stmtDeviceSetUpdate.run(nil, d.Tag, updateName, h.Name, h.IsProd, []string{d.Uuid}, nil, "", "", &effectiveUuids)
+	if err != nil || len(effectiveUuids) == 0 {
+		return false, err
+	}
+	d.storage.publishDeviceChanges(storage.DeviceChangeUpdate, d.Uuid)
+	// Rollouts of the previous update must not list the device as theirs anymore.
+	if prev := d.updatesFsHandle(); len(d.UpdateName) > 0 && (d.UpdateName != updateName || prev.Name != h.Name) {
+		return true, d.storage.removeUpdateEffectiveUuid(prev, d.Tag, d.UpdateName, d.Uuid)
+	}
+	return true, nil
+}
+
+// updatesFsHandle returns the update channel a device's update is served from.
+func (d Device) updatesFsHandle() storage.UpdatesChannelFsHandle {
+	return d.storage.deviceUpdatesFsHandle(d.UpdateChannel, d.IsProd)
+}
+
+func (s Storage) deviceUpdatesFsHandle(channel string, isProd bool) storage.UpdatesChannelFsHandle {
+	if h, ok := s.fs.Updates.Channel(channel); ok && h.IsProd == isProd {
+		return h
+	}
+	// Either no channel was set, or it was removed from the server configuration.
+	return s.fs.Updates.ForDevice(isProd)
+}
+
+// EffectiveConfig combines the device state with the TUF metadata of its assigned update.
+// Desired and Tuf are only set when the device has an update assigned, which has a target for the device tag.
+// Tuf URLs are relative to the device gateway URL.
+func (d Device) EffectiveConfig() (*DeviceEffectiveConfig, error) {
+	h := d.updatesFsHandle()
+	res := DeviceEffectiveConfig{
+		Uuid:          d.Uuid,
+		Tag:           d.Tag,
+		UpdateName:    d.UpdateName,
+		UpdateChannel: h.Name,
+		Pinned:        d.Pinned,
+		Running:       RunningTarget{Target: d.Target, OstreeHash: d.OstreeHash, Apps: d.Apps},
+	}
+	if res.Running.Apps == nil {
+		res.Running.Apps = []string{}
+	}
+	if len(d.UpdateName) == 0 || len(d.Tag) == 0 {
+		return &res, nil
+	}
+
+	content, err := h.Tuf.ReadFile(d.Tag, d.UpdateName, storage.TufTargetsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		// The update was removed after the device was assigned to it.
+		return &res, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if res.Desired, err = storage.LatestTarget(content, d.Tag, d.Target); err != nil || res.Desired == nil {
+		return &res, err
+	}
+	root, err := h.Tuf.LatestRootName(d.Tag, d.UpdateName)
+	if errors.Is(err, os.ErrNotExist) {
+		// Devices cannot fetch the update without its root metadata.
+		return &res, nil
+	} else if err != nil {
+		return nil, err
+	}
+	tuf := storage.NewTufMetaUrls("", root)
+	res.Tuf = &tuf
+	res.UpToDate = res.Desired.Target == d.Target && res.Desired.OstreeHash == d.OstreeHash
+	return &res, nil
+}
+
+// SetClaimant claims the device to a given user, or unclaims it when the claimant is empty.
+// The claim only changes while the device is still claimed by its ClaimedBy, so that concurrent claims cannot both
+// succeed: it returns false when another claim was made in the meantime.
+func (d *Device) SetClaimant(claimant string) (bool, error) {
+	if ok, err := d.storage.stmtDeviceSetClaimant.run(d.Uuid, claimant, d.ClaimedBy); err != nil || !ok {
+		return false, err
+	}
+	d.storage.publishDeviceChanges(storage.DeviceChangeClaim, d.Uuid)
+	d.ClaimedBy = claimant
+	return true, nil
+}
+
+// SetPinned pins the device to its current update, or unpins it, see Device.Pinned.
+func (d *Device) SetPinned(pinned bool) error {
+	if err := d.storage.stmtDeviceSetPinned.run(d.Uuid, pinned); err != nil {
+		return err
+	}
+	d.storage.publishDeviceChanges(storage.DeviceChangePin, d.Uuid)
+	d.Pinned = pinned
+	return nil
+}
+
+// ResetKey forgets the public key of the device, so that the device gateway enrolls the key of its next request.
+func (d *Device) ResetKey() error {
+	if err := d.storage.stmtDeviceResetKey.run(d.Uuid); err != nil {
+		return err
+	}
+	d.PubKey = ""
+	return nil
 }
 
 func (d Device) Updates() ([]string, error) {
@@ -141,20 +503,66 @@ func (d Device) Updates() ([]string, error) {
 	return names, nil
 }
 
-func (d Device) Events(updateId string) ([]DeviceUpdateEvent, error) {
-	name := fmt.Sprintf("%s-%s", storage.EventsPrefix, updateId)
-	content, err := d.storage.fs.Devices.ReadFile(d.Uuid, name)
+// Activity returns the device check-in times since a given time, oldest first.
+// Only the last storage.ActivityMaxDays days of activity are kept.
+func (d Device) Activity(since int64) ([]int64, error) {
+	names, err := d.storage.fs.Devices.ListFiles(d.Uuid, storage.ActivityPrefix, false)
 	if err != nil {
 		return nil, err
 	}
+	slices.Sort(names)
+	sinceName := storage.ActivityPrefix + "-" + time.Unix(since, 0).UTC().Format(storage.ActivityDayFormat)
+	res := make([]int64, 0)
+	for _, name := range names {
+		if name < sinceName {
+			continue
+		}
+		content, err := d.storage.fs.Devices.ReadFile(d.Uuid, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(content, "\n") {
+			if len(line) == 0 {
+				continue
+			}
+			ts, err := strconv.ParseInt(line, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("corrupted activity file %s line: %s", name, line)
+			} else if ts >= since {
+				res = append(res, ts)
+			}
+		}
+	}
+	return res, nil
+}
+
+// Certificate returns the PEM encoded client certificate last presented by the device, or an empty string.
+// It is only stored when the gateway runs with device certificates storage enabled.
+func (d Device) Certificate() (string, error) {
+	return d.storage.fs.Devices.ReadFile(d.Uuid, storage.CertFile)
+}
 
-	lines := strings.Split(content, "\n")
-	events := make([]DeviceUpdateEvent, 0, len(lines))
-	for _, line := range lines {
+func (d Device) Events(updateId string) ([]DeviceUpdateEvent, error) {
+	return d.EventsAfter(updateId, 0)
+}
+
+// EventsAfter returns the events of an update after a given number of lines of its events file.
+// The events file is indexed, so that these lines are not read, see storage.DevicesFsHandle.AppendIndexedFile.
+func (d Device) EventsAfter(updateId string, after int) ([]DeviceUpdateEvent, error) {
+	name := fmt.Sprintf("%s-%s", storage.EventsPrefix, updateId)
+	events := []DeviceUpdateEvent{}
+	for line, err := range d.storage.fs.Devices.ReadFileLines(d.Uuid, name, after) {
+		if err != nil {
+			return nil, fmt.Errorf("unexpected error reading file %s for device %s: %w", name, d.Uuid, err)
+		}
 		if len(line) > 0 {
 			var evt DeviceUpdateEvent
 			if err := json.Unmarshal([]byte(line), &evt); err != nil {
-				return nil, fmt.Errorf("unexpected error unmarshalling event json: %w", err)
+				if d.storage.strictEvents {
+					return nil, fmt.Errorf("unexpected error unmarshalling event json: %w", err)
+				}
+				slog.Warn("Skipping malformed device update event", "device", d.Uuid, "update", updateId, "error", err)
+				continue
 			}
 			events = append(events, evt)
 		}
@@ -162,6 +570,20 @@ func (d Device) Events(updateId string) ([]DeviceUpdateEvent, error) {
 	return events, nil
 }
 
+// InstallResult returns the final outcome of an update reported by the device, or nil if it was not reported yet.
+func (d Device) InstallResult(updateId string) (*DeviceInstallResult, error) {
+	name := fmt.Sprintf("%s-%s", storage.InstallResultPrefix, updateId)
+	content, err := d.storage.fs.Devices.ReadFile(d.Uuid, name)
+	if err != nil || len(content) == 0 {
+		return nil, err
+	}
+	var res DeviceInstallResult
+	if err := json.Unmarshal([]byte(content), &res); err != nil {
+		return nil, fmt.Errorf("unexpected error unmarshalling install result json: %w", err)
+	}
+	return &res, nil
+}
+
 func (d Device) AppsStates() ([]AppsStates, error) {
 	names, err := d.storage.fs.Devices.ListFiles(d.Uuid, storage.StatesPrefix, true)
 	if err != nil {
@@ -170,7 +592,7 @@ func (d Device) AppsStates() ([]AppsStates, error) {
 
 	states := make([]AppsStates, len(names))
 	for i, name := range names {
-		content, err := d.storage.fs.Devices.ReadFile(d.Uuid, name)
+		content, err := d.storage.fs.Devices.ReadFileDecompressed(d.Uuid, name)
 		if err != nil {
 			return nil, err
 		}
@@ -184,27 +606,58 @@ func (d Device) AppsStates() ([]AppsStates, error) {
 }
 
 func NewStorage(db *storage.DbHandle, fs *storage.FsHandle) (*Storage, error) {
-	handle := Storage{db: db, fs: fs}
+	handle := Storage{db: db, fs: fs, knownNames: newKnownNamesCache(), rolloutsLock: &sync.Mutex{}}
 
 	if err := db.InitStmt(
+		&handle.stmtDeviceAssignGroup,
+		&handle.stmtDeviceCancelUpdate,
+		&handle.stmtDeviceClearGroup,
+		&handle.stmtDeviceSetClaimant,
+		&handle.stmtDeviceSetPinned,
+		&handle.stmtDeviceResetKey,
 		&handle.stmtDeviceCount,
+		&handle.stmtDeviceCertExpiry,
+		&handle.stmtDeviceCountNoUpd,
+		&handle.stmtDeviceCountByTag,
+		&handle.stmtDeviceCountGroup,
+		&handle.stmtDeviceCountLabeled,
+		&handle.stmtDeviceGroupMembers,
+		&handle.stmtDeviceGroupCount,
+		&handle.stmtDeviceRolloutCandidates,
 		&handle.stmtDeviceDelete,
+		&handle.stmtDeviceDeleteFilter,
+		&handle.stmtDeviceDeleteFilterList,
+		&handle.stmtDeviceFindByKey,
+		&handle.stmtDeviceFindInvalid,
 		&handle.stmtDeviceGet,
 		&handle.stmtDeviceGetGroups,
 		&handle.stmtDeviceGetLabels,
 		&handle.stmtDeviceSetLabels,
 		&handle.stmtDeviceSetUpdate,
+		&handle.stmtDeviceUpdateCandidates,
+		&handle.stmtDeviceUpdatesList,
+		&handle.stmtDeviceSelectorGroups,
+		&handle.stmtDeviceSelectorList,
+		&handle.stmtDeviceSelectorCount,
+		&handle.stmtSelectorGroupSave,
+		&handle.stmtSelectorGroupDelete,
 	); err != nil {
 		return nil, err
 	}
 
 	handle.stmtDeviceList = make(map[OrderBy]stmtDeviceList, len(orderByDeviceMap))
+	handle.stmtDeviceListNoUpd = make(map[OrderBy]stmtDeviceList, len(orderByDeviceMap))
 	for orderBy, orderByStr := range orderByDeviceMap {
 		stmt := stmtDeviceList{}
-		if err := stmt.Init(*db, orderByStr); err != nil {
+		if err := stmt.Init(*db, orderByStr, ""); err != nil {
 			return nil, err
 		}
 		handle.stmtDeviceList[orderBy] = stmt
+		stmt = stmtDeviceList{}
+		if err := stmt.Init(*db, orderByStr, "AND update_name=''"); err != nil {
+			return nil, err
+		}
+		handle.stmtDeviceListNoUpd[orderBy] = stmt
 	}
 
 	return &handle, nil
@@ -213,26 +666,69 @@ func NewStorage(db *storage.DbHandle, fs *storage.FsHandle) (*Storage, error) {
 func (s Storage) DevicesList(opts DeviceListOpts) ([]DeviceListItem, int, error) {
 	orderBy := opts.OrderBy
 	if orderBy == "" {
-		orderBy = OrderByDeviceLastSeenDsc
+		orderBy = DefaultDeviceOrderBy
+	}
+	stmts, count := s.stmtDeviceList, s.stmtDeviceCount.run
+	switch opts.Update {
+	case "":
+	case DeviceUpdateNone:
+		stmts, count = s.stmtDeviceListNoUpd, s.stmtDeviceCountNoUpd.run
+	default:
+		return nil, 0, fmt.Errorf("invalid update arg: %s", opts.Update)
 	}
-	stmt, ok := s.stmtDeviceList[orderBy]
+	stmt, ok := stmts[orderBy]
 	if !ok {
 		return nil, 0, fmt.Errorf("invalid order by arg: %s", opts.OrderBy)
 	}
 
-	total, err := s.stmtDeviceCount.run()
+	if len(opts.PubKeyFingerprint) > 0 {
+		devices := make([]DeviceListItem, 0, 1)
+		err := s.stmtDeviceFindByKey.run(strings.ToLower(opts.PubKeyFingerprint),
+			opts.Update == DeviceUpdateNone, opts.LastSeenAfter, opts.LastSeenBefore, &devices)
+		if err != nil {
+			return nil, 0, err
+		}
+		return devices, len(devices), nil
+	}
+
+	total, err := count(opts.LastSeenAfter, opts.LastSeenBefore)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	devices := make([]DeviceListItem, 0, opts.Limit)
-	if err := stmt.run(opts.Limit, opts.Offset, &devices); err != nil {
+	if err := stmt.run(opts.LastSeenAfter, opts.LastSeenBefore, opts.Limit, opts.Offset, &devices); err != nil {
 		return nil, 0, err
 	}
 
 	return devices, total, nil
 }
 
+// DeviceCountsByTag returns how many devices report each tag, ordered by tag with CI devices first.
+func (s Storage) DeviceCountsByTag() ([]TagDevicesCount, error) {
+	return s.stmtDeviceCountByTag.run()
+}
+
+// DeviceGroupMembers returns a page of groups with their devices, ordered by group name and device UUID,
+// and the total number of groups. When countsOnly is set, only the number of devices of each group is returned.
+func (s Storage) DeviceGroupMembers(countsOnly bool, limit, offset int) ([]DeviceGroupMembers, int, error) {
+	total, err := s.stmtDeviceGroupCount.run()
+	if err != nil {
+		return nil, 0, err
+	}
+	groups, err := s.stmtDeviceGroupMembers.run(countsOnly, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return groups, total, nil
+}
+
+// CertExpiryCounts returns how many devices authenticated with a client certificate expiring before a given time,
+// and how many devices have a known certificate expiry at all.
+func (s Storage) CertExpiryCounts(before int64) (expiring, total int, err error) {
+	return s.stmtDeviceCertExpiry.run(before)
+}
+
 func (s Storage) DeviceGet(uuid string) (*Device, error) {
 	d := Device{storage: s, DeviceListItem: DeviceListItem{Uuid: uuid}}
 	var (
@@ -242,9 +738,9 @@ func (s Storage) DeviceGet(uuid string) (*Device, error) {
 	)
 	if err := s.stmtDeviceGet.run(
 		uuid,
-		&d.CreatedAt, &d.LastSeen,
-		&d.PubKey, &d.UpdateName, &d.Tag, &d.Target, &d.OstreeHash,
-		&apps, &labels, &d.IsProd,
+		&d.CreatedAt, &d.FirstSeen, &d.LastSeen,
+		&d.PubKey, &d.UpdateName, &d.UpdateChannel, &d.Tag, &d.Target, &d.OstreeHash,
+		&apps, &labels, &d.IsProd, &d.ClaimedBy, &d.Pinned,
 	); err != nil {
 		if err == sql.ErrNoRows {
 			err = nil
@@ -259,6 +755,9 @@ func (s Storage) DeviceGet(uuid string) (*Device, error) {
 	if err = json.Unmarshal([]byte(labels), &d.Labels); err != nil {
 		return nil, fmt.Errorf("failed to parse device labels: %w", err)
 	}
+	if d.Groups, err = s.stmtDeviceSelectorGroups.run(uuid); err != nil {
+		return nil, fmt.Errorf("failed to find device selector groups: %w", err)
+	}
 
 	if d.Aktoml, err = s.fs.Devices.ReadFile(d.Uuid, storage.AktomlFile); err != nil {
 		return nil, err
@@ -299,14 +798,32 @@ func (s Storage) DeviceGet(uuid string) (*Device, error) {
 
 var clearingEventTypes = []string{"EcuInstallationCompleted", "CertRotationCompleted", "MetadataUpdateCompleted"}
 
-func (s Storage) ListUpdates(tag string, isProd bool) (map[string][]string, error) {
-	return s.getRolloutsFsHandle(isProd).ListUpdates(tag)
+// UpdateChannels returns the names of all update channels, e.g. "ci" and "prod".
+func (s Storage) UpdateChannels() []string {
+	var names []string
+	for _, h := range s.fs.Updates.Channels() {
+		names = append(names, h.Name)
+	}
+	return names
+}
+
+func (s Storage) HasUpdateChannel(channel string) bool {
+	_, ok := s.fs.Updates.Channel(channel)
+	return ok
+}
+
+func (s Storage) ListUpdates(tag string, channel string) (map[string][]string, error) {
+	if h, err := s.getUpdatesFsHandle(channel); err != nil {
+		return nil, err
+	} else {
+		return h.Rollouts.ListUpdates(tag)
+	}
 }
 
-func (s Storage) GetUpdateTufMetadata(tag, updateName string, isProd bool) (map[string]map[string]any, error) {
-	handle := s.fs.Updates.Ci
-	if isProd {
-		handle = s.fs.Updates.Prod
+func (s Storage) GetUpdateTufMetadata(tag, updateName string, channel string) (map[string]map[string]any, error) {
+	handle, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return nil, err
 	}
 
 	latestRoot, err := handle.Tuf.LatestRootMetaName(tag, updateName)
@@ -333,52 +850,330 @@ func (s Storage) GetUpdateTufMetadata(tag, updateName string, isProd bool) (map[
 	return meta, nil
 }
 
-func (s Storage) ListRollouts(tag, updateName string, isProd bool) ([]string, error) {
-	return s.getRolloutsFsHandle(isProd).ListFiles(tag, updateName)
+// ImportTufRoot adds a new version of signed root metadata to an update.
+// The root version must directly follow the version of the current latest root of that update,
+// and be signed by the threshold of root keys of both the current latest root and the new root.
+func (s Storage) ImportTufRoot(tag, updateName string, channel string, content []byte) error {
+	handle, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return err
+	}
+
+	root, err := parseTufRoot(content)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTufRoot, err)
+	}
+	switch {
+	case root.Signed.Type != "root" && root.Signed.Type != "Root":
+		return fmt.Errorf("%w: _type must be root", ErrInvalidTufRoot)
+	case root.Signed.Version < 1:
+		return fmt.Errorf("%w: version must be a positive number", ErrInvalidTufRoot)
+	case len(root.Signed.Expires) == 0:
+		return fmt.Errorf("%w: missing expires", ErrInvalidTufRoot)
+	case len(root.Signed.Keys) == 0 || len(root.Signed.Roles) == 0:
+		return fmt.Errorf("%w: missing keys or roles", ErrInvalidTufRoot)
+	case len(root.Signatures) == 0:
+		return fmt.Errorf("%w: missing signatures", ErrInvalidTufRoot)
+	}
+
+	latestName, err := handle.Tuf.LatestRootName(tag, updateName)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %v", ErrUpdateNotFound, err)
+	} else if err != nil {
+		return err
+	}
+	latestContent, err := handle.Tuf.ReadFile(tag, updateName, latestName)
+	if err != nil {
+		return err
+	}
+	latest, err := parseTufRoot([]byte(latestContent))
+	if err != nil {
+		return fmt.Errorf("unexpected latest root metadata %s: %w", latestName, err)
+	}
+	if root.Signed.Version != latest.Signed.Version+1 {
+		return fmt.Errorf("%w: got %d, expected %d", ErrTufRootVersion, root.Signed.Version, latest.Signed.Version+1)
+	}
+	if err := root.verifiedBy(latest); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTufRoot, err)
+	} else if err := root.verifiedBy(root); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidTufRoot, err)
+	}
+
+	name := fmt.Sprintf("%d.root.json", root.Signed.Version)
+	return handle.Tuf.WriteFile(tag, updateName, name, string(content))
+}
+
+// SetMaxConcurrentInstalls limits how many devices may install an update at the same time.
+// A zero limit removes the limit.
+func (s Storage) SetMaxConcurrentInstalls(tag, updateName string, channel string, limit int) error {
+	handle, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return err
+	}
+	if _, err := handle.Tuf.LatestRootMetaName(tag, updateName); err != nil {
+		return fmt.Errorf("%w: %v", ErrUpdateNotFound, err)
+	}
+	return handle.Settings.WriteFile(tag, updateName, storage.SettingsMaxInstallsFile, strconv.Itoa(limit))
+}
+
+func (s Storage) ListRollouts(tag, updateName string, channel string) ([]string, error) {
+	if h, err := s.getUpdatesFsHandle(channel); err != nil {
+		return nil, err
+	} else {
+		return h.Rollouts.ListFiles(tag, updateName)
+	}
+}
+
+// ListRolloutsDetails returns the rollouts along with their commit status and how many devices each of them targets.
+// Until a rollout is committed its device count is zero.
+// The modification time of a rollout is when it was created or last changed, e.g. committed by the rollout daemon.
+func (s Storage) ListRolloutsDetails(tag, updateName string, channel string) ([]RolloutListItem, error) {
+	h, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := h.Rollouts.ListFileInfos(tag, updateName)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]RolloutListItem, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		rollout, err := s.GetRollout(tag, updateName, name, channel)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, RolloutListItem{
+			Name:        name,
+			Committed:   rollout.Commit,
+			DeviceCount: len(rollout.Effect),
+			ModifiedAt:  info.ModTime().Unix(),
+		})
+	}
+	return res, nil
+}
+
+// ListRolloutsProgress is ListRolloutsDetails with the progress of each rollout.
+// The update's rollouts log, including its rotated files, is read once for all rollouts.
+// Devices whose log lines were all removed by the log retention count as pending.
+func (s Storage) ListRolloutsProgress(tag, updateName string, channel string) ([]RolloutListItem, error) {
+	res, err := s.ListRolloutsDetails(tag, updateName, channel)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]string)
+	for line, err := range s.TailRolloutsLog(tag, updateName, channel, nil) {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			return nil, err
+		}
+		var status storage.DeviceStatus
+		if err := json.Unmarshal([]byte(line), &status); err != nil {
+			slog.Warn("Skipping malformed rollouts log line", "tag", tag, "update", updateName, "error", err)
+			continue
+		}
+		statuses[status.Uuid] = status.Status
+	}
+	for i := range res {
+		rollout, err := s.GetRollout(tag, updateName, res[i].Name, channel)
+		if err != nil {
+			return nil, err
+		}
+		var progress RolloutProgress
+		for _, uuid := range rollout.Effect {
+			switch status, ok := statuses[uuid]; {
+			case !ok:
+				progress.Pending++
+			case status == storage.StatusUpdateSucceeded || status == storage.StatusInstallationSucceeded:
+				progress.Succeeded++
+			case status == storage.StatusUpdateFailed || status == storage.StatusInstallationFailed:
+				progress.Failed++
+			default:
+				progress.InProgress++
+			}
+		}
+		res[i].Progress = &progress
+	}
+	return res, nil
 }
 
-func (s Storage) GetRollout(tag, updateName, rolloutName string, isProd bool) (res Rollout, err error) {
-	var content string
-	content, err = s.getRolloutsFsHandle(isProd).ReadFile(tag, updateName, rolloutName)
+func (s Storage) GetRollout(tag, updateName, rolloutName string, channel string) (res Rollout, err error) {
+	var (
+		h       storage.UpdatesChannelFsHandle
+		content string
+	)
+	if h, err = s.getUpdatesFsHandle(channel); err != nil {
+		return
+	}
+	content, err = h.Rollouts.ReadFile(tag, updateName, rolloutName)
 	if err == nil {
 		err = json.Unmarshal([]byte(content), &res)
 	}
 	return
 }
 
-func (s Storage) SaveRollout(tag, updateName, rolloutName string, isProd bool, rollout Rollout) error {
-	if data, err := json.Marshal(rollout); err != nil {
+// GetRolloutTargets resolves requested UUIDs and groups of a rollout to the devices it can update now.
+// All lists are sorted; a device both requested by UUID and by group is listed in both lists.
+func (s Storage) GetRolloutTargets(tag, updateName, rolloutName string, channel string) (res RolloutTargets, err error) {
+	rollout, err := s.GetRollout(tag, updateName, rolloutName, channel)
+	if err != nil {
+		return
+	}
+	h, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return
+	}
+	candidates, err := s.stmtDeviceRolloutCandidates.run(rollout.Uuids, rollout.Groups)
+	if err != nil {
+		return
+	}
+
+	res = RolloutTargets{Requested: []string{}, Grouped: []string{}, Effective: []string{}, Excluded: []RolloutTargetExclusion{}}
+	res.Requested = append(res.Requested, rollout.Uuids...)
+	for _, uuid := range rollout.Uuids {
+		if _, ok := candidates[uuid]; !ok {
+			res.Excluded = append(res.Excluded, RolloutTargetExclusion{Uuid: uuid, Reason: ExclusionNonexistent})
+		}
+	}
+	for uuid, c := range candidates {
+		if slices.Contains(rollout.Groups, c.group) {
+			res.Grouped = append(res.Grouped, uuid)
+		}
+		switch {
+		case c.deleted:
+			res.Excluded = append(res.Excluded, RolloutTargetExclusion{Uuid: uuid, Reason: ExclusionDeleted})
+		case c.isProd != h.IsProd:
+			res.Excluded = append(res.Excluded, RolloutTargetExclusion{Uuid: uuid, Reason: ExclusionWrongKind})
+		case c.tag != tag:
+			res.Excluded = append(res.Excluded, RolloutTargetExclusion{Uuid: uuid, Reason: ExclusionWrongTag})
+		case c.pinned:
+			res.Excluded = append(res.Excluded, RolloutTargetExclusion{Uuid: uuid, Reason: ExclusionPinned})
+		case len(rollout.Editor) > 0 && len(c.claimedBy) > 0 && c.claimedBy != rollout.Editor:
+			res.Excluded = append(res.Excluded, RolloutTargetExclusion{Uuid: uuid, Reason: ExclusionClaimed})
+		case len(rollout.FromTarget) > 0 && c.target != rollout.FromTarget && c.ostreeHash != rollout.FromTarget:
+			res.Excluded = append(res.Excluded, RolloutTargetExclusion{Uuid: uuid, Reason: ExclusionWrongTarget})
+		default:
+			res.Effective = append(res.Effective, uuid)
+		}
+	}
+	slices.Sort(res.Requested)
+	res.Requested = slices.Compact(res.Requested)
+	slices.Sort(res.Grouped)
+	slices.Sort(res.Effective)
+	slices.SortFunc(res.Excluded, func(a, b RolloutTargetExclusion) int { return strings.Compare(a.Uuid, b.Uuid) })
+	res.Excluded = slices.CompactFunc(res.Excluded, func(a, b RolloutTargetExclusion) bool { return a.Uuid == b.Uuid })
+	return
+}
+
+func (s Storage) SaveRollout(tag, updateName, rolloutName string, channel string, rollout Rollout) error {
+	h, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return err
+	}
+	return s.lockRollouts(h, tag, updateName, func() error {
+		return s.saveRollout(tag, updateName, rolloutName, channel, rollout)
+	})
+}
+
+// lockRollouts serializes changes of the rollout files of an update by this process,
+// and by other processes sharing the storage if file locking is enabled, see storage.SetFileLocking.
+func (s Storage) lockRollouts(h storage.UpdatesChannelFsHandle, tag, updateName string, fn func() error) error {
+	s.rolloutsLock.Lock()
+	defer s.rolloutsLock.Unlock()
+	return h.Rollouts.WithLock(tag, updateName, fn)
+}
+
+// saveRollout is SaveRollout for callers which already hold the rollouts lock.
+func (s Storage) saveRollout(tag, updateName, rolloutName string, channel string, rollout Rollout) error {
+	if h, err := s.getUpdatesFsHandle(channel); err != nil {
+		return err
+	} else if data, err := json.Marshal(rollout); err != nil {
 		return err
 	} else {
-		return s.getRolloutsFsHandle(isProd).WriteFile(tag, updateName, rolloutName, string(data))
+		return h.Rollouts.WriteFile(tag, updateName, rolloutName, string(data))
+	}
+}
+
+func (s Storage) CreateRollout(tag, updateName, rolloutName string, channel string, rollout Rollout) error {
+	h, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return err
 	}
+	return s.lockRollouts(h, tag, updateName, func() error {
+		return s.createRollout(h, tag, updateName, rolloutName, rollout)
+	})
 }
 
-func (s Storage) CreateRollout(tag, updateName, rolloutName string, isProd bool, rollout Rollout) error {
-	h := s.getRolloutsFsHandle(isProd)
+// createRollout is CreateRollout for callers which already hold the rollouts lock.
+func (s Storage) createRollout(h storage.UpdatesChannelFsHandle, tag, updateName, rolloutName string, rollout Rollout) error {
 	log := fmt.Sprintf("%s|%s|%s\n", tag, updateName, rolloutName)
 	if data, err := json.Marshal(rollout); err != nil {
 		return err
-	} else if err := h.AppendJournal(log); err != nil {
+	} else if err := h.Rollouts.AppendJournal(log); err != nil {
 		return err
 	} else {
-		return h.WriteFile(tag, updateName, rolloutName, string(data))
+		return h.Rollouts.WriteFile(tag, updateName, rolloutName, string(data))
 	}
 }
 
-func (s Storage) CommitRollout(tag, updateName, rolloutName string, isProd bool, rollout Rollout) (err error) {
-	if rollout.Effect, err = s.SetUpdateName(tag, updateName, isProd, rollout.Uuids, rollout.Groups); err != nil {
+// AddRollout creates a new rollout like CreateRollout, failing with ErrRolloutExists if the rollout already exists,
+// and with ErrRolloutsLimit if the update already has max rollouts, unless max is zero.
+// Both checks are made holding the rollouts lock along with the write, so concurrent requests cannot exceed the cap.
+// Rollouts pending approval are only saved, see SaveRollout, so that the rollout daemon does not commit them.
+func (s Storage) AddRollout(tag, updateName, rolloutName string, channel string, rollout Rollout, max int) error {
+	h, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return err
+	}
+	return s.lockRollouts(h, tag, updateName, func() error {
+		if names, err := h.Rollouts.ListFiles(tag, updateName); err != nil {
+			return err
+		} else if slices.Contains(names, rolloutName) {
+			return ErrRolloutExists
+		} else if max > 0 && len(names) >= max {
+			return fmt.Errorf("%w: %d", ErrRolloutsLimit, max)
+		} else if rollout.PendingApproval {
+			return s.saveRollout(tag, updateName, rolloutName, channel, rollout)
+		}
+		return s.createRollout(h, tag, updateName, rolloutName, rollout)
+	})
+}
+
+func (s Storage) CommitRollout(tag, updateName, rolloutName string, channel string, rollout Rollout) (err error) {
+	if rollout.Effect, err = s.SetUpdateName(
+		tag, updateName, channel, rollout.Uuids, rollout.Groups, rollout.FromTarget, rollout.Editor,
+	); err != nil {
 		return err
 	} else {
 		rollout.Commit = true
-		return s.SaveRollout(tag, updateName, rolloutName, isProd, rollout)
+		return s.SaveRollout(tag, updateName, rolloutName, channel, rollout)
+	}
+}
+
+// CommitRolloutChanges commits a rollout like CommitRollout, and returns the devices it moved from another update.
+// Devices which were already assigned to the rollout's update are not returned.
+func (s Storage) CommitRolloutChanges(
+	tag, updateName, rolloutName string, channel string, rollout Rollout,
+) (changes []DeviceUpdateChange, err error) {
+	if rollout.Effect, changes, err = s.setUpdateNameChanges(
+		tag, updateName, channel, rollout.Uuids, rollout.Groups, rollout.FromTarget, rollout.Editor,
+	); err != nil {
+		return nil, err
 	}
+	rollout.Commit = true
+	return changes, s.SaveRollout(tag, updateName, rolloutName, channel, rollout)
 }
 
-func (s Storage) ReadRolloutJournal(isProd bool) iter.Seq2[*[3]string, error] {
-	h := s.getRolloutsFsHandle(isProd)
+func (s Storage) ReadRolloutJournal(channel string) iter.Seq2[*[3]string, error] {
 	return func(yield func(*[3]string, error) bool) {
-		for log, err := range h.ReadJournal() {
+		h, err := s.getUpdatesFsHandle(channel)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		for log, err := range h.Rollouts.ReadJournal() {
 			if err != nil {
 				yield(nil, err)
 				break
@@ -397,35 +1192,153 @@ func (s Storage) ReadRolloutJournal(isProd bool) iter.Seq2[*[3]string, error] {
 	}
 }
 
-func (s Storage) RolloverRolloutJournal(isProd bool) error {
-	return s.getRolloutsFsHandle(isProd).RolloverJournal()
+// RolloverRolloutJournal starts a new rollout journal, once a given number of entries of the current one were processed.
+// Entries appended to the current journal after it was processed are carried over to the new one.
+func (s Storage) RolloverRolloutJournal(channel string, processed int) error {
+	if h, err := s.getUpdatesFsHandle(channel); err != nil {
+		return err
+	} else {
+		return h.Rollouts.RolloverJournal(processed)
+	}
 }
 
 func (s Storage) GetKnownDeviceGroupNames() ([]string, error) {
-	return s.stmtDeviceGetGroups.run()
+	return s.knownNames.get(knownGroupsKey, s.stmtDeviceGetGroups.run)
 }
 
 func (s Storage) GetKnownDeviceLabelNames() ([]string, error) {
-	return s.stmtDeviceGetLabels.run()
+	return s.knownNames.get(knownLabelsKey, s.stmtDeviceGetLabels.run)
 }
 
+// PatchDeviceLabels fails with ErrRequiredLabel if it would delete a required label from any of the devices,
+// see SetRequiredLabels.
 func (s Storage) PatchDeviceLabels(labels map[string]*string, uuids []string) error {
 	// This function applies a merge-patch on top of existing labels:
 	// new labels are added, updated labels are replaced, null labels are removed, missing labels are left intact.
-	return s.stmtDeviceSetLabels.run(labels, uuids)
+	if deletes := storage.RequiredLabelDeletes(s.requiredLabels, labels); len(deletes) > 0 {
+		if count, err := s.stmtDeviceCountLabeled.run(deletes, uuids); err != nil {
+			return err
+		} else if count > 0 {
+			return fmt.Errorf("%w: %s", ErrRequiredLabel, strings.Join(deletes, ", "))
+		}
+	}
+	if err := s.stmtDeviceSetLabels.run(labels, uuids); err != nil {
+		return err
+	}
+	s.knownNames.invalidate()
+	s.publishDeviceChanges(storage.DeviceChangeLabels, uuids...)
+	// The group_name column is generated from the "group" label, so its subscribers are told about it too.
+	if _, ok := labels["group"]; ok {
+		s.publishDeviceChanges(storage.DeviceChangeGroup, uuids...)
+	}
+	return nil
 }
 
-func (s Storage) SetUpdateName(tag, updateName string, isProd bool, uuids, groups []string) (effectiveUuids []string, err error) {
-	err = s.stmtDeviceSetUpdate.run(tag, updateName, isProd, uuids, groups, &effectiveUuids)
-	return
+// SetUpdateName assigns devices of the channel's device type (production or CI) to an update in that channel.
+// Pinned devices are skipped, and so are devices not running fromTarget, unless it is empty, see Rollout.FromTarget.
+// Devices claimed by other users than the editor are skipped too, an empty editor may change all devices.
+func (s Storage) SetUpdateName(
+	tag, updateName string, channel string, uuids, groups []string, fromTarget, editor string,
+) (effectiveUuids []string, err error) {
+	if h, err := s.getUpdatesFsHandle(channel); err != nil {
+		return nil, err
+	} else {
+		if err = s.stmtDeviceSetUpdate.run(
+			nil, tag, updateName, h.Name, h.IsProd, uuids, groups, fromTarget, editor, &effectiveUuids,
+		); err == nil {
+			s.publishDeviceChanges(storage.DeviceChangeUpdate, effectiveUuids...)
+		}
+		return effectiveUuids, err
+	}
 }
 
-func (s Storage) TailRolloutsLog(tag, updateName string, isProd bool, stop storage.DoneChan) iter.Seq2[string, error] {
-	fs := s.fs.Updates.Ci.Logs
-	if isProd {
-		fs = s.fs.Updates.Prod.Logs
+// setUpdateNameChanges is SetUpdateName which also returns the devices moved from another update.
+// SQLite only returns new values of updated rows, so previous updates are looked up before the update is made,
+// in the same transaction.
+func (s Storage) setUpdateNameChanges(
+	tag, updateName string, channel string, uuids, groups []string, fromTarget, editor string,
+) (effectiveUuids []string, changes []DeviceUpdateChange, err error) {
+	h, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return nil, nil, err
 	}
-	return fs.TailFileLines(tag, updateName, storage.LogRolloutsFile, stop)
+	err = s.db.InTx(func(tx *sql.Tx) error {
+		previous, err := s.stmtDeviceUpdateCandidates.run(tx, tag, h.IsProd, uuids, groups, fromTarget, editor)
+		if err != nil || len(previous) == 0 {
+			return err
+		}
+		if err = s.stmtDeviceSetUpdate.run(
+			tx, tag, updateName, h.Name, h.IsProd, uuids, groups, fromTarget, editor, &effectiveUuids,
+		); err != nil {
+			return err
+		}
+		for _, p := range previous {
+			if p.FromUpdate != updateName {
+				changes = append(changes, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	s.publishDeviceChanges(storage.DeviceChangeUpdate, effectiveUuids...)
+	return effectiveUuids, changes, nil
+}
+
+// SubscribeDeviceChanges returns a channel of changes of a device, see storage.DbHandle.SubscribeDeviceChanges.
+func (s Storage) SubscribeDeviceChanges(uuid string, size int) (<-chan DeviceChange, func()) {
+	return s.db.SubscribeDeviceChanges(uuid, size)
+}
+
+func (s Storage) publishDeviceChanges(kind string, uuids ...string) {
+	now := clock.Now().Unix()
+	for _, uuid := range uuids {
+		s.db.PublishDeviceChange(uuid, kind, now)
+	}
+}
+
+// FindInvalidUuids returns those of the given UUIDs which do not exist or belong to a different tag or device type.
+func (s Storage) FindInvalidUuids(tag string, channel string, uuids []string) ([]string, error) {
+	if h, err := s.getUpdatesFsHandle(channel); err != nil {
+		return nil, err
+	} else {
+		return s.stmtDeviceFindInvalid.run(tag, h.IsProd, uuids)
+	}
+}
+
+func (s Storage) TailRolloutsLog(tag, updateName string, channel string, stop storage.DoneChan) iter.Seq2[string, error] {
+	return s.TailRolloutsLogFrom(tag, updateName, channel, 0, stop)
+}
+
+// TailRolloutsLogFrom is TailRolloutsLog which skips a given number of lines first, seeking past them with the log index.
+// Lines are numbered across rotations of the log, lines removed by its retention are not read, see RolloutsLogFirstLine.
+func (s Storage) TailRolloutsLogFrom(tag, updateName, channel string, skip int, stop storage.DoneChan) iter.Seq2[string, error] {
+	h, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return func(yield func(string, error) bool) {
+			yield("", err)
+		}
+	}
+	return h.Logs.TailFileLinesFrom(tag, updateName, storage.LogRolloutsFile, skip, stop)
+}
+
+// RolloutsLogFirstLine returns the number of the first rollouts log line which is still kept, see LogRetention.
+func (s Storage) RolloutsLogFirstLine(tag, updateName, channel string) (int, error) {
+	h, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return 0, err
+	}
+	return h.Logs.FirstFileLine(tag, updateName, storage.LogRolloutsFile)
+}
+
+// RolloutsLogLines returns the number of rollouts log lines, including those removed by its retention.
+func (s Storage) RolloutsLogLines(tag, updateName, channel string) (int, error) {
+	h, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return 0, err
+	}
+	return h.Logs.CountFileLines(tag, updateName, storage.LogRolloutsFile)
 }
 
 func (s Storage) UploadConfigs(payload io.Reader) (err error) {
@@ -435,24 +1348,123 @@ func (s Storage) UploadConfigs(payload io.Reader) (err error) {
 	})
 }
 
-func (s Storage) CreateUpdate(tag, updateName string, isProd bool, payload io.Reader) error {
+// BackupDb makes a consistent snapshot of the database and returns a reader of it.
+// The snapshot is staged in a temporary directory next to the database, which is removed on Close.
+func (s Storage) BackupDb(ctx context.Context) (io.ReadCloser, error) {
+	dir, err := os.MkdirTemp(s.fs.Config.RootDir(), ".db-backup-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create backup directory: %w", err)
+	}
+	cleanup := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Error("Failed to remove database backup directory", "dir", dir, "error", err)
+		}
+	}
+
+	path := filepath.Join(dir, storage.DbFile)
+	if err = s.db.Backup(ctx, path); err != nil {
+		cleanup()
+		return nil, err
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("unable to open database backup: %w", err)
+	}
+	return dbBackupReader{fd, cleanup}, nil
+}
+
+type dbBackupReader struct {
+	*os.File
+	cleanup func()
+}
+
+func (r dbBackupReader) Close() error {
+	err := r.File.Close()
+	r.cleanup()
+	return err
+}
+
+func (s Storage) CreateUpdate(tag, updateName string, channel string, payload io.Reader) error {
+	h, err := s.getUpdatesFsHandle(channel)
+	if err != nil {
+		return err
+	}
 	cleanup := func(cleanupErr error) {
 		// This is not critical - log and let the "real" error/success return below.
 		slog.Error("Failed to clean upload directory", "error", cleanupErr)
 	}
-	if isProd {
-		return s.fs.Updates.Prod.SaveUpload(tag, updateName, payload, cleanup)
-	} else {
-		return s.fs.Updates.Ci.SaveUpload(tag, updateName, payload, cleanup)
+	return h.SaveUpload(tag, updateName, payload, cleanup)
+}
+
+// removeEffectiveUuids drops deleted devices from the effective uuids of the committed rollouts of their updates,
+// which are the rollouts counting them. Only the rollouts of these updates are read, each at most once.
+func (s Storage) removeEffectiveUuids(uuids []string) error {
+	if len(uuids) == 0 {
+		return nil
+	}
+	deleted := make(map[string]bool, len(uuids))
+	for _, uuid := range uuids {
+		deleted[uuid] = true
+	}
+	updates, err := s.stmtDeviceUpdatesList.run(uuids)
+	if err != nil {
+		return err
 	}
+	for _, u := range updates {
+		err := s.pruneRolloutEffects(s.deviceUpdatesFsHandle(u.channel, u.isProd), u.tag, u.updateName, func(uuid string) bool {
+			return deleted[uuid]
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (s Storage) getRolloutsFsHandle(isProd bool) storage.RolloutsFsHandle {
-	if isProd {
-		return s.fs.Updates.Prod.Rollouts
-	} else {
-		return s.fs.Updates.Ci.Rollouts
+// removeUpdateEffectiveUuid drops a device from the effective uuids of all committed rollouts of an update.
+func (s Storage) removeUpdateEffectiveUuid(h storage.UpdatesChannelFsHandle, tag, updateName, uuid string) error {
+	return s.pruneRolloutEffects(h, tag, updateName, func(effect string) bool {
+		return effect == uuid
+	})
+}
+
+// pruneRolloutEffects drops matching devices from the effective uuids of all committed rollouts of an update.
+// Only rollouts which change are rewritten, and they keep their modification time, which orders rollout listings.
+func (s Storage) pruneRolloutEffects(h storage.UpdatesChannelFsHandle, tag, updateName string, match func(string) bool) error {
+	return s.lockRollouts(h, tag, updateName, func() error {
+		infos, err := h.Rollouts.ListFileInfos(tag, updateName)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			name := info.Name()
+			rollout, err := s.GetRollout(tag, updateName, name, h.Name)
+			if err != nil {
+				return err
+			}
+			count := len(rollout.Effect)
+			rollout.Effect = slices.DeleteFunc(rollout.Effect, match)
+			if !rollout.Commit || len(rollout.Effect) == count {
+				continue
+			}
+			if err = s.saveRollout(tag, updateName, name, h.Name, rollout); err != nil {
+				return err
+			}
+			path := h.Rollouts.FilePath(tag, updateName, name)
+			if err = os.Chtimes(path, time.Time{}, info.ModTime()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s Storage) getUpdatesFsHandle(channel string) (storage.UpdatesChannelFsHandle, error) {
+	if h, ok := s.fs.Updates.Channel(channel); ok {
+		return h, nil
 	}
+	return storage.UpdatesChannelFsHandle{}, fmt.Errorf("%w: %s", ErrUnknownUpdateChannel, channel)
 }
 
 type stmtDeviceGet storage.DbStmt
@@ -460,7 +1472,8 @@ type stmtDeviceGet storage.DbStmt
 func (s *stmtDeviceGet) Init(db storage.DbHandle) (err error) {
 	s.Stmt, err = db.Prepare("apiDeviceGet", `
 		SELECT
-			created_at, last_seen, pubkey, update_name, tag, target_name, ostree_hash, apps, json(labels), is_prod
+			created_at, first_seen, last_seen, pubkey, update_name, update_channel, tag, target_name, ostree_hash, apps,
+			json(labels), is_prod, claimed_by, pinned
 		FROM devices
 		WHERE uuid = ? AND deleted=false`,
 	)
@@ -469,29 +1482,54 @@ func (s *stmtDeviceGet) Init(db storage.DbHandle) (err error) {
 
 func (s *stmtDeviceGet) run(
 	uuid string,
-	createdAt, lastSeen *int64,
-	pubkey, updateName, tag, targetName, ostreeHash, apps, labels *string,
-	isProd *bool,
+	createdAt, firstSeen, lastSeen *int64,
+	pubkey, updateName, updateChannel, tag, targetName, ostreeHash, apps, labels *string,
+	isProd *bool, claimedBy *string, pinned *bool,
 ) error {
 	return s.Stmt.QueryRow(uuid).Scan(
-		createdAt, lastSeen, pubkey, updateName, tag, targetName, ostreeHash, apps, labels, isProd)
+		createdAt, firstSeen, lastSeen, pubkey, updateName, updateChannel, tag, targetName, ostreeHash, apps, labels, isProd,
+		claimedBy, pinned)
 }
 
 type stmtDeviceList storage.DbStmt
 
-func (s *stmtDeviceList) Init(db storage.DbHandle, orderBy string) (err error) {
+func (s *stmtDeviceList) Init(db storage.DbHandle, orderBy, filter string) (err error) {
 	s.Stmt, err = db.Prepare("apiDeviceList", fmt.Sprintf(`
 		SELECT
 			uuid, created_at, last_seen, target_name, tag, is_prod, json(labels)
 		FROM devices
-		WHERE deleted=false
-		ORDER BY %s LIMIT ? OFFSET ?`, orderBy),
+		WHERE deleted=false AND %s %s
+		ORDER BY %s LIMIT ?3 OFFSET ?4`, deviceLastSeenSql, filter, orderBy),
 	)
 	return
 }
 
-func (s *stmtDeviceList) run(limit, offset int, dl *[]DeviceListItem) error {
-	if rows, err := s.Stmt.Query(limit, offset); err != nil {
+func (s *stmtDeviceList) run(lastSeenAfter, lastSeenBefore int64, limit, offset int, dl *[]DeviceListItem) error {
+	return scanDeviceList(s.Stmt, dl, lastSeenAfter, lastSeenBefore, limit, offset)
+}
+
+// deviceLastSeenSql selects devices by the LastSeenAfter and LastSeenBefore parameters of DeviceListOpts.
+var deviceLastSeenSql = `(?1 <= 0 OR last_seen >= ?1) AND (?2 <= 0 OR last_seen < ?2)`
+
+type stmtDeviceFindByKey storage.DbStmt
+
+func (s *stmtDeviceFindByKey) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceFindByKey", `
+		SELECT
+			uuid, created_at, last_seen, target_name, tag, is_prod, json(labels)
+		FROM devices
+		WHERE deleted=false AND pubkey_fingerprint=?3 AND (?4=false OR update_name='') AND `+deviceLastSeenSql+`
+		ORDER BY uuid ASC`,
+	)
+	return
+}
+
+func (s *stmtDeviceFindByKey) run(fingerprint string, noUpdate bool, lastSeenAfter, lastSeenBefore int64, dl *[]DeviceListItem) error {
+	return scanDeviceList(s.Stmt, dl, lastSeenAfter, lastSeenBefore, fingerprint, noUpdate)
+}
+
+func scanDeviceList(stmt *sql.Stmt, dl *[]DeviceListItem, args ...any) error {
+	if rows, err := stmt.Query(args...); err != nil {
 		return err
 	} else {
 		defer func() {
@@ -525,13 +1563,132 @@ type stmtDeviceCount storage.DbStmt
 
 func (s *stmtDeviceCount) Init(db storage.DbHandle) (err error) {
 	s.Stmt, err = db.Prepare("apiDeviceCount", `
-		SELECT COUNT(*) FROM devices WHERE deleted=false`,
+		SELECT COUNT(*) FROM devices WHERE deleted=false AND `+deviceLastSeenSql,
+	)
+	return
+}
+
+func (s *stmtDeviceCount) run(lastSeenAfter, lastSeenBefore int64) (count int, err error) {
+	err = s.Stmt.QueryRow(lastSeenAfter, lastSeenBefore).Scan(&count)
+	return
+}
+
+type stmtDeviceCountNoUpd storage.DbStmt
+
+func (s *stmtDeviceCountNoUpd) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceCountNoUpd", `
+		SELECT COUNT(*) FROM devices WHERE deleted=false AND update_name='' AND `+deviceLastSeenSql,
+	)
+	return
+}
+
+func (s *stmtDeviceCountNoUpd) run(lastSeenAfter, lastSeenBefore int64) (count int, err error) {
+	err = s.Stmt.QueryRow(lastSeenAfter, lastSeenBefore).Scan(&count)
+	return
+}
+
+type stmtDeviceCountByTag storage.DbStmt
+
+func (s *stmtDeviceCountByTag) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceCountByTag", `
+		SELECT tag, is_prod, COUNT(*) FROM devices
+		WHERE deleted=false
+		GROUP BY tag, is_prod
+		ORDER BY tag, is_prod`,
+	)
+	return
+}
+
+func (s *stmtDeviceCountByTag) run() ([]TagDevicesCount, error) {
+	rows, err := s.Stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			slog.Error("failed to close rows in device count by tag", "error", err)
+		}
+	}()
+	counts := []TagDevicesCount{}
+	for rows.Next() {
+		var c TagDevicesCount
+		if err = rows.Scan(&c.Tag, &c.IsProd, &c.Devices); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+type stmtDeviceGroupMembers storage.DbStmt
+
+func (s *stmtDeviceGroupMembers) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceGroupMembers", `
+		SELECT group_name, COUNT(*), json_group_array(uuid ORDER BY uuid) FILTER (WHERE NOT ?)
+		FROM devices
+		WHERE deleted=false AND group_name != ""
+		GROUP BY group_name
+		ORDER BY group_name
+		LIMIT ? OFFSET ?`,
+	)
+	return
+}
+
+func (s *stmtDeviceGroupMembers) run(countsOnly bool, limit, offset int) ([]DeviceGroupMembers, error) {
+	rows, err := s.Stmt.Query(countsOnly, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			slog.Error("failed to close rows in device group members", "error", err)
+		}
+	}()
+	groups := []DeviceGroupMembers{}
+	for rows.Next() {
+		var (
+			g     DeviceGroupMembers
+			uuids []byte
+		)
+		if err = rows.Scan(&g.Name, &g.Devices, &uuids); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(uuids, &g.Uuids); err != nil {
+			return nil, fmt.Errorf("failed to parse device group members: %w", err)
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+type stmtDeviceGroupCount storage.DbStmt
+
+func (s *stmtDeviceGroupCount) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceGroupCount", `
+		SELECT COUNT(DISTINCT group_name) FROM devices
+		WHERE deleted=false AND group_name != ""`,
 	)
 	return
 }
 
-func (s *stmtDeviceCount) run() (count int, err error) {
-	err = s.Stmt.QueryRow().Scan(&count)
+func (s *stmtDeviceGroupCount) run() (total int, err error) {
+	err = s.Stmt.QueryRow().Scan(&total)
+	return
+}
+
+type stmtDeviceCertExpiry storage.DbStmt
+
+func (s *stmtDeviceCertExpiry) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceCertExpiry", `
+		SELECT COALESCE(SUM(cert_not_after < ?), 0), COUNT(*)
+		FROM devices
+		WHERE deleted=false AND cert_not_after > 0`,
+	)
+	return
+}
+
+func (s *stmtDeviceCertExpiry) run(before int64) (expiring, total int, err error) {
+	err = s.Stmt.QueryRow(before).Scan(&expiring, &total)
 	return
 }
 
@@ -559,6 +1716,33 @@ func (s *stmtDeviceSetLabels) run(labels map[string]*string, uuids []string) err
 	return err
 }
 
+type stmtDeviceCountLabeled storage.DbStmt
+
+func (s *stmtDeviceCountLabeled) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceCountLabeled", `
+		SELECT COUNT(*) FROM devices
+		WHERE uuid IN (SELECT value FROM json_each(?2)) AND EXISTS (
+			SELECT 1 FROM json_each(?1) AS label
+			WHERE json_extract(devices.labels, '$."' || label.value || '"') IS NOT NULL
+		)`,
+	)
+	return
+}
+
+// run counts the devices which have any of the labels.
+func (s *stmtDeviceCountLabeled) run(labels, uuids []string) (count int, err error) {
+	labelsStr, err := json.Marshal(labels)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected error marshalling labels to JSON: %w", err)
+	}
+	uuidsStr, err := json.Marshal(uuids)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected error marshalling UUIDs to JSON: %w", err)
+	}
+	err = s.Stmt.QueryRow(labelsStr, uuidsStr).Scan(&count)
+	return
+}
+
 type stmtDeviceGetLabels storage.DbStmt
 
 func (s *stmtDeviceGetLabels) Init(db storage.DbHandle) (err error) {
@@ -592,22 +1776,114 @@ func (s *stmtDeviceGetGroups) run() (groups []string, err error) {
 	return
 }
 
+type stmtDeviceFindInvalid storage.DbStmt
+
+func (s *stmtDeviceFindInvalid) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceFindInvalid", `
+		SELECT json_group_array(value) FROM json_each(?)
+		WHERE value NOT IN (
+			SELECT uuid FROM devices WHERE tag=? AND is_prod=? AND deleted=false
+		)`,
+	)
+	return
+}
+
+func (s *stmtDeviceFindInvalid) run(tag string, isProd bool, uuids []string) (invalid []string, err error) {
+	uuidsStr, err := json.Marshal(uuids)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error marshalling UUIDs to JSON: %w", err)
+	}
+	var invalidStr []byte
+	if err = s.Stmt.QueryRow(uuidsStr, tag, isProd).Scan(&invalidStr); err == nil {
+		err = json.Unmarshal(invalidStr, &invalid)
+	}
+	return
+}
+
+type stmtDeviceRolloutCandidates storage.DbStmt
+
+type rolloutCandidate struct {
+	tag        string
+	group      string
+	target     string
+	ostreeHash string
+	isProd     bool
+	deleted    bool
+	pinned     bool
+	claimedBy  string
+}
+
+func (s *stmtDeviceRolloutCandidates) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceRolloutCandidates", `
+		SELECT uuid, tag, group_name, target_name, ostree_hash, is_prod, deleted, pinned, claimed_by FROM devices
+		WHERE uuid IN (SELECT value from json_each(?))
+		OR group_name IN (SELECT value from json_each(?))`,
+	)
+	return
+}
+
+func (s *stmtDeviceRolloutCandidates) run(uuids, groups []string) (map[string]rolloutCandidate, error) {
+	uuidsStr, err := json.Marshal(uuids)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error marshalling UUIDs to JSON: %w", err)
+	}
+	groupsStr, err := json.Marshal(groups)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error marshalling groups to JSON: %w", err)
+	}
+	rows, err := s.Stmt.Query(uuidsStr, groupsStr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			slog.Error("failed to close rows in rollout candidates", "error", err)
+		}
+	}()
+	res := make(map[string]rolloutCandidate)
+	for rows.Next() {
+		var (
+			uuid string
+			c    rolloutCandidate
+		)
+		if err = rows.Scan(&uuid, &c.tag, &c.group, &c.target, &c.ostreeHash, &c.isProd, &c.deleted, &c.pinned, &c.claimedBy); err != nil {
+			return nil, err
+		}
+		res[uuid] = c
+	}
+	return res, rows.Err()
+}
+
 type stmtDeviceSetUpdate storage.DbStmt
 
+// updateCandidatesSql is an SQL condition which matches devices a rollout may assign to an update:
+// devices of a tag and type (production or CI) which are neither deleted nor pinned, selected by UUID or group,
+// running a given target, unless it is empty, and not claimed by others than a given editor, see claimedBySql.
+func updateCandidatesSql(tag, isProd, uuids, groups, fromTarget, editor string) string {
+	return `tag=` + tag + ` AND is_prod=` + isProd + ` AND deleted=false AND pinned=false AND ` + claimedBySql(editor) + ` AND (
+			uuid IN (SELECT value from json_each(` + uuids + `))
+			OR
+			group_name IN (SELECT value from json_each(` + groups + `))
+		) AND (
+			` + fromTarget + ` = "" OR target_name = ` + fromTarget + ` OR ostree_hash = ` + fromTarget + `
+		)`
+}
+
 func (s *stmtDeviceSetUpdate) Init(db storage.DbHandle) (err error) {
 	s.Stmt, err = db.Prepare("apiDeviceSetUpdateName", `
 		UPDATE devices
-		SET update_name=?
-		WHERE tag=? AND is_prod=? AND (
-			uuid IN (SELECT value from json_each(?))
-			OR
-			group_name IN (SELECT value from json_each(?))
-		) RETURNING uuid`,
+		SET update_name=?1, update_channel=?2
+		WHERE `+updateCandidatesSql("?3", "?4", "?5", "?6", "?7", "?8")+`
+		RETURNING uuid`,
 	)
 	return
 }
 
-func (s *stmtDeviceSetUpdate) run(tag, updateName string, isProd bool, uuids, groups []string, effectiveUuids *[]string) error {
+// run may be given a transaction to run in, or nil.
+func (s *stmtDeviceSetUpdate) run(
+	tx *sql.Tx, tag, updateName, channel string, isProd bool, uuids, groups []string, fromTarget, editor string,
+	effectiveUuids *[]string,
+) error {
 	uuidsStr, err := json.Marshal(uuids)
 	if err != nil {
 		return fmt.Errorf("unexpected error marshalling UUIDs to JSON: %w", err)
@@ -616,7 +1892,9 @@ func (s *stmtDeviceSetUpdate) run(tag, updateName string, isProd bool, uuids, gr
 	if err != nil {
 		return fmt.Errorf("unexpected error marshalling groups to JSON: %w", err)
 	}
-	if rows, err := s.Stmt.Query(updateName, tag, isProd, uuidsStr, groupsStr); err != nil {
+	if rows, err := storage.TxStmt(tx, s.Stmt).Query(
+		updateName, channel, tag, isProd, uuidsStr, groupsStr, fromTarget, editor,
+	); err != nil {
 		return err
 	} else {
 		var resUuid string
@@ -633,6 +1911,146 @@ func (s *stmtDeviceSetUpdate) run(tag, updateName string, isProd bool, uuids, gr
 	return nil
 }
 
+type stmtDeviceUpdateCandidates storage.DbStmt
+
+func (s *stmtDeviceUpdateCandidates) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceUpdateCandidates", `
+		SELECT uuid, update_name
+		FROM devices
+		WHERE `+updateCandidatesSql("?1", "?2", "?3", "?4", "?5", "?6"),
+	)
+	return
+}
+
+// run finds the devices which stmtDeviceSetUpdate would update in the same transaction.
+func (s *stmtDeviceUpdateCandidates) run(
+	tx *sql.Tx, tag string, isProd bool, uuids, groups []string, fromTarget, editor string,
+) (res []DeviceUpdateChange, err error) {
+	uuidsStr, err := json.Marshal(uuids)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error marshalling UUIDs to JSON: %w", err)
+	}
+	groupsStr, err := json.Marshal(groups)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error marshalling groups to JSON: %w", err)
+	}
+	rows, err := storage.TxStmt(tx, s.Stmt).Query(tag, isProd, uuidsStr, groupsStr, fromTarget, editor)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			slog.Error("failed to close rows in device update candidates", "error", err)
+		}
+	}()
+	for rows.Next() {
+		var c DeviceUpdateChange
+		if err = rows.Scan(&c.Uuid, &c.FromUpdate); err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	return res, rows.Err()
+}
+
+// deviceUpdate identifies the update a device is assigned to.
+type deviceUpdate struct {
+	channel, tag, updateName string
+	isProd                   bool
+}
+
+type stmtDeviceUpdatesList storage.DbStmt
+
+func (s *stmtDeviceUpdatesList) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceUpdatesList", `
+		SELECT DISTINCT update_channel, is_prod, tag, update_name
+		FROM devices
+		WHERE uuid IN (SELECT value FROM json_each(?)) AND update_name != ''`,
+	)
+	return
+}
+
+// run lists the updates the devices are assigned to, deleted devices included.
+func (s *stmtDeviceUpdatesList) run(uuids []string) (res []deviceUpdate, err error) {
+	uuidsStr, err := json.Marshal(uuids)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error marshalling UUIDs to JSON: %w", err)
+	}
+	rows, err := s.Stmt.Query(uuidsStr)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			slog.Error("failed to close rows in device updates list", "error", err)
+		}
+	}()
+	for rows.Next() {
+		var u deviceUpdate
+		if err = rows.Scan(&u.channel, &u.isProd, &u.tag, &u.updateName); err != nil {
+			return nil, err
+		}
+		res = append(res, u)
+	}
+	return res, rows.Err()
+}
+
+type stmtDeviceCancelUpdate storage.DbStmt
+
+func (s *stmtDeviceCancelUpdate) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceCancelUpdate", `
+		UPDATE devices SET update_name='', update_channel='' WHERE uuid=?`)
+	return
+}
+
+func (s *stmtDeviceCancelUpdate) run(uuid string) error {
+	_, err := s.Stmt.Exec(uuid)
+	return err
+}
+
+type stmtDeviceSetClaimant storage.DbStmt
+
+func (s *stmtDeviceSetClaimant) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceSetClaimant", `
+		UPDATE devices SET claimed_by=?1 WHERE uuid=?2 AND claimed_by IN (?1, ?3)`)
+	return
+}
+
+func (s *stmtDeviceSetClaimant) run(uuid, claimant, previous string) (bool, error) {
+	res, err := s.Stmt.Exec(claimant, uuid, previous)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+type stmtDeviceSetPinned storage.DbStmt
+
+func (s *stmtDeviceSetPinned) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceSetPinned", `
+		UPDATE devices SET pinned=? WHERE uuid=?`)
+	return
+}
+
+func (s *stmtDeviceSetPinned) run(uuid string, pinned bool) error {
+	_, err := s.Stmt.Exec(pinned, uuid)
+	return err
+}
+
+type stmtDeviceResetKey storage.DbStmt
+
+func (s *stmtDeviceResetKey) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceResetKey", `
+		UPDATE devices SET pubkey="", pubkey_fingerprint="" WHERE uuid=?`)
+	return
+}
+
+func (s *stmtDeviceResetKey) run(uuid string) error {
+	_, err := s.Stmt.Exec(uuid)
+	return err
+}
+
 type stmtDeviceDelete storage.DbStmt
 
 func (s *stmtDeviceDelete) Init(db storage.DbHandle) (err error) {
@@ -645,3 +2063,61 @@ func (s *stmtDeviceDelete) run(uuid string) error {
 	_, err := s.Stmt.Exec(uuid)
 	return err
 }
+
+// deviceDeleteFilterSql selects devices by a DeviceDeleteFilter, with its LastSeenBefore and Selector parameters,
+// which are not claimed by others than the editor parameter.
+var deviceDeleteFilterSql = `deleted=false AND (?1 <= 0 OR last_seen < ?1) AND ` + labelSelectorSql("?2") +
+	` AND ` + claimedBySql("?3")
+
+type stmtDeviceDeleteFilterList storage.DbStmt
+
+func (s *stmtDeviceDeleteFilterList) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceDeleteFilterList", `
+		SELECT uuid FROM devices WHERE `+deviceDeleteFilterSql+` ORDER BY uuid`,
+	)
+	return
+}
+
+func (s *stmtDeviceDeleteFilterList) run(filter DeviceDeleteFilter, editor string) ([]string, error) {
+	return queryDeviceDeleteFilter(s.Stmt, filter, editor)
+}
+
+type stmtDeviceDeleteFilter storage.DbStmt
+
+func (s *stmtDeviceDeleteFilter) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceDeleteFilter", `
+		UPDATE devices SET deleted=1 WHERE `+deviceDeleteFilterSql+` RETURNING uuid`,
+	)
+	return
+}
+
+func (s *stmtDeviceDeleteFilter) run(filter DeviceDeleteFilter, editor string) ([]string, error) {
+	uuids, err := queryDeviceDeleteFilter(s.Stmt, filter, editor)
+	// Rows are returned in the order they are updated, sort them like the dry run list.
+	slices.Sort(uuids)
+	return uuids, err
+}
+
+func queryDeviceDeleteFilter(stmt *sql.Stmt, filter DeviceDeleteFilter, editor string) (uuids []string, err error) {
+	selectorStr, err := json.Marshal(filter.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error marshalling label selector to JSON: %w", err)
+	}
+	rows, err := stmt.Query(filter.LastSeenBefore, selectorStr, editor)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			slog.Error("failed to close rows in device delete by filter", "error", err)
+		}
+	}()
+	var uuid string
+	for rows.Next() {
+		if err = rows.Scan(&uuid); err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, uuid)
+	}
+	return uuids, rows.Err()
+}
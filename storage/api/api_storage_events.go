@@ -0,0 +1,126 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"time"
+
+	"github.com/foundriesio/dg-satellite/storage"
+)
+
+// maxEventLine is the longest line of an events file which AllEvents reads, longer lines are malformed events.
+const maxEventLine = 1024 * 1024
+
+// AllEvents iterates over the events of all updates of the device, in chronological order of their device times.
+// Events files are read line by line side by side, so that none of them is loaded into memory as a whole.
+// Events with an unparsable device time keep their place among the events of their update.
+func (d Device) AllEvents() iter.Seq2[DeviceUpdateEvent, error] {
+	return func(yield func(DeviceUpdateEvent, error) bool) {
+		// Oldest files first, so that events with equal times are ordered by the update they belong to.
+		names, err := d.storage.fs.Devices.ListFiles(d.Uuid, storage.EventsPrefix, true)
+		if err != nil {
+			yield(DeviceUpdateEvent{}, err)
+			return
+		}
+		readers := make([]*eventsReader, 0, len(names))
+		defer func() {
+			for _, r := range readers {
+				r.close()
+			}
+		}()
+		for _, name := range names {
+			r, err := d.openEvents(name)
+			if err != nil {
+				yield(DeviceUpdateEvent{}, err)
+				return
+			}
+			readers = append(readers, r)
+		}
+
+		for {
+			var next *eventsReader
+			for _, r := range readers {
+				if err := r.peek(); err != nil {
+					yield(DeviceUpdateEvent{}, err)
+					return
+				} else if r.ok && (next == nil || r.time.Before(next.time)) {
+					next = r
+				}
+			}
+			if next == nil {
+				return
+			}
+			next.ok = false
+			if !yield(next.evt, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (d Device) openEvents(name string) (*eventsReader, error) {
+	file, err := d.storage.fs.Devices.ReadFileStream(d.Uuid, name)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected error reading file %s for device %s: %w", name, d.Uuid, err)
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxEventLine)
+	return &eventsReader{device: d, name: name, file: file, scanner: scanner}, nil
+}
+
+// eventsReader reads events of a device update file one at a time, see Device.AllEvents.
+type eventsReader struct {
+	device  Device
+	name    string
+	file    io.Closer
+	scanner *bufio.Scanner
+	done    bool
+
+	// ok tells that evt was read, but not yet consumed.
+	ok   bool
+	evt  DeviceUpdateEvent
+	time time.Time
+}
+
+// peek reads the next event of the file unless the last read one was not consumed yet.
+func (r *eventsReader) peek() error {
+	for !r.ok && !r.done {
+		if !r.scanner.Scan() {
+			r.done = true
+			if err := r.scanner.Err(); err != nil {
+				return fmt.Errorf("unexpected error reading file %s for device %s: %w", r.name, r.device.Uuid, err)
+			}
+			break
+		}
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var evt DeviceUpdateEvent
+		if err := json.Unmarshal(line, &evt); err != nil {
+			if r.device.storage.strictEvents {
+				return fmt.Errorf("unexpected error unmarshalling event json: %w", err)
+			}
+			slog.Warn("Skipping malformed device update event", "device", r.device.Uuid, "file", r.name, "error", err)
+			continue
+		}
+		r.evt, r.ok = evt, true
+		if t, err := time.Parse(time.RFC3339, evt.DeviceTime); err == nil {
+			r.time = t
+		}
+	}
+	return nil
+}
+
+func (r *eventsReader) close() {
+	if err := r.file.Close(); err != nil {
+		slog.Error("Failed to close device events file", "device", r.device.Uuid, "file", r.name, "error", err)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/foundriesio/dg-satellite/storage"
+)
+
+// LabelSelector matches devices which have all of the given labels set to the given values.
+type LabelSelector map[string]string
+
+// ParseLabelSelector parses a selector expression of comma separated label=value pairs, e.g. "env=prod,region=eu".
+// Label names and values are not validated, see storage.ValidateLabels.
+func ParseLabelSelector(expr string) (LabelSelector, error) {
+	selector := LabelSelector{}
+	for _, term := range strings.Split(expr, ",") {
+		term = strings.TrimSpace(term)
+		if len(term) == 0 {
+			continue
+		}
+		name, value, ok := strings.Cut(term, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		switch {
+		case strings.HasSuffix(name, "!"):
+			return nil, fmt.Errorf("negated selector term %q is not supported, all labels must match", term)
+		case !ok || len(name) == 0:
+			return nil, fmt.Errorf("selector term %q must be a label=value pair", term)
+		}
+		if _, ok = selector[name]; ok {
+			return nil, fmt.Errorf("label %s is selected more than once", name)
+		}
+		selector[name] = value
+	}
+	if len(selector) == 0 {
+		return nil, errors.New("a label selector must be set")
+	}
+	return selector, nil
+}
+
+// labelSelectorSql is an SQL condition which evaluates a LabelSelector against devices.
+// The selector is an SQL expression of its JSON, e.g. a "?" parameter or a column.
+func labelSelectorSql(selector string) string {
+	return `NOT EXISTS (
+	SELECT 1 FROM json_each(` + selector + `) AS sel
+	WHERE json_extract(devices.labels, '$."' || sel.key || '"') IS NOT sel.value
+)`
+}
+
+// claimedBySql is an SQL condition which skips devices claimed by others than the user of a given parameter,
+// unless the parameter is empty, e.g. for admins.
+func claimedBySql(user string) string {
+	return `(` + user + ` = '' OR claimed_by IN ('', ` + user + `))`
+}
+
+// AssignDeviceGroup sets the "group" label for all devices matching the selector.
+// Devices claimed by other users than the editor are skipped, an empty editor may change all devices.
+// It returns the UUIDs of devices that were assigned to the group.
+func (s Storage) AssignDeviceGroup(group string, selector LabelSelector, editor string) (uuids []string, err error) {
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("label selector must not be empty")
+	}
+	if err = s.stmtDeviceAssignGroup.run(group, selector, editor, &uuids); err == nil {
+		s.knownNames.invalidate()
+		s.publishDeviceChanges(storage.DeviceChangeGroup, uuids...)
+	}
+	return
+}
+
+// DevicesBySelector lists devices whose labels match the selector ordered by UUID, and how many devices match in total.
+func (s Storage) DevicesBySelector(selector LabelSelector, limit, offset int) ([]DeviceListItem, int, error) {
+	selectorStr, err := json.Marshal(selector)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unexpected error marshalling label selector to JSON: %w", err)
+	}
+	total, err := s.stmtDeviceSelectorCount.run(selectorStr)
+	if err != nil {
+		return nil, 0, err
+	}
+	devices := make([]DeviceListItem, 0, min(limit, total))
+	if err = s.stmtDeviceSelectorList.run(selectorStr, limit, offset, &devices); err != nil {
+		return nil, 0, err
+	}
+	return devices, total, nil
+}
+
+// SaveSelectorGroup creates or replaces a selector group.
+// Unlike groups assigned by the "group" label, devices belong to a selector group while their labels match its selector.
+func (s Storage) SaveSelectorGroup(name string, selector LabelSelector) error {
+	if len(selector) == 0 {
+		return fmt.Errorf("label selector must not be empty")
+	}
+	return s.stmtSelectorGroupSave.run(name, selector)
+}
+
+// DeleteDeviceGroup removes a selector group, and unassigns devices from a group assigned by the "group" label.
+// Devices claimed by other users than the editor stay in the group, an empty editor may change all devices.
+// It returns false when there was neither a selector group nor a device assigned to the group.
+// It fails with ErrRequiredLabel, without changing anything, if the "group" label is required and would be deleted.
+func (s Storage) DeleteDeviceGroup(name, editor string) (found bool, err error) {
+	if slices.Contains(s.requiredLabels, "group") {
+		if count, err := s.stmtDeviceCountGroup.run(name, editor); err != nil {
+			return false, err
+		} else if count > 0 {
+			return false, fmt.Errorf("%w: group", ErrRequiredLabel)
+		}
+	}
+	if found, err = s.stmtSelectorGroupDelete.run(name); err != nil {
+		return
+	}
+	var (
+		uuids   []string
+		cleared int
+	)
+	if cleared, err = s.stmtDeviceClearGroup.run(name, editor, &uuids); err != nil {
+		return
+	}
+	s.knownNames.invalidate()
+	s.publishDeviceChanges(storage.DeviceChangeGroup, uuids...)
+	return found || cleared > 0, nil
+}
+
+type stmtDeviceAssignGroup storage.DbStmt
+
+func (s *stmtDeviceAssignGroup) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceAssignGroup", `
+		UPDATE devices
+		SET labels=jsonb_set(labels, '$.group', ?1)
+		WHERE deleted=false AND `+labelSelectorSql("?2")+` AND `+claimedBySql("?3")+`
+		RETURNING uuid`,
+	)
+	return
+}
+
+func (s *stmtDeviceAssignGroup) run(group string, selector LabelSelector, editor string, uuids *[]string) error {
+	selectorStr, err := json.Marshal(selector)
+	if err != nil {
+		return fmt.Errorf("unexpected error marshalling label selector to JSON: %w", err)
+	}
+	rows, err := s.Stmt.Query(group, selectorStr, editor)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			slog.Error("failed to close rows in device group assign", "error", err)
+		}
+	}()
+	var uuid string
+	for rows.Next() {
+		if err = rows.Scan(&uuid); err != nil {
+			return err
+		}
+		*uuids = append(*uuids, uuid)
+	}
+	return rows.Err()
+}
+
+type stmtDeviceSelectorList storage.DbStmt
+
+func (s *stmtDeviceSelectorList) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceSelectorList", `
+		SELECT
+			uuid, created_at, last_seen, target_name, tag, is_prod, json(labels)
+		FROM devices
+		WHERE deleted=false AND `+labelSelectorSql("?")+`
+		ORDER BY uuid ASC LIMIT ? OFFSET ?`,
+	)
+	return
+}
+
+func (s *stmtDeviceSelectorList) run(selector []byte, limit, offset int, dl *[]DeviceListItem) error {
+	return scanDeviceList(s.Stmt, dl, selector, limit, offset)
+}
+
+type stmtDeviceSelectorCount storage.DbStmt
+
+func (s *stmtDeviceSelectorCount) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceSelectorCount", `
+		SELECT COUNT(*) FROM devices
+		WHERE deleted=false AND `+labelSelectorSql("?"),
+	)
+	return
+}
+
+func (s *stmtDeviceSelectorCount) run(selector []byte) (count int, err error) {
+	err = s.Stmt.QueryRow(selector).Scan(&count)
+	return
+}
+
+type stmtSelectorGroupSave storage.DbStmt
+
+func (s *stmtSelectorGroupSave) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiSelectorGroupSave", `
+		INSERT INTO device_selector_groups (name, selector) VALUES (?, ?)
+		ON CONFLICT(name) DO UPDATE SET selector=excluded.selector`,
+	)
+	return
+}
+
+func (s *stmtSelectorGroupSave) run(name string, selector LabelSelector) error {
+	selectorStr, err := json.Marshal(selector)
+	if err != nil {
+		return fmt.Errorf("unexpected error marshalling label selector to JSON: %w", err)
+	}
+	_, err = s.Stmt.Exec(name, string(selectorStr))
+	return err
+}
+
+type stmtSelectorGroupDelete storage.DbStmt
+
+func (s *stmtSelectorGroupDelete) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiSelectorGroupDelete", `
+		DELETE FROM device_selector_groups WHERE name=?`,
+	)
+	return
+}
+
+func (s *stmtSelectorGroupDelete) run(name string) (bool, error) {
+	res, err := s.Stmt.Exec(name)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+type stmtDeviceCountGroup storage.DbStmt
+
+func (s *stmtDeviceCountGroup) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceCountGroup", `
+		SELECT COUNT(*) FROM devices
+		WHERE deleted=false AND group_name=?1 AND `+claimedBySql("?2"),
+	)
+	return
+}
+
+// run counts the devices assigned to a group which the editor may change.
+func (s *stmtDeviceCountGroup) run(group, editor string) (count int, err error) {
+	err = s.Stmt.QueryRow(group, editor).Scan(&count)
+	return
+}
+
+type stmtDeviceClearGroup storage.DbStmt
+
+func (s *stmtDeviceClearGroup) Init(db storage.DbHandle) (err error) {
+	// Deleted devices are unassigned too, so that the group is no longer listed among known groups.
+	s.Stmt, err = db.Prepare("apiDeviceClearGroup", `
+		UPDATE devices
+		SET labels=jsonb_remove(labels, '$.group')
+		WHERE group_name=?1 AND `+claimedBySql("?2")+`
+		RETURNING uuid, deleted`,
+	)
+	return
+}
+
+// run appends the UUIDs of unassigned devices which are not deleted, and returns how many devices were unassigned.
+func (s *stmtDeviceClearGroup) run(group, editor string, uuids *[]string) (int, error) {
+	rows, err := s.Stmt.Query(group, editor)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			slog.Error("failed to close rows in device group clear", "error", err)
+		}
+	}()
+	var (
+		uuid    string
+		deleted bool
+		count   int
+	)
+	for rows.Next() {
+		if err = rows.Scan(&uuid, &deleted); err != nil {
+			return 0, err
+		}
+		count++
+		if !deleted {
+			*uuids = append(*uuids, uuid)
+		}
+	}
+	return count, rows.Err()
+}
+
+type stmtDeviceSelectorGroups storage.DbStmt
+
+func (s *stmtDeviceSelectorGroups) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("apiDeviceSelectorGroups", `
+		SELECT json_group_array(name) FROM (
+			SELECT g.name FROM device_selector_groups AS g, devices
+			WHERE devices.uuid=? AND `+labelSelectorSql("g.selector")+`
+			ORDER BY g.name
+		)`,
+	)
+	return
+}
+
+func (s *stmtDeviceSelectorGroups) run(uuid string) (groups []string, err error) {
+	var groupsStr []byte
+	if err = s.Stmt.QueryRow(uuid).Scan(&groupsStr); err == nil {
+		err = json.Unmarshal(groupsStr, &groups)
+	}
+	return
+}
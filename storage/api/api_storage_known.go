@@ -0,0 +1,59 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package api
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	cache "github.com/go-pkgz/expirable-cache/v3"
+)
+
+// Known label and group names are fetched by UIs often, but rarely change.
+// Devices labelling themselves via the gateway do not invalidate the cache, so their labels show up within the TTL.
+const knownNamesTtl = 10 * time.Second
+
+const (
+	knownLabelsKey = "labels"
+	knownGroupsKey = "groups"
+)
+
+// knownNamesCache is a read-through cache of known names, invalidated by label writes of this storage.
+type knownNamesCache struct {
+	lock  sync.Mutex
+	gen   uint64
+	names cache.Cache[string, []string]
+}
+
+func newKnownNamesCache() *knownNamesCache {
+	return &knownNamesCache{names: cache.NewCache[string, []string]().WithTTL(knownNamesTtl)}
+}
+
+func (c *knownNamesCache) get(key string, load func() ([]string, error)) ([]string, error) {
+	if names, ok := c.names.Get(key); ok {
+		return slices.Clone(names), nil
+	}
+	c.lock.Lock()
+	gen := c.gen
+	c.lock.Unlock()
+
+	names, err := load()
+	if err == nil {
+		c.lock.Lock()
+		// Names loaded while labels were changed may be stale already.
+		if gen == c.gen {
+			c.names.Add(key, slices.Clone(names))
+		}
+		c.lock.Unlock()
+	}
+	return names, err
+}
+
+func (c *knownNamesCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gen++
+	c.names.Purge()
+}
@@ -54,7 +54,7 @@ func TestStorage(t *testing.T) {
 	_, err = dg.DeviceCreate("uuid-2", "pubkey-value-2", false)
 	require.Nil(t, err)
 
-	uuids, err := s.SetUpdateName("tag", "update42", false, []string{"uuid-1", "uuid-2"}, nil)
+	uuids, err := s.SetUpdateName("tag", "update42", "ci", []string{"uuid-1", "uuid-2"}, nil, "", "")
 	require.Nil(t, err)
 	require.Equal(t, 1, len(uuids))
 	assert.Equal(t, "uuid-1", uuids[0])
@@ -85,6 +85,41 @@ func TestStorage(t *testing.T) {
 	assert.Equal(t, "aktoml content", d.Aktoml)
 }
 
+func TestDevicesListByName(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	s, err := NewStorage(db, fs)
+	require.Nil(t, err)
+	dg, err := gateway.NewStorage(db, fs)
+	require.Nil(t, err)
+
+	for _, uuid := range []string{"uuid-1", "uuid-2", "uuid-3", "uuid-4"} {
+		_, err = dg.DeviceCreate(uuid, "pubkey-"+uuid, false)
+		require.Nil(t, err)
+	}
+	names := map[string]string{"uuid-1": "zebra", "uuid-2": "alpha", "uuid-4": "mike"}
+	for uuid, name := range names {
+		require.Nil(t, s.PatchDeviceLabels(map[string]*string{"name": &name}, []string{uuid}))
+	}
+
+	list := func(orderBy OrderBy) []string {
+		devices, _, err := s.DevicesList(DeviceListOpts{OrderBy: orderBy, Limit: 10})
+		require.Nil(t, err)
+		uuids := make([]string, 0, len(devices))
+		for _, d := range devices {
+			uuids = append(uuids, d.Uuid)
+		}
+		return uuids
+	}
+	// Unnamed devices always come last.
+	assert.Equal(t, []string{"uuid-2", "uuid-4", "uuid-1", "uuid-3"}, list(OrderByDeviceNameAsc))
+	assert.Equal(t, []string{"uuid-1", "uuid-4", "uuid-2", "uuid-3"}, list(OrderByDeviceNameDesc))
+	assert.Equal(t, list(OrderByDeviceNameAsc), list(""))
+}
+
 func TestDeviceDelete(t *testing.T) {
 	tmpdir := t.TempDir()
 	dbFile := filepath.Join(tmpdir, "sql.db")
@@ -0,0 +1,145 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package api
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+type tufKey struct {
+	KeyType string `json:"keytype"`
+	KeyVal  struct {
+		Public string `json:"public"`
+	} `json:"keyval"`
+}
+
+type tufRole struct {
+	KeyIds    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+type tufSignature struct {
+	KeyId string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+type tufRoot struct {
+	Signatures []tufSignature `json:"signatures"`
+	Signed     struct {
+		Type    string             `json:"_type"`
+		Version int                `json:"version"`
+		Expires string             `json:"expires"`
+		Keys    map[string]tufKey  `json:"keys"`
+		Roles   map[string]tufRole `json:"roles"`
+	} `json:"signed"`
+
+	// canonical is the canonical JSON form of the signed part, which signatures are made over.
+	canonical []byte
+}
+
+func parseTufRoot(content []byte) (*tufRoot, error) {
+	var root tufRoot
+	var raw struct {
+		Signed json.RawMessage `json:"signed"`
+	}
+	if err := json.Unmarshal(content, &root); err != nil {
+		return nil, err
+	} else if err = json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	} else if len(raw.Signed) == 0 {
+		return nil, errors.New("missing signed")
+	} else if root.canonical, err = canonicalJson(raw.Signed); err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
+// verifiedBy checks that the root is signed by the threshold of root role keys of the signer root.
+func (r tufRoot) verifiedBy(signer *tufRoot) error {
+	role, ok := signer.Signed.Roles["root"]
+	if !ok || role.Threshold < 1 {
+		return errors.New("missing root role")
+	}
+
+	valid := make(map[string]bool, len(role.KeyIds))
+	for _, sig := range r.Signatures {
+		if valid[sig.KeyId] || !slices.Contains(role.KeyIds, sig.KeyId) {
+			continue
+		}
+		if key, ok := signer.Signed.Keys[sig.KeyId]; ok && key.verify(r.canonical, sig.Sig) {
+			valid[sig.KeyId] = true
+		}
+	}
+	if len(valid) < role.Threshold {
+		return fmt.Errorf("%d of %d required signatures of root version %d", len(valid), role.Threshold, signer.Signed.Version)
+	}
+	return nil
+}
+
+// verify checks an Ed25519, RSASSA-PSS, or ECDSA signature of a message.
+func (k tufKey) verify(msg []byte, sig string) bool {
+	sigBytes, err := decodeHexOrBase64(sig)
+	if err != nil {
+		return false
+	}
+
+	var pub crypto.PublicKey
+	if block, _ := pem.Decode([]byte(k.KeyVal.Public)); block != nil {
+		if pub, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return false
+		}
+	} else if raw, err := decodeHexOrBase64(k.KeyVal.Public); err != nil || len(raw) != ed25519.PublicKeySize {
+		return false
+	} else {
+		pub = ed25519.PublicKey(raw)
+	}
+
+	digest := sha256.Sum256(msg)
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, msg, sigBytes)
+	case *rsa.PublicKey:
+		return rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sigBytes, nil) == nil
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(pub, digest[:], sigBytes)
+	}
+	return false
+}
+
+func decodeHexOrBase64(value string) ([]byte, error) {
+	if decoded, err := hex.DecodeString(value); err == nil {
+		return decoded, nil
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// canonicalJson re-encodes JSON with sorted object keys, no insignificant whitespace, and verbatim numbers.
+func canonicalJson(raw json.RawMessage) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -9,13 +9,18 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 
 	sqllite "github.com/mattn/go-sqlite3"
+
+	"github.com/foundriesio/dg-satellite/context"
 )
 
 type DbHandle struct {
 	db *sql.DB
+
+	deviceChanges *EventBus[DeviceChange]
 }
 
 var (
@@ -45,13 +50,49 @@ func NewDb(dbfile string) (*DbHandle, error) {
 			return nil, err
 		}
 	}
-	return &DbHandle{db: db}, nil
+	return &DbHandle{db: db, deviceChanges: newDeviceChanges()}, nil
 }
 
 func (d DbHandle) Close() error {
 	return d.db.Close()
 }
 
+// Backup writes a consistent copy of the database into a new file using the SQLite online backup API.
+// The database stays available for reads and writes while the backup is made.
+func (d DbHandle) Backup(ctx context.Context, destFile string) error {
+	dest, err := sql.Open("sqlite3", destFile)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dest.Close() }()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to open backup database: %w", err)
+	}
+	defer func() { _ = destConn.Close() }()
+	srcConn, err := d.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to open database: %w", err)
+	}
+	defer func() { _ = srcConn.Close() }()
+
+	return destConn.Raw(func(destRaw any) error {
+		return srcConn.Raw(func(srcRaw any) error {
+			backup, err := destRaw.(*sqllite.SQLiteConn).Backup("main", srcRaw.(*sqllite.SQLiteConn), "main")
+			if err != nil {
+				return fmt.Errorf("unable to start database backup: %w", err)
+			}
+			// Copying all pages in one step holds a read lock for a short time, which is fine for our database sizes.
+			if _, err = backup.Step(-1); err != nil {
+				_ = backup.Finish()
+				return fmt.Errorf("unable to copy database: %w", err)
+			}
+			return backup.Finish()
+		})
+	})
+}
+
 func (d DbHandle) Prepare(name, query string) (stmt *sql.Stmt, err error) {
 	if stmt, err = d.db.Prepare(query); err != nil {
 		err = fmt.Errorf("unable to prepare '%s' statement: %w", name, err)
@@ -59,6 +100,29 @@ func (d DbHandle) Prepare(name, query string) (stmt *sql.Stmt, err error) {
 	return
 }
 
+// InTx runs fn in a transaction, which is committed unless fn fails, see TxStmt.
+func (d DbHandle) InTx(fn func(tx *sql.Tx) error) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to begin transaction: %w", err)
+	}
+	if err = fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			slog.Error("Failed to roll back transaction", "error", rbErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// TxStmt returns a prepared statement which runs in a transaction, or the statement itself when tx is nil.
+func TxStmt(tx *sql.Tx, stmt *sql.Stmt) *sql.Stmt {
+	if tx == nil {
+		return stmt
+	}
+	return tx.Stmt(stmt)
+}
+
 func (d DbHandle) InitStmt(stmt ...DbStmtInit) (err error) {
 	for _, s := range stmt {
 		if err = s.Init(d); err != nil {
@@ -73,16 +137,22 @@ func createTables(db *sql.DB) error {
 		CREATE TABLE devices (
 			uuid VARCHAR(48) NOT NULL PRIMARY KEY,
 			pubkey TEXT,
+			pubkey_fingerprint VARCHAR(64) DEFAULT "",
 			deleted BOOL,
 			is_prod BOOL,
 			created_at INT DEFAULT 0,
+			first_seen INT DEFAULT 0,
 			last_seen INT DEFAULT 0,
 			tag VARCHAR(80) DEFAULT "",
 			labels JSONB(2048) DEFAULT "{}",
 			update_name VARCHAR(80) DEFAULT "",
+			update_channel VARCHAR(20) DEFAULT "",
 			target_name VARCHAR(80) DEFAULT "",
 			ostree_hash VARCHAR(80) DEFAULT "",
 			apps VARCHAR(2048) DEFAULT "",
+			cert_not_after INT DEFAULT 0,
+			claimed_by VARCHAR(80) DEFAULT "",
+			pinned BOOL DEFAULT 0,
 
 			group_name_modified_at INT DEFAULT 0,
 
@@ -97,6 +167,12 @@ func createTables(db *sql.DB) error {
 		CREATE UNIQUE INDEX idx_device_name_unique ON devices(name) WHERE name != "";
 		CREATE INDEX idx_device_name ON devices(name);
 		CREATE INDEX idx_device_group ON devices(group_name);
+		CREATE INDEX idx_device_pubkey_fingerprint ON devices(pubkey_fingerprint);
+
+		CREATE TABLE device_selector_groups (
+			name VARCHAR(80) NOT NULL PRIMARY KEY,
+			selector TEXT NOT NULL DEFAULT "{}"
+		) WITHOUT ROWID;
 
 		CREATE TABLE device_labels (
 			label VARCHAR(20) NOT NULL PRIMARY KEY
@@ -8,6 +8,8 @@ package storage
 import (
 	"database/sql"
 	"errors"
+
+	"github.com/foundriesio/dg-satellite/context"
 )
 
 var ErrDbConstraintUnique = errors.New("sqllite.ErrConstraintUnique")
@@ -17,6 +19,7 @@ func IsDbError(err error, code any) bool {
 }
 
 type DbHandle struct {
+	deviceChanges *EventBus[DeviceChange]
 }
 
 func NewDb(dbfile string) (*DbHandle, error) {
@@ -27,10 +30,22 @@ func (d DbHandle) Close() error {
 	return nil
 }
 
+func (d DbHandle) Backup(ctx context.Context, destFile string) error {
+	return nil
+}
+
 func (d DbHandle) Prepare(name, query string) (stmt *sql.Stmt, err error) {
 	return nil, nil
 }
 
+func (d DbHandle) InTx(fn func(tx *sql.Tx) error) error {
+	return fn(nil)
+}
+
+func TxStmt(tx *sql.Tx, stmt *sql.Stmt) *sql.Stmt {
+	return stmt
+}
+
 func (d DbHandle) InitStmt(stmt ...DbStmtInit) error {
 	return nil
 }
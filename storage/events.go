@@ -0,0 +1,101 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package storage
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// EventBus fans out events to subscribers without ever blocking a publisher.
+// A subscriber which does not keep up with events loses them.
+// Lost events are logged once per overflow of a subscriber, together with their count once it catches up.
+type EventBus[T any] struct {
+	Name string
+
+	lock sync.RWMutex
+	subs map[chan T]*subscriber[T]
+}
+
+type subscriber[T any] struct {
+	accept  func(T) bool
+	dropped atomic.Int64
+}
+
+// Subscribe returns a channel of events, buffered to a given size, and a function to cancel the subscription.
+// Only events passing the accept function are sent to the channel, all events if it is nil.
+func (b *EventBus[T]) Subscribe(size int, accept func(T) bool) (<-chan T, func()) {
+	ch := make(chan T, size)
+	b.lock.Lock()
+	if b.subs == nil {
+		b.subs = make(map[chan T]*subscriber[T])
+	}
+	b.subs[ch] = &subscriber[T]{accept: accept}
+	b.lock.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.lock.Lock()
+			delete(b.subs, ch)
+			b.lock.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends an event to all subscribers accepting it.
+func (b *EventBus[T]) Publish(evt T) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for ch, sub := range b.subs {
+		if sub.accept != nil && !sub.accept(evt) {
+			continue
+		}
+		select {
+		case ch <- evt:
+			if count := sub.dropped.Swap(0); count > 0 {
+				slog.Info("Slow subscriber caught up with events", "events", b.Name, "dropped", count)
+			}
+		default:
+			if sub.dropped.Add(1) == 1 {
+				slog.Warn("Dropping events for a slow subscriber", "events", b.Name)
+			}
+		}
+	}
+}
+
+const (
+	DeviceChangeCheckIn = "check-in"
+	DeviceChangeLabels  = "labels"
+	DeviceChangeGroup   = "group"
+	DeviceChangeUpdate  = "update"
+	DeviceChangeClaim   = "claim"
+	DeviceChangePin     = "pin"
+	DeviceChangeDeleted = "deleted"
+)
+
+// DeviceChange tells that a device database record has changed, e.g. its labels or its assigned update.
+type DeviceChange struct {
+	Uuid string `json:"uuid"`
+	Kind string `json:"kind"`
+	Time int64  `json:"time"`
+}
+
+func newDeviceChanges() *EventBus[DeviceChange] {
+	return &EventBus[DeviceChange]{Name: "device changes"}
+}
+
+// PublishDeviceChange notifies subscribers about a change of a device record.
+// Device records are changed by both the device gateway and the API storages, which share the database handle.
+func (d DbHandle) PublishDeviceChange(uuid, kind string, time int64) {
+	d.deviceChanges.Publish(DeviceChange{Uuid: uuid, Kind: kind, Time: time})
+}
+
+// SubscribeDeviceChanges returns a channel of changes of a given device, buffered to a given size,
+// and a function to cancel the subscription. Changes are dropped when the channel is full.
+func (d DbHandle) SubscribeDeviceChanges(uuid string, size int) (<-chan DeviceChange, func()) {
+	return d.deviceChanges.Subscribe(size, func(change DeviceChange) bool { return change.Uuid == uuid })
+}
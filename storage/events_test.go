@@ -0,0 +1,60 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package storage
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	var buf bytes.Buffer
+	defaultLog := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLog) })
+
+	bus := EventBus[int]{Name: "numbers"}
+	events, cancel := bus.Subscribe(1, nil)
+	defer cancel()
+
+	// Only the first lost event of an overflow is logged.
+	for i := range 5 {
+		bus.Publish(i)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], `msg="Dropping events for a slow subscriber" events=numbers`)
+	buf.Reset()
+
+	// The count of lost events is logged once the subscriber catches up.
+	require.Equal(t, 0, <-events)
+	bus.Publish(5)
+	require.Equal(t, 5, <-events)
+	bus.Publish(6)
+	require.Equal(t, 6, <-events)
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], `msg="Slow subscriber caught up with events" events=numbers dropped=4`)
+}
+
+func TestEventBusAccept(t *testing.T) {
+	bus := EventBus[int]{Name: "numbers"}
+	odd, cancelOdd := bus.Subscribe(1, func(i int) bool { return i%2 == 1 })
+	defer cancelOdd()
+	all, cancelAll := bus.Subscribe(10, nil)
+	defer cancelAll()
+
+	// Events which are not accepted do not take space in the buffer of a subscriber.
+	for i := range 4 {
+		bus.Publish(2 * i)
+	}
+	bus.Publish(7)
+	require.Equal(t, 7, <-odd)
+	assert.Len(t, all, 5)
+}
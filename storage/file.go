@@ -5,16 +5,24 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
 	"errors"
 	"fmt"
 	"io"
 	"iter"
+	"maps"
 	"os"
 	"path/filepath"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/foundriesio/dg-satellite/clock"
 )
 
 const (
@@ -46,12 +54,15 @@ const (
 
 	// Per device files/dirs
 	AktomlFile          = "aktoml"
+	CertFile            = "client.pem"
 	HwInfoFile          = "hardware-info"
 	NetInfoFile         = "network-info"
 	EventsPrefix        = "events"
+	InstallResultPrefix = "install-result"
 	StatesPrefix        = "apps-states"
 	TestsPrefix         = "tests"
 	TestArtifactsPrefix = "test-artifacts"
+	ActivityPrefix      = "activity"
 
 	// Per update files/dirs
 	// Update roots
@@ -63,6 +74,7 @@ const (
 	UpdatesAppsDir     = "apps"
 	UpdatesRolloutsDir = "rollouts"
 	UpdatesLogsDir     = "logs"
+	UpdatesSettingsDir = "settings"
 	// TUF category files
 	TufRootFile      = "root.json"
 	TufTimestampFile = "timestamp.json"
@@ -70,8 +82,19 @@ const (
 	TufTargetsFile   = "targets.json"
 	// Logs category files
 	LogRolloutsFile = "rollouts.log"
+	// Settings category files
+	SettingsMaxInstallsFile = "max-concurrent-installs"
 )
 
+const (
+	// Device check-ins are logged into one activity file per (UTC) day, only the last few days are kept.
+	ActivityDayFormat = "20060102"
+	ActivityMaxDays   = 7
+)
+
+// Only the last few apps states reports of a device are kept, see also the gateway apps states max age.
+const StatesMaxCount = 10
+
 const (
 	// File & Dir access
 	defaultDirAccess  os.FileMode = 0o750
@@ -132,10 +155,67 @@ type FsHandle struct {
 	Certs   CertsFsHandle
 	Configs ConfigsFsHandle
 	Devices DevicesFsHandle
-	Updates struct {
-		Ci   updatesFsHandleWrap
-		Prod updatesFsHandleWrap
+	Updates UpdatesChannelsFsHandle
+}
+
+// UpdatesChannelsFsHandle holds the built-in "ci" and "prod" update channels, and any custom channels.
+type UpdatesChannelsFsHandle struct {
+	Ci   UpdatesChannelFsHandle
+	Prod UpdatesChannelFsHandle
+
+	custom map[string]UpdatesChannelFsHandle
+}
+
+// Channel returns the update channel with a given name.
+func (s UpdatesChannelsFsHandle) Channel(name string) (UpdatesChannelFsHandle, bool) {
+	switch name {
+	case UpdatesCiDir:
+		return s.Ci, true
+	case UpdatesProdDir:
+		return s.Prod, true
+	default:
+		h, ok := s.custom[name]
+		return h, ok
+	}
+}
+
+// ForDevice returns the default update channel for production or CI devices.
+func (s UpdatesChannelsFsHandle) ForDevice(isProd bool) UpdatesChannelFsHandle {
+	if isProd {
+		return s.Prod
+	}
+	return s.Ci
+}
+
+// Channels returns all update channels, built-in channels first.
+func (s UpdatesChannelsFsHandle) Channels() []UpdatesChannelFsHandle {
+	res := []UpdatesChannelFsHandle{s.Ci, s.Prod}
+	for _, name := range slices.Sorted(maps.Keys(s.custom)) {
+		res = append(res, s.custom[name])
+	}
+	return res
+}
+
+var validUpdatesChannel = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,19}$`).MatchString
+
+// AddUpdatesChannel adds a custom update channel stored under "updates/<name>".
+// It must be called on startup, before any other storage is created out of this handle.
+func (fs *FsHandle) AddUpdatesChannel(name string, isProd bool) error {
+	if !validUpdatesChannel(name) {
+		return fmt.Errorf("invalid update channel name: %s", name)
+	} else if _, ok := fs.Updates.Channel(name); ok {
+		return fmt.Errorf("update channel already exists: %s", name)
+	}
+	var h UpdatesChannelFsHandle
+	h.init(filepath.Join(fs.Config.UpdatesDir(), name), name, isProd)
+	if err := h.mkdirs(defaultDirAccess, true); err != nil {
+		return fmt.Errorf("unable to initialize update channel %s: %w", name, err)
+	}
+	if fs.Updates.custom == nil {
+		fs.Updates.custom = make(map[string]UpdatesChannelFsHandle)
 	}
+	fs.Updates.custom[name] = h
+	return nil
 }
 
 func NewFs(root string) (*FsHandle, error) {
@@ -145,8 +225,8 @@ func NewFs(root string) (*FsHandle, error) {
 	fs.Certs.root = fs.Config.CertsDir()
 	fs.Configs.root = fs.Config.ConfigsDir()
 	fs.Devices.root = fs.Config.DevicesDir()
-	fs.Updates.Ci.init(fs.Config.UpdatesCiDir())
-	fs.Updates.Prod.init(fs.Config.UpdatesProdDir())
+	fs.Updates.Ci.init(fs.Config.UpdatesCiDir(), UpdatesCiDir, false)
+	fs.Updates.Prod.init(fs.Config.UpdatesProdDir(), UpdatesProdDir, true)
 
 	for _, h := range []baseFsHandle{
 		fs.Audit.baseFsHandle,
@@ -164,6 +244,18 @@ func NewFs(root string) (*FsHandle, error) {
 	return fs, nil
 }
 
+const lockFile = ".lock"
+
+var fileLocking atomic.Bool
+
+// SetFileLocking enables advisory file locks (flock) around file appends and rollovers.
+// By default, appends rely on O_APPEND semantics, which only serialize writers on a single host.
+// Locking is needed when several processes share the storage over a networked filesystem.
+// This is a process wide setting.
+func SetFileLocking(enabled bool) {
+	fileLocking.Store(enabled)
+}
+
 type baseFsHandle struct {
 	root string
 }
@@ -186,18 +278,38 @@ func (s baseFsHandle) readFile(name string, ignoreNotExist bool) (string, error)
 	}
 }
 
-func (s baseFsHandle) readFileLines(name string, ignoreNotExist bool, infinityStop DoneChan) iter.Seq2[string, error] {
+// readFileLines yields lines of a file after skipping a given number of them.
+// Skipped lines are not read if the file has a line index, see appendIndexedFile.
+func (s baseFsHandle) readFileLines(name string, skip int, ignoreNotExist bool, infinityStop DoneChan) iter.Seq2[string, error] {
 	// memory efficient way to read lines from a potentially large file
 	return func(yield func(string, error) bool) {
-		if fd, err := os.OpenFile(filepath.Join(s.root, name), os.O_RDONLY, 0); err != nil {
+		path := filepath.Join(s.root, name)
+		if fd, err := os.OpenFile(path, os.O_RDONLY, 0); err != nil {
 			if !ignoreNotExist || !errors.Is(err, os.ErrNotExist) {
 				yield("", err)
 			}
 		} else {
-			defer fd.Close() // nolint:errcheck
+			var rotated *os.File
+			defer func() {
+				_ = fd.Close()
+				if rotated != nil {
+					_ = rotated.Close()
+				}
+			}()
+			if offset, ok := s.lineOffset(name, fd, skip); ok {
+				if _, err = fd.Seek(offset, io.SeekStart); err != nil {
+					yield("", err)
+					return
+				}
+				skip = 0
+			}
 		TAIL:
 			scanner := bufio.NewScanner(fd) // line reader
 			for scanner.Scan() {
+				if skip > 0 {
+					skip--
+					continue
+				}
 				if !yield(scanner.Text(), nil) {
 					return
 				}
@@ -207,6 +319,14 @@ func (s baseFsHandle) readFileLines(name string, ignoreNotExist bool, infinitySt
 				return
 			}
 			if infinityStop != nil {
+				if rotated != nil {
+					// All lines appended before the rotation were read, continue with the new file.
+					_ = fd.Close()
+					fd, rotated = rotated, nil
+					goto TAIL
+				} else if rotated = openRotatedFile(fd, path); rotated != nil {
+					goto TAIL
+				}
 				// Tail functionality - simply re-create the scanner with the same fd after some time.
 				// File position remains the same, so a new scanner continues from it.
 				select {
@@ -220,6 +340,52 @@ func (s baseFsHandle) readFileLines(name string, ignoreNotExist bool, infinitySt
 	}
 }
 
+// readLastLine returns the last non-empty line of a file, reading the file backwards from its end.
+// A missing file has no lines.
+func (s baseFsHandle) readLastLine(name string) (string, error) {
+	fd, err := os.Open(filepath.Join(s.root, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer fd.Close() // nolint:errcheck
+	info, err := fd.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	const blockSize = 4096
+	var tail []byte
+	for end := info.Size(); end > 0; {
+		start := max(end-blockSize, 0)
+		block := make([]byte, end-start, int(end-start)+len(tail))
+		if _, err = fd.ReadAt(block, start); err != nil {
+			return "", err
+		}
+		tail = append(block, tail...)
+		trimmed := bytes.TrimRight(tail, " \t\r\n")
+		if pos := bytes.LastIndexByte(trimmed, '\n'); pos >= 0 {
+			return string(trimmed[pos+1:]), nil
+		}
+		end = start
+	}
+	return string(bytes.TrimSpace(tail)), nil
+}
+
+// openRotatedFile opens a file at the path, if it is not the file open as fd anymore, see rotateFile.
+func openRotatedFile(fd *os.File, path string) *os.File {
+	if cur, err := fd.Stat(); err != nil {
+		return nil
+	} else if info, err := os.Stat(path); err != nil || os.SameFile(cur, info) {
+		return nil
+	} else if next, err := os.OpenFile(path, os.O_RDONLY, 0); err != nil {
+		return nil
+	} else {
+		return next
+	}
+}
+
 func (s baseFsHandle) writeFile(name, content string, mode os.FileMode) error {
 	path := filepath.Join(s.root, name)
 	partial := filepath.Join(s.root, name+partialFileSuffix)
@@ -252,6 +418,13 @@ func (s baseFsHandle) writeFileStream(name string, src io.Reader, mode os.FileMo
 }
 
 func (s baseFsHandle) appendFile(name, content string, mode os.FileMode) error { //nolint:unparam
+	return s.withLock(func() error {
+		return s.appendFileLocked(name, content, mode)
+	})
+}
+
+// appendFileLocked is appendFile for callers which already hold the lock, see withLock.
+func (s baseFsHandle) appendFileLocked(name, content string, mode os.FileMode) error {
 	// O_APPEND + O_SYNC on Linux warrants that concurrent file appends up to 1MB are serialized.
 	fd, err := os.OpenFile(filepath.Join(s.root, name),
 		os.O_CREATE|os.O_APPEND|syscall.O_SYNC|os.O_WRONLY, mode)
@@ -266,6 +439,23 @@ func (s baseFsHandle) appendFile(name, content string, mode os.FileMode) error {
 	return err
 }
 
+// withLock runs fn holding an exclusive lock of the handle directory, if file locking is enabled.
+func (s baseFsHandle) withLock(fn func() error) error {
+	if !fileLocking.Load() {
+		return fn()
+	}
+	fd, err := os.OpenFile(filepath.Join(s.root, lockFile), os.O_CREATE|os.O_RDWR, defaultFileAccess)
+	if err != nil {
+		return fmt.Errorf("unable to open lock file: %w", err)
+	}
+	defer fd.Close() // nolint:errcheck
+	if err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("unable to lock %s: %w", s.root, err)
+	}
+	// Closing the file releases the lock.
+	return fn()
+}
+
 func (s baseFsHandle) deleteFile(name string, ignoreNotExist bool) error {
 	err := os.Remove(filepath.Join(s.root, name))
 	if err != nil && ignoreNotExist && errors.Is(err, os.ErrNotExist) {
@@ -274,23 +464,209 @@ func (s baseFsHandle) deleteFile(name string, ignoreNotExist bool) error {
 	return err
 }
 
-func (s baseFsHandle) rolloverFiles(prefix string, max int) error {
-	names, err := s.matchFiles(prefix, true)
-	if err == nil {
-		for i := 0; i < len(names)-max; i++ {
-			if err = s.deleteFile(names[i], false); err != nil {
-				break
+// rolloverFiles keeps at most max of the newest files with a given prefix.
+// If maxAge is positive, it also removes files modified longer than maxAge ago.
+func (s baseFsHandle) rolloverFiles(prefix string, max int, maxAge time.Duration) error {
+	return s.withLock(func() error {
+		infos, err := s.matchFileInfos(prefix, true)
+		if err != nil {
+			return err
+		}
+		expired := clock.Now().Add(-maxAge)
+		for i, info := range infos {
+			if i >= len(infos)-max && (maxAge <= 0 || info.ModTime().After(expired)) {
+				continue
+			}
+			if err = s.deleteFile(info.Name(), false); err != nil {
+				return err
+			} else if err = s.deleteFile(info.Name()+lineIndexSuffix, true); err != nil {
+				return err
 			}
 		}
+		return nil
+	})
+}
+
+// LogRetention limits the disk space of append-only log files.
+// A log is rotated once it exceeds MaxSize, keeping at most MaxFiles of the newest rotated logs,
+// and if MaxAge is positive, none of them modified longer than MaxAge ago. A zero MaxSize disables rotation.
+// The newest rotated log is always kept, as it tells how many lines the log had before the current file.
+type LogRetention struct {
+	MaxSize  int64
+	MaxFiles int
+	MaxAge   time.Duration
+}
+
+// rotateFile renames a file exceeding the retention size to <name>.<number of its first line>,
+// so that next appends start a new file, and removes rotated files beyond the retention.
+// Lines are numbered across rotations, see readRotatedFileLines.
+func (s baseFsHandle) rotateFile(name string, retention LogRetention) error {
+	if retention.MaxSize <= 0 {
+		return nil
+	}
+	path := filepath.Join(s.root, name)
+	// Indexed appends must not interleave with the rename, or their index entries would be rotated apart from their lines.
+	mu := lineIndexLock(path)
+	mu.Lock()
+	rotated := false
+	err := s.withLock(func() error {
+		info, err := os.Stat(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		} else if info.Size() < retention.MaxSize {
+			return nil
+		}
+		rotated = true
+		_, start, err := s.rotatedFiles(name)
+		if err != nil {
+			return err
+		}
+		// The index of a rotated file tells how many lines it has, see rotatedFiles.
+		if end, err := s.lastIndexedLineEnd(name); err != nil || end != info.Size() {
+			if err = s.rebuildLineIndex(name); err != nil {
+				return err
+			}
+		}
+		dst := fmt.Sprintf("%s.%012d", path, start)
+		if err = os.Rename(path+lineIndexSuffix, dst+lineIndexSuffix); err != nil {
+			return err
+		} else if err = os.Rename(path, dst); err != nil {
+			return err
+		}
+		// Readers of the log expect it to exist once it was written, see readRotatedFileLines.
+		return s.writeFile(name, "", defaultFileAccess)
+	})
+	mu.Unlock()
+	if err != nil || !rotated {
+		return err
+	}
+	// Not under the lock above, rolloverFiles takes it on its own.
+	return s.rolloverFiles(name+".", max(retention.MaxFiles, 1), retention.MaxAge)
+}
+
+type rotatedFile struct {
+	name  string
+	start int
+	lines int
+}
+
+// rotatedFiles returns the kept rotated files of a log oldest first, and the number of the first line of the log file.
+func (s baseFsHandle) rotatedFiles(name string) ([]rotatedFile, int, error) {
+	names, err := s.matchFiles(name+".", false)
+	if err != nil {
+		return nil, 0, err
+	}
+	var files []rotatedFile
+	for _, rotated := range names {
+		start, err := strconv.Atoi(strings.TrimPrefix(rotated, name+"."))
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(s.root, rotated+lineIndexSuffix))
+		if errors.Is(err, os.ErrNotExist) {
+			if err = s.rebuildLineIndex(rotated); err == nil {
+				info, err = os.Stat(filepath.Join(s.root, rotated+lineIndexSuffix))
+			}
+		}
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// Removed by a concurrent rotation
+				continue
+			}
+			return nil, 0, err
+		}
+		files = append(files, rotatedFile{name: rotated, start: start, lines: int(info.Size() / lineIndexEntrySize)})
+	}
+	slices.SortFunc(files, func(a, b rotatedFile) int { return cmp.Compare(a.start, b.start) })
+	if len(files) == 0 {
+		return nil, 0, nil
+	}
+	last := files[len(files)-1]
+	return files, last.start + last.lines, nil
+}
+
+// firstRotatedFileLine returns the number of the first kept line of a log rotated by rotateFile.
+func (s baseFsHandle) firstRotatedFileLine(name string) (int, error) {
+	files, start, err := s.rotatedFiles(name)
+	if len(files) > 0 {
+		start = files[0].start
+	}
+	return start, err
+}
+
+// countRotatedFileLines returns the number of lines of a log rotated by rotateFile, including the removed ones,
+// that is, the number of the line which is appended next.
+func (s baseFsHandle) countRotatedFileLines(name string) (int, error) {
+	_, start, err := s.rotatedFiles(name)
+	if err != nil {
+		return 0, err
+	}
+	count, err := s.countFileLines(name)
+	return start + count, err
+}
+
+// readRotatedFileLines is readFileLines of a log rotated by rotateFile, which reads its kept rotated files first.
+// Lines are numbered across rotations: skip is the number of the first line to read,
+// when that line is no longer kept, reading starts at the first kept line, see firstRotatedFileLine.
+func (s baseFsHandle) readRotatedFileLines(name string, skip int, infinityStop DoneChan) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		next := skip
+		for {
+			files, start, err := s.rotatedFiles(name)
+			if err != nil {
+				yield("", err)
+				return
+			}
+			for _, f := range files {
+				if next >= f.start+f.lines {
+					continue
+				}
+				next = max(next, f.start)
+				// A rotated file may be removed meanwhile by a rotation, see rolloverFiles.
+				for line, err := range s.readFileLines(f.name, next-f.start, true, nil) {
+					if !yield(line, err) || err != nil {
+						return
+					}
+					next++
+				}
+			}
+			if again, _, err := s.rotatedFiles(name); err != nil {
+				yield("", err)
+				return
+			} else if len(again) > 0 && (len(files) == 0 || again[len(again)-1].name != files[len(files)-1].name) {
+				// The log was rotated while reading rotated files, read the newly rotated ones too.
+				continue
+			}
+			for line, err := range s.readFileLines(name, max(next-start, 0), false, infinityStop) {
+				if !yield(line, err) {
+					return
+				}
+			}
+			return
+		}
 	}
-	return err
 }
 
 func (s baseFsHandle) matchFiles(prefix string, sortByModTime bool) ([]string, error) {
+	infos, err := s.matchFileInfos(prefix, sortByModTime)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
+
+func (s baseFsHandle) matchFileInfos(prefix string, sortByModTime bool) ([]os.FileInfo, error) {
 	entries, err := os.ReadDir(s.root)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			return []string{}, nil
+			return []os.FileInfo{}, nil
 		}
 		return nil, err
 	}
@@ -300,8 +676,8 @@ func (s baseFsHandle) matchFiles(prefix string, sortByModTime bool) ([]string, e
 			return nil, err
 		} else {
 			name := info.Name()
-			if strings.HasSuffix(name, partialFileSuffix) {
-				// Filter out partial files - uploads in progress or data corruptions
+			if strings.HasSuffix(name, partialFileSuffix) || strings.HasSuffix(name, lineIndexSuffix) || name == lockFile {
+				// Filter out partial files - uploads in progress or data corruptions, line indexes, and lock files
 				continue
 			} else if len(prefix) == 0 || strings.HasPrefix(name, prefix) {
 				infos = append(infos, info)
@@ -310,13 +686,9 @@ func (s baseFsHandle) matchFiles(prefix string, sortByModTime bool) ([]string, e
 	}
 	if sortByModTime {
 		slices.SortFunc(infos, func(a, b os.FileInfo) int {
-			// UnixMilli is int64, but in our universe UnixMilli difference of two events files of the same device is int.
-			return int(a.ModTime().UnixMilli() - b.ModTime().UnixMilli())
+			// Files modified within the same millisecond are ordered by name, see e.g. apps states names.
+			return cmp.Or(cmp.Compare(a.ModTime().UnixMilli(), b.ModTime().UnixMilli()), strings.Compare(a.Name(), b.Name()))
 		})
 	}
-	names := make([]string, 0, len(infos))
-	for _, info := range infos {
-		names = append(names, info.Name())
-	}
-	return names, nil
+	return infos, nil
 }
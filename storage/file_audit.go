@@ -5,10 +5,43 @@ package storage
 
 import (
 	"fmt"
+	"iter"
 	"log/slog"
+	"strings"
 	"time"
 )
 
+// AuditEvent is a single parsed line of an audit log.
+type AuditEvent struct {
+	Time  int64  `json:"time"`
+	Event string `json:"event"`
+}
+
+// ParseAuditLog converts the content returned by ReadEvents into structured events.
+// Lines with an unparsable timestamp are kept, with a zero time.
+func ParseAuditLog(content string) []AuditEvent {
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	events := make([]AuditEvent, 0, len(lines))
+	for _, line := range lines {
+		if len(line) > 0 {
+			events = append(events, parseAuditLine(line))
+		}
+	}
+	return events
+}
+
+func parseAuditLine(line string) (evt AuditEvent) {
+	// RFC3339 timestamps contain colons too, so split on the first colon followed by a space.
+	if ts, msg, ok := strings.Cut(line, ": "); ok {
+		if t, err := time.Parse(time.RFC3339, ts); err == nil {
+			evt.Time = t.Unix()
+			line = msg
+		}
+	}
+	evt.Event = line
+	return
+}
+
 type AuditLogsFsHandle struct {
 	baseFsHandle
 }
@@ -20,6 +53,33 @@ func (h AuditLogsFsHandle) AppendEvent(userid int64, event string) {
 	}
 }
 
+// AppendEvents records several events at once, with a single write to the audit log.
+func (h AuditLogsFsHandle) AppendEvents(userid int64, events []string) {
+	ts := time.Now().Format(time.RFC3339)
+	var sb strings.Builder
+	for _, event := range events {
+		fmt.Fprintf(&sb, "%s: %s\n", ts, event)
+	}
+	if err := h.appendFile(fmt.Sprintf("users-%d", userid), sb.String(), defaultFileAccess); err != nil {
+		slog.Error("Failed to append audit log", "userID", userid, "error", err)
+	}
+}
+
+// IterEvents yields the parsed events of a user audit log one by one, oldest first, see ParseAuditLog.
+// A user without an audit log has no events.
+func (h AuditLogsFsHandle) IterEvents(userid int64) iter.Seq2[AuditEvent, error] {
+	return func(yield func(AuditEvent, error) bool) {
+		for line, err := range h.readFileLines(fmt.Sprintf("users-%d", userid), 0, true, nil) {
+			if err != nil {
+				yield(AuditEvent{}, fmt.Errorf("reading audit log for user %d: %w", userid, err))
+				return
+			} else if len(line) > 0 && !yield(parseAuditLine(line), nil) {
+				return
+			}
+		}
+	}
+}
+
 func (h AuditLogsFsHandle) ReadEvents(userid int64) (string, error) {
 	data, err := h.readFile(fmt.Sprintf("users-%d", userid), false)
 	if err != nil {
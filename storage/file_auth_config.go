@@ -22,11 +22,31 @@ type RateLimitConfig struct {
 }
 
 type AuthConfig struct {
-	Type                 string
-	SessionTimeoutHours  int // Default is 48 hours
-	NewUserDefaultScopes []string
-	RateLimits           RateLimitConfig
-	Config               json.RawMessage
+	Type                  string
+	SessionTimeoutHours   int // Default is 48 hours
+	NewUserDefaultScopes  []string
+	RateLimits            RateLimitConfig
+	UniqueUserEmails      bool // Require a non-empty email of every user, unique among active users
+	MaxSessionsPerUser    int  // A new session evicts the oldest sessions of a user over this limit, 0 means no limit
+	MinTokenLifetimeHours int  // New API tokens must be valid for at least this long, 0 means no limit
+	MaxTokenLifetimeHours int  // New API tokens may be valid for at most this long, 0 means no limit
+	LoginRedirects        []LoginRedirect
+	LoginBranding         LoginBranding
+	Config                json.RawMessage
+}
+
+// LoginRedirect sends users who have all of given scopes to a path after they log in.
+// The first matching redirect is used, users matching none of them are sent to "/".
+type LoginRedirect struct {
+	Scopes []string
+	Path   string
+}
+
+// LoginBranding customizes the login page for white-labeled deployments, empty fields keep the defaults.
+type LoginBranding struct {
+	Title          string
+	LogoUrl        string
+	SupportContact string
 }
 
 func (h AuthFsHandle) InitHmacSecret() error {
@@ -289,7 +289,7 @@ func (s configsFsHandle) purgeHistory(keepLatest int) (err error) {
 
 func (s configsFsHandle) readJournal() ([]configJournalItem, error) {
 	var items []configJournalItem
-	for line, err := range s.readFileLines(ConfigsJournalFile, true, nil) {
+	for line, err := range s.readFileLines(ConfigsJournalFile, 0, true, nil) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to read journal file: %w", err)
 		}
@@ -4,15 +4,57 @@
 package storage
 
 import (
+	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
+// deviceShardLen is the length of the UUID prefix used as a shard directory name.
+const deviceShardLen = 2
+
+// deviceShardsDir holds shard directories, apart from flat device directories, so that no device directory
+// may ever be a shard directory too, e.g. for a device with a UUID as short as a shard name.
+const deviceShardsDir = "_shards"
+
+// GzipSuffix marks device files stored gzip compressed, see WriteCompressedFile.
+const GzipSuffix = ".gz"
+
 type DevicesFsHandle struct {
 	baseFsHandle
+	sharded bool
+}
+
+// EnableSharding switches to a two-level "devices/_shards/<uuid-prefix>/<uuid>" layout.
+// Any device directories still stored in the flat "devices/<uuid>" layout are migrated.
+// There is no way back: once enabled, sharding must be enabled on every start.
+func (s *DevicesFsHandle) EnableSharding() error {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return fmt.Errorf("unable to list device file storage: %w", err)
+	}
+	s.sharded = true
+	for _, entry := range entries {
+		uuid := entry.Name()
+		if !entry.IsDir() || uuid == deviceShardsDir {
+			continue
+		}
+		h, _ := s.deviceLocalHandle(uuid, false)
+		shard := baseFsHandle{root: filepath.Dir(h.root)}
+		if err = shard.mkdirs(defaultDirAccess, true); err != nil {
+			return fmt.Errorf("unable to create shard for device %s: %w", uuid, err)
+		}
+		if err = os.Rename(filepath.Join(s.root, uuid), h.root); err != nil {
+			return fmt.Errorf("unable to migrate file storage for device %s: %w", uuid, err)
+		}
+	}
+	return nil
 }
 
 func (s DevicesFsHandle) Delete(uuid string) error {
@@ -41,6 +83,24 @@ func (s DevicesFsHandle) ReadFile(uuid, name string) (string, error) {
 	return content, err
 }
 
+// ReadFileDecompressed is ReadFile which transparently decompresses files named with a GzipSuffix.
+func (s DevicesFsHandle) ReadFileDecompressed(uuid, name string) (string, error) {
+	content, err := s.ReadFile(uuid, name)
+	if err != nil || !strings.HasSuffix(name, GzipSuffix) || len(content) == 0 {
+		return content, err
+	}
+	zr, err := gzip.NewReader(strings.NewReader(content))
+	if err != nil {
+		return "", fmt.Errorf("unexpected error decompressing file %s for device %s: %w", name, uuid, err)
+	}
+	defer zr.Close() // nolint:errcheck
+	var buf strings.Builder
+	if _, err = io.Copy(&buf, zr); err != nil {
+		return "", fmt.Errorf("unexpected error decompressing file %s for device %s: %w", name, uuid, err)
+	}
+	return buf.String(), nil
+}
+
 func (s DevicesFsHandle) WriteFile(uuid, name, content string) error {
 	if h, err := s.deviceLocalHandle(uuid, true); err != nil {
 		return err
@@ -50,6 +110,18 @@ func (s DevicesFsHandle) WriteFile(uuid, name, content string) error {
 	return nil
 }
 
+// WriteCompressedFile writes gzip compressed content into a file named with a GzipSuffix appended to a given name.
+func (s DevicesFsHandle) WriteCompressedFile(uuid, name, content string) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(content)); err != nil {
+		return fmt.Errorf("error compressing file %s for device %s: %w", name, uuid, err)
+	} else if err = zw.Close(); err != nil {
+		return fmt.Errorf("error compressing file %s for device %s: %w", name, uuid, err)
+	}
+	return s.WriteFile(uuid, name+GzipSuffix, buf.String())
+}
+
 func (s DevicesFsHandle) WriteFileStream(uuid, name string, src io.Reader) error {
 	if h, err := s.deviceLocalHandle(uuid, true); err != nil {
 		return err
@@ -70,6 +142,35 @@ func (s DevicesFsHandle) AppendFile(uuid, name, content string) error {
 	return nil
 }
 
+// AppendIndexedFile is AppendFile which maintains a line index of the file, so that its lines can be read
+// starting at a given line without scanning the lines before it, see ReadFileLines.
+func (s DevicesFsHandle) AppendIndexedFile(uuid, name, content string) error {
+	if h, err := s.deviceLocalHandle(uuid, true); err != nil {
+		return err
+	} else if err = h.appendIndexedFile(name, content); err != nil {
+		return fmt.Errorf("error writing file %s for device %s: %w", name, uuid, err)
+	}
+	return nil
+}
+
+// ReadFileLines yields lines of a device file after skipping a given number of them.
+// A missing file has no lines.
+func (s DevicesFsHandle) ReadFileLines(uuid, name string, skip int) iter.Seq2[string, error] {
+	h, _ := s.deviceLocalHandle(uuid, false)
+	return h.readFileLines(name, skip, true, nil)
+}
+
+// ReadLastLine returns the last non-empty line of a device file without reading the whole file.
+// A missing file has no lines.
+func (s DevicesFsHandle) ReadLastLine(uuid, name string) (string, error) {
+	h, _ := s.deviceLocalHandle(uuid, false)
+	line, err := h.readLastLine(name)
+	if err != nil {
+		err = fmt.Errorf("unexpected error reading file %s for device %s: %w", name, uuid, err)
+	}
+	return line, err
+}
+
 func (s DevicesFsHandle) ListFiles(uuid, prefix string, sortByModTime bool) ([]string, error) {
 	h, _ := s.deviceLocalHandle(uuid, false)
 	names, err := h.matchFiles(prefix, sortByModTime)
@@ -79,17 +180,23 @@ func (s DevicesFsHandle) ListFiles(uuid, prefix string, sortByModTime bool) ([]s
 	return names, err
 }
 
-func (s DevicesFsHandle) RolloverFiles(uuid, prefix string, max int) error {
+// RolloverFiles keeps at most max of the newest device files with a given prefix, and none older than maxAge.
+// A zero maxAge keeps files regardless of their age.
+func (s DevicesFsHandle) RolloverFiles(uuid, prefix string, max int, maxAge time.Duration) error {
 	if h, err := s.deviceLocalHandle(uuid, true); err != nil {
 		return err
-	} else if err = h.rolloverFiles(prefix, max); err != nil {
+	} else if err = h.rolloverFiles(prefix, max, maxAge); err != nil {
 		return fmt.Errorf("error rolling over %s files for device %s: %w", prefix, uuid, err)
 	}
 	return nil
 }
 
 func (s DevicesFsHandle) deviceLocalHandle(uuid string, forUpdate bool) (h baseFsHandle, err error) {
-	h.root = filepath.Join(s.root, uuid)
+	if s.sharded {
+		h.root = filepath.Join(s.root, deviceShardsDir, uuid[:min(len(uuid), deviceShardLen)], uuid)
+	} else {
+		h.root = filepath.Join(s.root, uuid)
+	}
 	if forUpdate {
 		if err = h.mkdirs(defaultDirAccess, true); err != nil {
 			err = fmt.Errorf("unable to create file storage for device %s: %w", uuid, err)
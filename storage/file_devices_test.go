@@ -0,0 +1,105 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDevicesSharding(t *testing.T) {
+	fs, err := NewFs(t.TempDir())
+	require.Nil(t, err)
+	root := fs.Config.DevicesDir()
+
+	// Flat layout before sharding is enabled.
+	require.Nil(t, fs.Devices.WriteFile("abcdef", AktomlFile, "flat"))
+	require.Nil(t, fs.Devices.AppendFile("x", EventsPrefix, "short"))
+	assert.FileExists(t, filepath.Join(root, "abcdef", AktomlFile))
+
+	require.Nil(t, fs.Devices.EnableSharding())
+
+	// Existing devices were migrated, including those with UUIDs shorter than a shard name.
+	shards := filepath.Join(root, deviceShardsDir)
+	assert.NoDirExists(t, filepath.Join(root, "abcdef"))
+	assert.NoDirExists(t, filepath.Join(root, "x"))
+	assert.FileExists(t, filepath.Join(shards, "ab", "abcdef", AktomlFile))
+	assert.FileExists(t, filepath.Join(shards, "x", "x", EventsPrefix))
+	content, err := fs.Devices.ReadFile("abcdef", AktomlFile)
+	require.Nil(t, err)
+	assert.Equal(t, "flat", content)
+	content, err = fs.Devices.ReadFile("x", EventsPrefix)
+	require.Nil(t, err)
+	assert.Equal(t, "short", content)
+
+	// New devices are written straight into their shard.
+	require.Nil(t, fs.Devices.WriteFile("abzzzz", HwInfoFile, "hw"))
+	require.Nil(t, fs.Devices.AppendFile("cd1234", EventsPrefix+"-1", "evt"))
+	assert.FileExists(t, filepath.Join(shards, "ab", "abzzzz", HwInfoFile))
+	assert.FileExists(t, filepath.Join(shards, "cd", "cd1234", EventsPrefix+"-1"))
+	names, err := fs.Devices.ListFiles("cd1234", EventsPrefix, true)
+	require.Nil(t, err)
+	assert.Equal(t, []string{EventsPrefix + "-1"}, names)
+	fd, err := fs.Devices.ReadFileStream("abzzzz", HwInfoFile)
+	require.Nil(t, err)
+	require.Nil(t, fd.Close())
+
+	// Enabling sharding again is a no-op.
+	require.Nil(t, fs.Devices.EnableSharding())
+	content, err = fs.Devices.ReadFile("abcdef", AktomlFile)
+	require.Nil(t, err)
+	assert.Equal(t, "flat", content)
+
+	require.Nil(t, fs.Devices.Delete("abcdef"))
+	assert.NoDirExists(t, filepath.Join(shards, "ab", "abcdef"))
+	_, err = os.Stat(filepath.Join(shards, "ab", "abzzzz"))
+	assert.Nil(t, err)
+}
+
+func TestDevicesShardingShortUuid(t *testing.T) {
+	fs, err := NewFs(t.TempDir())
+	require.Nil(t, err)
+	root := fs.Config.DevicesDir()
+
+	// A device with a UUID as long as a shard name, and another device in the same shard.
+	require.Nil(t, fs.Devices.WriteFile("ab", AktomlFile, "short"))
+	require.Nil(t, fs.Devices.WriteFile("abcdef", AktomlFile, "long"))
+	require.Nil(t, fs.Devices.EnableSharding())
+	require.Nil(t, fs.Devices.WriteFile("ab1234", AktomlFile, "new"))
+
+	// Deleting the short device must not delete devices of its shard.
+	require.Nil(t, fs.Devices.Delete("ab"))
+	for uuid, expected := range map[string]string{"abcdef": "long", "ab1234": "new"} {
+		content, err := fs.Devices.ReadFile(uuid, AktomlFile)
+		require.Nil(t, err, uuid)
+		assert.Equal(t, expected, content, uuid)
+	}
+	assert.NoDirExists(t, filepath.Join(root, deviceShardsDir, "ab", "ab"))
+}
+
+func TestDevicesReadLastLine(t *testing.T) {
+	fs, err := NewFs(t.TempDir())
+	require.Nil(t, err)
+
+	line, err := fs.Devices.ReadLastLine("dev1", EventsPrefix)
+	require.Nil(t, err)
+	assert.Empty(t, line)
+
+	require.Nil(t, fs.Devices.AppendFile("dev1", EventsPrefix, "only"))
+	line, err = fs.Devices.ReadLastLine("dev1", EventsPrefix)
+	require.Nil(t, err)
+	assert.Equal(t, "only", line)
+
+	// Lines longer than a block read from the end, and trailing empty lines.
+	long := strings.Repeat("x", 5000)
+	require.Nil(t, fs.Devices.AppendFile("dev1", EventsPrefix, "\n"+long+"1\n"+long+"2\n\n"))
+	line, err = fs.Devices.ReadLastLine("dev1", EventsPrefix)
+	require.Nil(t, err)
+	assert.Equal(t, long+"2", line)
+}
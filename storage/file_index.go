@@ -0,0 +1,172 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// A line index lets readers of a large append-only file, e.g. device update events or a rollouts log,
+// start at a given line without scanning the file from its start, see readFileLines.
+// The index of a file is stored next to it, and holds the byte offset where each line of the file ends,
+// as a big-endian uint64 per line.
+const (
+	lineIndexSuffix    = "..idx"
+	lineIndexEntrySize = 8
+)
+
+// lineIndexLocks serialize indexed appends and rotations within the process, so that index entries follow the order of lines.
+// Appends of other processes are serialized only when file locking is enabled, see SetFileLocking.
+var lineIndexLocks [64]sync.Mutex
+
+func lineIndexLock(path string) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(path))
+	return &lineIndexLocks[h.Sum32()%uint32(len(lineIndexLocks))]
+}
+
+// appendIndexedFile is appendFile which also records where each appended line ends in the line index of the file.
+// An index which does not end at the end of the file, e.g. for a file written before indexing or by appendFile,
+// is rebuilt from the file content first.
+func (s baseFsHandle) appendIndexedFile(name, content string) error {
+	path := filepath.Join(s.root, name)
+	mu := lineIndexLock(path)
+	mu.Lock()
+	defer mu.Unlock()
+	return s.withLock(func() error {
+		var size int64
+		if info, err := os.Stat(path); err == nil {
+			size = info.Size()
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if end, err := s.lastIndexedLineEnd(name); err != nil || end != size {
+			if err = s.rebuildLineIndex(name); err != nil {
+				return err
+			}
+		}
+
+		if err := s.appendFileLocked(name, content, defaultFileAccess); err != nil {
+			return err
+		}
+
+		var entries []byte
+		for offset := size; len(content) > 0; {
+			pos := strings.IndexByte(content, '\n')
+			if pos < 0 {
+				// An unterminated line is not indexed, and makes the next append rebuild the index.
+				break
+			}
+			offset += int64(pos + 1)
+			entries = binary.BigEndian.AppendUint64(entries, uint64(offset))
+			content = content[pos+1:]
+		}
+		return s.appendFileLocked(name+lineIndexSuffix, string(entries), defaultFileAccess)
+	})
+}
+
+// lastIndexedLineEnd returns the offset where the last indexed line of a file ends, zero if none is indexed.
+func (s baseFsHandle) lastIndexedLineEnd(name string) (int64, error) {
+	fd, err := os.Open(filepath.Join(s.root, name+lineIndexSuffix))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer fd.Close() // nolint:errcheck
+	info, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	count := info.Size() / lineIndexEntrySize
+	if count == 0 {
+		return 0, nil
+	}
+	return readLineIndexEntry(fd, count-1)
+}
+
+// countFileLines returns the number of lines of a file, counting the indexed ones without reading them.
+func (s baseFsHandle) countFileLines(name string) (int, error) {
+	var indexed int
+	if info, err := os.Stat(filepath.Join(s.root, name+lineIndexSuffix)); err == nil {
+		indexed = int(info.Size() / lineIndexEntrySize)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	// Lines appended without indexing them are counted by reading them, see appendIndexedFile.
+	count := indexed
+	for _, err := range s.readFileLines(name, indexed, true, nil) {
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (s baseFsHandle) rebuildLineIndex(name string) error {
+	fd, err := os.Open(filepath.Join(s.root, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return s.deleteFile(name+lineIndexSuffix, true)
+	} else if err != nil {
+		return err
+	}
+	defer fd.Close() // nolint:errcheck
+	var (
+		entries []byte
+		offset  int64
+	)
+	reader := bufio.NewReader(fd)
+	for {
+		line, err := reader.ReadSlice('\n')
+		offset += int64(len(line))
+		if err == nil {
+			entries = binary.BigEndian.AppendUint64(entries, uint64(offset))
+		} else if errors.Is(err, io.EOF) {
+			break
+		} else if !errors.Is(err, bufio.ErrBufferFull) {
+			return err
+		}
+	}
+	return s.writeFile(name+lineIndexSuffix, string(entries), defaultFileAccess)
+}
+
+// lineOffset returns the offset where a zero-based line of a file open as fd starts, according to the line index.
+// It returns false if the index does not tell that, or does not match the file content.
+func (s baseFsHandle) lineOffset(name string, fd *os.File, line int) (int64, bool) {
+	if line <= 0 {
+		return 0, true
+	}
+	idx, err := os.Open(filepath.Join(s.root, name+lineIndexSuffix))
+	if err != nil {
+		return 0, false
+	}
+	defer idx.Close() // nolint:errcheck
+	offset, err := readLineIndexEntry(idx, int64(line-1))
+	if err != nil || offset <= 0 {
+		return 0, false
+	}
+	// The previous line must end right before the offset, otherwise the index is stale.
+	last := make([]byte, 1)
+	if _, err = fd.ReadAt(last, offset-1); err != nil || last[0] != '\n' {
+		return 0, false
+	}
+	return offset, true
+}
+
+func readLineIndexEntry(idx *os.File, pos int64) (int64, error) {
+	entry := make([]byte, lineIndexEntrySize)
+	if _, err := idx.ReadAt(entry, pos*lineIndexEntrySize); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(entry)), nil
+}
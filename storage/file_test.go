@@ -0,0 +1,334 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLockingAppends(t *testing.T) {
+	SetFileLocking(true)
+	defer SetFileLocking(false)
+
+	fs, err := NewFs(t.TempDir())
+	require.Nil(t, err)
+
+	// Every writer opens its own file descriptors, so they contend for locks the same way separate processes do.
+	const writers, lines = 8, 50
+	pad := strings.Repeat("x", 8192)
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range lines {
+				line := fmt.Sprintf("%d-%d-%s\n", w, i, pad)
+				assert.Nil(t, fs.Devices.AppendFile("dev1", EventsPrefix, line))
+				assert.Nil(t, fs.Updates.Ci.Rollouts.AppendJournal(line))
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range lines {
+			assert.Nil(t, fs.Devices.RolloverFiles("dev1", StatesPrefix, 1, 0))
+		}
+	}()
+	wg.Wait()
+
+	content, err := fs.Devices.ReadFile("dev1", EventsPrefix)
+	require.Nil(t, err)
+	got := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	assert.Len(t, got, writers*lines)
+	seen := make(map[string]bool)
+	for _, line := range got {
+		w, rest, _ := strings.Cut(line, "-")
+		i, data, _ := strings.Cut(rest, "-")
+		require.Equal(t, pad, data, "interleaved append")
+		seen[w+"-"+i] = true
+	}
+	assert.Len(t, seen, writers*lines)
+
+	require.Nil(t, fs.Updates.Ci.Rollouts.RolloverJournal(0))
+	count := 0
+	for line, err := range fs.Updates.Ci.Rollouts.ReadJournal() {
+		require.Nil(t, err)
+		assert.True(t, strings.HasSuffix(line, "-"+pad))
+		count++
+	}
+	assert.Equal(t, writers*lines, count)
+
+	// Lock files are never listed as storage files.
+	names, err := fs.Devices.ListFiles("dev1", "", false)
+	require.Nil(t, err)
+	assert.Equal(t, []string{EventsPrefix}, names)
+}
+
+func TestRolloverJournalLateEntries(t *testing.T) {
+	fs, err := NewFs(t.TempDir())
+	require.Nil(t, err)
+	rollouts := fs.Updates.Ci.Rollouts
+	journal := func() (lines []string) {
+		for line, err := range rollouts.ReadJournal() {
+			require.Nil(t, err)
+			lines = append(lines, line)
+		}
+		return
+	}
+
+	require.Nil(t, rollouts.AppendJournal("tag|update|roll1\n"))
+	require.Nil(t, rollouts.RolloverJournal(0))
+	assert.Equal(t, []string{"tag|update|roll1"}, journal())
+
+	// A writer which opened the journal right before the rollover appends to it after it was processed.
+	require.Nil(t, rollouts.appendFile(rolloutJournalFile, "tag|update|roll2\n", defaultFileAccess))
+	require.Nil(t, rollouts.AppendJournal("tag|update|roll3\n"))
+	require.Nil(t, rollouts.RolloverJournal(1))
+	assert.Equal(t, []string{"tag|update|roll3", "tag|update|roll2"}, journal())
+
+	// Without new entries, the journal is kept as is.
+	require.Nil(t, rollouts.RolloverJournal(1))
+	assert.Equal(t, []string{"tag|update|roll3", "tag|update|roll2"}, journal())
+	require.Nil(t, rollouts.AppendJournal("tag|update|roll4\n"))
+	require.Nil(t, rollouts.RolloverJournal(2))
+	assert.Equal(t, []string{"tag|update|roll4"}, journal())
+}
+
+func TestRolloverFilesByAge(t *testing.T) {
+	fs, err := NewFs(t.TempDir())
+	require.Nil(t, err)
+
+	now := time.Now()
+	for i, age := range []time.Duration{10 * 24 * time.Hour, 8 * 24 * time.Hour, 2 * 24 * time.Hour, time.Hour, 0} {
+		name := fmt.Sprintf("%s-%d", StatesPrefix, i)
+		require.Nil(t, fs.Devices.WriteFile("dev1", name, "{}"))
+		modTime := now.Add(-age)
+		require.Nil(t, os.Chtimes(filepath.Join(fs.Devices.root, "dev1", name), modTime, modTime))
+	}
+	list := func() []string {
+		names, err := fs.Devices.ListFiles("dev1", StatesPrefix, true)
+		require.Nil(t, err)
+		return names
+	}
+
+	// No age limit: only the count applies.
+	require.Nil(t, fs.Devices.RolloverFiles("dev1", StatesPrefix, 4, 0))
+	assert.Equal(t, []string{"apps-states-1", "apps-states-2", "apps-states-3", "apps-states-4"}, list())
+
+	// Files older than a week are removed even though the count allows them.
+	require.Nil(t, fs.Devices.RolloverFiles("dev1", StatesPrefix, 4, 7*24*time.Hour))
+	assert.Equal(t, []string{"apps-states-2", "apps-states-3", "apps-states-4"}, list())
+
+	// The count cap still applies to recent files.
+	require.Nil(t, fs.Devices.RolloverFiles("dev1", StatesPrefix, 2, 7*24*time.Hour))
+	assert.Equal(t, []string{"apps-states-3", "apps-states-4"}, list())
+}
+
+func TestLineIndex(t *testing.T) {
+	fs, err := NewFs(t.TempDir())
+	require.Nil(t, err)
+	const name = EventsPrefix + "-uuid"
+	read := func(skip int) (lines []string) {
+		for line, err := range fs.Devices.ReadFileLines("dev1", name, skip) {
+			require.Nil(t, err)
+			lines = append(lines, line)
+		}
+		return
+	}
+	line := func(i int) string {
+		// Lines of varying length, so that offsets are not a multiple of the line number.
+		return fmt.Sprintf("line-%d", i)
+	}
+
+	// Lines appended before indexing are indexed with the first indexed append.
+	var expected []string
+	offsets := []int64{0}
+	for i := range 100 {
+		if i < 10 {
+			require.Nil(t, fs.Devices.AppendFile("dev1", name, line(i)+"\n"))
+		} else {
+			require.Nil(t, fs.Devices.AppendIndexedFile("dev1", name, line(i)+"\n"))
+		}
+		expected = append(expected, line(i))
+		offsets = append(offsets, offsets[i]+int64(len(line(i))+1))
+	}
+	assert.Equal(t, expected, read(0))
+	assert.Equal(t, expected[50:], read(50))
+	assert.Equal(t, expected[99:], read(99))
+	assert.Empty(t, read(100))
+	assert.Empty(t, read(1000))
+
+	// A mid-history line is found through the index, rather than by scanning the lines before it.
+	h, _ := fs.Devices.deviceLocalHandle("dev1", false)
+	fd, err := os.Open(filepath.Join(h.root, name))
+	require.Nil(t, err)
+	defer fd.Close() // nolint:errcheck
+	for _, i := range []int{1, 10, 50, 99, 100} {
+		offset, ok := h.lineOffset(name, fd, i)
+		assert.True(t, ok, i)
+		assert.Equal(t, offsets[i], offset, i)
+	}
+	_, ok := h.lineOffset(name, fd, 101)
+	assert.False(t, ok)
+
+	// Lines appended without the index are indexed with the next indexed append.
+	require.Nil(t, fs.Devices.AppendFile("dev1", name, "not-indexed\n"))
+	require.Nil(t, fs.Devices.AppendIndexedFile("dev1", name, "indexed\n"))
+	assert.Equal(t, []string{"not-indexed", "indexed"}, read(100))
+	assert.Equal(t, []string{"indexed"}, read(101))
+
+	// Indexes are neither listed, nor kept after the files they index.
+	names, err := fs.Devices.ListFiles("dev1", EventsPrefix, false)
+	require.Nil(t, err)
+	assert.Equal(t, []string{name}, names)
+	require.Nil(t, fs.Devices.RolloverFiles("dev1", EventsPrefix, 0, 0))
+	_, err = os.Stat(filepath.Join(h.root, name+lineIndexSuffix))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRotateFile(t *testing.T) {
+	fs, err := NewFs(t.TempDir())
+	require.Nil(t, err)
+	logs := fs.Updates.Ci.Logs
+	retention := LogRetention{MaxSize: 1000, MaxFiles: 2}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	require.Nil(t, logs.AppendFile("tag", "update", LogRolloutsFile, "line-000\n"))
+	tail := logs.TailFileLines("tag", "update", LogRolloutsFile, stop)
+	tailed := make(chan string, 1000)
+	go func() {
+		for line, err := range tail {
+			if err != nil {
+				return
+			}
+			tailed <- line
+		}
+	}()
+
+	// A tail follows the log across rotations, as long as it keeps up with them.
+	next := 0
+	waitTail := func(upTo int) {
+		for ; next <= upTo; next++ {
+			select {
+			case line := <-tailed:
+				require.Equal(t, fmt.Sprintf("line-%03d", next), line)
+			case <-time.After(time.Second):
+				require.Fail(t, "tail missed lines after a rotation", "line %d", next)
+			}
+		}
+	}
+
+	const lines = 500
+	for i := 1; i < lines; i++ {
+		require.Nil(t, logs.AppendFile("tag", "update", LogRolloutsFile, fmt.Sprintf("line-%03d\n", i)))
+		require.Nil(t, logs.RotateFile("tag", "update", LogRolloutsFile, retention))
+		if i%20 == 0 {
+			waitTail(i)
+		}
+	}
+	waitTail(lines - 1)
+
+	dir := filepath.Dir(logs.FilePath("tag", "update", LogRolloutsFile))
+	rotatedLogs := func() []string {
+		rotated, err := filepath.Glob(filepath.Join(dir, LogRolloutsFile+".*"))
+		require.Nil(t, err)
+		return slices.DeleteFunc(rotated, func(path string) bool { return strings.HasSuffix(path, lineIndexSuffix) })
+	}
+	rotated := rotatedLogs()
+	assert.Len(t, rotated, 2)
+	info, err := os.Stat(filepath.Join(dir, LogRolloutsFile))
+	require.Nil(t, err)
+	assert.Less(t, info.Size(), retention.MaxSize)
+
+	// The newest entries are kept in order, across the rotated and the current log.
+	slices.Sort(rotated)
+	var kept []string
+	for _, path := range append(rotated, filepath.Join(dir, LogRolloutsFile)) {
+		content, err := os.ReadFile(path)
+		require.Nil(t, err)
+		kept = append(kept, strings.Fields(string(content))...)
+	}
+	assert.Greater(t, len(kept), 2*int(retention.MaxSize)/len("line-000\n"))
+	for i, line := range kept {
+		assert.Equal(t, fmt.Sprintf("line-%03d", lines-len(kept)+i), line)
+	}
+
+	// Readers span the rotated logs, and number lines across rotations.
+	first, err := logs.FirstFileLine("tag", "update", LogRolloutsFile)
+	require.Nil(t, err)
+	assert.Equal(t, lines-len(kept), first)
+	var read []string
+	for line, err := range logs.TailFileLinesFrom("tag", "update", LogRolloutsFile, 0, nil) {
+		require.Nil(t, err)
+		read = append(read, line)
+	}
+	assert.Equal(t, kept, read)
+	count, err := logs.CountFileLines("tag", "update", LogRolloutsFile)
+	require.Nil(t, err)
+	assert.Equal(t, lines, count)
+	for _, skip := range []int{first + 1, first + len(kept)/2, lines - 1} {
+		for line, err := range logs.TailFileLinesFrom("tag", "update", LogRolloutsFile, skip, nil) {
+			require.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("line-%03d", skip), line)
+			break
+		}
+	}
+
+	// Disabled rotation keeps the log as is.
+	require.Nil(t, logs.RotateFile("tag", "update", LogRolloutsFile, LogRetention{}))
+	require.Nil(t, logs.AppendFile("tag", "update", LogRolloutsFile, strings.Repeat("x", 2000)+"\n"))
+	// Lines appended without the index are counted too.
+	count, err = logs.CountFileLines("tag", "update", LogRolloutsFile)
+	require.Nil(t, err)
+	assert.Equal(t, lines+1, count)
+	require.Nil(t, logs.RotateFile("tag", "update", LogRolloutsFile, LogRetention{}))
+	assert.Len(t, rotatedLogs(), 2)
+}
+
+func TestRotateFileConcurrentAppends(t *testing.T) {
+	fs, err := NewFs(t.TempDir())
+	require.Nil(t, err)
+	logs := fs.Updates.Ci.Logs
+	retention := LogRetention{MaxSize: 500, MaxFiles: 1000}
+
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				assert.Nil(t, logs.AppendIndexedFile("tag", "update", LogRolloutsFile, fmt.Sprintf("line-%d-%03d\n", w, i)))
+				assert.Nil(t, logs.RotateFile("tag", "update", LogRolloutsFile, retention))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Each rotated log keeps the index of its own lines, so that readers seek to any line.
+	var read []string
+	for line, err := range logs.TailFileLinesFrom("tag", "update", LogRolloutsFile, 0, nil) {
+		require.Nil(t, err)
+		read = append(read, line)
+	}
+	require.Len(t, read, 400)
+	for skip := 0; skip < len(read); skip += 7 {
+		for line, err := range logs.TailFileLinesFrom("tag", "update", LogRolloutsFile, skip, nil) {
+			require.Nil(t, err)
+			assert.Equal(t, read[skip], line, skip)
+			break
+		}
+	}
+}
@@ -18,17 +18,25 @@ import (
 
 var ErrInvalidUpdate = errors.New("invalid update archive")
 
-type updatesFsHandleWrap struct {
+// UpdatesChannelFsHandle holds the updates of a single update channel, like "ci" or "prod".
+// Every channel serves updates to either production or CI devices.
+type UpdatesChannelFsHandle struct {
 	baseFsHandle
+	Name   string
+	IsProd bool
+
 	Apps     UpdatesFsHandle
 	Ostree   UpdatesFsHandle
 	Tuf      UpdatesFsHandle
 	Rollouts RolloutsFsHandle
 	Logs     UpdatesFsHandle
+	Settings UpdatesFsHandle
 }
 
-func (s *updatesFsHandleWrap) init(root string) {
+func (s *UpdatesChannelFsHandle) init(root, name string, isProd bool) {
 	s.root = root
+	s.Name = name
+	s.IsProd = isProd
 	s.Apps.root = root
 	s.Apps.category = UpdatesAppsDir
 	s.Ostree.root = root
@@ -39,6 +47,8 @@ func (s *updatesFsHandleWrap) init(root string) {
 	s.Tuf.category = UpdatesTufDir
 	s.Logs.root = root
 	s.Logs.category = UpdatesLogsDir
+	s.Settings.root = root
+	s.Settings.category = UpdatesSettingsDir
 }
 
 // checkUpdateTargets ensures that the update contains a valid targets.json file by looking for:
@@ -75,7 +85,7 @@ func checkUpdateTargets(targetsPath, tag string) error {
 	return fmt.Errorf("no target with tag '%s' found in targets.json", tag)
 }
 
-func (s updatesFsHandleWrap) SaveUpload(tag, update string, payload io.Reader, onCleanupFailure func(error)) error {
+func (s UpdatesChannelFsHandle) SaveUpload(tag, update string, payload io.Reader, onCleanupFailure func(error)) error {
 	const (
 		appsDir   = UpdatesAppsDir + string(filepath.Separator)
 		ostreeDir = UpdatesOstreeDir + string(filepath.Separator)
@@ -143,7 +153,7 @@ func (s UpdatesFsHandle) LatestRootMetaName(tag, update string) (string, error)
 	if err != nil {
 		return "", fmt.Errorf("error find latest root metadata: %w", err)
 	} else if len(files) == 0 {
-		return "", fmt.Errorf("no metadata files found for tag %s update %s", tag, update)
+		return "", fmt.Errorf("no metadata files found for tag %s update %s: %w", tag, update, os.ErrNotExist)
 	}
 	slices.SortFunc(files, func(a, b string) int {
 		aIsRoot := strings.HasSuffix(a, ".root.json")
@@ -164,9 +174,47 @@ func (s UpdatesFsHandle) LatestRootMetaName(tag, update string) (string, error)
 	return files[0], nil
 }
 
+// LatestRootName is LatestRootMetaName which fails with os.ErrNotExist, unless the update has root metadata.
+func (s UpdatesFsHandle) LatestRootName(tag, update string) (string, error) {
+	name, err := s.LatestRootMetaName(tag, update)
+	if err == nil && !strings.HasSuffix(name, "."+TufRootFile) {
+		err = fmt.Errorf("no root metadata found for tag %s update %s: %w", tag, update, os.ErrNotExist)
+	}
+	return name, err
+}
+
 func (s UpdatesFsHandle) TailFileLines(tag, update, name string, stop DoneChan) iter.Seq2[string, error] {
+	return s.TailFileLinesFrom(tag, update, name, 0, stop)
+}
+
+// TailFileLinesFrom is TailFileLines which skips a given number of lines first,
+// without reading them if the file was written with AppendIndexedFile.
+// Lines of a file rotated with RotateFile are read and numbered across rotations, see FirstFileLine.
+func (s UpdatesFsHandle) TailFileLinesFrom(tag, update, name string, skip int, stop DoneChan) iter.Seq2[string, error] {
 	h, _ := s.updateLocalHandle(tag, update, false)
-	return h.readFileLines(name, false, stop)
+	return h.readRotatedFileLines(name, skip, stop)
+}
+
+// FirstFileLine returns the number of the first line of a file rotated with RotateFile which is still kept,
+// that is, the number of lines removed by its retention.
+func (s UpdatesFsHandle) FirstFileLine(tag, update, name string) (int, error) {
+	h, _ := s.updateLocalHandle(tag, update, false)
+	line, err := h.firstRotatedFileLine(name)
+	if err != nil {
+		err = fmt.Errorf("error reading %s rotated files for tag %s update %s: %w", s.category, tag, update, err)
+	}
+	return line, err
+}
+
+// CountFileLines returns the number of lines of a file rotated with RotateFile, numbered across rotations.
+// Lines indexed by AppendIndexedFile are counted without reading them.
+func (s UpdatesFsHandle) CountFileLines(tag, update, name string) (int, error) {
+	h, _ := s.updateLocalHandle(tag, update, false)
+	count, err := h.countRotatedFileLines(name)
+	if err != nil {
+		err = fmt.Errorf("error counting %s file lines for tag %s update %s: %w", s.category, tag, update, err)
+	}
+	return count, err
 }
 
 func (s UpdatesFsHandle) WriteFile(tag, update, name, content string) error {
@@ -187,6 +235,26 @@ func (s UpdatesFsHandle) AppendFile(tag, update, name, content string) error {
 	return nil
 }
 
+// AppendIndexedFile is AppendFile which maintains a line index of the file, so that its lines can be read
+// starting at a given line without scanning the lines before it, see TailFileLinesFrom.
+func (s UpdatesFsHandle) AppendIndexedFile(tag, update, name, content string) error {
+	if h, err := s.updateLocalHandle(tag, update, true); err != nil {
+		return err
+	} else if err = h.appendIndexedFile(name, content); err != nil {
+		return fmt.Errorf("error appending %s file for tag %s update %s: %w", s.category, tag, update, err)
+	}
+	return nil
+}
+
+// RotateFile rotates a log file of the update once it exceeds the retention size, see LogRetention.
+func (s UpdatesFsHandle) RotateFile(tag, update, name string, retention LogRetention) error {
+	h, _ := s.updateLocalHandle(tag, update, false)
+	if err := h.rotateFile(name, retention); err != nil {
+		return fmt.Errorf("error rotating %s file for tag %s update %s: %w", s.category, tag, update, err)
+	}
+	return nil
+}
+
 func (s UpdatesFsHandle) updateLocalHandle(tag, update string, forUpdate bool) (h baseFsHandle, err error) {
 	h.root = filepath.Join(s.root, tag, update, s.category)
 	if forUpdate {
@@ -240,22 +308,57 @@ func (s RolloutsFsHandle) ListFiles(tag, update string) ([]string, error) {
 	return h.matchFiles("", true)
 }
 
+// ListFileInfos is ListFiles returning the file infos, for callers that need the modification times.
+func (s RolloutsFsHandle) ListFileInfos(tag, update string) ([]os.FileInfo, error) {
+	h, _ := s.updateLocalHandle(tag, update, false)
+	return h.matchFileInfos("", true)
+}
+
+// WithLock runs fn holding an exclusive lock of an update, if file locking is enabled, see SetFileLocking.
+// Changes of rollout files which read them first need it when several processes share the storage.
+func (s RolloutsFsHandle) WithLock(tag, update string, fn func() error) error {
+	h := baseFsHandle{root: filepath.Join(s.root, tag, update)}
+	if _, err := os.Stat(h.root); errors.Is(err, os.ErrNotExist) {
+		// An update which does not exist has no rollouts to change.
+		return fn()
+	}
+	return h.withLock(fn)
+}
+
 func (s RolloutsFsHandle) AppendJournal(content string) error {
 	return s.appendFile(rolloutJournalFile+partialFileSuffix, content, defaultFileAccess)
 }
 
-func (s RolloutsFsHandle) RolloverJournal() (err error) {
-	from := filepath.Join(s.root, rolloutJournalFile+partialFileSuffix)
-	to := filepath.Join(s.root, rolloutJournalFile)
-	if err = os.Rename(from, to); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			// No new writes into a journal since the last rollover - that's just fine.
-			err = nil
+// RolloverJournal replaces the journal with the entries appended since the last rollover.
+// Journal entries after the given number of processed ones were appended after the journal was processed,
+// by writers which opened the journal right before the last rollover: these are carried over to the new journal.
+func (s RolloutsFsHandle) RolloverJournal(processed int) error {
+	return s.withLock(func() (err error) {
+		var late strings.Builder
+		for line, err := range s.readFileLines(rolloutJournalFile, processed, true, nil) {
+			if err != nil {
+				return err
+			}
+			late.WriteString(line + "\n")
 		}
-	}
-	return
+		from := filepath.Join(s.root, rolloutJournalFile+partialFileSuffix)
+		to := filepath.Join(s.root, rolloutJournalFile)
+		if err = os.Rename(from, to); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// No new writes into a journal since the last rollover - that's just fine.
+				// Late entries, if any, stay in the journal, which is processed again.
+				err = nil
+			}
+			return
+		} else if late.Len() > 0 {
+			err = s.appendFileLocked(rolloutJournalFile, late.String(), defaultFileAccess)
+		}
+		return
+	})
 }
 
+// ReadJournal reads the journal as of the last rollover.
+// Entries appended since then are in the temporary part file of the journal, which is not read, see RolloverJournal.
 func (s RolloutsFsHandle) ReadJournal() iter.Seq2[string, error] {
-	return s.readFileLines(rolloutJournalFile, true, nil)
+	return s.readFileLines(rolloutJournalFile, 0, true, nil)
 }
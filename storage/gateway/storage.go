@@ -6,19 +6,30 @@ package gateway
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/foundriesio/dg-satellite/clock"
 	"github.com/foundriesio/dg-satellite/storage"
 )
 
 type (
 	// Convenience aliases for importing modules
-	DbHandle = storage.DbHandle
-	FsHandle = storage.FsHandle
-
-	AppsStates        = storage.AppsStates
-	DeviceUpdateEvent = storage.DeviceUpdateEvent
+	DbHandle     = storage.DbHandle
+	FsHandle     = storage.FsHandle
+	LogRetention = storage.LogRetention
+
+	AppsStates          = storage.AppsStates
+	DeviceInstallResult = storage.DeviceInstallResult
+	DeviceUpdateEvent   = storage.DeviceUpdateEvent
+	TufMetaUrls         = storage.TufMetaUrls
 )
 
 var (
@@ -27,6 +38,16 @@ var (
 
 	TestIdRegex        = storage.TestIdRegex
 	ValidCorrelationId = storage.ValidCorrelationId
+	ValidateLabels     = storage.ValidateLabels
+	IsStandardLabel    = storage.IsStandardLabel
+	NewTufMetaUrls     = storage.NewTufMetaUrls
+	SamePubKey         = storage.SamePubKey
+
+	IsDbError             = storage.IsDbError
+	ErrDbConstraintUnique = storage.ErrDbConstraintUnique
+	ErrRequiredLabel      = storage.ErrRequiredLabel
+
+	ErrDeviceQuota = errors.New("device quota exceeded")
 )
 
 const (
@@ -40,8 +61,9 @@ const (
 	HwInfoFile  = storage.HwInfoFile
 	NetInfoFile = storage.NetInfoFile
 
-	EventsPrefix = storage.EventsPrefix
-	StatesPrefix = storage.StatesPrefix
+	EventsPrefix        = storage.EventsPrefix
+	InstallResultPrefix = storage.InstallResultPrefix
+	StatesPrefix        = storage.StatesPrefix
 
 	// Per update files/dirs
 	TufRootFile      = storage.TufRootFile
@@ -50,16 +72,90 @@ const (
 	TufTargetsFile   = storage.TufTargetsFile
 )
 
+// EventInstallCompleted is the last event a device sends for an update, unless it resends some events later.
+const EventInstallCompleted = "EcuInstallationCompleted"
+
 type Storage struct {
 	db *DbHandle
 	fs *FsHandle
 
-	stmtDeviceCheckIn stmtDeviceCheckIn
-	stmtDeviceCreate  stmtDeviceCreate
-	stmtDeviceGet     stmtDeviceGet
+	stmtDeviceCheckIn      stmtDeviceCheckIn
+	stmtDeviceCreate       stmtDeviceCreate
+	stmtDeviceFirstSeen    stmtDeviceFirstSeen
+	stmtDeviceGet          stmtDeviceGet
+	stmtDeviceCertNotAfter stmtDeviceCertNotAfter
+	stmtDeviceEnroll       stmtDeviceEnroll
+	stmtDevicePatchLabels  stmtDevicePatchLabels
+
+	maxDevices     int
+	maxEvents      int
+	maxStates      int
+	maxStatesAge   time.Duration
+	compressStates bool
+	rolloutsLog    storage.LogRetention
+	requiredLabels []string
+}
+
+// Limits are the effective limits of the files a device gateway keeps for each device.
+type Limits struct {
+	MaxEvents         int    `json:"max-events"`
+	MaxAppsStates     int    `json:"max-apps-states"`
+	AppsStatesMaxAge  int64  `json:"apps-states-max-age"`
+	AppsStatesGzip    bool   `json:"apps-states-gzip"`
+	AppsStatesMaxSize string `json:"apps-states-max-size,omitempty"`
+	AppsMaxLength     int    `json:"apps-max-length,omitempty"`
+	MaxDevices        int    `json:"max-devices,omitempty"`
+}
+
+// Limits returns the effective storage limits, the maximum age of apps states is in seconds.
+// Request size limits are not known to the storage and left empty.
+func (s Storage) Limits() Limits {
+	return Limits{
+		MaxEvents:        s.maxEvents,
+		MaxAppsStates:    s.maxStates,
+		AppsStatesMaxAge: int64(s.maxStatesAge.Seconds()),
+		AppsStatesGzip:   s.compressStates,
+		MaxDevices:       s.maxDevices,
+	}
+}
+
+// SetMaxDevices caps how many devices, not counting deleted ones, the gateway creates.
+// Zero, the default, does not cap devices.
+func (s *Storage) SetMaxDevices(count int) {
+	s.maxDevices = count
+}
+
+// SetMaxEvents sets how many update events and install results files are kept for each device, 20 by default.
+func (s *Storage) SetMaxEvents(count int) {
+	s.maxEvents = count
+}
+
+// SetMaxStates sets how many apps states reports are kept for each device, storage.StatesMaxCount by default.
+func (s *Storage) SetMaxStates(count int) {
+	s.maxStates = count
+}
+
+// SetMaxStatesAge removes apps states reports older than a given age, in addition to keeping at most the maximum count of them.
+// Zero keeps reports regardless of their age.
+func (s *Storage) SetMaxStatesAge(age time.Duration) {
+	s.maxStatesAge = age
+}
+
+// SetRolloutsLogRetention rotates the rollouts log of an update once it grows too large.
+// By default, the log is never rotated.
+func (s *Storage) SetRolloutsLogRetention(retention storage.LogRetention) {
+	s.rolloutsLog = retention
+}
+
+// SetRequiredLabels sets the standard labels which devices may change but not delete once they have them,
+// see storage.ValidateRequiredLabels. By default, devices may delete any label.
+func (s *Storage) SetRequiredLabels(labels []string) {
+	s.requiredLabels = slices.Clone(labels)
+}
 
-	maxEvents int
-	maxStates int
+// SetCompressStates stores new apps states reports gzip compressed, older reports are still read as they are.
+func (s *Storage) SetCompressStates(compress bool) {
+	s.compressStates = compress
 }
 
 type Device struct {
@@ -68,6 +164,7 @@ type Device struct {
 	Uuid       string `json:"uuid"`
 	Apps       string `json:"docker_apps"`
 	Deleted    bool   `json:"-"`
+	FirstSeen  int64  `json:"first_seen"`
 	GroupName  string `json:"group_name"`
 	IsProd     bool   `json:"is_prod"`
 	LastSeen   int64  `json:"last_seen"`
@@ -76,23 +173,144 @@ type Device struct {
 	TargetName string `json:"target_name"`
 	Tag        string `json:"tag"`
 	UpdateName string `json:"update_name"`
+	// UpdateChannel is empty unless the device was assigned to an update by a rollout.
+	UpdateChannel string `json:"update_channel"`
+	// CertNotAfter is the expiry time of the last client certificate the device authenticated with.
+	CertNotAfter int64 `json:"-"`
 
 	groupNameModifiedAt int64
 }
 
 func (d *Device) CheckIn(targetName, tag, ostreeHash string, apps string) error {
-	now := time.Now().Unix()
-	if apps == d.Apps && ostreeHash == d.OstreeHash && tag == d.Tag && targetName == d.TargetName && now-d.LastSeen < 60 {
+	apps = normalizeApps(apps)
+	now := clock.Now().Unix()
+	changed := apps != d.Apps || ostreeHash != d.OstreeHash || tag != d.Tag || targetName != d.TargetName
+	if !changed && now-d.LastSeen < 60 {
 		// Skip database updating when all fields are the same and last checkin was less than a minute ago.
 		return nil
 	}
 	// Update in-memory device object fields to new actual values
+	prevLastSeen := d.LastSeen
 	d.Apps = apps
 	d.LastSeen = now
 	d.OstreeHash = ostreeHash
 	d.Tag = tag
 	d.TargetName = targetName
-	return d.storage.stmtDeviceCheckIn.run(d.Uuid, targetName, tag, ostreeHash, apps, now)
+	if err := d.storage.stmtDeviceCheckIn.run(d.Uuid, targetName, tag, ostreeHash, apps, now); err != nil {
+		return err
+	}
+	if changed {
+		d.storage.db.PublishDeviceChange(d.Uuid, storage.DeviceChangeCheckIn, now)
+	}
+	// The check-in is already stored, so a lost activity record must not fail it.
+	if err := d.recordActivity(prevLastSeen, now); err != nil {
+		slog.Error("Failed to record device check-in activity", "device", d.Uuid, "error", err)
+	}
+	return nil
+}
+
+// normalizeApps sorts a comma-separated apps list, so that devices reporting the same apps in another order
+// do not cause database updates. Whitespace around app names and empty names are dropped.
+func normalizeApps(apps string) string {
+	names := strings.Split(apps, ",")
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+	names = slices.DeleteFunc(names, func(name string) bool { return len(name) == 0 })
+	slices.Sort(names)
+	return strings.Join(names, ",")
+}
+
+// recordActivity appends a check-in time to the activity file of the current day.
+// Old activity files are removed when a new day starts.
+func (d *Device) recordActivity(prevLastSeen, now int64) error {
+	day := time.Unix(now, 0).UTC().Format(storage.ActivityDayFormat)
+	name := storage.ActivityPrefix + "-" + day
+	if err := d.storage.fs.Devices.AppendFile(d.Uuid, name, fmt.Sprintf("%d\n", now)); err != nil {
+		return err
+	}
+	if time.Unix(prevLastSeen, 0).UTC().Format(storage.ActivityDayFormat) != day {
+		return d.storage.fs.Devices.RolloverFiles(d.Uuid, storage.ActivityPrefix, storage.ActivityMaxDays, 0)
+	}
+	return nil
+}
+
+// MarkFirstSeen records the time of the first successful device authentication.
+// A device may be registered (created) long before it connects for the first time.
+func (d *Device) MarkFirstSeen() error {
+	if d.FirstSeen > 0 {
+		return nil
+	}
+	now := clock.Now().Unix()
+	if err := d.storage.stmtDeviceFirstSeen.run(d.Uuid, now); err != nil {
+		return err
+	}
+	d.FirstSeen = now
+	return nil
+}
+
+// Enroll records the public key of a device which key was reset, making it the only key accepted for this device.
+func (d *Device) Enroll(pubkey string) error {
+	if len(d.PubKey) > 0 {
+		return errors.New("device key must be reset before enrolling a new key")
+	}
+	if enrolled, err := d.storage.stmtDeviceEnroll.run(d.Uuid, pubkey); err != nil {
+		return err
+	} else if !enrolled {
+		return errors.New("device key was enrolled by a concurrent request")
+	}
+	d.PubKey = pubkey
+	return nil
+}
+
+// SetCertNotAfter records the expiry time of the device client certificate.
+func (d *Device) SetCertNotAfter(notAfter int64) error {
+	if d.CertNotAfter == notAfter {
+		return nil
+	}
+	if err := d.storage.stmtDeviceCertNotAfter.run(d.Uuid, notAfter); err != nil {
+		return err
+	}
+	d.CertNotAfter = notAfter
+	return nil
+}
+
+// PatchLabels applies a merge-patch of labels a device reports about itself, a nil value deletes a label.
+// The labels must be validated by the caller, see storage.ValidateLabels.
+// Devices may never delete a required label, see Storage.SetRequiredLabels.
+func (d *Device) PatchLabels(labels map[string]*string) error {
+	if deletes := storage.RequiredLabelDeletes(d.storage.requiredLabels, labels); len(deletes) > 0 {
+		return fmt.Errorf("%w: %s", ErrRequiredLabel, strings.Join(deletes, ", "))
+	}
+	if changed, err := d.storage.stmtDevicePatchLabels.run(d.Uuid, labels); err != nil {
+		return err
+	} else if changed {
+		d.storage.db.PublishDeviceChange(d.Uuid, storage.DeviceChangeLabels, clock.Now().Unix())
+	}
+	if group, ok := labels["group"]; ok {
+		// The group_name column is generated from the "group" label, keep the loaded device in sync with it.
+		groupName := ""
+		if group != nil {
+			groupName = *group
+		}
+		if groupName != d.GroupName {
+			d.GroupName = groupName
+			d.storage.db.PublishDeviceChange(d.Uuid, storage.DeviceChangeGroup, clock.Now().Unix())
+		}
+	}
+	return nil
+}
+
+// SaveCertificate stores the PEM encoded client certificate of a device along with its expiry time,
+// unless a certificate with the same expiry time is already recorded, see SetCertNotAfter.
+func (d *Device) SaveCertificate(certPem string, notAfter int64) error {
+	if d.CertNotAfter == notAfter {
+		return nil
+	}
+	if err := d.storage.fs.Devices.WriteFile(d.Uuid, storage.CertFile, certPem); err != nil {
+		return err
+	}
+	return d.SetCertNotAfter(notAfter)
 }
 
 func (d *Device) PutFile(name string, content string) error {
@@ -100,74 +318,224 @@ func (d *Device) PutFile(name string, content string) error {
 }
 
 func (d Device) ProcessEvents(events []storage.DeviceUpdateEvent) error {
-	var corrId string
+	var (
+		corrId, prevName string
+		seq              int
+		last             *storage.DeviceUpdateEvent
+	)
 	for _, evt := range events {
-		if corrId != "" && corrId != evt.Event.CorrelationId {
+		if corrId != evt.Event.CorrelationId {
+			corrId = evt.Event.CorrelationId
+			var err error
+			if seq, last, err = d.lastEventsFile(corrId); err != nil {
+				return err
+			}
+		}
+		if last != nil && len(last.Event.TargetName) > 0 && len(evt.Event.TargetName) > 0 &&
+			last.Event.TargetName != evt.Event.TargetName {
+			// The device reused a correlation id for another target, whether or not it completed the previous one.
+			// Start a separate history for it. Events of the previous target which arrive after that,
+			// e.g. when a device resends them, start yet another history, as events only go to the latest one.
+			seq++
+		}
+		last = &evt
+		name := eventsFileName(corrId, seq)
+		if prevName != "" && prevName != name {
 			// Events ordering depends onto ModTime.
 			// Make sure that a later events file gets a later ModTime.
 			// Tests show that filesystem's time precision is good enough for 4 milliseconds delay.
 			time.Sleep(4 * time.Millisecond)
 		}
-		corrId = evt.Event.CorrelationId
-		name := fmt.Sprintf("%s-%s", storage.EventsPrefix, corrId)
+		prevName = name
 		bytes, err := json.Marshal(evt)
 		if err != nil {
 			return err
 		}
-		if err := d.storage.fs.Devices.AppendFile(d.Uuid, name, string(bytes)+"\n"); err != nil {
+		if err := d.storage.fs.Devices.AppendIndexedFile(d.Uuid, name, string(bytes)+"\n"); err != nil {
 			return err
 		}
 		if status := evt.ParseStatus(); len(d.UpdateName) > 0 && len(d.Tag) > 0 {
 			status.Uuid = d.Uuid
-			bytes, err = json.Marshal(status)
-			if err != nil {
-				return err
-			}
-			fs := d.storage.fs.Updates.Ci.Logs
-			if d.IsProd {
-				fs = d.storage.fs.Updates.Prod.Logs
-			}
-			if err = fs.AppendFile(d.Tag, d.UpdateName, storage.LogRolloutsFile, string(bytes)+"\n"); err != nil {
+			if err = d.appendRolloutsLog(status); err != nil {
 				return err
 			}
 		}
 	}
-	return d.storage.fs.Devices.RolloverFiles(d.Uuid, storage.EventsPrefix, d.storage.maxEvents)
+	return d.storage.fs.Devices.RolloverFiles(d.Uuid, storage.EventsPrefix, d.storage.maxEvents, 0)
 }
 
+// eventsFileName is "events-<correlation id>" for the first update with a correlation id,
+// and "events-<correlation id>.<seq>" for the later updates which reused it.
+func eventsFileName(corrId string, seq int) string {
+	if seq <= 1 {
+		return fmt.Sprintf("%s-%s", storage.EventsPrefix, corrId)
+	}
+	return fmt.Sprintf("%s-%s.%d", storage.EventsPrefix, corrId, seq)
+}
+
+// lastEventsFile returns the sequence number of the latest events file of a correlation id, and its last event.
+func (d Device) lastEventsFile(corrId string) (seq int, last *storage.DeviceUpdateEvent, err error) {
+	prefix := eventsFileName(corrId, 1) + "."
+	names, err := d.storage.fs.Devices.ListFiles(d.Uuid, prefix, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	seq = 1
+	for _, name := range names {
+		if n, err := strconv.Atoi(name[len(prefix):]); err == nil && n > seq {
+			seq = n
+		}
+	}
+	line, err := d.storage.fs.Devices.ReadLastLine(d.Uuid, eventsFileName(corrId, seq))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(line) > 0 {
+		var evt storage.DeviceUpdateEvent
+		if err = json.Unmarshal([]byte(line), &evt); err == nil {
+			last = &evt
+		}
+	}
+	return seq, last, nil
+}
+
+// SaveInstallResult stores the final outcome of an update, and logs it to the rollout progress of the device update.
+func (d Device) SaveInstallResult(res DeviceInstallResult) error {
+	bytes, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s", storage.InstallResultPrefix, res.CorrelationId)
+	if err := d.storage.fs.Devices.WriteFile(d.Uuid, name, string(bytes)); err != nil {
+		return err
+	}
+	if len(d.UpdateName) > 0 && len(d.Tag) > 0 {
+		status := storage.DeviceStatus{
+			Uuid:          d.Uuid,
+			CorrelationId: res.CorrelationId,
+			Status:        storage.StatusUpdateSucceeded,
+			DeviceTime:    res.DeviceTime,
+			Reason:        res.Reason,
+		}
+		if !res.Success {
+			status.Status = storage.StatusUpdateFailed
+		}
+		if err = d.appendRolloutsLog(status); err != nil {
+			return err
+		}
+	}
+	return d.storage.fs.Devices.RolloverFiles(d.Uuid, storage.InstallResultPrefix, d.storage.maxEvents, 0)
+}
+
+// appendRolloutsLog logs the status to the rollout progress of the device update, rotating the log when it grows too large.
+func (d Device) appendRolloutsLog(status storage.DeviceStatus) error {
+	bytes, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	fs := d.updatesFsHandle().Logs
+	if err = fs.AppendIndexedFile(d.Tag, d.UpdateName, storage.LogRolloutsFile, string(bytes)+"\n"); err != nil {
+		return err
+	}
+	return fs.RotateFile(d.Tag, d.UpdateName, storage.LogRolloutsFile, d.storage.rolloutsLog)
+}
+
+// statesSeq tells apart apps states reports saved within the same millisecond.
+var statesSeq atomic.Uint32
+
 func (d Device) SaveAppsStates(content string) error {
-	// Apps states ordering depends onto ModTime.
-	// Make sure that a later events file gets a later ModTime.
-	time.Sleep(4 * time.Millisecond)
-	name := fmt.Sprintf("%s-%d", storage.StatesPrefix, time.Now().UnixMilli())
-	if err := d.storage.fs.Devices.WriteFile(d.Uuid, name, content); err != nil {
+	// Apps states are ordered by ModTime, and by name when ModTimes are equal.
+	// The sequence suffix makes names of reports saved within the same millisecond unique and ordered.
+	name := fmt.Sprintf("%s-%d-%05d", storage.StatesPrefix, clock.Now().UnixMilli(), statesSeq.Add(1)%100000)
+	write := d.storage.fs.Devices.WriteFile
+	if d.storage.compressStates {
+		write = d.storage.fs.Devices.WriteCompressedFile
+	}
+	if err := write(d.Uuid, name, content); err != nil {
 		return err
 	}
-	return d.storage.fs.Devices.RolloverFiles(d.Uuid, storage.StatesPrefix, d.storage.maxStates)
+	return d.storage.fs.Devices.RolloverFiles(d.Uuid, storage.StatesPrefix, d.storage.maxStates, d.storage.maxStatesAge)
 }
 
 func (d Device) GetAppsFilePath(file string) string {
-	if d.IsProd {
-		return d.storage.fs.Updates.Prod.Apps.FilePath(d.Tag, d.UpdateName, file)
-	} else {
-		return d.storage.fs.Updates.Ci.Apps.FilePath(d.Tag, d.UpdateName, file)
-	}
+	return d.updatesFsHandle().Apps.FilePath(d.Tag, d.UpdateName, file)
 }
 
 func (d Device) GetOstreeFilePath(file string) string {
-	if d.IsProd {
-		return d.storage.fs.Updates.Prod.Ostree.FilePath(d.Tag, d.UpdateName, file)
-	} else {
-		return d.storage.fs.Updates.Ci.Ostree.FilePath(d.Tag, d.UpdateName, file)
-	}
+	return d.updatesFsHandle().Ostree.FilePath(d.Tag, d.UpdateName, file)
 }
 
 func (d Device) GetTufMeta(tag, file string) (string, error) {
-	if d.IsProd {
-		return d.storage.fs.Updates.Prod.Tuf.ReadFile(tag, d.UpdateName, file)
-	} else {
-		return d.storage.fs.Updates.Ci.Tuf.ReadFile(tag, d.UpdateName, file)
+	return d.updatesFsHandle().Tuf.ReadFile(tag, d.UpdateName, file)
+}
+
+// MaxConcurrentInstalls returns how many devices may install the device's update at the same time.
+// Zero means there is no limit.
+func (d Device) MaxConcurrentInstalls(tag string) (int, error) {
+	content, err := d.updatesFsHandle().Settings.ReadFile(tag, d.UpdateName, storage.SettingsMaxInstallsFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(content))
+}
+
+// InstallPending tells if the device has yet to install the latest target of its update for a tag:
+// it neither runs that target, nor reported installing it in its last update events.
+// A device reports an install completed before it reboots into the target, and checks in with it.
+func (d Device) InstallPending(tag string) (bool, error) {
+	content, err := d.GetTufMeta(tag, storage.TufTargetsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	desired, err := storage.LatestTarget(content, tag, d.TargetName)
+	if err != nil || desired == nil || desired.Target == d.TargetName {
+		return false, err
+	}
+	names, err := d.storage.fs.Devices.ListFiles(d.Uuid, storage.EventsPrefix, true)
+	if err != nil || len(names) == 0 {
+		return err == nil, err
+	}
+	line, err := d.storage.fs.Devices.ReadLastLine(d.Uuid, names[len(names)-1])
+	if err != nil {
+		return false, err
+	}
+	var last storage.DeviceUpdateEvent
+	if err = json.Unmarshal([]byte(line), &last); err != nil {
+		// A malformed event tells nothing about the install.
+		return true, nil
+	}
+	installed := last.EventType.Id == EventInstallCompleted && last.Event.TargetName == desired.Target &&
+		(last.Event.Success == nil || *last.Event.Success)
+	return !installed, nil
+}
+
+// GetTufRootName returns the file name of the latest TUF root metadata of the device's update, e.g. "3.root.json".
+func (d Device) GetTufRootName(tag string) (string, error) {
+	return d.updatesFsHandle().Tuf.LatestRootName(tag, d.UpdateName)
+}
+
+// UpdatesChannel returns the name of the update channel the device's update is served from.
+func (d Device) UpdatesChannel() string {
+	return d.updatesFsHandle().Name
+}
+
+// UpdateKey identifies the device's update across all update channels.
+func (d Device) UpdateKey(tag string) string {
+	return d.updatesFsHandle().Name + "/" + tag + "/" + d.UpdateName
+}
+
+// updatesFsHandle returns the update channel a device's update is served from.
+func (d Device) updatesFsHandle() storage.UpdatesChannelFsHandle {
+	if h, ok := d.storage.fs.Updates.Channel(d.UpdateChannel); ok && h.IsProd == d.IsProd {
+		return h
 	}
+	// Either no channel was set, or it was removed from the server configuration.
+	return d.storage.fs.Updates.ForDevice(d.IsProd)
 }
 
 func (d Device) GetConfigs() (configs [3]string, timestamp int64, err error) {
@@ -199,12 +567,16 @@ func NewStorage(db *storage.DbHandle, fs *storage.FsHandle) (*Storage, error) {
 		db:        db,
 		fs:        fs,
 		maxEvents: 20,
-		maxStates: 10,
+		maxStates: storage.StatesMaxCount,
 	}
 
 	if err := db.InitStmt(
 		&handle.stmtDeviceCheckIn,
 		&handle.stmtDeviceCreate,
+		&handle.stmtDeviceFirstSeen,
+		&handle.stmtDeviceCertNotAfter,
+		&handle.stmtDeviceEnroll,
+		&handle.stmtDevicePatchLabels,
 		&handle.stmtDeviceGet,
 	); err != nil {
 		return nil, err
@@ -213,10 +585,13 @@ func NewStorage(db *storage.DbHandle, fs *storage.FsHandle) (*Storage, error) {
 	return &handle, nil
 }
 
+// DeviceCreate returns ErrDeviceQuota if the maximum number of devices is reached, see SetMaxDevices.
 func (s Storage) DeviceCreate(uuid, pubkey string, isProd bool) (*Device, error) {
-	now := time.Now().Unix()
-	if err := s.stmtDeviceCreate.run(uuid, pubkey, now, now, isProd); err != nil {
+	now := clock.Now().Unix()
+	if created, err := s.stmtDeviceCreate.run(uuid, pubkey, now, now, isProd, s.maxDevices); err != nil {
 		return nil, err
+	} else if !created {
+		return nil, ErrDeviceQuota
 	}
 
 	d := Device{
@@ -262,14 +637,35 @@ type stmtDeviceCreate storage.DbStmt
 
 func (s *stmtDeviceCreate) Init(db storage.DbHandle) (err error) {
 	s.Stmt, err = db.Prepare("DeviceCreate", `
-		INSERT INTO devices(uuid, pubkey, created_at, last_seen, is_prod, deleted)
-		VALUES (?, ?, ?, ?, ?, false)`,
+		INSERT INTO devices(uuid, pubkey, pubkey_fingerprint, created_at, last_seen, is_prod, deleted)
+		SELECT ?, ?, ?, ?, ?, ?, false
+		WHERE ? <= 0 OR (SELECT COUNT(*) FROM devices WHERE deleted = false) < ?`,
+	)
+	return
+}
+
+// run checks the quota in the same statement as it inserts the device, so that concurrent requests cannot exceed it.
+func (s *stmtDeviceCreate) run(uuid, pubkey string, createdAt, lastSeen int64, isProd bool, maxDevices int) (bool, error) {
+	fingerprint := storage.PubKeyFingerprint(pubkey)
+	res, err := s.Stmt.Exec(uuid, pubkey, fingerprint, createdAt, lastSeen, isProd, maxDevices, maxDevices)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+type stmtDeviceFirstSeen storage.DbStmt
+
+func (s *stmtDeviceFirstSeen) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("DeviceFirstSeen", `
+		UPDATE devices SET first_seen=? WHERE uuid = ? AND first_seen = 0`,
 	)
 	return
 }
 
-func (s *stmtDeviceCreate) run(uuid, pubkey string, createdAt, lastSeen int64, isProd bool) error {
-	_, err := s.Stmt.Exec(uuid, pubkey, createdAt, lastSeen, isProd)
+func (s *stmtDeviceFirstSeen) run(uuid string, firstSeen int64) error {
+	_, err := s.Stmt.Exec(firstSeen, uuid)
 	return err
 }
 
@@ -278,8 +674,8 @@ type stmtDeviceGet storage.DbStmt
 func (s *stmtDeviceGet) Init(db storage.DbHandle) (err error) {
 	s.Stmt, err = db.Prepare("DeviceGet", `
 		SELECT
-			deleted, pubkey, group_name, update_name, last_seen, is_prod, tag, target_name,
-			ostree_hash, apps, group_name_modified_at
+			deleted, pubkey, group_name, update_name, update_channel, first_seen, last_seen, is_prod, tag, target_name,
+			ostree_hash, apps, cert_not_after, group_name_modified_at
 		FROM devices
 		WHERE uuid = ?`,
 	)
@@ -288,6 +684,61 @@ func (s *stmtDeviceGet) Init(db storage.DbHandle) (err error) {
 
 func (s *stmtDeviceGet) run(uuid string, d *Device) error {
 	return s.Stmt.QueryRow(uuid).Scan(
-		&d.Deleted, &d.PubKey, &d.GroupName, &d.UpdateName, &d.LastSeen, &d.IsProd, &d.Tag, &d.TargetName,
-		&d.OstreeHash, &d.Apps, &d.groupNameModifiedAt)
+		&d.Deleted, &d.PubKey, &d.GroupName, &d.UpdateName, &d.UpdateChannel, &d.FirstSeen, &d.LastSeen, &d.IsProd, &d.Tag, &d.TargetName,
+		&d.OstreeHash, &d.Apps, &d.CertNotAfter, &d.groupNameModifiedAt)
+}
+
+type stmtDevicePatchLabels storage.DbStmt
+
+func (s *stmtDevicePatchLabels) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("DevicePatchLabels", `
+		UPDATE devices SET labels=jsonb_patch(labels, ?1)
+		WHERE uuid = ?2 AND labels != jsonb_patch(labels, ?1)`,
+	)
+	return
+}
+
+func (s *stmtDevicePatchLabels) run(uuid string, labels map[string]*string) (changed bool, err error) {
+	labelsStr, err := json.Marshal(labels)
+	if err != nil {
+		return false, fmt.Errorf("unexpected error marshalling labels to JSON: %w", err)
+	}
+	res, err := s.Stmt.Exec(labelsStr, uuid)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows > 0, err
+}
+
+type stmtDeviceCertNotAfter storage.DbStmt
+
+func (s *stmtDeviceCertNotAfter) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("DeviceCertNotAfter", `
+		UPDATE devices SET cert_not_after=? WHERE uuid = ?`,
+	)
+	return
+}
+
+func (s *stmtDeviceCertNotAfter) run(uuid string, notAfter int64) error {
+	_, err := s.Stmt.Exec(notAfter, uuid)
+	return err
+}
+
+type stmtDeviceEnroll storage.DbStmt
+
+func (s *stmtDeviceEnroll) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("DeviceEnroll", `
+		UPDATE devices SET pubkey=?, pubkey_fingerprint=? WHERE uuid = ? AND pubkey = ""`,
+	)
+	return
+}
+
+func (s *stmtDeviceEnroll) run(uuid, pubkey string) (bool, error) {
+	res, err := s.Stmt.Exec(pubkey, storage.PubKeyFingerprint(pubkey), uuid)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows > 0, err
 }
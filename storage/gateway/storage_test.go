@@ -9,11 +9,13 @@ import (
 	"fmt"
 	"io"
 	mrand "math/rand"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/foundriesio/dg-satellite/clock"
 	"github.com/foundriesio/dg-satellite/storage"
 	"github.com/foundriesio/dg-satellite/storage/api"
 	"github.com/google/uuid"
@@ -368,3 +370,161 @@ func Test_Fiotest(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, "artifact content", string(content))
 }
+
+func TestCheckInEvents(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		require.Nil(t, db.Close())
+	})
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	s, err := NewStorage(db, fs)
+	require.Nil(t, err)
+
+	now := time.Now()
+	defer func() { clock.Now = time.Now }()
+	clock.Now = func() time.Time { return now }
+
+	events, cancel := db.SubscribeDeviceChanges("dev1", 1)
+	d, err := s.DeviceCreate("dev1", "pubkey", false)
+	require.Nil(t, err)
+	noEvent := func() {
+		select {
+		case evt := <-events:
+			t.Fatalf("Unexpected device change: %v", evt)
+		default:
+		}
+	}
+
+	require.Nil(t, d.CheckIn("target-1", "main", "hash-1", "app1"))
+	evt := <-events
+	require.Equal(t, storage.DeviceChange{Uuid: "dev1", Kind: storage.DeviceChangeCheckIn, Time: now.Unix()}, evt)
+
+	// Unchanged fields do not emit events, even when the last seen time is updated.
+	require.Nil(t, d.CheckIn("target-1", "main", "hash-1", "app1"))
+	noEvent()
+	clock.Now = func() time.Time { return now.Add(2 * time.Minute) }
+	require.Nil(t, d.CheckIn("target-1", "main", "hash-1", "app1"))
+	noEvent()
+
+	// A slow subscriber never blocks a check-in, it loses events instead.
+	clock.Now = func() time.Time { return now.Add(3 * time.Minute) }
+	require.Nil(t, d.CheckIn("target-2", "main", "hash-2", "app1"))
+	clock.Now = func() time.Time { return now.Add(4 * time.Minute) }
+	require.Nil(t, d.CheckIn("target-2", "main", "hash-2", "app2"))
+	evt = <-events
+	require.Equal(t, now.Add(3*time.Minute).Unix(), evt.Time)
+	noEvent()
+
+	cancel()
+	require.Nil(t, d.CheckIn("target-3", "main", "hash-3", "app2"))
+	_, ok := <-events
+	require.False(t, ok)
+}
+
+func TestCheckInActivityFailure(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		require.Nil(t, db.Close())
+	})
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	s, err := NewStorage(db, fs)
+	require.Nil(t, err)
+
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	defer func() { clock.Now = time.Now }()
+	clock.Now = func() time.Time { return now }
+	d, err := s.DeviceCreate("dev1", "pubkey", false)
+	require.Nil(t, err)
+
+	// The check-in is stored even though its activity cannot be recorded, e.g. on a full disk.
+	require.Nil(t, os.MkdirAll(filepath.Join(fs.Config.DevicesDir(), "dev1", storage.ActivityPrefix+"-20260101"), 0o700))
+	require.Nil(t, d.CheckIn("target-1", "main", "hash-1", ""))
+	d, err = s.DeviceGet("dev1")
+	require.Nil(t, err)
+	require.Equal(t, now.Unix(), d.LastSeen)
+	require.Equal(t, "target-1", d.TargetName)
+}
+
+func TestCheckInAppsOrder(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		require.Nil(t, db.Close())
+	})
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	s, err := NewStorage(db, fs)
+	require.Nil(t, err)
+
+	now := time.Now()
+	defer func() { clock.Now = time.Now }()
+	clock.Now = func() time.Time { return now }
+
+	d, err := s.DeviceCreate("dev1", "pubkey", false)
+	require.Nil(t, err)
+	require.Nil(t, d.CheckIn("target-1", "main", "hash-1", "shellhttpd, fiotest,,app-a"))
+	require.Equal(t, "app-a,fiotest,shellhttpd", d.Apps)
+
+	// The same apps in another order do not update the database within a minute of the last check-in.
+	clock.Now = func() time.Time { return now.Add(30 * time.Second) }
+	require.Nil(t, d.CheckIn("target-1", "main", "hash-1", "fiotest,app-a,shellhttpd"))
+	d, err = s.DeviceGet("dev1")
+	require.Nil(t, err)
+	require.Equal(t, now.Unix(), d.LastSeen)
+	require.Equal(t, "app-a,fiotest,shellhttpd", d.Apps)
+
+	// Another set of apps does.
+	require.Nil(t, d.CheckIn("target-1", "main", "hash-1", "fiotest,shellhttpd"))
+	d, err = s.DeviceGet("dev1")
+	require.Nil(t, err)
+	require.Equal(t, now.Add(30*time.Second).Unix(), d.LastSeen)
+	require.Equal(t, "fiotest,shellhttpd", d.Apps)
+}
+
+func TestAppsStatesSameMillisecond(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		require.Nil(t, db.Close())
+	})
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	s, err := NewStorage(db, fs)
+	require.Nil(t, err)
+
+	now := time.Now()
+	defer func() { clock.Now = time.Now }()
+	clock.Now = func() time.Time { return now }
+
+	d, err := s.DeviceCreate("dev1", "pubkey", false)
+	require.Nil(t, err)
+	require.Nil(t, d.SaveAppsStates(`{"deviceTime":"1"}`))
+	require.Nil(t, d.SaveAppsStates(`{"deviceTime":"2"}`))
+
+	names, err := fs.Devices.ListFiles("dev1", storage.StatesPrefix, true)
+	require.Nil(t, err)
+	require.Len(t, names, 2)
+	// Even when the file system reports the same modification time.
+	for _, name := range names {
+		require.Nil(t, os.Chtimes(filepath.Join(tmpdir, "devices", "dev1", name), now, now))
+	}
+
+	a, err := api.NewStorage(db, fs)
+	require.Nil(t, err)
+	ad, err := a.DeviceGet("dev1")
+	require.Nil(t, err)
+	states, err := ad.AppsStates()
+	require.Nil(t, err)
+	require.Len(t, states, 2)
+	// Newest first
+	require.Equal(t, "2", states[0].DeviceTime)
+	require.Equal(t, "1", states[1].DeviceTime)
+}
@@ -4,7 +4,16 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"regexp"
+	"slices"
+	"strconv"
 )
 
 // DeviceUpdateEvent represents update events that devices send the
@@ -18,6 +27,173 @@ type DeviceUpdateEvent struct {
 
 var ValidCorrelationId = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`).MatchString
 
+// ValidUpdateId matches ids of device update histories: a correlation id, followed by a sequence number
+// when a device reused the correlation id for a later update.
+var ValidUpdateId = regexp.MustCompile(`^[a-zA-Z0-9_\-]+(\.[0-9]+)?$`).MatchString
+
+const (
+	// Together with a 2048 limit on total labels JSONB size,
+	// these constraints allow at least 24 labels per device (realistic limit is around 60-70).
+	maxLabelName  = 20
+	maxLabelValue = 60
+	// Label names are lowercase only; label values are case-sensitive.
+	validLabelNameRegex  = `^[a-z0-9_\-\.]+$`
+	validLabelValueRegex = `^[a-zA-Z0-9_\-\.]+$`
+)
+
+var (
+	validateLabelName  = regexp.MustCompile(validLabelNameRegex).MatchString
+	validateLabelValue = regexp.MustCompile(validLabelValueRegex).MatchString
+)
+
+// TufMetaUrls are where devices fetch the TUF metadata of their update from the device gateway.
+type TufMetaUrls struct {
+	Root      string `json:"root"`
+	Timestamp string `json:"timestamp"`
+	Snapshot  string `json:"snapshot"`
+	Targets   string `json:"targets"`
+}
+
+// NewTufMetaUrls returns TUF metadata URLs under a device gateway URL, an empty gatewayUrl makes these relative to it.
+// The root is the file name of the latest root metadata, see UpdatesFsHandle.LatestRootName.
+func NewTufMetaUrls(gatewayUrl, root string) TufMetaUrls {
+	repo := gatewayUrl + "/repo/"
+	return TufMetaUrls{
+		Root:      repo + root,
+		Timestamp: repo + TufTimestampFile,
+		Snapshot:  repo + TufSnapshotFile,
+		Targets:   repo + TufTargetsFile,
+	}
+}
+
+// DesiredTarget is the latest target of an update for a device tag.
+type DesiredTarget struct {
+	Target     string            `json:"target"`
+	Version    string            `json:"version"`
+	OstreeHash string            `json:"ostree-hash"`
+	Apps       map[string]string `json:"apps"` // App name -> URI
+}
+
+// LatestTarget returns the target with the highest version among the targets of a tag in targets.json.
+// When the running target of a device is among them, only targets for its hardware IDs are considered.
+func LatestTarget(targetsJson, tag, running string) (*DesiredTarget, error) {
+	var targets struct {
+		Signed struct {
+			Targets map[string]struct {
+				Hashes struct {
+					Sha256 string `json:"sha256"`
+				} `json:"hashes"`
+				Custom struct {
+					HardwareIds []string `json:"hardwareIds"`
+					Tags        []string `json:"tags"`
+					Version     string   `json:"version"`
+					Apps        map[string]struct {
+						Uri string `json:"uri"`
+					} `json:"docker_compose_apps"`
+				} `json:"custom"`
+			} `json:"targets"`
+		} `json:"signed"`
+	}
+	if err := json.Unmarshal([]byte(targetsJson), &targets); err != nil {
+		return nil, fmt.Errorf("failed to parse targets.json: %w", err)
+	}
+	var (
+		res           *DesiredTarget
+		latestVersion = -1
+		hardwareIds   = targets.Signed.Targets[running].Custom.HardwareIds
+	)
+	for name, t := range targets.Signed.Targets {
+		version, err := strconv.Atoi(t.Custom.Version)
+		if err != nil || !slices.Contains(t.Custom.Tags, tag) || version < latestVersion {
+			continue
+		} else if len(hardwareIds) > 0 && !slices.ContainsFunc(t.Custom.HardwareIds, func(id string) bool {
+			return slices.Contains(hardwareIds, id)
+		}) {
+			continue
+		} else if res != nil && version == latestVersion && name < res.Target {
+			// Make the choice among targets of the same version stable.
+			continue
+		}
+		latestVersion = version
+		res = &DesiredTarget{Target: name, Version: t.Custom.Version, OstreeHash: t.Hashes.Sha256, Apps: map[string]string{}}
+		for app, v := range t.Custom.Apps {
+			res.Apps[app] = v.Uri
+		}
+	}
+	return res, nil
+}
+
+// StandardLabels are device labels which all clients know, these can only be changed through the API.
+var StandardLabels = []string{"name", "group"}
+
+// IsStandardLabel tells if a label is one of StandardLabels.
+func IsStandardLabel(label string) bool {
+	return slices.Contains(StandardLabels, label)
+}
+
+// ErrRequiredLabel is returned when a label change would delete a label which devices must keep.
+var ErrRequiredLabel = errors.New("required label cannot be deleted")
+
+// ValidateRequiredLabels checks that labels which may be changed but not deleted once a device has them
+// are all standard labels, see the SetRequiredLabels of the API and the device gateway storage.
+func ValidateRequiredLabels(labels []string) error {
+	for _, label := range labels {
+		if !IsStandardLabel(label) {
+			return fmt.Errorf("only standard labels may be required: %s", label)
+		}
+	}
+	return nil
+}
+
+// RequiredLabelDeletes returns those of the required labels which a merge-patch of labels deletes.
+func RequiredLabelDeletes(required []string, labels map[string]*string) (deletes []string) {
+	for label, value := range labels {
+		if value == nil && slices.Contains(required, label) {
+			deletes = append(deletes, label)
+		}
+	}
+	slices.Sort(deletes)
+	return
+}
+
+// ValidateLabels checks names and values of device labels, a nil value deletes a label.
+func ValidateLabels(labels map[string]*string) error {
+	for k, v := range labels {
+		switch {
+		case len(k) > maxLabelName:
+			return fmt.Errorf("label %s exceeds maximum label name limit %d", k, maxLabelName)
+		case v != nil && len(*v) > maxLabelValue:
+			return fmt.Errorf("label %s exceeds maximum label value limit %d", k, maxLabelValue)
+		case !validateLabelName(k):
+			return fmt.Errorf("label %s name must match a given regexp: %s", k, validLabelNameRegex)
+		case v != nil && !validateLabelValue(*v):
+			return fmt.Errorf("label %s value must match a given regexp: %s", k, validLabelValueRegex)
+		}
+	}
+	return nil
+}
+
+// PubKeyFingerprint returns a hex encoded SHA-256 of the DER bytes of a PEM encoded public key.
+// If the value is not a valid PEM, the hash of the raw value is returned instead.
+func PubKeyFingerprint(pubkey string) string {
+	sum := sha256.Sum256(pubKeyDer(pubkey))
+	return hex.EncodeToString(sum[:])
+}
+
+// SamePubKey compares PEM encoded public keys by their DER bytes, so that keys which only differ
+// in whitespace or line endings of their PEM encoding are the same. Values which are not a valid PEM are compared as is.
+func SamePubKey(a, b string) bool {
+	return bytes.Equal(pubKeyDer(a), pubKeyDer(b))
+}
+
+func pubKeyDer(pubkey string) []byte {
+	data := []byte(pubkey)
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes
+	}
+	return data
+}
+
 type DeviceEvent struct {
 	CorrelationId string `json:"correlationId"`
 	Ecu           string `json:"ecu"`
@@ -38,8 +214,29 @@ type DeviceStatus struct {
 	TargetName    string `json:"target-name"`
 	Status        string `json:"status"`
 	DeviceTime    string `json:"deviceTime"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// DeviceInstallResult is the final outcome of an update reported by a device,
+// with a reason explaining a failure or a rollback.
+type DeviceInstallResult struct {
+	CorrelationId string `json:"correlationId"`
+	Success       bool   `json:"success"`
+	Reason        string `json:"reason,omitempty"`
+	DeviceTime    string `json:"deviceTime"`
 }
 
+// Statuses of the final outcome of a device update, as logged to the rollouts log, see DeviceStatus.
+const (
+	StatusUpdateSucceeded       = "Update succeeded"
+	StatusUpdateFailed          = "Update failed"
+	StatusInstallationSucceeded = "Installation completed" + statusSucceeded
+	StatusInstallationFailed    = "Installation completed" + statusFailed
+
+	statusSucceeded = "; succeeded"
+	statusFailed    = "; failed"
+)
+
 var evtIdToStatus = map[string]string{
 	"MetadataUpdateCompleted":  "Metadata update completed",
 	"EcuDownloadStarted":       "Download started",
@@ -66,9 +263,9 @@ func (e DeviceUpdateEvent) ParseStatus() DeviceStatus {
 	case "EcuDownloadCompleted", "EcuInstallationCompleted", "CertRotationCompleted", "MetadataUpdateCompleted":
 		if e.Event.Success != nil {
 			if !*e.Event.Success {
-				status += "; failed"
+				status += statusFailed
 			} else {
-				status += "; succeeded"
+				status += statusSucceeded
 			}
 		} else {
 			status += "; unknown result"
@@ -0,0 +1,62 @@
+// Copyright (c) Qualcomm Technologies, Inc. and/or its subsidiaries.
+// SPDX-License-Identifier: BSD-3-Clause-Clear
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatestTarget(t *testing.T) {
+	target := func(version, tag, hwid string) string {
+		return `{"hashes":{"sha256":"sha-` + version + `"},"custom":{"version":"` + version + `","tags":["` + tag +
+			`"],"hardwareIds":["` + hwid + `"],"docker_compose_apps":{"app":{"uri":"app-` + version + `"}}}}`
+	}
+	targetsJson := func(targets map[string]string) string {
+		res := `{"signed":{"targets":{`
+		first := true
+		for name, t := range targets {
+			if !first {
+				res += ","
+			}
+			first = false
+			res += `"` + name + `":` + t
+		}
+		return res + `}}}`
+	}
+
+	// Targets whose version does not parse are never picked, and do not break the tie-break among the others.
+	targets := map[string]string{
+		"lmp-bad": target("bad", "main", "hw1"),
+		"lmp-neg": target("-1", "main", "hw1"),
+	}
+	res, err := LatestTarget(targetsJson(targets), "main", "")
+	require.Nil(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, "lmp-neg", res.Target)
+
+	targets["lmp-1"] = target("1", "main", "hw1")
+	targets["lmp-2a"] = target("2", "main", "hw1")
+	targets["lmp-2b"] = target("2", "main", "hw1")
+	targets["lmp-3"] = target("3", "other", "hw1")
+	targets["lmp-4"] = target("4", "main", "hw2")
+	for range 10 {
+		res, err = LatestTarget(targetsJson(targets), "main", "lmp-1")
+		require.Nil(t, err)
+		assert.Equal(t, &DesiredTarget{Target: "lmp-2b", Version: "2", OstreeHash: "sha-2", Apps: map[string]string{"app": "app-2"}}, res)
+	}
+
+	// Without a known running target, any hardware is fine.
+	res, err = LatestTarget(targetsJson(targets), "main", "")
+	require.Nil(t, err)
+	assert.Equal(t, "lmp-4", res.Target)
+
+	res, err = LatestTarget(targetsJson(map[string]string{"lmp-bad": target("bad", "main", "hw1")}), "main", "")
+	require.Nil(t, err)
+	assert.Nil(t, res)
+	_, err = LatestTarget("not json", "main", "")
+	assert.NotNil(t, err)
+}
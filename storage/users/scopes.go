@@ -23,6 +23,7 @@ const (
 	scopeShiftDevices Scopes = 0
 	scopeShiftUpdates Scopes = 4
 	scopeShiftUsers   Scopes = 8
+	scopeShiftAdmin   Scopes = 12
 
 	ScopeDevicesR  = scopeR << scopeShiftDevices
 	ScopeDevicesRU = (scopeU | scopeR) << scopeShiftDevices
@@ -35,6 +36,8 @@ const (
 	ScopeUsersRU = (scopeU | scopeR) << scopeShiftUsers
 	ScopeUsersC  = scopeC << scopeShiftUsers
 	ScopeUsersD  = scopeD << scopeShiftUsers
+
+	ScopeAdminR = scopeR << scopeShiftAdmin
 )
 
 var maskToString = map[Scopes]string{
@@ -49,6 +52,8 @@ var maskToString = map[Scopes]string{
 	ScopeUsersRU: "users:read-update",
 	ScopeUsersC:  "users:create",
 	ScopeUsersD:  "users:delete",
+
+	ScopeAdminR: "admin:read",
 }
 
 var stringToMask = map[string]Scopes{}
@@ -124,3 +129,26 @@ OUTER:
 func (s Scopes) Has(scope Scopes) bool {
 	return s&scope == scope
 }
+
+// Exceeding returns the names of scopes in this mask which are not fully granted by the allowed mask.
+func (s Scopes) Exceeding(allowed Scopes) []string {
+	var result []string
+	for _, name := range s.ToSlice() {
+		if !allowed.Has(stringToMask[name]) {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// Clamp drops the scopes which are not fully granted by the allowed mask.
+// For example, devices:read-update clamped to devices:read becomes devices:read.
+func (s Scopes) Clamp(allowed Scopes) Scopes {
+	var result Scopes
+	for k := range maskToString {
+		if s.Has(k) && allowed.Has(k) {
+			result |= k
+		}
+	}
+	return result
+}
@@ -112,3 +112,23 @@ func TestScopes_ToSlice(t *testing.T) {
 		})
 	}
 }
+
+func TestScopesExceedingAndClamp(t *testing.T) {
+	allowed := ScopeDevicesR | ScopeUpdatesRU
+	requested := ScopeDevicesRU | ScopeUpdatesR | ScopeUsersD
+
+	exceeding := requested.Exceeding(allowed)
+	if !slices.Equal(exceeding, []string{"devices:read-update", "users:delete"}) {
+		t.Errorf("Exceeding() = %v", exceeding)
+	}
+	if got := (ScopeDevicesR | ScopeUpdatesR).Exceeding(allowed); len(got) != 0 {
+		t.Errorf("Exceeding() = %v, want none", got)
+	}
+
+	if got, want := requested.Clamp(allowed), ScopeDevicesR|ScopeUpdatesR; got != want {
+		t.Errorf("Clamp() = %s, want %s", got, want)
+	}
+	if got := ScopeUsersD.Clamp(allowed); got != 0 {
+		t.Errorf("Clamp() = %s, want none", got)
+	}
+}
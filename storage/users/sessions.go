@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/foundriesio/dg-satellite/clock"
 	"github.com/foundriesio/dg-satellite/storage"
 )
 
@@ -41,12 +42,15 @@ func (s Storage) GetBySession(id string) (*User, error) {
 		return nil, nil
 	}
 	u, err := s.stmtUserGetById.run(sess.UserID)
-	if u != nil {
-		u.h = s
-		u.AllowedScopes = sess.Scopes & u.AllowedScopes
+	if err == sql.ErrNoRows {
+		// A deleted user must not be able to use a session which survived the deletion.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
-
-	return u, err
+	u.h = s
+	u.AllowedScopes = sess.Scopes & u.AllowedScopes
+	return u, nil
 }
 
 func (u User) CreateSession(remoteIP string, expires int64, scopes Scopes) (string, error) {
@@ -58,12 +62,22 @@ func (u User) CreateSession(remoteIP string, expires int64, scopes Scopes) (stri
 	if err != nil {
 		return "", fmt.Errorf("unable to hash session id: %w", err)
 	}
-	if err := u.h.stmtSessionCreate.run(u, hashed, remoteIP, time.Now().Unix(), expires, scopes); err != nil {
+	if err := u.h.stmtSessionCreate.run(u, hashed, remoteIP, clock.Now().Unix(), expires, scopes); err != nil {
 		return "", fmt.Errorf("unable to create session: %w", err)
 	}
 
 	msg := fmt.Sprintf("Session created (ip=%s, expires=%d, scopes=%s)", remoteIP, expires, scopes)
 	u.h.fs.Audit.AppendEvent(u.id, msg)
+
+	if u.h.maxSessions > 0 {
+		// The new session is always kept, even if older sessions were created within the same second.
+		if evicted, err := u.h.stmtSessionDeleteOldest.run(u, hashed, u.h.maxSessions-1); err != nil {
+			return "", fmt.Errorf("unable to evict oldest sessions: %w", err)
+		} else if evicted > 0 {
+			msg = fmt.Sprintf("Evicted %d oldest session(s) over the limit of %d sessions", evicted, u.h.maxSessions)
+			u.h.fs.Audit.AppendEvent(u.id, msg)
+		}
+	}
 	return idStr, nil
 }
 
@@ -124,6 +138,45 @@ func (s *stmtSessionDelete) run(id string) error {
 	return err
 }
 
+type stmtSessionDeleteAll storage.DbStmt
+
+func (s *stmtSessionDeleteAll) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("sessionDeleteAll", `
+		DELETE FROM session
+		WHERE user_id = ?`,
+	)
+	return
+}
+
+func (s *stmtSessionDeleteAll) run(u User) error {
+	_, err := s.Stmt.Exec(u.id)
+	return err
+}
+
+type stmtSessionDeleteOldest storage.DbStmt
+
+func (s *stmtSessionDeleteOldest) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("sessionDeleteOldest", `
+		DELETE FROM session
+		WHERE user_id = ? AND id != ? AND id NOT IN (
+			SELECT id FROM session
+			WHERE user_id = ? AND id != ?
+			ORDER BY created_at DESC
+			LIMIT ?
+		)`,
+	)
+	return
+}
+
+// run deletes sessions of a user except for a given one and a given number of the newest others.
+func (s *stmtSessionDeleteOldest) run(u User, keepId string, keepOthers int) (int64, error) {
+	res, err := s.Stmt.Exec(u.id, keepId, u.id, keepId, keepOthers)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 type stmtSessionDeleteExpired storage.DbStmt
 
 func (s *stmtSessionDeleteExpired) Init(db storage.DbHandle) (err error) {
@@ -8,9 +8,11 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"strings"
 	"time"
 
 	"github.com/foundriesio/dg-satellite/storage"
@@ -26,6 +28,26 @@ type Token struct {
 	Value       string
 }
 
+// ErrScopesExceeded is returned when a token is requested with scopes the user is not allowed.
+type ErrScopesExceeded struct {
+	Exceeding []string
+}
+
+func (e ErrScopesExceeded) Error() string {
+	return "requested scopes are not allowed for this user: " + strings.Join(e.Exceeding, ", ")
+}
+
+// ErrTokenLifetime is returned when a token is requested with an expiry outside of the configured lifetime limits.
+var ErrTokenLifetime = errors.New("token lifetime is out of the allowed range")
+
+// ClampTokenExpiry moves the expiry of a new API token back to the maximum token lifetime, if it is later than that.
+func (s Storage) ClampTokenExpiry(expires time.Time) time.Time {
+	if max := s.tokenMaxLifetime; max > 0 && time.Until(expires) > max {
+		return time.Now().Add(max)
+	}
+	return expires
+}
+
 func (s Storage) genTokenKey(token string) ([]byte, error) {
 	if len(token) < 17 {
 		return nil, fmt.Errorf("token too short to derive key")
@@ -69,7 +91,13 @@ func (s Storage) GetByToken(token string) (*User, error) {
 
 func (u User) GenerateToken(description string, expires int64, scopes Scopes) (*Token, error) {
 	if scopes&u.AllowedScopes != scopes {
-		return nil, fmt.Errorf("requested scopes %s exceed allowed scopes %s", scopes.String(), u.AllowedScopes.String())
+		return nil, ErrScopesExceeded{Exceeding: scopes.Exceeding(u.AllowedScopes)}
+	}
+	lifetime := time.Until(time.Unix(expires, 0))
+	if min := u.h.tokenMinLifetime; min > 0 && lifetime < min {
+		return nil, fmt.Errorf("%w: tokens must be valid for at least %s", ErrTokenLifetime, min)
+	} else if max := u.h.tokenMaxLifetime; max > 0 && lifetime > max {
+		return nil, fmt.Errorf("%w: tokens may be valid for at most %s", ErrTokenLifetime, max)
 	}
 
 	value := rand.Text()
@@ -4,9 +4,13 @@
 package users
 
 import (
+	"cmp"
 	"database/sql"
+	"errors"
 	"fmt"
+	"iter"
 	"log/slog"
+	"slices"
 	"time"
 
 	"github.com/foundriesio/dg-satellite/storage"
@@ -33,10 +37,18 @@ func (u User) Delete() error {
 	if err := u.h.stmtTokenDeleteAll.run(u); err != nil {
 		return fmt.Errorf("unable to delete user while deleting tokens: %w", err)
 	}
+	if err := u.h.stmtSessionDeleteAll.run(u); err != nil {
+		return fmt.Errorf("unable to delete user while deleting sessions: %w", err)
+	}
 	return u.Update("User deleted")
 }
 
 func (u User) Update(reason string) error {
+	if !u.Deleted {
+		if err := u.h.checkEmail(u); err != nil {
+			return err
+		}
+	}
 	if err := u.h.stmtUserUpdate.run(u); err != nil {
 		return err
 	}
@@ -44,25 +56,126 @@ func (u User) Update(reason string) error {
 	return nil
 }
 
+// LogAuditEvent records an action done by the user in the user's audit log.
+func (u User) LogAuditEvent(msg string) {
+	u.h.fs.Audit.AppendEvent(u.id, msg)
+}
+
+// LogAuditEvents records several actions done by the user at once, e.g. for each device changed by a batch operation.
+func (u User) LogAuditEvents(msgs []string) {
+	u.h.fs.Audit.AppendEvents(u.id, msgs)
+}
+
 func (u User) GetAuditLog() (string, error) {
 	return u.h.fs.Audit.ReadEvents(u.id)
 }
 
+// GetAuditEvents returns the user's audit log parsed into events, oldest first.
+func (u User) GetAuditEvents() ([]storage.AuditEvent, error) {
+	log, err := u.GetAuditLog()
+	if err != nil {
+		return nil, err
+	}
+	return storage.ParseAuditLog(log), nil
+}
+
+// UserAuditEvent is an audit log event annotated with the name of the user it belongs to.
+type UserAuditEvent struct {
+	Username string `json:"username"`
+	storage.AuditEvent
+}
+
+// GetAllAuditEvents merges the audit logs of all users, including deleted users, oldest first,
+// and returns a page of at most limit events after skipping offset events, along with the total number of events.
+// The logs are read line by line, so only the events of the page are kept in memory.
+// Events of the same time keep the order in which they were logged for each user.
+func (s Storage) GetAllAuditEvents(offset, limit int) (res []UserAuditEvent, total int, err error) {
+	users, err := s.list(true)
+	if err != nil {
+		return nil, 0, err
+	}
+	slices.SortFunc(users, func(a, b User) int { return cmp.Compare(a.id, b.id) })
+
+	// Each user log is appended in time order, so a merge of their heads yields all events in time order.
+	type cursor struct {
+		username string
+		evt      storage.AuditEvent
+		next     func() (storage.AuditEvent, error, bool)
+		stop     func()
+	}
+	advance := func(c *cursor) (ok bool, err error) {
+		c.evt, err, ok = c.next()
+		return ok && err == nil, err
+	}
+	cursors := make([]*cursor, 0, len(users))
+	defer func() {
+		for _, c := range cursors {
+			c.stop()
+		}
+	}()
+	for _, u := range users {
+		c := &cursor{username: u.Username}
+		c.next, c.stop = iter.Pull2(s.fs.Audit.IterEvents(u.id))
+		cursors = append(cursors, c)
+		if ok, err := advance(c); err != nil {
+			return nil, 0, err
+		} else if !ok {
+			c.stop()
+			cursors = cursors[:len(cursors)-1]
+		}
+	}
+
+	res = make([]UserAuditEvent, 0, min(limit, 1000))
+	for len(cursors) > 0 {
+		first := 0
+		for i, c := range cursors[1:] {
+			if cmp.Compare(c.evt.Time, cursors[first].evt.Time) < 0 {
+				first = i + 1
+			}
+		}
+		c := cursors[first]
+		if total >= offset && len(res) < limit {
+			res = append(res, UserAuditEvent{Username: c.username, AuditEvent: c.evt})
+		}
+		total++
+		if ok, err := advance(c); err != nil {
+			return nil, 0, err
+		} else if !ok {
+			c.stop()
+			cursors = slices.Delete(cursors, first, first+1)
+		}
+	}
+	return res, total, nil
+}
+
+var (
+	ErrEmailRequired = errors.New("user email is required")
+	ErrEmailTaken    = errors.New("user email is already in use")
+)
+
 type Storage struct {
 	db *storage.DbHandle
 	fs *storage.FsHandle
 
-	hmacSecret []byte
+	hmacSecret   []byte
+	uniqueEmails bool
+	maxSessions  int
 
-	stmtUserCreate    stmtUserCreate
-	stmtUserGetById   stmtUserGetById
-	stmtUserGetByName stmtUserGetByName
-	stmtUserList      stmtUserList
-	stmtUserUpdate    stmtUserUpdate
+	tokenMinLifetime time.Duration
+	tokenMaxLifetime time.Duration
+
+	stmtUserCreate     stmtUserCreate
+	stmtUserEmailTaken stmtUserEmailTaken
+	stmtUserGetById    stmtUserGetById
+	stmtUserGetByName  stmtUserGetByName
+	stmtUserList       stmtUserList
+	stmtUserUpdate     stmtUserUpdate
 
 	stmtSessionCreate        stmtSessionCreate
 	stmtSessionDelete        stmtSessionDelete
+	stmtSessionDeleteAll     stmtSessionDeleteAll
 	stmtSessionDeleteExpired stmtSessionDeleteExpired
+	stmtSessionDeleteOldest  stmtSessionDeleteOldest
 	stmtSessionGet           stmtSessionGet
 
 	stmtTokenCreate        stmtTokenCreate
@@ -86,13 +199,16 @@ func NewStorage(db *storage.DbHandle, fs *storage.FsHandle) (*Storage, error) {
 
 	if err := db.InitStmt(
 		&handle.stmtUserCreate,
+		&handle.stmtUserEmailTaken,
 		&handle.stmtUserGetById,
 		&handle.stmtUserGetByName,
 		&handle.stmtUserList,
 		&handle.stmtUserUpdate,
 		&handle.stmtSessionCreate,
 		&handle.stmtSessionDelete,
+		&handle.stmtSessionDeleteAll,
 		&handle.stmtSessionDeleteExpired,
+		&handle.stmtSessionDeleteOldest,
 		&handle.stmtSessionGet,
 		&handle.stmtTokenCreate,
 		&handle.stmtTokenDelete,
@@ -120,7 +236,58 @@ func (s Storage) RunGc() {
 	}
 }
 
+// SetUniqueEmails enables or disables the requirement of a non-empty email of every user, unique among active users.
+// Enabling it fails if existing active users share an email.
+func (s *Storage) SetUniqueEmails(enabled bool) error {
+	query := "DROP INDEX IF EXISTS idx_users_email_unique"
+	if enabled {
+		query = "CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_unique ON users(email) WHERE deleted = 0"
+	}
+	stmt, err := s.db.Prepare("userEmailUniqueIndex", query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close() // nolint:errcheck
+	if _, err = stmt.Exec(); err != nil {
+		if storage.IsDbError(err, storage.ErrDbConstraintUnique) {
+			return fmt.Errorf("existing users have duplicate emails, fix them before requiring unique emails: %w", err)
+		}
+		return fmt.Errorf("unable to update users email index: %w", err)
+	}
+	s.uniqueEmails = enabled
+	return nil
+}
+
+// SetMaxSessions limits how many sessions each user may have at once: a new session evicts the oldest ones.
+// Zero means no limit.
+func (s *Storage) SetMaxSessions(max int) {
+	s.maxSessions = max
+}
+
+// SetTokenLifetime limits how long new API tokens may be valid: at least min and at most max from their creation.
+// Zero means no limit.
+func (s *Storage) SetTokenLifetime(min, max time.Duration) {
+	s.tokenMinLifetime = min
+	s.tokenMaxLifetime = max
+}
+
+func (s Storage) checkEmail(u User) error {
+	if !s.uniqueEmails {
+		return nil
+	} else if len(u.Email) == 0 {
+		return ErrEmailRequired
+	} else if taken, err := s.stmtUserEmailTaken.run(u.Email, u.id); err != nil {
+		return err
+	} else if taken {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
 func (s Storage) Create(u *User) error {
+	if err := s.checkEmail(*u); err != nil {
+		return err
+	}
 	err := s.stmtUserCreate.run(u)
 	if err == nil {
 		u.h = s
@@ -157,7 +324,11 @@ func (s Storage) Get(username string) (*User, error) {
 }
 
 func (s Storage) List() ([]User, error) {
-	users, err := s.stmtUserList.run()
+	return s.list(false)
+}
+
+func (s Storage) list(withDeleted bool) ([]User, error) {
+	users, err := s.stmtUserList.run(withDeleted)
 	if err == nil {
 		for i := range users {
 			users[i].h = s
@@ -202,6 +373,20 @@ func (s *stmtUserCreate) run(u *User) error {
 	return nil
 }
 
+type stmtUserEmailTaken storage.DbStmt
+
+func (s *stmtUserEmailTaken) Init(db storage.DbHandle) (err error) {
+	s.Stmt, err = db.Prepare("userEmailTaken", `
+		SELECT EXISTS(SELECT 1 FROM users WHERE email = ? AND deleted = 0 AND id != ?)`,
+	)
+	return
+}
+
+func (s *stmtUserEmailTaken) run(email string, id int64) (taken bool, err error) {
+	err = s.Stmt.QueryRow(email, id).Scan(&taken)
+	return
+}
+
 type stmtUserGetById storage.DbStmt
 
 func (s *stmtUserGetById) Init(db storage.DbHandle) (err error) {
@@ -272,14 +457,14 @@ func (s *stmtUserList) Init(db storage.DbHandle) (err error) {
 	s.Stmt, err = db.Prepare("userList", `
 		SELECT id, username, password, email, created_at, deleted, allowed_scopes
 		FROM users
-		WHERE deleted = false`,
+		WHERE deleted = false OR ?`,
 	)
 	return
 }
 
-func (s *stmtUserList) run() ([]User, error) {
+func (s *stmtUserList) run(withDeleted bool) ([]User, error) {
 	var users []User
-	rows, err := s.Stmt.Query()
+	rows, err := s.Stmt.Query(withDeleted)
 	if err != nil {
 		return nil, err
 	}
@@ -5,10 +5,14 @@ package users
 
 import (
 	"encoding/json"
+	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/foundriesio/dg-satellite/clock"
 	"github.com/foundriesio/dg-satellite/storage"
 	"github.com/stretchr/testify/require"
 )
@@ -158,8 +162,12 @@ func TestTokens(t *testing.T) {
 	require.Nil(t, err)
 	require.Len(t, tokens, 0)
 
-	_, err = u.GenerateToken("invalid scope", expires, ScopeUsersC)
+	_, err = u.GenerateToken("invalid scope", expires, ScopeUsersC|ScopeDevicesR)
 	require.NotNil(t, err)
+	var errScopes ErrScopesExceeded
+	require.ErrorAs(t, err, &errScopes)
+	require.Equal(t, []string{"users:create"}, errScopes.Exceeding)
+	require.Equal(t, "requested scopes are not allowed for this user: users:create", err.Error())
 
 	// Generate token with read-update
 	t1, err = u.GenerateToken("desc", expires, ScopeDevicesRU)
@@ -180,6 +188,195 @@ func TestTokens(t *testing.T) {
 	require.Contains(t, events, "User deleted")
 }
 
+func TestTokenLifetime(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	require.Nil(t, fs.Auth.InitHmacSecret())
+	users, err := NewStorage(db, fs)
+	require.Nil(t, err)
+	users.SetTokenLifetime(time.Hour, 30*24*time.Hour)
+
+	u := User{Username: "testuser", AllowedScopes: ScopeDevicesR}
+	require.Nil(t, users.Create(&u))
+	now := time.Now()
+
+	_, err = u.GenerateToken("short", now.Add(30*time.Minute).Unix(), ScopeDevicesR)
+	require.ErrorIs(t, err, ErrTokenLifetime)
+	require.ErrorContains(t, err, "at least 1h0m0s")
+	_, err = u.GenerateToken("long", now.Add(31*24*time.Hour).Unix(), ScopeDevicesR)
+	require.ErrorIs(t, err, ErrTokenLifetime)
+	require.ErrorContains(t, err, "at most 720h0m0s")
+
+	_, err = u.GenerateToken("min", now.Add(time.Hour+time.Minute).Unix(), ScopeDevicesR)
+	require.Nil(t, err)
+	_, err = u.GenerateToken("max", now.Add(30*24*time.Hour-time.Minute).Unix(), ScopeDevicesR)
+	require.Nil(t, err)
+
+	// Zero lifetimes do not limit tokens of users loaded afterwards.
+	users.SetTokenLifetime(0, 0)
+	u2, err := users.Get(u.Username)
+	require.Nil(t, err)
+	_, err = u2.GenerateToken("short", now.Add(time.Minute).Unix(), ScopeDevicesR)
+	require.Nil(t, err)
+	_, err = u2.GenerateToken("long", now.Add(365*24*time.Hour).Unix(), ScopeDevicesR)
+	require.Nil(t, err)
+}
+
+func TestDeleteUserSessions(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	require.Nil(t, fs.Auth.InitHmacSecret())
+	users, err := NewStorage(db, fs)
+	require.Nil(t, err)
+
+	u := User{Username: "testuser", AllowedScopes: ScopeDevicesR}
+	require.Nil(t, users.Create(&u))
+	expires := time.Now().Add(time.Hour).Unix()
+	sess1, err := u.CreateSession("127.0.0.1", expires, ScopeDevicesR)
+	require.Nil(t, err)
+	sess2, err := u.CreateSession("127.0.0.2", expires, ScopeDevicesR)
+	require.Nil(t, err)
+
+	u2, err := users.GetBySession(sess1)
+	require.Nil(t, err)
+	require.NotNil(t, u2)
+
+	require.Nil(t, u.Delete())
+	for _, id := range []string{sess1, sess2} {
+		u2, err = users.GetBySession(id)
+		require.Nil(t, err)
+		require.Nil(t, u2)
+	}
+	// Even a session which was created for a deleted user is not accepted.
+	sess3, err := u.CreateSession("127.0.0.3", expires, ScopeDevicesR)
+	require.Nil(t, err)
+	u2, err = users.GetBySession(sess3)
+	require.Nil(t, err)
+	require.Nil(t, u2)
+	events, err := fs.Audit.ReadEvents(u.id)
+	require.Nil(t, err)
+	require.Contains(t, events, "User deleted")
+}
+
+func TestMaxSessions(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	require.Nil(t, fs.Auth.InitHmacSecret())
+	users, err := NewStorage(db, fs)
+	require.Nil(t, err)
+	users.SetMaxSessions(2)
+
+	now := time.Now()
+	defer func() { clock.Now = time.Now }()
+
+	u := User{Username: "testuser", AllowedScopes: ScopeDevicesR}
+	require.Nil(t, users.Create(&u))
+	other := User{Username: "other", AllowedScopes: ScopeDevicesR}
+	require.Nil(t, users.Create(&other))
+	expires := now.Add(time.Hour).Unix()
+
+	var sessions []string
+	for i := range 3 {
+		clock.Now = func() time.Time { return now.Add(time.Duration(i) * time.Minute) }
+		sess, err := u.CreateSession("127.0.0.1", expires, ScopeDevicesR)
+		require.Nil(t, err)
+		sessions = append(sessions, sess)
+	}
+	otherSess, err := other.CreateSession("127.0.0.2", expires, ScopeDevicesR)
+	require.Nil(t, err)
+
+	// The third session evicted the oldest one; sessions of other users are not affected.
+	for i, id := range append(sessions, otherSess) {
+		u2, err := users.GetBySession(id)
+		require.Nil(t, err)
+		if i == 0 {
+			require.Nil(t, u2)
+		} else {
+			require.NotNil(t, u2)
+		}
+	}
+	events, err := fs.Audit.ReadEvents(u.id)
+	require.Nil(t, err)
+	require.Contains(t, events, "Evicted 1 oldest session(s) over the limit of 2 sessions")
+
+	// A new session is kept even when all sessions were created within the same second.
+	sess, err := u.CreateSession("127.0.0.1", expires, ScopeDevicesR)
+	require.Nil(t, err)
+	u2, err := users.GetBySession(sess)
+	require.Nil(t, err)
+	require.NotNil(t, u2)
+	u2, err = users.GetBySession(sessions[1])
+	require.Nil(t, err)
+	require.Nil(t, u2)
+}
+
+func TestGetAllAuditEvents(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	require.Nil(t, fs.Auth.InitHmacSecret())
+	users, err := NewStorage(db, fs)
+	require.Nil(t, err)
+
+	alice := User{Username: "alice", AllowedScopes: ScopeDevicesR}
+	require.Nil(t, users.Create(&alice))
+	bob := User{Username: "bob", AllowedScopes: ScopeDevicesR}
+	require.Nil(t, users.Create(&bob))
+	carol := User{Username: "carol", AllowedScopes: ScopeDevicesR}
+	require.Nil(t, users.Create(&carol))
+	require.Nil(t, carol.Delete())
+
+	// Overwrite the logs to get distinct, interleaved event times.
+	writeLog := func(u User, lines ...string) {
+		path := filepath.Join(fs.Config.AuditDir(), fmt.Sprintf("users-%d", u.id))
+		require.Nil(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o640))
+	}
+	writeLog(alice,
+		"2025-01-01T10:00:00Z: alice 1",
+		"2025-01-01T12:00:00Z: alice 2",
+		"2025-01-01T12:00:00Z: alice 3",
+	)
+	writeLog(bob,
+		"2025-01-01T11:00:00+00:00: bob 1",
+		"2025-01-01T14:00:00+02:00: bob 2",
+		"2025-01-01T13:00:00Z: bob 3",
+	)
+	writeLog(carol,
+		"2025-01-01T11:30:00Z: carol 1",
+		"2025-01-01T15:00:00Z: User deleted",
+	)
+
+	page := func(offset, limit int) []string {
+		events, total, err := users.GetAllAuditEvents(offset, limit)
+		require.Nil(t, err)
+		require.Equal(t, 8, total)
+		var res []string
+		for _, evt := range events {
+			res = append(res, evt.Username+": "+evt.Event)
+		}
+		return res
+	}
+	// Events of deleted users are kept.
+	require.Equal(t, []string{
+		"alice: alice 1", "bob: bob 1", "carol: carol 1", "alice: alice 2", "alice: alice 3", "bob: bob 2", "bob: bob 3",
+		"carol: User deleted",
+	}, page(0, 100))
+	require.Equal(t, []string{"alice: alice 3", "bob: bob 2", "bob: bob 3"}, page(4, 3))
+	require.Equal(t, []string{"carol: User deleted"}, page(7, 3))
+	require.Empty(t, page(8, 3))
+}
+
 func TestGc(t *testing.T) {
 	tmpdir := t.TempDir()
 	dbFile := filepath.Join(tmpdir, "sql.db")
@@ -220,3 +417,50 @@ func TestGc(t *testing.T) {
 	require.Nil(t, err)
 	require.Nil(t, u2)
 }
+
+func TestUniqueEmails(t *testing.T) {
+	tmpdir := t.TempDir()
+	db, err := storage.NewDb(filepath.Join(tmpdir, "sql.db"))
+	require.Nil(t, err)
+	fs, err := storage.NewFs(tmpdir)
+	require.Nil(t, err)
+	require.Nil(t, fs.Auth.InitHmacSecret())
+	users, err := NewStorage(db, fs)
+	require.Nil(t, err)
+
+	// Duplicates are allowed by default, and prevent enabling the requirement.
+	alice := &User{Username: "alice", Email: "team@example.com", AllowedScopes: ScopeDevicesR}
+	bob := &User{Username: "bob", Email: "team@example.com", AllowedScopes: ScopeDevicesR}
+	require.Nil(t, users.Create(alice))
+	require.Nil(t, users.Create(bob))
+	require.NotNil(t, users.SetUniqueEmails(true))
+
+	bob.Email = "bob@example.com"
+	require.Nil(t, bob.Update("Email changed"))
+	require.Nil(t, users.SetUniqueEmails(true))
+
+	carol := &User{Username: "carol", AllowedScopes: ScopeDevicesR}
+	require.ErrorIs(t, users.Create(carol), ErrEmailRequired)
+	carol.Email = "bob@example.com"
+	require.ErrorIs(t, users.Create(carol), ErrEmailTaken)
+	carol.Email = "carol@example.com"
+	require.Nil(t, users.Create(carol))
+
+	bob, err = users.Get("bob")
+	require.Nil(t, err)
+	bob.Email = "carol@example.com"
+	require.ErrorIs(t, bob.Update("Email changed"), ErrEmailTaken)
+	bob.Email = ""
+	require.ErrorIs(t, bob.Update("Email changed"), ErrEmailRequired)
+
+	// Emails of deleted users may be reused.
+	require.Nil(t, carol.Delete())
+	dave := &User{Username: "dave", Email: "carol@example.com", AllowedScopes: ScopeDevicesR}
+	require.Nil(t, users.Create(dave))
+
+	require.Nil(t, users.SetUniqueEmails(false))
+	erin := &User{Username: "erin", Email: "dave@example.com", AllowedScopes: ScopeDevicesR}
+	require.Nil(t, users.Create(erin))
+	erin.Email = "carol@example.com"
+	require.Nil(t, erin.Update("Email changed"))
+}